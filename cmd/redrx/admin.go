@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/arumes31/redrx/internal/config"
+	"github.com/arumes31/redrx/internal/linkcache"
+	"github.com/arumes31/redrx/internal/ratelimit"
+	"github.com/arumes31/redrx/internal/session"
+	"github.com/arumes31/redrx/internal/shortcode"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// adminCommand is one of the operator's one-off tasks, such as `user create`.
+// Each reads the same environment as the server.
+type adminCommand struct {
+	name  string // as typed, e.g. "user create"
+	usage string // the arguments after the name
+	help  string
+	run   func(ctx context.Context, a *adminEnv, args []string) error
+}
+
+// adminCommands is the command tree, in the order `redrx help` lists it.
+var adminCommands = []adminCommand{
+	{"migrate", "", "create or update the database schema", runMigrate},
+	{"user create", "-username NAME -email ADDRESS [flags]", "create an account", runUserCreate},
+	{"user list", "", "list every account", runUserList},
+	{"user disable", "USER", "stop an account from signing in or using its API key", runUserDisable},
+	{"user enable", "USER", "allow a disabled account again", runUserEnable},
+	{"user reset-totp", "USER", "turn off an account's authenticator app, for a lost device", runUserResetTOTP},
+	{"user make-admin", "[-revoke] USER", "grant or revoke the admin pages", runUserMakeAdmin},
+	{"link show", "CODE", "print a link's settings", runLinkShow},
+	{"link disable", "CODE", "pause a link", runLinkDisable},
+	{"link enable", "CODE", "resume a paused link", runLinkEnable},
+	{"link delete", "CODE", "move a link to its owner's trash", runLinkDelete},
+	{"link transfer", "CODE USER", "give a link to another account", runLinkTransfer},
+	{"blocklist refresh", "", "download the phishing feeds now", runBlocklistRefresh},
+	{"blocklist check", "URL", "report whether a URL is blocked; exits 1 when it is", runBlocklistCheck},
+	{"blocklist sweep", "[-dry-run]", "move links to blocked domains to the trash", runBlocklistSweep},
+	{"export", "[-o FILE]", "write users, links and clicks to a portable backup archive", runExport},
+	{"import", "FILE|-from DATABASE_URL", "fill an empty database from an archive or another database", runImport},
+	{"config check", "", "validate the environment and print the effective configuration, secrets redacted", runConfigCheck},
+}
+
+// findAdminCommand matches the leading arguments against the command tree,
+// returning the command and the arguments after its name.
+func findAdminCommand(args []string) (*adminCommand, []string, bool) {
+	for i := range adminCommands {
+		cmd := &adminCommands[i]
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):], true
+		}
+	}
+	return nil, nil, false
+}
+
+// isAdminGroup reports whether name starts an admin command, so main can
+// tell `redrx user` (a mistake to explain) from no subcommand at all.
+func isAdminGroup(name string) bool {
+	for _, cmd := range adminCommands {
+		if strings.Fields(cmd.name)[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runAdmin runs the admin command args names.
+func runAdmin(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cmd, rest, ok := findAdminCommand(args)
+	if !ok {
+		printAdminUsage(stderr)
+		return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	a := &adminEnv{stdin: stdin, stdout: stdout, stderr: stderr, cmd: cmd}
+	defer a.close()
+	return cmd.run(ctx, a, rest)
+}
+
+func printAdminUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: redrx [COMMAND]")
+	fmt.Fprintln(w, "Without a command, redrx serves the shortener. Commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "  import-links\t%s\n", "move another shortener's export into an account (see import-links -h)")
+	for _, cmd := range adminCommands {
+		fmt.Fprintf(tw, "  %s\t%s\n", strings.TrimSpace(cmd.name+" "+cmd.usage), cmd.help)
+	}
+	_ = tw.Flush()
+}
+
+// adminEnv is what a command runs with. The configuration and database are
+// loaded on first use, so `-h` works without either.
+type adminEnv struct {
+	stdin          io.Reader
+	stdout, stderr io.Writer
+	cmd            *adminCommand
+
+	cfg *config.Config
+	db  *store.DB
+	// linkChanged is told the codes of the links a command changes, so the
+	// running servers stop serving them from their caches. It is nil when
+	// the servers share no Redis.
+	linkChanged func(codes []string)
+	// sessions is the Redis session registry when SESSION_STORAGE_URL sets
+	// one. Without it sessions live in the database only.
+	sessions session.Store
+	closers  []func()
+}
+
+// parse parses a command's flags and checks it was given want positional
+// arguments, or any number when want is negative.
+func (a *adminEnv) parse(fs *flag.FlagSet, args []string, want int) error {
+	fs.SetOutput(a.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(a.stderr, "usage: redrx %s %s\n  %s\n", a.cmd.name, a.cmd.usage, a.cmd.help)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if want >= 0 && fs.NArg() != want {
+		fs.Usage()
+		return fmt.Errorf("want %d argument(s), got %d", want, fs.NArg())
+	}
+	return nil
+}
+
+// noFlags is parse for a command without flags.
+func (a *adminEnv) noFlags(args []string, want int) error {
+	return a.parse(flag.NewFlagSet(a.cmd.name, flag.ContinueOnError), args, want)
+}
+
+func (a *adminEnv) config() (*config.Config, error) {
+	if a.cfg == nil {
+		cfg, err := config.Load()
+		if err != nil {
+			return nil, err
+		}
+		a.cfg = cfg
+	}
+	return a.cfg, nil
+}
+
+// database opens the configured database and brings its schema up to date,
+// as the server does at boot.
+func (a *adminEnv) database(ctx context.Context) (*store.DB, error) {
+	if a.db != nil {
+		return a.db, nil
+	}
+	cfg, err := a.config()
+	if err != nil {
+		return nil, err
+	}
+	db, err := store.Open(ctx, cfg.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := a.connectRedis(cfg); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if a.linkChanged != nil {
+		db.OnURLChange(a.linkChanged)
+	}
+	a.db = db
+	return db, nil
+}
+
+// connectRedis reaches what the servers share through Redis. With a shared
+// link cache, a paused or deleted link stops redirecting at once rather than
+// when its cached copy expires: the command caches nothing itself, it only
+// deletes the shared entries and tells every replica to drop its own. With
+// a shared session registry, revoking a user's sessions clears it too. As
+// in the server, one URL for both is one connection.
+func (a *adminEnv) connectRedis(cfg *config.Config) error {
+	var cache *redis.Client
+	if uri := cfg.RateLimitStorageURI; a.linkChanged == nil && uri != "" && uri != "memory://" {
+		client, err := a.redisClient(uri)
+		if err != nil {
+			return fmt.Errorf("link cache: %w", err)
+		}
+		cache = client
+		links := linkcache.New(linkcache.Options{
+			Redis:  client,
+			Logger: slog.New(slog.NewTextHandler(a.stderr, nil)),
+		})
+		a.linkChanged = links.Invalidate
+	}
+	if uri := cfg.SessionStorageURI; a.sessions == nil && uri != "" {
+		client := cache
+		if client == nil || uri != cfg.RateLimitStorageURI {
+			var err error
+			if client, err = a.redisClient(uri); err != nil {
+				return fmt.Errorf("session storage: %w", err)
+			}
+		}
+		a.sessions = session.NewRedisStore(client)
+	}
+	return nil
+}
+
+// redisClient connects with the rate limiter's tuned timeouts, as the
+// server does, and closes the connection with the environment.
+func (a *adminEnv) redisClient(uri string) (*redis.Client, error) {
+	backend, err := ratelimit.NewRedisBackend(uri)
+	if err != nil {
+		return nil, err
+	}
+	a.closers = append(a.closers, func() { _ = backend.Close() })
+	return backend.Client(), nil
+}
+
+// revokeSessions signs the user out everywhere: the database's session rows
+// and, when the servers keep sessions in Redis, its registry.
+func (a *adminEnv) revokeSessions(ctx context.Context, userID int64) error {
+	if err := a.db.DeleteUserSessions(ctx, userID, ""); err != nil {
+		return err
+	}
+	if a.sessions != nil {
+		return a.sessions.DeleteAll(ctx, userID, "")
+	}
+	return nil
+}
+
+func (a *adminEnv) close() {
+	if a.db != nil {
+		a.db.Close()
+	}
+	for _, c := range a.closers {
+		c()
+	}
+}
+
+// user resolves a username or email, as the sign-in form does.
+func (a *adminEnv) user(ctx context.Context, login string) (*store.User, error) {
+	db, err := a.database(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := db.UserByLogin(ctx, login)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("no account has the username or email %q", login)
+	}
+	return u, err
+}
+
+// link resolves a short code to a link outside the trash. Codes are stored
+// uppercase, so it normalises as the web handlers do.
+func (a *adminEnv) link(ctx context.Context, code string) (*store.URL, error) {
+	db, err := a.database(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := db.URLByShortCode(ctx, shortcode.Normalize(code))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("no link has the code %q", code)
+	}
+	return u, err
+}
+
+// adminActor attributes the changes commands make to links.
+var adminActor = store.SystemActor("command line")
+
+func runMigrate(ctx context.Context, a *adminEnv, args []string) error {
+	if err := a.noFlags(args, 0); err != nil {
+		return err
+	}
+	db, err := a.database(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "The %s database schema is up to date.\n", dialectName(db.Dialect()))
+	return nil
+}
+
+func runConfigCheck(ctx context.Context, a *adminEnv, args []string) error {
+	if err := a.noFlags(args, 0); err != nil {
+		return err
+	}
+	cfg, err := a.config()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	for _, s := range effectiveConfig(cfg) {
+		fmt.Fprintf(tw, "%s\t%s\n", s[0], s[1])
+	}
+	return tw.Flush()
+}
+
+// effectiveConfig lists every setting as a name and printable value, with
+// the secret key, passwords and the credentials in connection URLs replaced.
+func effectiveConfig(cfg *config.Config) [][2]string {
+	v := reflect.ValueOf(cfg).Elem()
+	var out [][2]string
+	for i := range v.NumField() {
+		name := v.Type().Field(i).Name
+		out = append(out, [2]string{name, settingValue(name, v.Field(i).Interface())})
+	}
+	return out
+}
+
+const redacted = "(redacted)"
+
+func settingValue(name string, v any) string {
+	switch v := v.(type) {
+	case []byte:
+		if len(v) > 0 {
+			return redacted
+		}
+		return ""
+	case string:
+		if v != "" && (strings.Contains(name, "Password") || strings.Contains(name, "Secret")) {
+			return redacted
+		}
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				return u.Redacted()
+			}
+		}
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	case []*net.IPNet:
+		nets := make([]string, len(v))
+		for i, n := range v {
+			nets[i] = n.String()
+		}
+		return strings.Join(nets, ",")
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/arumes31/redrx/internal/store"
+)
+
+func runExport(ctx context.Context, a *adminEnv, args []string) error {
+	fs := flag.NewFlagSet(a.cmd.name, flag.ContinueOnError)
+	output := fs.String("o", "", "write the archive to this file instead of standard output")
+	if err := a.parse(fs, args, 0); err != nil {
+		return err
+	}
+	db, err := a.database(ctx)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		// Standard output carries the archive, so the summary goes beside it.
+		counts, err := db.Export(ctx, a.stdout)
+		if err != nil {
+			return err
+		}
+		return printTableCounts(a.stderr, "Exported", counts)
+	}
+
+	f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	counts, err := db.Export(ctx, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(*output)
+		return err
+	}
+	return printTableCounts(a.stdout, "Exported", counts)
+}
+
+func runImport(ctx context.Context, a *adminEnv, args []string) error {
+	fs := flag.NewFlagSet(a.cmd.name, flag.ContinueOnError)
+	from := fs.String("from", "", "copy straight from the database at this URL instead of reading an archive")
+	if err := a.parse(fs, args, -1); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 || (*from == "") == (fs.NArg() == 0) {
+		fs.Usage()
+		return errors.New("name an archive or -from, but not both")
+	}
+	db, err := a.database(ctx)
+	if err != nil {
+		return err
+	}
+
+	var counts []store.TableCount
+	if *from != "" {
+		if *from == a.cfg.DatabaseURL {
+			return errors.New("-from names the database being imported into")
+		}
+		// The source is only read, so it is not migrated: a legacy file is
+		// copied as it is.
+		src, err := store.Open(ctx, *from)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		counts, err = store.Copy(ctx, src, db)
+		if err != nil {
+			return err
+		}
+	} else {
+		var r io.Reader = a.stdin
+		if name := fs.Arg(0); name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		if counts, err = db.Import(ctx, r); err != nil {
+			return err
+		}
+	}
+	return printTableCounts(a.stdout, "Imported", counts)
+}
+
+// printTableCounts reports how many rows of each table a backup moved, and
+// the rows an import left out because what they belonged to was gone.
+func printTableCounts(w io.Writer, verb string, counts []store.TableCount) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	var total int64
+	for _, c := range counts {
+		note := ""
+		switch {
+		case c.Skipped > 0:
+			note = fmt.Sprintf("%d skipped: their owner no longer exists", c.Skipped)
+		case c.Detached > 0:
+			note = fmt.Sprintf("%d made anonymous: their owner no longer exists", c.Detached)
+		}
+		fmt.Fprintf(tw, "%s\t%d", c.Table, c.Rows)
+		if note != "" {
+			fmt.Fprintf(tw, "\t%s", note)
+		}
+		fmt.Fprintln(tw)
+		total += c.Rows
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s %d rows.\n", verb, total)
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arumes31/redrx/internal/config"
+	"github.com/arumes31/redrx/internal/safety"
+)
+
+// errBlocked fails `blocklist check` for a blocked URL, so scripts can test
+// the exit status.
+var errBlocked = errors.New("blocked")
+
+// loadBlocklist returns a checker for a one-off command. The server keeps the
+// list on disk; when the command runs where it has never been downloaded, it
+// is fetched once rather than every destination being refused.
+func loadBlocklist(ctx context.Context, cfg *config.Config) (*safety.Checker, error) {
+	checker := safety.New(safety.Options{
+		Enabled:         cfg.EnablePhishingCheck,
+		BlockedListPath: cfg.BlockedDomainsPath,
+		FeedURLs:        cfg.PhishingListURLs,
+		ManualDomains:   cfg.BlockedDomains,
+	})
+	if _, err := checker.CheckURL("https://example.com/"); err != nil {
+		if err := checker.Refresh(ctx); err != nil {
+			return nil, fmt.Errorf("the phishing blocklist is unavailable (%w); "+
+				"run where the server keeps it, or set ENABLE_PHISHING_CHECK=false to go without it", err)
+		}
+	}
+	return checker, nil
+}
+
+func runBlocklistRefresh(ctx context.Context, a *adminEnv, args []string) error {
+	if err := a.noFlags(args, 0); err != nil {
+		return err
+	}
+	cfg, err := a.config()
+	if err != nil {
+		return err
+	}
+	if !cfg.EnablePhishingCheck || cfg.BlockedDomainsPath == "" || len(cfg.PhishingListURLs) == 0 {
+		return errors.New("no phishing feed is configured (ENABLE_PHISHING_CHECK, PHISHING_LIST_URLS)")
+	}
+	checker := safety.New(safety.Options{
+		Enabled:         true,
+		BlockedListPath: cfg.BlockedDomainsPath,
+		FeedURLs:        cfg.PhishingListURLs,
+		// Any age counts as stale, so the feeds are downloaded even when the
+		// server refreshed them a minute ago.
+		RefreshInterval: time.Nanosecond,
+		ManualDomains:   cfg.BlockedDomains,
+	})
+	if err := checker.Refresh(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "Refreshed %s; running servers pick it up on their next check.\n", cfg.BlockedDomainsPath)
+	return nil
+}
+
+func runBlocklistCheck(ctx context.Context, a *adminEnv, args []string) error {
+	if err := a.noFlags(args, 1); err != nil {
+		return err
+	}
+	target := args[0]
+	if !safety.IsAbsoluteHTTPURL(target) {
+		return fmt.Errorf("%q is not an absolute http or https URL", target)
+	}
+	cfg, err := a.config()
+	if err != nil {
+		return err
+	}
+	checker, err := loadBlocklist(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	ok, err := checker.CheckURL(target)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Fprintf(a.stdout, "%s is blocked.\n", target)
+		return errBlocked
+	}
+	fmt.Fprintf(a.stdout, "%s is allowed.\n", target)
+	return nil
+}
+
+func runBlocklistSweep(ctx context.Context, a *adminEnv, args []string) error {
+	fs := flag.NewFlagSet(a.cmd.name, flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "list the links that would be moved, without moving them")
+	if err := a.parse(fs, args, 0); err != nil {
+		return err
+	}
+	db, err := a.database(ctx)
+	if err != nil {
+		return err
+	}
+	checker, err := loadBlocklist(ctx, a.cfg)
+	if err != nil {
+		return err
+	}
+
+	links, err := findBlockedLinks(ctx, checker, db)
+	if !*dryRun && err == nil {
+		links, err = sweepBlockedLinks(ctx, checker, db, slog.New(slog.DiscardHandler))
+	}
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CODE\tDESTINATION")
+	for _, link := range links {
+		fmt.Fprintf(tw, "%s\t%s\n", link.ShortCode, link.LongURL)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Fprintf(a.stdout, "\n%d link(s) point at blocked domains (dry run, nothing moved).\n", len(links))
+	} else {
+		fmt.Fprintf(a.stdout, "\nMoved %d link(s) pointing at blocked domains to the trash.\n", len(links))
+	}
+	return nil
+}
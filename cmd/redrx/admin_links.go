@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func runLinkShow(ctx context.Context, a *adminEnv, args []string) error {
+	if err := a.noFlags(args, 1); err != nil {
+		return err
+	}
+	link, err := a.link(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	owner := "anonymous"
+	if link.UserID != nil {
+		u, err := a.db.UserByID(ctx, *link.UserID)
+		if err != nil {
+			return err
+		}
+		owner = u.Username
+	}
+	state := "active"
+	switch {
+	case link.IsDraft:
+		state = "draft"
+	case !link.IsEnabled:
+		state = "paused"
+	case !link.IsActive():
+		state = "outside its schedule or expired"
+	}
+
+	tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	row := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(tw, "%s\t%s\n", name, value)
+		}
+	}
+	row("Code", link.ShortCode)
+	row("Short URL", a.cfg.ShortURL(link.ShortCode))
+	row("Destination", link.LongURL)
+	row("Rotation", strings.Join(link.RotateTargets, " "))
+	row("iOS", link.IOSTargetURL)
+	row("Android", link.AndroidTargetURL)
+	row("Title", link.Title)
+	row("Tags", strings.Join(link.Tags, ", "))
+	row("Owner", owner)
+	row("State", state)
+	if link.PasswordHash != "" {
+		row("Password", "required")
+	}
+	row("Clicks", fmt.Sprint(link.ClicksCount))
+	row("Created", formatTime(&link.CreatedAt))
+	row("Starts", formatTime(link.StartAt))
+	row("Ends", formatTime(link.EndAt))
+	row("Expires", formatTime(link.ExpiresAt))
+	row("Last click", formatTime(link.LastAccessedAt))
+	return tw.Flush()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02 15:04 UTC")
+}
+
+func runLinkDisable(ctx context.Context, a *adminEnv, args []string) error {
+	return setLinkEnabled(ctx, a, args, false)
+}
+
+func runLinkEnable(ctx context.Context, a *adminEnv, args []string) error {
+	return setLinkEnabled(ctx, a, args, true)
+}
+
+func setLinkEnabled(ctx context.Context, a *adminEnv, args []string, enabled bool) error {
+	if err := a.noFlags(args, 1); err != nil {
+		return err
+	}
+	link, err := a.link(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if err := a.db.SetURLEnabled(ctx, link.ID, enabled, adminActor); err != nil {
+		return err
+	}
+	if enabled {
+		fmt.Fprintf(a.stdout, "Resumed %s.\n", link.ShortCode)
+	} else {
+		fmt.Fprintf(a.stdout, "Paused %s.\n", link.ShortCode)
+	}
+	return nil
+}
+
+func runLinkDelete(ctx context.Context, a *adminEnv, args []string) error {
+	if err := a.noFlags(args, 1); err != nil {
+		return err
+	}
+	link, err := a.link(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if err := a.db.DeleteURL(ctx, link.ID, adminActor); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "Moved %s to the trash, which keeps it for %d days.\n",
+		link.ShortCode, a.cfg.TrashRetentionDays)
+	return nil
+}
+
+func runLinkTransfer(ctx context.Context, a *adminEnv, args []string) error {
+	if err := a.noFlags(args, 2); err != nil {
+		return err
+	}
+	link, err := a.link(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	to, err := a.user(ctx, args[1])
+	if err != nil {
+		return err
+	}
+	if err := a.db.TransferURL(ctx, link.ID, to, adminActor); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "%s now belongs to %s.\n", link.ShortCode, to.Username)
+	return nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/arumes31/redrx/internal/config"
+	"github.com/arumes31/redrx/internal/safety"
+	"github.com/arumes31/redrx/internal/security"
+	"github.com/arumes31/redrx/internal/session"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// runAdminCommand runs an admin command against db, returning its output.
+func runAdminCommand(t *testing.T, db *store.DB, cfg *config.Config, stdin string, args ...string) (string, error) {
+	t.Helper()
+	return runAdminEnv(t, &adminEnv{stdin: strings.NewReader(stdin), cfg: cfg, db: db}, args...)
+}
+
+// runAdminEnv is runAdminCommand in an environment the test set up, with
+// the output going to a buffer.
+func runAdminEnv(t *testing.T, a *adminEnv, args ...string) (string, error) {
+	t.Helper()
+	cmd, rest, ok := findAdminCommand(args)
+	if !ok {
+		t.Fatalf("no command %q", args)
+	}
+	var out, errOut strings.Builder
+	a.stdout, a.stderr, a.cmd = &out, &errOut, cmd
+	err := cmd.run(context.Background(), a, rest)
+	return out.String(), err
+}
+
+// revokedSessions stands in for the Redis session registry, recording whose
+// sessions were revoked.
+type revokedSessions struct {
+	session.Store
+	users []int64
+}
+
+func (r *revokedSessions) DeleteAll(_ context.Context, userID int64, except string) error {
+	r.users = append(r.users, userID)
+	return nil
+}
+
+func TestUserCommands(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &config.Config{AdminUsers: []string{"carol"}}
+	registry := &revokedSessions{}
+	run := func(stdin string, args ...string) string {
+		t.Helper()
+		a := &adminEnv{stdin: strings.NewReader(stdin), cfg: cfg, db: db, sessions: registry}
+		out, err := runAdminEnv(t, a, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+
+	out := run("", "user", "create", "-username", "dave", "-email", "dave@example.com", "-admin")
+	password, ok := strings.CutPrefix(strings.Split(out, "\n")[1], "Password: ")
+	if !ok {
+		t.Fatalf("no generated password in %q", out)
+	}
+	dave, err := db.UserByLogin(ctx, "dave")
+	if err != nil || !dave.IsAdmin || dave.APIKey == "" || !security.CheckPasswordHash(dave.PasswordHash, password) {
+		t.Fatalf("created %+v, %v", dave, err)
+	}
+	run("carol-password\n", "user", "create", "-username", "carol", "-email", "carol@example.com", "-password-stdin")
+	carol, _ := db.UserByLogin(ctx, "carol")
+	if !security.CheckPasswordHash(carol.PasswordHash, "carol-password") {
+		t.Error("the password from standard input was not set")
+	}
+	if _, err := runAdminCommand(t, db, cfg, "", "user", "create", "-username", "dave", "-email", "d2@example.com"); err == nil {
+		t.Error("a second dave was created")
+	}
+
+	run("", "user", "disable", "carol@example.com")
+	if !slices.Equal(registry.users, []int64{carol.ID}) {
+		t.Errorf("disable revoked the sessions of %v in Redis, want carol's", registry.users)
+	}
+	run("", "user", "make-admin", "-revoke", "dave")
+	list := strings.Join(strings.Fields(run("", "user", "list")), " ")
+	for _, want := range []string{"dave dave@example.com", "no no active", "carol carol@example.com", "no ADMIN_USERS disabled"} {
+		if !strings.Contains(list, want) {
+			t.Errorf("user list is missing %q:\n%s", want, list)
+		}
+	}
+
+	if err := db.SetTOTPPending(ctx, carol.ID, "sealed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.EnableTOTP(ctx, carol.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateUserSession(ctx, &store.UserSession{ID: "stolen", UserID: carol.ID}); err != nil {
+		t.Fatal(err)
+	}
+	run("", "user", "reset-totp", "carol")
+	if sessions, _ := db.UserSessions(ctx, carol.ID); len(sessions) != 0 {
+		t.Errorf("reset-totp left %d sessions signed in", len(sessions))
+	}
+	if len(registry.users) != 2 {
+		t.Errorf("reset-totp did not revoke the sessions in Redis: %v", registry.users)
+	}
+	if carol, _ = db.UserByID(ctx, carol.ID); carol.TOTPEnabled || carol.TOTPSecret != "" {
+		t.Error("reset-totp left the authenticator app on")
+	}
+	if events, _ := db.SecurityEvents(ctx, carol.ID, 1); len(events) != 1 || events[0].Event != store.EventTOTPDisabled {
+		t.Errorf("security events = %v; want the reset recorded", events)
+	}
+}
+
+func TestLinkCommands(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &config.Config{BaseDomain: "short.example.com", TrashRetentionDays: 30}
+	erin := &store.User{Username: "erin", Email: "erin@example.com", PasswordHash: "x"}
+	if err := db.CreateUser(ctx, erin); err != nil {
+		t.Fatal(err)
+	}
+	link := &store.URL{ShortCode: "CLI123", LongURL: "https://cli.example/", IsEnabled: true}
+	if err := db.CreateURL(ctx, link, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	run := func(args ...string) string {
+		t.Helper()
+		out, err := runAdminCommand(t, db, cfg, "", args...)
+		if err != nil {
+			t.Fatalf("%s: %v", strings.Join(args, " "), err)
+		}
+		return out
+	}
+
+	run("link", "transfer", "CLI123", "erin")
+	run("link", "disable", "CLI123")
+	// Codes are typed as they appear in a short URL, in any case.
+	show := run("link", "show", "cli123")
+	for _, want := range []string{"https://short.example.com/CLI123", "Owner        erin", "State        paused"} {
+		if !strings.Contains(show, want) {
+			t.Errorf("link show is missing %q:\n%s", want, show)
+		}
+	}
+	revs, _ := db.Revisions(ctx, link.ID, 10)
+	if len(revs) != 3 || revs[0].Action != store.ActionDisable || revs[1].Action != store.ActionTransfer || revs[0].Actor != "command line" {
+		t.Errorf("revisions = %+v", revs)
+	}
+
+	run("link", "delete", "CLI123")
+	if trashed, _ := db.TrashedUserURLs(ctx, erin.ID); len(trashed) != 1 {
+		t.Errorf("erin's trash holds %d links, want the deleted one", len(trashed))
+	}
+	if _, err := runAdminCommand(t, db, cfg, "", "link", "show", "CLI123"); err == nil {
+		t.Error("link show found a link in the trash")
+	}
+}
+
+// TestLinkCommandsInvalidateCaches checks a pause from the command line
+// reaches the hook that clears the servers' link caches, which database sets
+// up when it opens the store.
+func TestLinkCommandsInvalidateCaches(t *testing.T) {
+	ctx := context.Background()
+	url := "sqlite:///" + filepath.ToSlash(filepath.Join(t.TempDir(), "links.db"))
+	db, err := store.Open(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateURL(ctx, &store.URL{ShortCode: "HOT123", LongURL: "https://hot.example/", IsEnabled: true}, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	var changed []string
+	a := &adminEnv{
+		cfg:         &config.Config{DatabaseURL: url},
+		linkChanged: func(codes []string) { changed = append(changed, codes...) },
+	}
+	defer a.close()
+	if _, err := runAdminEnv(t, a, "link", "disable", "HOT123"); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(changed, []string{"HOT123"}) {
+		t.Errorf("the cache hook was told %q, want the paused link", changed)
+	}
+}
+
+func TestBlocklistCommands(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	list := filepath.Join(t.TempDir(), "blocked_domains.txt")
+	if err := os.WriteFile(list, []byte("phish.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{EnablePhishingCheck: true, BlockedDomainsPath: list}
+	for _, l := range []*store.URL{
+		{ShortCode: "GOOD01", LongURL: "https://good.example/", IsEnabled: true},
+		{ShortCode: "PHISH1", LongURL: "https://login.phish.example/", IsEnabled: true},
+		{ShortCode: "PHISH2", LongURL: "https://good.example/", RotateTargets: []string{"https://phish.example/x"}, IsEnabled: true},
+	} {
+		if err := db.CreateURL(ctx, l, store.SystemActor("test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out, err := runAdminCommand(t, db, cfg, "", "blocklist", "check", "https://www.phish.example/"); !errors.Is(err, errBlocked) || !strings.Contains(out, "is blocked") {
+		t.Errorf("check of a blocked URL = %q, %v", out, err)
+	}
+	if out, err := runAdminCommand(t, db, cfg, "", "blocklist", "check", "https://good.example/"); err != nil || !strings.Contains(out, "is allowed") {
+		t.Errorf("check of an allowed URL = %q, %v", out, err)
+	}
+
+	out, err := runAdminCommand(t, db, cfg, "", "blocklist", "sweep", "-dry-run")
+	if err != nil || !strings.Contains(out, "PHISH1") || !strings.Contains(out, "PHISH2") || strings.Contains(out, "GOOD01") ||
+		!strings.Contains(out, "2 link(s) point at blocked domains (dry run, nothing moved).") {
+		t.Fatalf("dry run = %q, %v", out, err)
+	}
+	if _, err := db.URLByShortCode(ctx, "PHISH1"); err != nil {
+		t.Fatal("the dry run moved a link")
+	}
+	if out, err := runAdminCommand(t, db, cfg, "", "blocklist", "sweep"); err != nil || !strings.Contains(out, "Moved 2 link(s)") {
+		t.Fatalf("sweep = %q, %v", out, err)
+	}
+	for code, want := range map[string]bool{"GOOD01": true, "PHISH1": false, "PHISH2": false} {
+		if _, err := db.URLByShortCode(ctx, code); (err == nil) != want {
+			t.Errorf("%s live = %v after the sweep, want %v", code, err == nil, want)
+		}
+	}
+
+	// Without a readable list nothing is judged, and nothing is moved.
+	cfg.BlockedDomainsPath = filepath.Join(t.TempDir(), "missing.txt")
+	if _, err := runAdminCommand(t, db, cfg, "", "blocklist", "sweep"); !errors.Is(err, safety.ErrListUnavailable) {
+		t.Errorf("sweep without a list = %v, want the list reported unavailable", err)
+	}
+}
+
+func TestConfigCheckRedactsSecrets(t *testing.T) {
+	cfg := &config.Config{
+		SecretKey:           []byte("the-key"),
+		SMTPPassword:        "smtp-secret",
+		DatabaseURL:         "postgresql://redrx:db-secret@db:5432/redrx",
+		RateLimitStorageURI: "redis://:redis-secret@redis:6379",
+		BaseDomain:          "short.example.com",
+		AdminUsers:          []string{"alice", "root"},
+	}
+	out, err := runAdminCommand(t, nil, cfg, "", "config", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"the-key", "smtp-secret", "db-secret", "redis-secret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("config check printed %q:\n%s", secret, out)
+		}
+	}
+	for _, want := range []string{"BaseDomain", "short.example.com", "alice,root", "postgresql://redrx:xxxxx@db:5432/redrx", "SMTPPassword"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("config check is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestExportAndImportCommands(t *testing.T) {
+	ctx := context.Background()
+	srcURL := "sqlite:///" + filepath.ToSlash(filepath.Join(t.TempDir(), "source.db"))
+	src, err := store.Open(ctx, srcURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { src.Close() })
+	if err := src.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	frank := &store.User{Username: "frank", Email: "frank@example.com", PasswordHash: "x"}
+	if err := src.CreateUser(ctx, frank); err != nil {
+		t.Fatal(err)
+	}
+	link := &store.URL{UserID: &frank.ID, ShortCode: "BAK123", LongURL: "https://backup.example/", IsEnabled: true}
+	if err := src.CreateURL(ctx, link, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "redrx.backup")
+	out, err := runAdminCommand(t, src, &config.Config{}, "", "export", "-o", archive)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if !strings.Contains(out, "Exported") {
+		t.Errorf("export printed %q", out)
+	}
+	if _, err := runAdminCommand(t, src, &config.Config{}, "", "export", "-o", archive); err == nil {
+		t.Error("export overwrote an existing file")
+	}
+
+	fromFile := openTestDB(t)
+	if _, err := runAdminCommand(t, fromFile, &config.Config{}, "", "import", archive); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	fromDB := openTestDB(t)
+	if _, err := runAdminCommand(t, fromDB, &config.Config{}, "", "import", "-from", srcURL); err != nil {
+		t.Fatalf("import -from: %v", err)
+	}
+	for name, db := range map[string]*store.DB{"archive": fromFile, "database": fromDB} {
+		got, err := db.URLByShortCode(ctx, "BAK123")
+		if err != nil || got.ID != link.ID || got.UserID == nil || *got.UserID != frank.ID {
+			t.Errorf("from the %s, BAK123 = %+v, %v", name, got, err)
+		}
+	}
+
+	if _, err := runAdminCommand(t, fromFile, &config.Config{}, "", "import", archive); err == nil {
+		t.Error("import into a database holding rows succeeded")
+	}
+	if _, err := runAdminCommand(t, fromFile, &config.Config{}, "", "import", "-from", srcURL, archive); err == nil {
+		t.Error("import accepted both an archive and -from")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/uuid"
+
+	"github.com/arumes31/redrx/internal/security"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+func runUserCreate(ctx context.Context, a *adminEnv, args []string) error {
+	fs := flag.NewFlagSet(a.cmd.name, flag.ContinueOnError)
+	username := fs.String("username", "", "the new account's username, 4 to 20 characters")
+	email := fs.String("email", "", "the new account's email address")
+	admin := fs.Bool("admin", false, "grant the admin pages")
+	fromStdin := fs.Bool("password-stdin", false, "read the password from the first line of standard input instead of generating one")
+	if err := a.parse(fs, args, 0); err != nil {
+		return err
+	}
+	if n := len([]rune(*username)); n < 4 || n > 20 {
+		return errors.New("the username must be between 4 and 20 characters long")
+	}
+	if !strings.Contains(*email, "@") {
+		return errors.New("a valid email address is required")
+	}
+
+	password := rand.Text()
+	if *fromStdin {
+		line, err := bufio.NewReader(a.stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("read the password: %w", err)
+		}
+		if password = strings.TrimRight(line, "\r\n"); len(password) < 6 {
+			return errors.New("the password must be at least 6 characters long")
+		}
+	}
+
+	db, err := a.database(ctx)
+	if err != nil {
+		return err
+	}
+	if taken, err := db.UsernameTaken(ctx, *username); err != nil {
+		return err
+	} else if taken {
+		return fmt.Errorf("the username %q is already taken", *username)
+	}
+	if taken, err := db.EmailTaken(ctx, *email); err != nil {
+		return err
+	} else if taken {
+		return fmt.Errorf("the email %q is already registered", *email)
+	}
+	hash, err := security.GeneratePasswordHash(password)
+	if err != nil {
+		return err
+	}
+	u := &store.User{Username: *username, Email: *email, PasswordHash: hash, APIKey: uuid.NewString()}
+	if err := db.CreateUser(ctx, u); err != nil {
+		return err
+	}
+	if *admin {
+		if err := db.SetUserAdmin(ctx, u.ID, true); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(a.stdout, "Created account %d, %s.\n", u.ID, u.Username)
+	if !*fromStdin {
+		fmt.Fprintf(a.stdout, "Password: %s\n", password)
+	}
+	return nil
+}
+
+func runUserList(ctx context.Context, a *adminEnv, args []string) error {
+	if err := a.noFlags(args, 0); err != nil {
+		return err
+	}
+	db, err := a.database(ctx)
+	if err != nil {
+		return err
+	}
+	users, err := db.Users(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSERNAME\tEMAIL\tCREATED\t2FA\tADMIN\tSTATUS")
+	for _, u := range users {
+		admin := "no"
+		if u.IsAdmin {
+			admin = "yes"
+		} else if a.cfg.IsAdmin(u.Username) {
+			admin = "ADMIN_USERS"
+		}
+		status := "active"
+		if u.DisabledAt != nil {
+			status = "disabled " + u.DisabledAt.UTC().Format("2006-01-02")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", u.ID, u.Username, u.Email,
+			u.CreatedAt.UTC().Format("2006-01-02"), yesNo(u.TOTPEnabled), admin, status)
+	}
+	return tw.Flush()
+}
+
+func runUserDisable(ctx context.Context, a *adminEnv, args []string) error {
+	return setUserDisabled(ctx, a, args, true)
+}
+
+func runUserEnable(ctx context.Context, a *adminEnv, args []string) error {
+	return setUserDisabled(ctx, a, args, false)
+}
+
+func setUserDisabled(ctx context.Context, a *adminEnv, args []string, disabled bool) error {
+	if err := a.noFlags(args, 1); err != nil {
+		return err
+	}
+	u, err := a.user(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if err := a.db.SetUserDisabled(ctx, u.ID, disabled); err != nil {
+		return err
+	}
+	if disabled {
+		// The store ends the database's sessions with the change; a Redis
+		// registry is outside its reach.
+		if err := a.revokeSessions(ctx, u.ID); err != nil {
+			return fmt.Errorf("disabled %s, but signing it out failed: %w", u.Username, err)
+		}
+		fmt.Fprintf(a.stdout, "Disabled %s. Its sessions and API key no longer work.\n", u.Username)
+	} else {
+		fmt.Fprintf(a.stdout, "Enabled %s.\n", u.Username)
+	}
+	return nil
+}
+
+func runUserResetTOTP(ctx context.Context, a *adminEnv, args []string) error {
+	if err := a.noFlags(args, 1); err != nil {
+		return err
+	}
+	u, err := a.user(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if u.TOTPSecret == "" && !u.TOTPEnabled {
+		fmt.Fprintf(a.stdout, "%s has no authenticator app set up.\n", u.Username)
+		return nil
+	}
+	if err := a.db.DisableTOTP(ctx, u.ID); err != nil {
+		return err
+	}
+	// As when the owner turns it off: whoever holds a session from the lost
+	// device is signed out with it.
+	if err := a.revokeSessions(ctx, u.ID); err != nil {
+		return err
+	}
+	// The owner sees this in their security log, beside their own changes.
+	if err := a.db.RecordSecurityEvent(ctx, &store.SecurityEvent{
+		UserID: u.ID, Event: store.EventTOTPDisabled, Detail: "reset by an administrator",
+	}); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "Turned off the authenticator app of %s and signed it out everywhere.\n", u.Username)
+	return nil
+}
+
+func runUserMakeAdmin(ctx context.Context, a *adminEnv, args []string) error {
+	fs := flag.NewFlagSet(a.cmd.name, flag.ContinueOnError)
+	revoke := fs.Bool("revoke", false, "take the admin pages away instead")
+	if err := a.parse(fs, args, 1); err != nil {
+		return err
+	}
+	u, err := a.user(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := a.db.SetUserAdmin(ctx, u.ID, !*revoke); err != nil {
+		return err
+	}
+	switch {
+	case !*revoke:
+		fmt.Fprintf(a.stdout, "%s is now an admin.\n", u.Username)
+	case a.cfg.IsAdmin(u.Username):
+		fmt.Fprintf(a.stdout, "Revoked; %s stays an admin while ADMIN_USERS lists it.\n", u.Username)
+	default:
+		fmt.Fprintf(a.stdout, "%s is no longer an admin.\n", u.Username)
+	}
+	return nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/arumes31/redrx/internal/config"
+	"github.com/arumes31/redrx/internal/linkcheck"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// monitorDestinations probes every destination of every active link on
+// HEALTH_CHECK_INTERVAL, recording the results for the dashboard and acting on
+// the owners' auto-pause and skip-unhealthy settings.
+func monitorDestinations(ctx context.Context, cfg *config.Config, db *store.DB, log *slog.Logger) {
+	if !cfg.EnableHealthCheck {
+		return
+	}
+
+	prober := linkcheck.New(linkcheck.Options{
+		Concurrency: cfg.HealthCheckConcurrency,
+		Timeout:     time.Duration(cfg.HealthCheckTimeout) * time.Second,
+		UserAgent:   "redrx-linkcheck/1.0 (+https://" + cfg.CanonicalHost() + "/)",
+	})
+
+	check := func() {
+		if err := checkDestinations(ctx, prober, db, log); err != nil && ctx.Err() == nil {
+			log.Warn("destination health check failed", "error", err)
+		}
+	}
+
+	check()
+
+	ticker := time.NewTicker(time.Duration(cfg.HealthCheckInterval) * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+// checkDestinations runs one round of probes and records the outcome.
+//
+// Each distinct destination is probed once per round however many links share
+// it, and all probing finishes before anything is written: on SQLite the pool
+// is a single connection, and holding it across slow network calls would stall
+// every redirect for the length of the round.
+func checkDestinations(ctx context.Context, prober *linkcheck.Prober, db *store.DB, log *slog.Logger) error {
+	var links []*store.URL
+	if err := db.EachURL(ctx, func(u *store.URL) error {
+		if u.IsActive() {
+			links = append(links, u)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var targets []string
+	for _, u := range links {
+		targets = append(targets, u.Destinations()...)
+	}
+	results := prober.CheckAll(ctx, targets)
+	if err := ctx.Err(); err != nil {
+		// A round cut short would record only some targets; drop it whole.
+		return err
+	}
+
+	for _, u := range links {
+		if err := recordLinkHealth(ctx, db, u, results, log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordLinkHealth stores one link's results, then pauses the link or updates
+// its unhealthy rotation targets as its current settings ask.
+func recordLinkHealth(ctx context.Context, db *store.DB, u *store.URL, results map[string]linkcheck.Result, log *slog.Logger) error {
+	destinations := u.Destinations()
+	failures := make(map[string]int, len(destinations))
+
+	for _, target := range destinations {
+		res, ok := results[target]
+		// A destination the prober refused to contact is neither healthy nor
+		// failing; recording it either way would be a claim we cannot make.
+		if !ok || errors.Is(res.Err, linkcheck.ErrPrivateAddress) {
+			continue
+		}
+		h := &store.LinkHealth{
+			URLID:      u.ID,
+			Target:     target,
+			StatusCode: res.StatusCode,
+			LatencyMS:  res.Latency.Milliseconds(),
+			CheckedAt:  res.CheckedAt,
+		}
+		if !res.Healthy() {
+			h.Error = res.Describe()
+		}
+		n, err := db.RecordLinkHealth(ctx, h, res.Healthy())
+		if err != nil {
+			return err
+		}
+		failures[target] = n
+	}
+
+	// Rows for destinations edited off the link would otherwise keep counting
+	// against it on the dashboard.
+	if err := db.PruneLinkHealth(ctx, u.ID, destinations); err != nil {
+		return err
+	}
+
+	// The owner may have edited, paused or deleted the link while the round
+	// was probing; act on what it is now, and not at all if the results no
+	// longer describe its destinations.
+	cur, err := db.URLByShortCode(ctx, u.ShortCode)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if cur.ID != u.ID || !cur.IsActive() || !slices.Equal(cur.Destinations(), destinations) {
+		return nil
+	}
+	u = cur
+
+	var unhealthy []string
+	for _, t := range u.RotateTargets {
+		if failures[t] > 0 {
+			unhealthy = append(unhealthy, t)
+		}
+	}
+	if !slices.Equal(unhealthy, u.UnhealthyTargets) {
+		if err := db.SetUnhealthyTargets(ctx, u.ID, unhealthy); err != nil {
+			return err
+		}
+	}
+
+	if u.AutoPauseAfter <= 0 {
+		return nil
+	}
+	// The link is down for as many rounds as its healthiest primary target has
+	// been failing; a single working rotation target keeps it up, and so does
+	// one that could not be checked at all.
+	run := -1
+	for _, t := range u.PrimaryTargets() {
+		n, checked := failures[t]
+		if !checked {
+			return nil
+		}
+		if run < 0 || n < run {
+			run = n
+		}
+	}
+	if run >= u.AutoPauseAfter {
+		if err := db.SetURLEnabled(ctx, u.ID, false, store.SystemActor("health check")); err != nil {
+			return err
+		}
+		log.Warn("paused link after repeated failed health checks",
+			"code", u.ShortCode, "consecutive_failures", run)
+	}
+	return nil
+}
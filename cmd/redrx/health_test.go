@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arumes31/redrx/internal/linkcheck"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+func openTestDB(t *testing.T) *store.DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "health.db")
+	db, err := store.Open(context.Background(), "sqlite:///"+filepath.ToSlash(path))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+// TestCheckDestinationsPausesAndSkips runs the monitor against a server with
+// one working and one dead path, and checks both owner settings take effect:
+// a link whose only destination is dead is paused once the failure run reaches
+// its threshold, and a dead rotation target is marked for skipping while the
+// link itself stays up.
+func TestCheckDestinationsPausesAndSkips(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dead" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	live, dead := ts.URL+"/live", ts.URL+"/dead"
+
+	paused := &store.URL{ShortCode: "DEAD01", LongURL: dead, IsEnabled: true, AutoPauseAfter: 2}
+	rotating := &store.URL{ShortCode: "ROT001", LongURL: live, RotateTargets: []string{live, dead},
+		IsEnabled: true, AutoPauseAfter: 2, SkipUnhealthyTargets: true}
+	for _, u := range []*store.URL{paused, rotating} {
+		if err := db.CreateURL(ctx, u, store.SystemActor("test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prober := linkcheck.New(linkcheck.Options{AllowPrivateNetworks: true})
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	reload := func(code string) *store.URL {
+		t.Helper()
+		u, err := db.URLByShortCode(ctx, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	if err := checkDestinations(ctx, prober, db, log); err != nil {
+		t.Fatalf("first round: %v", err)
+	}
+	if !reload("DEAD01").IsEnabled {
+		t.Fatal("link paused after one failure; the threshold is two")
+	}
+
+	if err := checkDestinations(ctx, prober, db, log); err != nil {
+		t.Fatalf("second round: %v", err)
+	}
+	if reload("DEAD01").IsEnabled {
+		t.Error("link still enabled after two consecutive failures")
+	}
+
+	got := reload("ROT001")
+	if !got.IsEnabled {
+		t.Error("rotating link paused although one of its targets works")
+	}
+	if len(got.UnhealthyTargets) != 1 || got.UnhealthyTargets[0] != dead {
+		t.Errorf("UnhealthyTargets = %v, want [%s]", got.UnhealthyTargets, dead)
+	}
+	if targets := got.HealthyRotateTargets(); len(targets) != 1 || targets[0] != live {
+		t.Errorf("HealthyRotateTargets = %v, want [%s]", targets, live)
+	}
+
+	health, err := db.LinkHealthFor(ctx, []int64{rotating.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range health[rotating.ID] {
+		if h.Target == live && (h.StatusCode != http.StatusOK || !h.Healthy()) {
+			t.Errorf("live target recorded as %+v", h)
+		}
+		if h.Target == dead && (h.StatusCode != http.StatusNotFound || h.ConsecutiveFailures != 2) {
+			t.Errorf("dead target recorded as %+v, want 404 with two failures", h)
+		}
+	}
+}
+
+// TestRecordLinkHealthRereadsTheLink checks a round acts on the link as it is
+// when the results come in, not on the copy read before probing: an owner who
+// turned auto-pause off mid-round keeps the link up.
+func TestRecordLinkHealthRereadsTheLink(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	const dead = "https://dead.example/"
+	link := &store.URL{ShortCode: "EDIT01", LongURL: dead, IsEnabled: true, AutoPauseAfter: 1}
+	if err := db.CreateURL(ctx, link, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := db.URLByShortCode(ctx, link.ShortCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited := *snapshot
+	edited.AutoPauseAfter = 0
+	if err := db.UpdateURL(ctx, &edited, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	results := map[string]linkcheck.Result{dead: {StatusCode: http.StatusNotFound, CheckedAt: time.Now()}}
+	if err := recordLinkHealth(ctx, db, snapshot, results, log); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.URLByShortCode(ctx, link.ShortCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IsEnabled {
+		t.Error("link paused by the setting its owner had turned off")
+	}
+}
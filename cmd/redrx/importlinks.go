@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/arumes31/redrx/internal/config"
+	"github.com/arumes31/redrx/internal/linkimport"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// importLinksOptions are the flags of `redrx import-links`.
+type importLinksOptions struct {
+	source string
+	owner  string
+	dryRun bool
+	json   bool
+}
+
+// runImportLinks is `redrx import-links`: it moves the links of a YOURLS,
+// Shlink or Bitly export into an account, keeping their codes, and prints a
+// line per link. It reads the same environment as the server.
+func runImportLinks(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("import-links", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var opts importLinksOptions
+	fs.StringVar(&opts.source, "from", "", "the shortener the export comes from: "+strings.Join(linkimport.Sources, ", "))
+	fs.StringVar(&opts.owner, "owner", "", "username or email of the account that receives the links")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "report what would be created and every conflict, without creating anything")
+	fs.BoolVar(&opts.json, "json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: redrx import-links -from SOURCE -owner USER [-dry-run] [-json] FILE")
+		fmt.Fprintln(stderr, "FILE may be - for standard input.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || !slices.Contains(linkimport.Sources, opts.source) || opts.owner == "" {
+		fs.Usage()
+		return errors.New("a source, an owner and one file are required")
+	}
+
+	in := io.Reader(os.Stdin)
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := store.Open(ctx, cfg.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Migrate(ctx); err != nil {
+		return err
+	}
+
+	checker, err := loadBlocklist(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	return importLinks(ctx, db, in, opts, checker.CheckURL, stdout)
+}
+
+// importLinks parses the export and migrates it, then writes the report. The
+// report is written even when the migration stops part way, so the operator
+// sees which links went in before the error.
+func importLinks(ctx context.Context, db *store.DB, in io.Reader, opts importLinksOptions, check func(string) (bool, error), out io.Writer) error {
+	owner, err := db.UserByLogin(ctx, opts.owner)
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("no account has the username or email %q", opts.owner)
+	}
+	if err != nil {
+		return err
+	}
+	links, err := linkimport.ParseExport(in, opts.source)
+	if err != nil {
+		return err
+	}
+
+	results, migrateErr := linkimport.Migrate(ctx, db, links, linkimport.MigrateOptions{
+		Owner:  owner,
+		Actor:  store.SystemActor("import from " + opts.source),
+		DryRun: opts.dryRun,
+		Check:  check,
+	})
+	if opts.json {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+		return migrateErr
+	}
+
+	counts := map[string]int{}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LINE\tSTATUS\tCODE\tDESTINATION\tDETAILS")
+	for _, res := range results {
+		counts[res.Status]++
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", res.Line, res.Status, res.ShortCode, res.LongURL, res.Message)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	created := fmt.Sprintf("%d created", counts[linkimport.MigrateCreated])
+	if opts.dryRun {
+		created = fmt.Sprintf("%d ready to move (dry run, nothing created)", counts[linkimport.MigrateValid])
+	}
+	fmt.Fprintf(out, "\n%s for %s, %d conflicting, %d failed.\n",
+		created, owner.Username, counts[linkimport.MigrateConflict], counts[linkimport.MigrateFailed])
+	return migrateErr
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// TestImportLinksKeepsCodesAndReportsConflicts migrates a Shlink export into
+// an account: new codes are created with their history, and codes already in
+// use — here or earlier in the file — are reported and left untouched.
+func TestImportLinksKeepsCodesAndReportsConflicts(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	owner := &store.User{Username: "carol", Email: "carol@example.com", PasswordHash: "x"}
+	if err := db.CreateUser(ctx, owner); err != nil {
+		t.Fatal(err)
+	}
+	existing := &store.URL{ShortCode: "TAKEN", LongURL: "https://mine.example/", IsEnabled: true}
+	if err := db.CreateURL(ctx, existing, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	export := `[
+		{"shortCode": "spring", "longUrl": "https://a.example/", "title": "Spring", "tags": ["sale"],
+		 "dateCreated": "2021-02-03T04:05:06+00:00", "visitsCount": 99},
+		{"shortCode": "taken", "longUrl": "https://theirs.example/", "dateCreated": "2021-02-03T04:05:06+00:00"},
+		{"shortCode": "Spring", "longUrl": "https://b.example/", "dateCreated": "2021-02-03T04:05:06+00:00"},
+		{"shortCode": "x", "longUrl": "https://c.example/", "dateCreated": "2021-02-03T04:05:06+00:00"},
+		{"shortCode": "blocked", "longUrl": "https://bad.example/", "dateCreated": "2021-02-03T04:05:06+00:00"}
+	]`
+	check := func(target string) (bool, error) { return !strings.Contains(target, "bad.example"), nil }
+	run := func(dryRun bool) string {
+		var out strings.Builder
+		opts := importLinksOptions{source: "shlink", owner: "carol", dryRun: dryRun}
+		if err := importLinks(ctx, db, strings.NewReader(export), opts, check, &out); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	if out := run(true); !strings.Contains(out, "1 ready to move (dry run, nothing created) for carol, 2 conflicting, 2 failed.") {
+		t.Fatalf("dry run report:\n%s", out)
+	}
+	if taken, _ := db.ShortCodeTaken(ctx, "SPRING"); taken {
+		t.Fatal("the dry run created a link")
+	}
+
+	out := run(false)
+	for _, want := range []string{"1 created for carol", "An existing link already uses this code.",
+		"Line 1 has the same code", "between 3 and 20 characters", "blocked for safety reasons"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report is missing %q:\n%s", want, out)
+		}
+	}
+	link, err := db.URLByShortCode(ctx, "SPRING")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.UserID == nil || *link.UserID != owner.ID || link.ClicksCount != 99 || link.Title != "Spring" ||
+		len(link.Tags) != 1 || !link.CreatedAt.Equal(time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)) || link.PreviewMode {
+		t.Errorf("migrated link = %+v", link)
+	}
+	if kept, _ := db.URLByShortCode(ctx, "TAKEN"); kept.LongURL != "https://mine.example/" {
+		t.Errorf("the conflicting link was changed to %q", kept.LongURL)
+	}
+
+	// A second run finds its own links and says so.
+	if out := run(false); !strings.Contains(out, "Already here with the same destination") {
+		t.Errorf("rerun report:\n%s", out)
+	}
+}
@@ -1,9 +1,15 @@
 // Command redrx serves the URL shortener.
+//
+// With a subcommand it instead runs one of the operator's one-off tasks:
+// migrating, backing up or restoring the database, managing accounts and
+// links, checking the blocklist or the configuration, or moving the links of
+// another shortener's export into an account. Run `redrx help` for the list.
 package main
 
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -12,6 +18,9 @@ import (
 	"sync"
 	"syscall"
 	"time"
+	// Analytics are bucketed in each owner's timezone, and the runtime image
+	// ships no zone database.
+	_ "time/tzdata"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
@@ -19,19 +28,49 @@ import (
 
 	"github.com/arumes31/redrx/internal/config"
 	"github.com/arumes31/redrx/internal/geo"
+	"github.com/arumes31/redrx/internal/linkcache"
+	"github.com/arumes31/redrx/internal/mail"
 	"github.com/arumes31/redrx/internal/ratelimit"
 	"github.com/arumes31/redrx/internal/safety"
+	"github.com/arumes31/redrx/internal/session"
 	"github.com/arumes31/redrx/internal/store"
+	"github.com/arumes31/redrx/internal/telemetry"
 	"github.com/arumes31/redrx/internal/web"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1:])
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			if !errors.Is(err, errBlocked) {
+				fmt.Fprintln(os.Stderr, "redrx:", err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := run(); err != nil {
 		slog.Error("startup failed", "error", err)
 		os.Exit(1)
 	}
 }
 
+// runCommand runs the one-off task args names instead of the server.
+func runCommand(args []string) error {
+	switch name := args[0]; {
+	case name == "import-links":
+		return runImportLinks(args[1:], os.Stdout, os.Stderr)
+	case name == "help", name == "-h", name == "--help":
+		printAdminUsage(os.Stdout)
+		return nil
+	case isAdminGroup(name):
+		return runAdmin(args, os.Stdin, os.Stdout, os.Stderr)
+	}
+	printAdminUsage(os.Stderr)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
 func run() error {
 	cfg, err := config.Load()
 	if err != nil {
@@ -44,6 +83,29 @@ func run() error {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	// Before anything that starts spans, so none are lost to the no-op
+	// provider.
+	shutdownTracing, err := telemetry.Setup(ctx, telemetry.Options{
+		Endpoint:    cfg.OTLPEndpoint,
+		ServiceName: cfg.OTelServiceName,
+		SampleRatio: cfg.TraceSampleRatio,
+	})
+	if err != nil {
+		return fmt.Errorf("set up tracing: %w", err)
+	}
+	defer func() {
+		// Runs last, after the server and workers, so their final spans are
+		// sent too.
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.Warn("flush traces", "error", err)
+		}
+	}()
+	if cfg.OTLPEndpoint != "" {
+		log.Info("exporting traces", "endpoint", cfg.OTLPEndpoint, "sample_ratio", cfg.TraceSampleRatio)
+	}
+
 	db, err := store.Open(ctx, cfg.DatabaseURL)
 	if err != nil {
 		return err
@@ -68,10 +130,13 @@ func run() error {
 	})
 
 	resolver := geo.New(geo.Options{
-		DatabasePath:  cfg.GeoIPDBPath,
-		UseCloudflare: cfg.UseCloudflare,
-		Cache:         cache,
-		Logger:        log,
+		DatabasePath:     cfg.GeoIPDBPath,
+		CityDatabasePath: cfg.GeoIPCityDBPath,
+		ASNDatabasePath:  cfg.GeoIPASNDBPath,
+		CoarseOnly:       cfg.GeoIPCoarseOnly,
+		UseCloudflare:    cfg.UseCloudflare,
+		Cache:            cache,
+		Logger:           log,
 	})
 	// srv.Shutdown closes this too on the graceful path; Close is idempotent, so
 	// this only covers the paths that return before the server is built.
@@ -83,6 +148,40 @@ func run() error {
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
 
+	// A nil Mailer, not a disabled one, is what switches the account mail
+	// features off in the web server.
+	var mailer mail.Sender
+	if cfg.MailEnabled() {
+		mailer = mail.New(mail.Options{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.SMTPFrom,
+			TLS:      cfg.SMTPTLS,
+		})
+	}
+
+	sessions, closeSessions, err := buildSessionStore(cfg, cache, log)
+	if err != nil {
+		return err
+	}
+	defer closeSessions()
+
+	// The store drops changed links from the cache, whoever changes them: the
+	// handlers or the background jobs below.
+	var links *linkcache.Cache
+	if cfg.LinkCacheSize > 0 {
+		links = linkcache.New(linkcache.Options{
+			Size:     cfg.LinkCacheSize,
+			TTL:      time.Duration(cfg.LinkCacheTTL) * time.Second,
+			Redis:    cache,
+			Logger:   log,
+			Registry: registry,
+		})
+		db.OnURLChange(links.Invalidate)
+	}
+
 	srv, err := web.NewServer(web.Options{
 		Config:   cfg,
 		DB:       db,
@@ -91,6 +190,9 @@ func run() error {
 		Safety:   checker,
 		Geo:      resolver,
 		Registry: registry,
+		Mailer:   mailer,
+		Sessions: sessions,
+		Links:    links,
 	})
 	if err != nil {
 		return err
@@ -106,6 +208,40 @@ func run() error {
 		defer bg.Done()
 		maintainBlocklist(ctx, cfg, checker, db, log)
 	}()
+	bg.Add(1)
+	go func() {
+		defer bg.Done()
+		monitorDestinations(ctx, cfg, db, log)
+	}()
+	bg.Add(1)
+	go func() {
+		defer bg.Done()
+		purgeTrash(ctx, cfg, db, log)
+	}()
+	bg.Add(1)
+	go func() {
+		defer bg.Done()
+		forgetVisitors(ctx, cfg, db, log)
+	}()
+	bg.Add(1)
+	go func() {
+		defer bg.Done()
+		rollupClicks(ctx, cfg, db, log)
+	}()
+	if links != nil {
+		bg.Add(1)
+		go func() {
+			defer bg.Done()
+			links.Listen(ctx)
+		}()
+	}
+	if sessions == nil {
+		bg.Add(1)
+		go func() {
+			defer bg.Done()
+			purgeSessions(ctx, db, log)
+		}()
+	}
 
 	httpServer := &http.Server{
 		Addr:              cfg.Listen,
@@ -127,7 +263,7 @@ func run() error {
 
 	select {
 	case err := <-errCh:
-		// The server never ran; stop the background worker and wait for it
+		// The server never ran; stop the background workers and wait for them
 		// before the deferred db/limiter Close calls run.
 		stop()
 		bg.Wait()
@@ -145,10 +281,13 @@ func run() error {
 		log.Error("graceful shutdown failed", "error", err)
 	}
 
-	// ctx is already cancelled, so the worker's refresh/sweep return promptly.
-	// Wait for it before the deferred db.Close and limiterBackend.Close run.
+	// ctx is already cancelled, so the workers' refreshes, sweeps and probes
+	// return promptly. Wait for them before the deferred db.Close and
+	// limiterBackend.Close run.
 	bg.Wait()
 
+	// With no requests left in flight, this writes the clicks still queued
+	// before the deferred db.Close runs.
 	srvCtx, cancelSrv := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancelSrv()
 	return srv.Shutdown(srvCtx)
@@ -164,7 +303,7 @@ func newLogger(cfg *config.Config) *slog.Logger {
 	if cfg.AnonymizeLogs {
 		handler = anonymizingHandler{handler}
 	}
-	return slog.New(handler)
+	return slog.New(telemetry.LogHandler{Inner: handler})
 }
 
 // buildRateLimitBackend returns the configured limiter storage. A Redis URL
@@ -193,6 +332,36 @@ func buildRateLimitBackend(cfg *config.Config, log *slog.Logger) (ratelimit.Back
 	return backend, backend.Client()
 }
 
+// buildSessionStore returns the Redis session registry when
+// SESSION_STORAGE_URL is set, or nil for the web server's database default.
+// Unlike rate limiting there is no fallback: replicas that disagree on which
+// sessions exist would honour a revoked one. A Redis outage signs visitors out
+// until it recovers.
+func buildSessionStore(cfg *config.Config, cache *redis.Client, log *slog.Logger) (session.Store, func(), error) {
+	uri := cfg.SessionStorageURI
+	if uri == "" {
+		return nil, func() {}, nil
+	}
+	if uri == cfg.RateLimitStorageURI && cache != nil {
+		log.Info("using redis for sessions")
+		return session.NewRedisStore(cache), func() {}, nil
+	}
+
+	// The limiter's backend carries the tuned timeouts; only its client is used.
+	backend, err := ratelimit.NewRedisBackend(uri)
+	if err != nil {
+		return nil, nil, fmt.Errorf("session storage: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := backend.Ping(ctx); err != nil {
+		log.Warn("session redis unreachable; sign-ins fail until it is back", "error", err)
+	} else {
+		log.Info("using redis for sessions")
+	}
+	return session.NewRedisStore(backend.Client()), func() { _ = backend.Close() }, nil
+}
+
 // maintainBlocklist refreshes the phishing feed on PHISHING_CHECK_INTERVAL and,
 // when auto-removal is on, sweeps links pointing at blocked domains on its own
 // PHISHING_REMOVE_INTERVAL. The two are independent because they answer to
@@ -217,7 +386,7 @@ func maintainBlocklist(ctx context.Context, cfg *config.Config, checker *safety.
 		if !cfg.EnableAutoRemovePhish {
 			return
 		}
-		if err := sweepBlockedLinks(ctx, checker, db, log); err != nil {
+		if _, err := sweepBlockedLinks(ctx, checker, db, log); err != nil {
 			log.Warn("phishing sweep failed", "error", err)
 		}
 	}
@@ -286,8 +455,9 @@ func intervalHours(hours int) time.Duration {
 	return time.Duration(hours) * time.Hour
 }
 
-// sweepBlockedLinks deletes links whose destination or any rotation target is
-// now on the blocklist.
+// sweepBlockedLinks moves links whose destination or any rotation target is
+// now on the blocklist to their owners' trash. The link stops resolving at once,
+// and a false positive can be restored until the trash retention runs out.
 //
 // It deletes only on a positive blocklist match. IsSafeURL cannot be used here:
 // it reports false both for "this domain is blocked" and for "the blocklist
@@ -296,9 +466,30 @@ func intervalHours(hours int) time.Duration {
 // not. An unreadable list would otherwise mean every URL is unsafe and this
 // function would empty the links table, which is exactly the state a fresh
 // container is in before its first feed download succeeds.
-func sweepBlockedLinks(ctx context.Context, checker *safety.Checker, db *store.DB, log *slog.Logger) error {
-	// blocked reports a definite match. An error means the list is unavailable,
-	// which aborts the sweep rather than condemning the row.
+func sweepBlockedLinks(ctx context.Context, checker *safety.Checker, db *store.DB, log *slog.Logger) ([]*store.URL, error) {
+	doomed, err := findBlockedLinks(ctx, checker, db)
+	if err != nil {
+		return nil, fmt.Errorf("sweep aborted without deleting anything: %w", err)
+	}
+
+	var moved []*store.URL
+	for _, link := range doomed {
+		if err := db.DeleteURL(ctx, link.ID, store.SystemActor("safety sweep")); err != nil {
+			log.Warn("could not remove blocked link", "id", link.ID, "error", err)
+			continue
+		}
+		moved = append(moved, link)
+	}
+	if len(moved) > 0 {
+		log.Info("moved links pointing at blocked domains to the trash", "count", len(moved))
+	}
+	return moved, nil
+}
+
+// findBlockedLinks returns the links sweepBlockedLinks would remove. An error
+// means the list is unavailable, which aborts the search rather than
+// condemning the row.
+func findBlockedLinks(ctx context.Context, checker *safety.Checker, db *store.DB) ([]*store.URL, error) {
 	blocked := func(target string) (bool, error) {
 		// A row whose URL does not parse cannot match a domain. Skip it instead
 		// of treating "unparseable" as "blocked".
@@ -312,42 +503,21 @@ func sweepBlockedLinks(ctx context.Context, checker *safety.Checker, db *store.D
 		return !ok, nil
 	}
 
-	var doomed []int64
-
+	var doomed []*store.URL
 	err := db.EachURL(ctx, func(u *store.URL) error {
-		hit, err := blocked(u.LongURL)
-		if err != nil {
-			return err
-		}
-		if hit {
-			doomed = append(doomed, u.ID)
-			return nil
-		}
-		for _, t := range u.RotateTargets {
+		for _, t := range append([]string{u.LongURL}, u.RotateTargets...) {
 			hit, err := blocked(t)
 			if err != nil {
 				return err
 			}
 			if hit {
-				doomed = append(doomed, u.ID)
+				doomed = append(doomed, u)
 				return nil
 			}
 		}
 		return nil
 	})
-	if err != nil {
-		return fmt.Errorf("sweep aborted without deleting anything: %w", err)
-	}
-
-	for _, id := range doomed {
-		if err := db.DeleteURL(ctx, id); err != nil {
-			log.Warn("could not remove blocked link", "id", id, "error", err)
-		}
-	}
-	if len(doomed) > 0 {
-		log.Info("removed links pointing at blocked domains", "count", len(doomed))
-	}
-	return nil
+	return doomed, err
 }
 
 func dialectName(d store.Dialect) string {
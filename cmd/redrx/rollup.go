@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/arumes31/redrx/internal/config"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+const (
+	// rollupInterval is how often new clicks are folded into the rollups.
+	// The stats count the clicks since from the clicks table, so this only
+	// bounds how many that is.
+	rollupInterval = time.Minute
+	// rollupBatch is the clicks folded in one transaction.
+	rollupBatch = 5000
+	// clickPurgeInterval is how often clicks past CLICK_RETENTION_DAYS are
+	// deleted. Retention is counted in days, so an hour is precise enough.
+	clickPurgeInterval = time.Hour
+)
+
+// rollupClicks keeps the click rollups current and, with a retention set,
+// deletes the raw clicks that have outlived it.
+func rollupClicks(ctx context.Context, cfg *config.Config, db *store.DB, log *slog.Logger) {
+	var lastPurge time.Time
+	run := func() {
+		var total int
+		for {
+			n, err := db.RollupClicks(ctx, rollupBatch)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Warn("click rollup failed", "error", err)
+				}
+				return
+			}
+			total += n
+			if n < rollupBatch {
+				break
+			}
+		}
+		if total > 0 {
+			log.Debug("rolled up clicks", "count", total)
+		}
+
+		if cfg.ClickRetentionDays == 0 || time.Since(lastPurge) < clickPurgeInterval {
+			return
+		}
+		cutoff := time.Now().UTC().AddDate(0, 0, -cfg.ClickRetentionDays)
+		n, err := db.PurgeClicks(ctx, cutoff)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warn("click purge failed", "error", err)
+			}
+			return
+		}
+		lastPurge = time.Now()
+		if n > 0 {
+			log.Info("purged clicks past retention", "count", n, "retention_days", cfg.ClickRetentionDays)
+		}
+	}
+
+	run()
+
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			run()
+		}
+	}
+}
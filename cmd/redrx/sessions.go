@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/arumes31/redrx/internal/session"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// sessionPurgeInterval is how often idle session registrations are removed.
+// They stop counting the moment they go idle too long, so this only keeps the
+// table small.
+const sessionPurgeInterval = 6 * time.Hour
+
+// purgeSessions deletes database session registrations idle for longer than a
+// session cookie lives. Redis expires its own.
+func purgeSessions(ctx context.Context, db *store.DB, log *slog.Logger) {
+	purge := func() {
+		n, err := db.PurgeUserSessions(ctx, time.Now().UTC().Add(-session.MaxAge))
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warn("session purge failed", "error", err)
+			}
+			return
+		}
+		if n > 0 {
+			log.Info("purged idle sessions", "count", n)
+		}
+	}
+
+	purge()
+
+	ticker := time.NewTicker(sessionPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purge()
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/arumes31/redrx/internal/config"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// trashPurgeInterval is how often the trash is emptied of links past their
+// retention. Retention is counted in days, so an hour is precise enough.
+const trashPurgeInterval = time.Hour
+
+// purgeTrash permanently removes links that have been in the trash longer than
+// TRASH_RETENTION_DAYS.
+func purgeTrash(ctx context.Context, cfg *config.Config, db *store.DB, log *slog.Logger) {
+	purge := func() {
+		cutoff := time.Now().UTC().AddDate(0, 0, -cfg.TrashRetentionDays)
+		n, err := db.PurgeDeletedURLs(ctx, cutoff)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warn("trash purge failed", "error", err)
+			}
+			return
+		}
+		if n > 0 {
+			log.Info("purged links from the trash", "count", n)
+		}
+	}
+
+	purge()
+
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purge()
+		}
+	}
+}
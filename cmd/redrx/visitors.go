@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/arumes31/redrx/internal/config"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// visitorForgetInterval is how often visitor hashes past their dedupe window
+// are cleared and old salts deleted.
+const visitorForgetInterval = 10 * time.Minute
+
+// forgetVisitors keeps visitor hashes only as long as UNIQUE_VISITOR_WINDOW
+// needs them, and a day's salt only for that day. With the window at 0 it
+// clears any hashes left from when it was not.
+func forgetVisitors(ctx context.Context, cfg *config.Config, db *store.DB, log *slog.Logger) {
+	forget := func() {
+		now := time.Now().UTC()
+		cutoff := now.Add(-time.Duration(cfg.UniqueVisitorWindow) * time.Minute)
+		n, err := db.ForgetVisitors(ctx, cutoff, now.Format("2006-01-02"))
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warn("forgetting visitor hashes failed", "error", err)
+			}
+			return
+		}
+		if n > 0 {
+			log.Debug("cleared visitor hashes", "count", n)
+		}
+	}
+
+	forget()
+
+	ticker := time.NewTicker(visitorForgetInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			forget()
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Package botdetect tells automated clients — crawlers, link unfurlers,
+// security scanners, monitoring probes and HTTP libraries — from people, by
+// their User-Agent.
+//
+// The useragent parser flags the well-known crawlers; signatures.txt, a plain
+// list kept alongside this file, covers the rest, and operators can add their
+// own without a release.
+package botdetect
+
+import (
+	"bufio"
+	_ "embed"
+	"strings"
+
+	"github.com/mileusna/useragent"
+)
+
+//go:embed signatures.txt
+var builtin string
+
+// Detector matches User-Agents against the signatures. It is read-only after
+// New, so one is shared by every request.
+type Detector struct {
+	signatures []string
+}
+
+// New returns a detector of the built-in signatures plus extra, each a
+// case-insensitive substring of the User-Agent.
+func New(extra []string) *Detector {
+	d := &Detector{signatures: parseSignatures(builtin)}
+	for _, s := range extra {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+			d.signatures = append(d.signatures, s)
+		}
+	}
+	return d
+}
+
+func parseSignatures(list string) []string {
+	var out []string
+	sc := bufio.NewScanner(strings.NewReader(list))
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.ToLower(strings.TrimSpace(line)); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// IsBot reports whether ua is an automated client. Every browser sends a
+// User-Agent, so a missing one is taken for a bot.
+func (d *Detector) IsBot(ua useragent.UserAgent) bool {
+	if ua.Bot || strings.TrimSpace(ua.String) == "" {
+		return true
+	}
+	lower := strings.ToLower(ua.String)
+	for _, s := range d.signatures {
+		if strings.Contains(lower, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package botdetect
+
+import (
+	"testing"
+
+	"github.com/mileusna/useragent"
+)
+
+func TestIsBot(t *testing.T) {
+	d := New([]string{" Acme-Probe "})
+	for _, tc := range []struct {
+		ua   string
+		want bool
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/128.0 Safari/537.36", false},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1", false},
+		{"Mozilla/5.0 (Linux; Android 12; CUBOT_X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile Safari/537.36", false},
+		{"", true},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", true},
+		{"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", true},
+		{"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", true},
+		{"WhatsApp/2.23.20.0", true},
+		{"Mozilla/5.0 (compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)", true},
+		{"Mozilla/5.0 zgrab/0.x", true},
+		{"curl/8.5.0", true},
+		{"python-requests/2.31.0", true},
+		{"Mozilla/5.0 (X11; Linux x86_64) HeadlessChrome/120.0 Safari/537.36", true},
+		{"acme-probe/1.0", true},
+	} {
+		if got := d.IsBot(useragent.Parse(tc.ua)); got != tc.want {
+			t.Errorf("IsBot(%q) = %v, want %v", tc.ua, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Package channel tells which kind of traffic brought a click: direct,
+// search, social, email, messaging, internal or, for any other site,
+// referral.
+//
+// The UTM parameters of the short URL come first, as the sender's own
+// account of where the link was posted; the referrer decides otherwise.
+// Referrers are looked up in domains.txt, a plain list kept alongside this
+// file.
+package channel
+
+import (
+	"bufio"
+	_ "embed"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// The channels a click is classified into.
+const (
+	Direct    = "direct"
+	Search    = "search"
+	Social    = "social"
+	Email     = "email"
+	Messaging = "messaging"
+	Internal  = "internal"
+	Referral  = "referral"
+)
+
+//go:embed domains.txt
+var builtin string
+
+// mediums maps the utm_medium values in common use to their channel.
+var mediums = map[string]string{
+	"email": Email, "e-mail": Email, "e_mail": Email, "newsletter": Email, "mail": Email,
+	"social": Social, "social-media": Social, "social_media": Social, "socialmedia": Social,
+	"social-network": Social, "sm": Social,
+	"organic": Search, "search": Search, "cpc": Search, "ppc": Search, "sem": Search,
+	"paid-search": Search, "paidsearch": Search,
+	"messaging": Messaging, "messenger": Messaging, "chat": Messaging, "im": Messaging, "sms": Messaging,
+}
+
+// UTM is the campaign a short URL was tagged with.
+type UTM struct {
+	Source, Medium, Campaign string
+}
+
+// FromQuery reads the utm_source, utm_medium and utm_campaign parameters.
+func FromQuery(q url.Values) UTM {
+	return UTM{
+		Source:   strings.TrimSpace(q.Get("utm_source")),
+		Medium:   strings.TrimSpace(q.Get("utm_medium")),
+		Campaign: strings.TrimSpace(q.Get("utm_campaign")),
+	}
+}
+
+// Classifier maps referrers to channels. It is read-only after New, so one
+// is shared by every request.
+type Classifier struct {
+	// domains holds the entries with a dot, names those without.
+	domains, names map[string]string
+	// own are the hosts the service answers on, whose referrers are
+	// internal.
+	own []string
+}
+
+// New returns a classifier of the built-in domains, treating referrers from
+// the own hosts, and their subdomains, as internal.
+func New(own ...string) *Classifier {
+	c := &Classifier{domains: map[string]string{}, names: map[string]string{}}
+	sc := bufio.NewScanner(strings.NewReader(builtin))
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		channel, entry, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if strings.Contains(entry, ".") {
+			c.domains[entry] = channel
+		} else {
+			c.names[entry] = channel
+		}
+	}
+	for _, h := range own {
+		if h = hostname(h); h != "" {
+			c.own = append(c.own, h)
+		}
+	}
+	return c
+}
+
+// Classify returns the channel of a click that came from referrer, empty
+// when there was none, to a short URL tagged with utm. An unknown
+// utm_medium or utm_source falls back to the referrer.
+func (c *Classifier) Classify(referrer string, utm UTM) string {
+	if ch, ok := mediums[strings.ToLower(utm.Medium)]; ok {
+		return ch
+	}
+	if src := strings.ToLower(utm.Source); src != "" {
+		if ch := c.lookup(src); ch != "" {
+			return ch
+		}
+		if !strings.Contains(src, ".") {
+			if ch := c.lookup(src + ".com"); ch != "" {
+				return ch
+			}
+		}
+	}
+
+	if referrer == "" {
+		return Direct
+	}
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return Referral
+	}
+	host := hostname(u.Host)
+	for _, own := range c.own {
+		if host == own || strings.HasSuffix(host, "."+own) {
+			return Internal
+		}
+	}
+	if ch := c.lookup(host); ch != "" {
+		return ch
+	}
+	return Referral
+}
+
+// lookup finds the channel of host: its most specific domain entry, or else
+// a name among its labels.
+func (c *Classifier) lookup(host string) string {
+	for h := host; ; {
+		if ch, ok := c.domains[h]; ok {
+			return ch
+		}
+		_, rest, ok := strings.Cut(h, ".")
+		if !ok {
+			break
+		}
+		h = rest
+	}
+	labels := strings.Split(host, ".")
+	for _, l := range labels[:len(labels)-1] {
+		if ch, ok := c.names[l]; ok {
+			return ch
+		}
+	}
+	return ""
+}
+
+// hostname lowercases host and strips its port and any trailing dot.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
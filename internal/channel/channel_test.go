@@ -0,0 +1,35 @@
+package channel
+
+import "testing"
+
+func TestClassify(t *testing.T) {
+	c := New("short.example.com:8443")
+	for _, tc := range []struct {
+		referrer string
+		utm      UTM
+		want     string
+	}{
+		{"", UTM{}, Direct},
+		{"https://www.google.co.uk/", UTM{}, Search},
+		{"https://duckduckgo.com/", UTM{}, Search},
+		{"https://mail.google.com/mail/u/0/", UTM{}, Email},
+		{"https://l.facebook.com/l.php?u=x", UTM{}, Social},
+		{"https://t.co/abc", UTM{}, Social},
+		{"https://web.whatsapp.com/", UTM{}, Messaging},
+		{"https://webmail.example.net/", UTM{}, Email},
+		{"https://SHORT.example.com/dashboard", UTM{}, Internal},
+		{"https://blog.example.org/post", UTM{}, Referral},
+		{"not a url", UTM{}, Referral},
+		// UTM parameters outrank the referrer.
+		{"https://www.google.com/", UTM{Medium: "Email"}, Email},
+		{"", UTM{Source: "linkedin"}, Social},
+		{"", UTM{Source: "news.ycombinator.com"}, Social},
+		// Unknown ones leave it to the referrer.
+		{"", UTM{Source: "spring-mailing", Medium: "banner"}, Direct},
+		{"https://reddit.com/r/golang", UTM{Source: "acme"}, Social},
+	} {
+		if got := c.Classify(tc.referrer, tc.utm); got != tc.want {
+			t.Errorf("Classify(%q, %+v) = %q, want %q", tc.referrer, tc.utm, got, tc.want)
+		}
+	}
+}
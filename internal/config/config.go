@@ -21,13 +21,19 @@ type Config struct {
 	DatabaseURL   string
 	MaxUploadSize int64
 
-	BaseDomain       string
-	BlockedDomains   []string
-	ExpiryHours      int
-	ShortCodeLength  int
-	DefaultQRColor   string
-	DefaultQRBG      string
-	GeoIPDBPath      string
+	BaseDomain      string
+	BlockedDomains  []string
+	ExpiryHours     int
+	ShortCodeLength int
+	DefaultQRColor  string
+	DefaultQRBG     string
+	GeoIPDBPath     string
+	// GeoIPCityDBPath and GeoIPASNDBPath add the region and city, and the
+	// network, to each click; empty leaves them out. GeoIPCoarseOnly
+	// resolves the country alone, whatever databases are set.
+	GeoIPCityDBPath  string
+	GeoIPASNDBPath   string
+	GeoIPCoarseOnly  bool
 	PhishingListURLs []string
 
 	BlockedDomainsPath     string
@@ -36,10 +42,89 @@ type Config struct {
 	EnableAutoRemovePhish  bool
 	PhishingRemoveInterval int
 
+	// EnableHealthCheck runs the destination monitor. The interval is in
+	// minutes and the timeout, per probe, in seconds.
+	EnableHealthCheck      bool
+	HealthCheckInterval    int
+	HealthCheckConcurrency int
+	HealthCheckTimeout     int
+
+	// TrashRetentionDays is how long a deleted link stays restorable before
+	// the background purge removes it for good.
+	TrashRetentionDays int
+
+	// UniqueVisitorWindow is the minutes after a click in which the same
+	// visitor clicking the same link again is not counted as unique. 0 keeps
+	// no visitor hashes and counts every click as unique. Visitors are told
+	// apart by a salt that changes each UTC day, so the window is at most a
+	// day.
+	UniqueVisitorWindow int
+
+	// ClickRetentionDays is how long raw clicks are kept. Older ones are
+	// deleted once counted in the hourly rollups, which the stats keep
+	// showing. 0 keeps them for as long as their link.
+	ClickRetentionDays int
+
+	// ClickQueueSize is how many redirects can wait in memory for their
+	// click and last-access time to be written; redirects arriving while it
+	// is full are not recorded. 0 writes them during the redirect instead.
+	// ClickBatchSize is the most redirects written in one transaction, and
+	// ClickFlushInterval the seconds at most one waits for it.
+	ClickQueueSize     int
+	ClickBatchSize     int
+	ClickFlushInterval int
+
+	// LinkCacheSize is how many resolved links the redirect path keeps in
+	// memory, and separately how many unknown codes; 0 turns the cache off.
+	// LinkCacheTTL is the seconds an entry lives unless a change to the link
+	// drops it first.
+	LinkCacheSize int
+	LinkCacheTTL  int
+
+	// InternalNetworks are the addresses and CIDR blocks whose clicks count
+	// as internal traffic on every link, such as the operator's office.
+	InternalNetworks []*net.IPNet
+	// BotSignatures are User-Agent substrings to treat as bots on top of the
+	// built-in list.
+	BotSignatures []string
+
+	// SMTP sends account mail: address verification and password resets.
+	// An empty SMTPHost disables mail and both features with it. SMTPTLS is
+	// "starttls", "tls" (implicit, usually port 465) or "none".
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+	SMTPTLS      string
+	// PasswordResetTTL is how long a reset link stays valid, in minutes.
+	PasswordResetTTL int
+
+	// WebAuthnOrigins are the page origins security keys and passkeys are
+	// accepted from. Empty in the environment means https://<BASE_DOMAIN>,
+	// plus the plain-HTTP origin in debug.
+	WebAuthnOrigins []string
+
+	// SessionStorageURI is where signed-in sessions are registered. Empty
+	// keeps them in the database; a redis:// URL shares them through Redis.
+	SessionStorageURI string
+
 	// TrustedProxies lists the peer addresses and CIDR blocks whose
 	// X-Forwarded-* and CF-* headers are believed. Empty means trust none.
 	TrustedProxies []*net.IPNet
 
+	// OTLPEndpoint is the OpenTelemetry collector traces are exported to
+	// over OTLP/HTTP, as http://collector:4318; empty turns tracing off.
+	// TraceSampleRatio is the share of new traces kept, from 0 to 1; a
+	// request that arrives as part of a trace follows its caller's choice.
+	OTLPEndpoint     string
+	OTelServiceName  string
+	TraceSampleRatio float64
+
+	// AdminUsers are the usernames allowed on the admin pages. Listed names
+	// that are still free cannot be registered, so one cannot be claimed.
+	AdminUsers []string
+
 	DisableAnonymousCreate bool
 	DisableRegistration    bool
 	UseCloudflare          bool
@@ -127,6 +212,9 @@ func envList(key, def string) []string {
 // never a host anyone actually serves from.
 const placeholderBaseDomain = "short.example.com"
 
+// maxUniqueVisitorWindow is a day in minutes: the life of a visitor salt.
+const maxUniqueVisitorWindow = 24 * 60
+
 // maxForwardedHops caps how many entries of X-Forwarded-For are parsed, so a
 // client cannot pad the header without bound.
 const maxForwardedHops = 20
@@ -148,6 +236,9 @@ func Load() (*Config, error) {
 		DefaultQRColor:  env("DEFAULT_QR_COLOR", "black"),
 		DefaultQRBG:     env("DEFAULT_QR_BACKGROUND", "white"),
 		GeoIPDBPath:     env("GEOIP_DB_PATH", filepath.Join(baseDir, "GeoLite2-Country.mmdb")),
+		GeoIPCityDBPath: env("GEOIP_CITY_DB_PATH", ""),
+		GeoIPASNDBPath:  env("GEOIP_ASN_DB_PATH", ""),
+		GeoIPCoarseOnly: envBool("GEOIP_COARSE_ONLY", false),
 
 		PhishingListURLs: envList("PHISHING_LIST_URLS",
 			"https://raw.githubusercontent.com/mitchellkrogza/Phishing.Database/master/phishing-domains-ACTIVE.txt"),
@@ -157,8 +248,39 @@ func Load() (*Config, error) {
 		EnableAutoRemovePhish:  envBool("ENABLE_AUTO_REMOVE_PHISHING", false),
 		PhishingRemoveInterval: envInt("PHISHING_REMOVE_INTERVAL", 24),
 
+		EnableHealthCheck:      envBool("ENABLE_HEALTH_CHECK", false),
+		HealthCheckInterval:    envPositiveInt("HEALTH_CHECK_INTERVAL", 60),
+		HealthCheckConcurrency: envPositiveInt("HEALTH_CHECK_CONCURRENCY", 8),
+		HealthCheckTimeout:     envPositiveInt("HEALTH_CHECK_TIMEOUT", 10),
+
+		TrashRetentionDays: envPositiveInt("TRASH_RETENTION_DAYS", 30),
+
+		UniqueVisitorWindow: min(max(envInt("UNIQUE_VISITOR_WINDOW", maxUniqueVisitorWindow), 0), maxUniqueVisitorWindow),
+		ClickRetentionDays:  max(envInt("CLICK_RETENTION_DAYS", 0), 0),
+		ClickQueueSize:      max(envInt("CLICK_QUEUE_SIZE", 10000), 0),
+		ClickBatchSize:      envPositiveInt("CLICK_BATCH_SIZE", 500),
+		ClickFlushInterval:  envPositiveInt("CLICK_FLUSH_INTERVAL", 1),
+		LinkCacheSize:       max(envInt("LINK_CACHE_SIZE", 10000), 0),
+		LinkCacheTTL:        envPositiveInt("LINK_CACHE_TTL", 60),
+
+		SMTPHost:         env("SMTP_HOST", ""),
+		SMTPPort:         envPositiveInt("SMTP_PORT", 587),
+		SMTPUsername:     env("SMTP_USERNAME", ""),
+		SMTPPassword:     env("SMTP_PASSWORD", ""),
+		SMTPFrom:         env("SMTP_FROM", ""),
+		SMTPTLS:          strings.ToLower(env("SMTP_TLS", "starttls")),
+		PasswordResetTTL: envPositiveInt("PASSWORD_RESET_TTL", 60),
+
+		WebAuthnOrigins: envList("WEBAUTHN_ORIGINS", ""),
+
+		SessionStorageURI: env("SESSION_STORAGE_URL", ""),
+
+		OTLPEndpoint:    env("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		OTelServiceName: env("OTEL_SERVICE_NAME", "redrx"),
+
 		DisableAnonymousCreate: envBool("DISABLE_ANONYMOUS_CREATE", false),
 		DisableRegistration:    envBool("DISABLE_REGISTRATION", false),
+		AdminUsers:             envList("ADMIN_USERS", ""),
 		UseCloudflare:          envBool("USE_CLOUDFLARE", false),
 		AnonymizeLogs:          envBool("ANONYMIZE_LOGS", false),
 		EnableSEO:              envBool("ENABLE_SEO", false),
@@ -192,6 +314,15 @@ func Load() (*Config, error) {
 	}
 	c.TrustedProxies = proxies
 
+	for _, e := range envList("INTERNAL_NETWORKS", "") {
+		network, err := ParseNetwork(e)
+		if err != nil {
+			return nil, fmt.Errorf("INTERNAL_NETWORKS: %w", err)
+		}
+		c.InternalNetworks = append(c.InternalNetworks, network)
+	}
+	c.BotSignatures = envList("BOT_SIGNATURES", "")
+
 	c.DatabaseURL = env("DATABASE_URL", "")
 	if c.DatabaseURL == "" {
 		c.DatabaseURL = "sqlite:///" + filepath.Join(baseDir, "db", "shortener.db")
@@ -210,6 +341,31 @@ func Load() (*Config, error) {
 	}
 	c.SecretKey = []byte(secret)
 
+	switch c.SMTPTLS {
+	case "starttls", "tls", "none":
+	default:
+		return nil, errors.New(`SMTP_TLS must be "starttls", "tls" or "none"`)
+	}
+	if c.SMTPFrom == "" {
+		c.SMTPFrom = "no-reply@" + c.CanonicalHost()
+	}
+	if len(c.WebAuthnOrigins) == 0 {
+		c.WebAuthnOrigins = c.defaultWebAuthnOrigins()
+	}
+	if c.SessionStorageURI != "" && !strings.HasPrefix(c.SessionStorageURI, "redis://") &&
+		!strings.HasPrefix(c.SessionStorageURI, "rediss://") {
+		return nil, errors.New("SESSION_STORAGE_URL must be empty or a redis:// URL")
+	}
+
+	c.TraceSampleRatio = 1
+	if v := env("TRACE_SAMPLE_RATIO", ""); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(ratio >= 0 && ratio <= 1) {
+			return nil, errors.New("TRACE_SAMPLE_RATIO must be a number between 0 and 1")
+		}
+		c.TraceSampleRatio = ratio
+	}
+
 	if c.AnonymousPoWDifficulty < 0 || c.AnonymousPoWDifficulty > 28 {
 		return nil, errors.New("ANONYMOUS_POW_DIFFICULTY must be between 0 and 28")
 	}
@@ -226,8 +382,7 @@ func Load() (*Config, error) {
 	return c, nil
 }
 
-// parseTrustedProxies turns the configured entries into networks. A bare
-// address becomes a single-host network so both forms compare the same way.
+// parseTrustedProxies turns the configured entries into networks.
 func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
 	var out []*net.IPNet
 	for _, raw := range entries {
@@ -241,27 +396,39 @@ func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
 			_, all4, _ := net.ParseCIDR("0.0.0.0/0")
 			_, all6, _ := net.ParseCIDR("::/0")
 			out = append(out, all4, all6)
-		case strings.Contains(e, "/"):
-			_, network, err := net.ParseCIDR(e)
+		default:
+			network, err := ParseNetwork(e)
 			if err != nil {
-				return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not a valid CIDR block: %w", e, err)
+				return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
 			}
 			out = append(out, network)
-		default:
-			ip := net.ParseIP(e)
-			if ip == nil {
-				return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not a valid IP address or CIDR block", e)
-			}
-			bits := 32
-			if ip.To4() == nil {
-				bits = 128
-			}
-			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
 		}
 	}
 	return out, nil
 }
 
+// ParseNetwork reads an address or a CIDR block. A bare address becomes a
+// single-host network so both forms compare the same way.
+func ParseNetwork(e string) (*net.IPNet, error) {
+	e = strings.TrimSpace(e)
+	if strings.Contains(e, "/") {
+		_, network, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid CIDR block: %w", e, err)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(e)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not a valid IP address or CIDR block", e)
+	}
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
 // IsTrustedProxy reports whether headers from this peer may be believed.
 func (c *Config) IsTrustedProxy(remoteAddr string) bool {
 	host, _, err := net.SplitHostPort(remoteAddr)
@@ -341,6 +508,49 @@ func (c *Config) CanonicalHost() string {
 	return strings.TrimSuffix(d, "/")
 }
 
+// WebAuthnRPID is the relying party id security keys are registered to: the
+// canonical host without its port.
+func (c *Config) WebAuthnRPID() string {
+	host := c.CanonicalHost()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func (c *Config) defaultWebAuthnOrigins() []string {
+	origins := []string{"https://" + c.CanonicalHost()}
+	if c.Debug {
+		origins = append(origins, "http://"+c.CanonicalHost())
+	}
+	return origins
+}
+
+// ResolvesCity reports whether clicks record a region and city.
+func (c *Config) ResolvesCity() bool {
+	return c.GeoIPCityDBPath != "" && !c.GeoIPCoarseOnly
+}
+
+// ResolvesNetwork reports whether clicks record the network they came from.
+func (c *Config) ResolvesNetwork() bool {
+	return c.GeoIPASNDBPath != "" && !c.GeoIPCoarseOnly
+}
+
+// MailEnabled reports whether an SMTP server is configured.
+func (c *Config) MailEnabled() bool {
+	return c.SMTPHost != ""
+}
+
+// IsAdmin reports whether username is listed in ADMIN_USERS, ignoring case.
+func (c *Config) IsAdmin(username string) bool {
+	for _, a := range c.AdminUsers {
+		if strings.EqualFold(a, username) {
+			return true
+		}
+	}
+	return false
+}
+
 // ShortURL builds the public https URL for a short code.
 func (c *Config) ShortURL(code string) string {
 	return "https://" + c.CanonicalHost() + "/" + code
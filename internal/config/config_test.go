@@ -16,15 +16,24 @@ func clearEnv(t *testing.T) {
 		"SECRET_KEY", "FLASK_DEBUG", "REDRX_DEBUG", "DATABASE_URL", "BASE_DOMAIN",
 		"BLOCKED_DOMAINS", "BLOCKED_DOMAINS_PATH", "EXPIRY_HOURS", "SHORT_CODE_LENGTH",
 		"DEFAULT_QR_COLOR", "DEFAULT_QR_BACKGROUND", "GEOIP_DB_PATH",
+		"GEOIP_CITY_DB_PATH", "GEOIP_ASN_DB_PATH", "GEOIP_COARSE_ONLY",
 		"PHISHING_LIST_URLS", "PHISHING_CHECK_INTERVAL", "PHISHING_REMOVE_INTERVAL",
 		"ENABLE_PHISHING_CHECK", "ENABLE_AUTO_REMOVE_PHISHING",
-		"DISABLE_ANONYMOUS_CREATE", "DISABLE_REGISTRATION", "USE_CLOUDFLARE",
+		"ENABLE_HEALTH_CHECK", "HEALTH_CHECK_INTERVAL", "HEALTH_CHECK_CONCURRENCY",
+		"HEALTH_CHECK_TIMEOUT", "TRASH_RETENTION_DAYS", "UNIQUE_VISITOR_WINDOW",
+		"INTERNAL_NETWORKS", "BOT_SIGNATURES", "CLICK_RETENTION_DAYS",
+		"CLICK_QUEUE_SIZE", "CLICK_BATCH_SIZE", "CLICK_FLUSH_INTERVAL",
+		"LINK_CACHE_SIZE", "LINK_CACHE_TTL",
+		"SMTP_HOST", "SMTP_PORT", "SMTP_USERNAME", "SMTP_PASSWORD", "SMTP_FROM", "SMTP_TLS",
+		"PASSWORD_RESET_TTL", "WEBAUTHN_ORIGINS", "SESSION_STORAGE_URL",
+		"DISABLE_ANONYMOUS_CREATE", "DISABLE_REGISTRATION", "ADMIN_USERS", "USE_CLOUDFLARE",
 		"ANONYMIZE_LOGS", "ENABLE_SEO", "SEO_DOMAIN", "TRUSTED_PROXIES",
 		"ANONYMOUS_POW_DIFFICULTY", "ENABLE_CONSENT_BANNER", "HONOR_DO_NOT_TRACK",
 		"RATELIMIT_DEFAULT", "RATELIMIT_STORAGE_URL", "RATELIMIT_LOGIN",
 		"RATELIMIT_REGISTER", "RATELIMIT_AUTH", "RATELIMIT_API", "RATELIMIT_CREATE",
 		"RATELIMIT_REDIRECT",
 		"LISTEN_ADDR", "MAXMIND_LICENSE_KEY",
+		"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_SERVICE_NAME", "TRACE_SAMPLE_RATIO",
 	} {
 		t.Setenv(k, "")
 	}
@@ -111,6 +120,9 @@ func TestDefaultsMatchPreviousDeployment(t *testing.T) {
 		{"DisableRegistration", cfg.DisableRegistration, false},
 		{"DisableAnonymousCreate", cfg.DisableAnonymousCreate, false},
 		{"UseCloudflare", cfg.UseCloudflare, false},
+		{"GeoIPCityDBPath", cfg.GeoIPCityDBPath, ""},
+		{"GeoIPASNDBPath", cfg.GeoIPASNDBPath, ""},
+		{"GeoIPCoarseOnly", cfg.GeoIPCoarseOnly, false},
 		{"EnableSEO", cfg.EnableSEO, false},
 		{"EnableConsentBanner", cfg.EnableConsentBanner, false},
 		{"HonorDoNotTrack", cfg.HonorDoNotTrack, true},
@@ -119,7 +131,26 @@ func TestDefaultsMatchPreviousDeployment(t *testing.T) {
 		{"RateLimitDefault", cfg.RateLimitDefault, "200 per day;50 per hour"},
 		{"RateLimitStorageURI", cfg.RateLimitStorageURI, "memory://"},
 		{"PhishingCheckInterval", cfg.PhishingCheckInterval, 24},
+		{"TrashRetentionDays", cfg.TrashRetentionDays, 30},
+		{"UniqueVisitorWindow", cfg.UniqueVisitorWindow, 1440},
+		{"ClickRetentionDays", cfg.ClickRetentionDays, 0},
+		{"ClickQueueSize", cfg.ClickQueueSize, 10000},
+		{"ClickBatchSize", cfg.ClickBatchSize, 500},
+		{"ClickFlushInterval", cfg.ClickFlushInterval, 1},
+		{"LinkCacheSize", cfg.LinkCacheSize, 10000},
+		{"LinkCacheTTL", cfg.LinkCacheTTL, 60},
+		{"SMTPPort", cfg.SMTPPort, 587},
+		{"SMTPTLS", cfg.SMTPTLS, "starttls"},
+		{"SMTPFrom", cfg.SMTPFrom, "no-reply@short.example.com"},
+		{"PasswordResetTTL", cfg.PasswordResetTTL, 60},
+		{"MailEnabled", cfg.MailEnabled(), false},
+		{"WebAuthnRPID", cfg.WebAuthnRPID(), "short.example.com"},
+		{"WebAuthnOrigins", strings.Join(cfg.WebAuthnOrigins, ","), "https://short.example.com,http://short.example.com"},
+		{"SessionStorageURI", cfg.SessionStorageURI, ""},
 		{"Listen", cfg.Listen, ":5000"},
+		{"OTLPEndpoint", cfg.OTLPEndpoint, ""},
+		{"OTelServiceName", cfg.OTelServiceName, "redrx"},
+		{"TraceSampleRatio", cfg.TraceSampleRatio, 1.0},
 	}
 	for _, c := range checks {
 		if c.got != c.want {
@@ -346,6 +377,57 @@ func TestTrustedProxiesRejectsGarbage(t *testing.T) {
 	}
 }
 
+func TestInternalNetworks(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("SECRET_KEY", "k")
+	t.Setenv("BASE_DOMAIN", "links.example.org")
+	t.Setenv("INTERNAL_NETWORKS", "192.0.2.0/24, 2001:db8::1")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(cfg.InternalNetworks) != 2 || !cfg.InternalNetworks[0].Contains(net.ParseIP("192.0.2.77")) ||
+		!cfg.InternalNetworks[1].Contains(net.ParseIP("2001:db8::1")) || cfg.InternalNetworks[1].Contains(net.ParseIP("2001:db8::2")) {
+		t.Errorf("InternalNetworks = %v", cfg.InternalNetworks)
+	}
+
+	t.Setenv("INTERNAL_NETWORKS", "192.0.2.0/33")
+	if _, err := Load(); err == nil {
+		t.Fatal("Load accepted an invalid INTERNAL_NETWORKS entry")
+	}
+}
+
+func TestSessionStorageMustBeRedis(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("SECRET_KEY", "k")
+	t.Setenv("BASE_DOMAIN", "links.example.org")
+	t.Setenv("SESSION_STORAGE_URL", "memory://")
+	if _, err := Load(); err == nil {
+		t.Fatal("Load accepted a non-Redis SESSION_STORAGE_URL")
+	}
+}
+
+func TestTraceSampleRatio(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("SECRET_KEY", "k")
+	t.Setenv("BASE_DOMAIN", "links.example.org")
+	t.Setenv("TRACE_SAMPLE_RATIO", "0.25")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.TraceSampleRatio != 0.25 {
+		t.Errorf("TraceSampleRatio = %v, want 0.25", cfg.TraceSampleRatio)
+	}
+
+	for _, v := range []string{"1.5", "-0.1", "NaN", "half"} {
+		t.Setenv("TRACE_SAMPLE_RATIO", v)
+		if _, err := Load(); err == nil {
+			t.Errorf("Load accepted TRACE_SAMPLE_RATIO=%s", v)
+		}
+	}
+}
+
 func mustCIDR(t *testing.T, s string) *net.IPNet {
 	t.Helper()
 	_, n, err := net.ParseCIDR(s)
@@ -1,14 +1,20 @@
-// Package geo resolves a client IP to a country name.
+// Package geo resolves a client IP to a country name and, when the operator
+// provides the databases, a region, city and network.
 //
 // Lookups are tried in the same order the previous implementation used: Redis
 // cache, Cloudflare's CF-IPCountry header, private-network shortcut, then the
-// local MaxMind database.
+// local MaxMind databases: GeoLite2-Country for the country, and the optional
+// GeoLite2-City and GeoLite2-ASN files for the rest. With coarse-only
+// geolocation, only the country is ever resolved.
 package geo
 
 import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
@@ -19,8 +25,13 @@ import (
 
 	"github.com/oschwald/geoip2-golang"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/arumes31/redrx/internal/telemetry"
 )
 
+var tracer = telemetry.Tracer("geo")
+
 // trustedProxyKey marks a request whose forwarding headers arrived from a
 // proxy listed in TRUSTED_PROXIES.
 type trustedProxyKey struct{}
@@ -41,13 +52,33 @@ const (
 	cacheTTL    = 5 * time.Minute
 )
 
-// Resolver looks up countries and caches the answers.
+// Location is where an address resolves to. The fields the configured
+// databases do not cover, or coarse-only geolocation leaves out, are empty.
+type Location struct {
+	Country string `json:"country"`
+	Region  string `json:"region,omitempty"`
+	City    string `json:"city,omitempty"`
+	// Network is the autonomous system announcing the address, as
+	// "AS64496 Example Networks".
+	Network string `json:"network,omitempty"`
+}
+
+// Resolver looks up locations and caches the answers.
 type Resolver struct {
-	dbPath        string
 	useCloudflare bool
 	cache         *redis.Client
 	log           *slog.Logger
 
+	// city and asn are nil when not configured, or with coarse-only
+	// geolocation.
+	country, city, asn *database
+}
+
+// database is one MaxMind file, opened on first use.
+type database struct {
+	path string
+	log  *slog.Logger
+
 	// mu guards every field below. Lookups take it for reading and hold it for
 	// the duration of the query, so Close cannot unmap the database underneath
 	// an in-flight read.
@@ -73,7 +104,13 @@ type Resolver struct {
 const readerRecheckInterval = time.Minute
 
 type Options struct {
-	DatabasePath  string
+	DatabasePath string
+	// CityDatabasePath and ASNDatabasePath name the optional GeoLite2-City
+	// and GeoLite2-ASN files; empty leaves region, city or network unresolved.
+	CityDatabasePath string
+	ASNDatabasePath  string
+	// CoarseOnly resolves the country alone, whatever databases are set.
+	CoarseOnly    bool
 	UseCloudflare bool
 	Cache         *redis.Client
 	Logger        *slog.Logger
@@ -84,12 +121,21 @@ func New(opts Options) *Resolver {
 	if log == nil {
 		log = slog.Default()
 	}
-	return &Resolver{
-		dbPath:        opts.DatabasePath,
+	r := &Resolver{
 		useCloudflare: opts.UseCloudflare,
 		cache:         opts.Cache,
 		log:           log,
+		country:       &database{path: opts.DatabasePath, log: log},
 	}
+	if !opts.CoarseOnly {
+		if opts.CityDatabasePath != "" {
+			r.city = &database{path: opts.CityDatabasePath, log: log}
+		}
+		if opts.ASNDatabasePath != "" {
+			r.asn = &database{path: opts.ASNDatabasePath, log: log}
+		}
+	}
+	return r
 }
 
 // ClientIP returns the caller's address.
@@ -109,34 +155,50 @@ func (r *Resolver) ClientIP(req *http.Request) string {
 // Country resolves the country for ip, consulting the request headers first
 // when Cloudflare integration is enabled.
 func (r *Resolver) Country(ctx context.Context, ip string, req *http.Request) string {
+	return r.Locate(ctx, ip, req).Country
+}
+
+// Locate resolves the location of ip: the country as Country does, and the
+// region, city and network from the databases configured for them.
+func (r *Resolver) Locate(ctx context.Context, ip string, req *http.Request) Location {
 	if ip == "" {
-		return "Unknown"
+		return Location{Country: "Unknown"}
 	}
 
-	if v := r.cached(ctx, ip); v != "" {
-		return v
+	ctx, span := tracer.Start(ctx, "geo.locate")
+	defer span.End()
+	if loc, ok := r.cached(ctx, ip); ok {
+		span.SetAttributes(attribute.Bool("geo.cache_hit", true))
+		return loc
 	}
+	span.SetAttributes(attribute.Bool("geo.cache_hit", false))
 
+	var loc Location
 	if r.useCloudflare && req != nil && IsFromTrustedProxy(req.Context()) {
 		// Validate the shape before it becomes a stored analytics value: the
 		// column is VARCHAR(100), so an over-long header fails the insert on
 		// Postgres, and any value poisons the geo cache for this IP.
 		if cc := strings.TrimSpace(req.Header.Get("CF-IPCountry")); isCountryCode(cc) {
-			cc = strings.ToUpper(cc)
-			r.store(ctx, ip, cc)
-			return cc
+			loc.Country = strings.ToUpper(cc)
 		}
 	}
 
-	if isLocal(ip) {
-		return "Local Network"
+	if loc.Country == "" && isLocal(ip) {
+		return Location{Country: "Local Network"}
 	}
 
-	country := r.lookupDB(ip)
-	if country != "" && !strings.Contains(country, "Unknown") {
-		r.store(ctx, ip, country)
+	addr := net.ParseIP(ip)
+	if loc.Country == "" {
+		loc.Country = r.lookupCountry(addr)
 	}
-	return country
+	if addr != nil {
+		r.lookupCity(addr, &loc)
+		r.lookupASN(addr, &loc)
+	}
+	if !strings.Contains(loc.Country, "Unknown") {
+		r.store(ctx, ip, loc)
+	}
+	return loc
 }
 
 // cacheKey hashes the IP so the cache never persists a visitor's raw address.
@@ -147,22 +209,43 @@ func cacheKey(ip string) string {
 	return cachePrefix + hex.EncodeToString(sum[:16])
 }
 
-func (r *Resolver) cached(ctx context.Context, ip string) string {
+// cached returns the location cached for ip. Entries are JSON; a bare string
+// is a country cached before locations were.
+func (r *Resolver) cached(ctx context.Context, ip string) (Location, bool) {
 	if r.cache == nil {
-		return ""
+		return Location{}, false
 	}
 	v, err := r.cache.Get(ctx, cacheKey(ip)).Result()
-	if err != nil {
-		return ""
+	if err != nil || v == "" {
+		return Location{}, false
 	}
-	return v
+	if !strings.HasPrefix(v, "{") {
+		return Location{Country: v}, true
+	}
+	var loc Location
+	if err := json.Unmarshal([]byte(v), &loc); err != nil || loc.Country == "" {
+		return Location{}, false
+	}
+	// Replicas share the cache, and one may not resolve as much as another:
+	// never hand out more than this one would.
+	if r.city == nil {
+		loc.Region, loc.City = "", ""
+	}
+	if r.asn == nil {
+		loc.Network = ""
+	}
+	return loc, true
 }
 
-func (r *Resolver) store(ctx context.Context, ip, country string) {
-	if r.cache == nil || country == "" {
+func (r *Resolver) store(ctx context.Context, ip string, loc Location) {
+	if r.cache == nil || loc.Country == "" {
+		return
+	}
+	v, err := json.Marshal(loc)
+	if err != nil {
 		return
 	}
-	if err := r.cache.Set(ctx, cacheKey(ip), country, cacheTTL).Err(); err != nil {
+	if err := r.cache.Set(ctx, cacheKey(ip), v, cacheTTL).Err(); err != nil {
 		r.log.Debug("geo cache write failed", "error", err)
 	}
 }
@@ -190,142 +273,189 @@ func isLocal(ip string) bool {
 	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified()
 }
 
-// lookupDB queries the MaxMind database, opening it on first use and keeping
-// the handle for subsequent lookups.
-//
-// The read lock is held across the query itself, not just while fetching the
-// handle: geoip2 reads straight out of a memory mapping that Close unmaps, so a
-// Close racing an in-flight lookup would otherwise read freed pages.
-func (r *Resolver) lookupDB(ip string) string {
-	addr := net.ParseIP(ip)
+// lookupCountry queries the country database.
+func (r *Resolver) lookupCountry(addr net.IP) string {
 	if addr == nil {
 		return "Unknown"
 	}
+	country := "Unknown"
+	found := r.country.query(func(reader *geoip2.Reader) {
+		record, err := reader.Country(addr)
+		if err != nil || record == nil {
+			return
+		}
+		if name := record.Country.Names["en"]; name != "" {
+			country = name
+		} else if record.Country.IsoCode != "" {
+			country = record.Country.IsoCode
+		}
+	})
+	if !found {
+		return "Unknown (DB Missing)"
+	}
+	return country
+}
+
+// lookupCity fills in the region and city from the city database, if any.
+// The region is the largest subdivision: the state, province or country part.
+func (r *Resolver) lookupCity(addr net.IP, loc *Location) {
+	if r.city == nil {
+		return
+	}
+	r.city.query(func(reader *geoip2.Reader) {
+		record, err := reader.City(addr)
+		if err != nil || record == nil {
+			return
+		}
+		if len(record.Subdivisions) > 0 {
+			loc.Region = record.Subdivisions[0].Names["en"]
+		}
+		loc.City = record.City.Names["en"]
+	})
+}
 
+// lookupASN fills in the network from the ASN database, if any.
+func (r *Resolver) lookupASN(addr net.IP, loc *Location) {
+	if r.asn == nil {
+		return
+	}
+	r.asn.query(func(reader *geoip2.Reader) {
+		record, err := reader.ASN(addr)
+		if err != nil || record == nil || record.AutonomousSystemNumber == 0 {
+			return
+		}
+		loc.Network = strings.TrimSpace(fmt.Sprintf("AS%d %s",
+			record.AutonomousSystemNumber, record.AutonomousSystemOrganization))
+	})
+}
+
+// query runs q against the database, opening it on first use and keeping the
+// handle for subsequent lookups. It reports false when there is no database
+// to query.
+//
+// The read lock is held across the query itself, not just while fetching the
+// handle: geoip2 reads straight out of a memory mapping that Close unmaps, so a
+// Close racing an in-flight lookup would otherwise read freed pages.
+func (db *database) query(q func(*geoip2.Reader)) bool {
 	// Fast path: a reader that is open and was verified recently answers under
 	// the read lock alone. Going through ensureReader every time would funnel
 	// every concurrent redirect through the exclusive lock — and, with no
 	// database present, add a stat syscall per lookup while holding it.
-	if country, ok := r.lookupWithOpenReader(addr); ok {
-		return country
+	if db.queryOpenReader(q) {
+		return true
 	}
 
 	// Equally, once the database has been found missing, do not take the write
 	// lock and re-stat on every lookup until the recheck interval elapses.
-	if r.recentlyMissing() {
-		return "Unknown (DB Missing)"
-	}
-
-	if err := r.ensureReader(); err != nil {
-		return "Unknown (DB Missing)"
+	if db.recentlyMissing() {
+		return false
 	}
 
-	if country, ok := r.lookupWithOpenReader(addr); ok {
-		return country
+	if err := db.ensureReader(); err != nil {
+		return false
 	}
-	return "Unknown (DB Missing)"
+	return db.queryOpenReader(q)
 }
 
-// lookupWithOpenReader answers from the currently open database, reporting
+// queryOpenReader runs q against the currently open database, reporting
 // false when there is none or its fingerprint is due to be rechecked. The read
 // lock is held across the query itself: geoip2 reads out of a memory mapping
 // that Close unmaps, so releasing it first would risk reading freed pages.
-func (r *Resolver) lookupWithOpenReader(addr net.IP) (string, bool) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-
-	if r.reader == nil || r.closed || time.Since(r.checkedAt) > readerRecheckInterval {
-		return "", false
-	}
+func (db *database) queryOpenReader(q func(*geoip2.Reader)) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
-	record, err := r.reader.Country(addr)
-	if err != nil || record == nil {
-		return "Unknown", true
-	}
-	if name := record.Country.Names["en"]; name != "" {
-		return name, true
-	}
-	if record.Country.IsoCode != "" {
-		return record.Country.IsoCode, true
+	if db.reader == nil || db.closed || time.Since(db.checkedAt) > readerRecheckInterval {
+		return false
 	}
-	return "Unknown", true
+	q(db.reader)
+	return true
 }
 
 // recentlyMissing reports whether a recent stat already found no database, so
 // the caller can skip the write lock and the syscall until the recheck window
 // expires and the database is worth looking for again.
-func (r *Resolver) recentlyMissing() bool {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	return r.reader == nil && !r.missingAt.IsZero() &&
-		time.Since(r.missingAt) < readerRecheckInterval
+func (db *database) recentlyMissing() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.reader == nil && !db.missingAt.IsZero() &&
+		time.Since(db.missingAt) < readerRecheckInterval
 }
 
 // ensureReader opens the database, or reopens it when the file on disk has been
 // replaced. It takes the write lock, so it must never be called while the read
 // lock is held.
-func (r *Resolver) ensureReader() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+func (db *database) ensureReader() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	if r.closed {
+	if db.closed {
 		return os.ErrClosed
 	}
-	if r.dbPath == "" {
-		r.missingAt = time.Now()
+	if db.path == "" {
+		db.missingAt = time.Now()
 		return os.ErrNotExist
 	}
 
-	info, err := os.Stat(r.dbPath)
+	info, err := os.Stat(db.path)
 	if err != nil {
-		r.missingAt = time.Now()
+		db.missingAt = time.Now()
 		return err
 	}
 
 	// Open and unchanged: just extend the recheck deadline.
-	if r.reader != nil && r.opened == r.dbPath &&
-		info.ModTime().Equal(r.modTime) && info.Size() == r.size {
-		r.checkedAt = time.Now()
+	if db.reader != nil && db.opened == db.path &&
+		info.ModTime().Equal(db.modTime) && info.Size() == db.size {
+		db.checkedAt = time.Now()
 		return nil
 	}
 
-	reader, err := geoip2.Open(r.dbPath)
+	reader, err := geoip2.Open(db.path)
 	if err != nil {
-		r.missingAt = time.Now()
-		r.log.Warn("cannot open GeoIP database", "path", r.dbPath, "error", err)
+		db.missingAt = time.Now()
+		db.log.Warn("cannot open GeoIP database", "path", db.path, "error", err)
 		return err
 	}
-	if err := r.closeReaderLocked(); err != nil {
-		r.log.Warn("closing the previous GeoIP database failed", "error", err)
+	if err := db.closeReaderLocked(); err != nil {
+		db.log.Warn("closing the previous GeoIP database failed", "path", db.path, "error", err)
 	}
-	r.reader, r.opened = reader, r.dbPath
-	r.modTime, r.size, r.checkedAt = info.ModTime(), info.Size(), time.Now()
+	db.reader, db.opened = reader, db.path
+	db.modTime, db.size, db.checkedAt = info.ModTime(), info.Size(), time.Now()
 	// The database is open again, so clear the negative cache.
-	r.missingAt = time.Time{}
+	db.missingAt = time.Time{}
 	return nil
 }
 
 // closeReaderLocked releases the current reader. The caller must hold the write
 // lock, so no lookup can be reading through it.
-func (r *Resolver) closeReaderLocked() error {
-	if r.reader == nil {
+func (db *database) closeReaderLocked() error {
+	if db.reader == nil {
 		return nil
 	}
-	err := r.reader.Close()
-	r.reader, r.opened = nil, ""
-	r.modTime, r.size, r.checkedAt = time.Time{}, 0, time.Time{}
+	err := db.reader.Close()
+	db.reader, db.opened = nil, ""
+	db.modTime, db.size, db.checkedAt = time.Time{}, 0, time.Time{}
 	return err
 }
 
-// Close releases the MaxMind reader, waiting for any in-flight lookup to finish
-// first. It is terminal: a lookup arriving afterwards must not reopen the
-// database, or a request still running past the shutdown deadline would leak a
-// fresh mapping that nothing closes.
+// close releases the reader, waiting for any in-flight lookup to finish
+// first, and keeps it from being opened again.
+func (db *database) close() error {
+	if db == nil {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.closed = true
+	return db.closeReaderLocked()
+}
+
+// Close releases the MaxMind readers, waiting for any in-flight lookup to
+// finish first. It is terminal: a lookup arriving afterwards must not reopen a
+// database, or a request still running past the shutdown deadline would leak
+// a fresh mapping that nothing closes.
 func (r *Resolver) Close() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.closed = true
-	return r.closeReaderLocked()
+	return errors.Join(r.country.close(), r.city.close(), r.asn.close())
 }
 
 // AnonymizeIP masks an address down to the precision the privacy policy
@@ -0,0 +1,450 @@
+// Package linkcache caches the links the redirect path resolves, so a busy
+// link is not a database round trip on every visit.
+//
+// Lookups are tried in process first, in a bounded LRU, then in Redis when
+// one is configured, shared by every replica, and only then in the database.
+// Codes that resolve to nothing are cached too, in an LRU of their own, so
+// scanning for codes neither reaches the database nor evicts the links in use.
+//
+// Entries expire after the TTL and are dropped sooner by Invalidate, which
+// the store calls whenever a link changes. With Redis, Invalidate also
+// deletes the shared entries and publishes the codes, and Listen drops them
+// from every other replica's memory. Without Redis, another replica's change
+// shows once the TTL has passed.
+package linkcache
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/arumes31/redrx/internal/store"
+	"github.com/arumes31/redrx/internal/telemetry"
+)
+
+var tracer = telemetry.Tracer("linkcache")
+
+const (
+	keyPrefix     = "redrx:link:"
+	versionPrefix = "redrx:link-version:"
+	// channel carries the space-separated codes to drop.
+	channel = "redrx:link-invalidations"
+	// unknown is the Redis value of a code that resolves to nothing.
+	unknown = "-"
+)
+
+// redisTimeout bounds each Redis call, so an outage costs a lookup the
+// database round trip the cache was saving rather than stalling it.
+const redisTimeout = 500 * time.Millisecond
+
+// versionTTL is how long a code's invalidation count is kept: longer than a
+// load and its Redis calls can take, after which no load can hold the old
+// count. A count that expired reads as none, which a load that saw one
+// cannot match either.
+const versionTTL = time.Minute
+
+// loadTimeout bounds a database load. The load is shared by every request
+// waiting on the code, so it runs on none of their contexts.
+const loadTimeout = 3 * time.Second
+
+// Options configures a Cache.
+type Options struct {
+	// Size is how many links are held in process, and separately how many
+	// unknown codes.
+	Size int
+	TTL  time.Duration
+	// Redis, when set, adds the shared tier and the invalidation messages.
+	Redis    *redis.Client
+	Logger   *slog.Logger
+	Registry prometheus.Registerer
+}
+
+// Cache holds resolved links. The links it returns are shared and must not
+// be modified, and are only what the redirect needs: one that came through
+// Redis has no password hash to check, only a mark that it needs one.
+type Cache struct {
+	ttl    time.Duration
+	redis  *redis.Client
+	log    *slog.Logger
+	loads  singleflight.Group
+	lookup *prometheus.CounterVec
+
+	// mu guards the LRUs and gen. gen counts invalidations, so a load that
+	// raced one is not cached: it may have read the link before the change.
+	mu     sync.Mutex
+	links  *lru
+	misses *lru
+	gen    uint64
+}
+
+func New(opts Options) *Cache {
+	log := opts.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	c := &Cache{
+		ttl:    opts.TTL,
+		redis:  opts.Redis,
+		log:    log,
+		links:  newLRU(opts.Size),
+		misses: newLRU(opts.Size),
+		lookup: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "redrx_link_cache_lookups_total",
+			Help: "Redirect link lookups by where they were answered: memory, unknown (a cached miss), redis or database",
+		}, []string{"source"}),
+	}
+	if opts.Registry != nil {
+		opts.Registry.MustRegister(c.lookup)
+	}
+	return c
+}
+
+func redisKey(code string) string { return keyPrefix + code }
+
+// versionKey counts a code's invalidations; see toRedis.
+func versionKey(code string) string { return versionPrefix + code }
+
+// Get returns the link with code, or store.ErrNotFound, loading it with load
+// on a miss. Concurrent misses for one code share a single load.
+func (c *Cache) Get(ctx context.Context, code string, load func(context.Context, string) (*store.URL, error)) (*store.URL, error) {
+	ctx, span := tracer.Start(ctx, "linkcache.get")
+	defer span.End()
+
+	now := time.Now()
+	c.mu.Lock()
+	if link, ok := c.links.get(code, now); ok {
+		c.mu.Unlock()
+		c.lookup.WithLabelValues("memory").Inc()
+		span.SetAttributes(attribute.String("linkcache.source", "memory"))
+		return link, nil
+	}
+	if _, ok := c.misses.get(code, now); ok {
+		c.mu.Unlock()
+		c.lookup.WithLabelValues("unknown").Inc()
+		span.SetAttributes(attribute.String("linkcache.source", "unknown"))
+		return nil, store.ErrNotFound
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	// Keyed by generation too, so a lookup after an invalidation does not
+	// join a load that began before it.
+	ch := c.loads.DoChan(strconv.FormatUint(gen, 10)+":"+code, func() (any, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), loadTimeout)
+		defer cancel()
+		return c.load(loadCtx, code, gen, load)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*store.URL), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// load resolves a code missing from memory, from Redis or else the database,
+// and caches the answer unless an invalidation came in since gen.
+func (c *Cache) load(ctx context.Context, code string, gen uint64, load func(context.Context, string) (*store.URL, error)) (*store.URL, error) {
+	// The load is shared by the concurrent lookups; its span is in the trace
+	// of the one that started it.
+	ctx, span := tracer.Start(ctx, "linkcache.load")
+	defer span.End()
+	link, found, ok, version := c.fromRedis(ctx, code)
+	if ok {
+		c.lookup.WithLabelValues("redis").Inc()
+		span.SetAttributes(attribute.String("linkcache.source", "redis"))
+		c.keep(code, link, gen)
+		if !found {
+			return nil, store.ErrNotFound
+		}
+		return link, nil
+	}
+
+	c.lookup.WithLabelValues("database").Inc()
+	span.SetAttributes(attribute.String("linkcache.source", "database"))
+	link, err := load(ctx, code)
+	if errors.Is(err, store.ErrNotFound) {
+		link = nil
+	} else if err != nil {
+		return nil, err
+	}
+	if c.keep(code, link, gen) && version != nil {
+		c.toRedis(ctx, code, link, gen, *version)
+	}
+	if link == nil {
+		return nil, store.ErrNotFound
+	}
+	return link, nil
+}
+
+// keep caches a link, or nil for an unknown code, in memory unless an
+// invalidation came in since gen, and reports whether it did.
+func (c *Cache) keep(code string, link *store.URL, gen uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return false
+	}
+	expires := time.Now().Add(c.ttl)
+	if link == nil {
+		c.misses.put(code, nil, expires)
+	} else {
+		c.links.put(code, link, expires)
+	}
+	return true
+}
+
+// fromRedis reports ok when Redis had an answer for code: the link, or
+// found false for an unknown code. Either way it returns the code's version
+// as it stood, for toRedis; nil when Redis could not be read.
+func (c *Cache) fromRedis(ctx context.Context, code string) (link *store.URL, found, ok bool, version *string) {
+	if c.redis == nil {
+		return nil, false, false, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	vals, err := c.redis.MGet(ctx, redisKey(code), versionKey(code)).Result()
+	if err != nil {
+		c.log.Debug("link cache read failed", "error", err)
+		return nil, false, false, nil
+	}
+	ver, _ := vals[1].(string)
+	v, cached := vals[0].(string)
+	if !cached {
+		return nil, false, false, &ver
+	}
+	if v == unknown {
+		return nil, false, true, &ver
+	}
+	link, err = decodeLink([]byte(v))
+	if err != nil {
+		c.log.Debug("link cache entry unreadable", "code", code, "error", err)
+		return nil, false, false, &ver
+	}
+	return link, true, true, &ver
+}
+
+// storeIfCurrent writes a link's entry only while its version is still the
+// one read before the load, so a load that raced an invalidation, on this
+// replica or another, cannot put the old link back.
+var storeIfCurrent = redis.NewScript(`
+if (redis.call('GET', KEYS[2]) or '') ~= ARGV[2] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+return 1
+`)
+
+// toRedis shares what a load found, unless the code was invalidated since
+// gen here or since version anywhere.
+func (c *Cache) toRedis(ctx context.Context, code string, link *store.URL, gen uint64, version string) {
+	if c.redis == nil {
+		return
+	}
+	v := unknown
+	if link != nil {
+		b, err := encodeLink(link)
+		if err != nil {
+			return
+		}
+		v = string(b)
+	}
+	c.mu.Lock()
+	stale := c.gen != gen
+	c.mu.Unlock()
+	if stale {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	keys := []string{redisKey(code), versionKey(code)}
+	if err := storeIfCurrent.Run(ctx, c.redis, keys, v, version, c.ttl.Milliseconds()).Err(); err != nil {
+		c.log.Debug("link cache write failed", "error", err)
+	}
+}
+
+// cachedLink is what Redis holds of a link: the fields the redirect reads,
+// and no others. The password hash stays out of the shared instance; a
+// protected link is only marked as one, and the password form checks what
+// a visitor types against the database.
+type cachedLink struct {
+	ID int64 `json:"id"`
+	// UserID tells the owner's own visits apart from their visitors'.
+	UserID               *int64     `json:"user_id,omitempty"`
+	ShortCode            string     `json:"short_code"`
+	LongURL              string     `json:"long_url"`
+	RotateTargets        []string   `json:"rotate_targets,omitempty"`
+	IOSTargetURL         string     `json:"ios_target_url,omitempty"`
+	AndroidTargetURL     string     `json:"android_target_url,omitempty"`
+	PasswordProtected    bool       `json:"password_protected,omitempty"`
+	PreviewMode          bool       `json:"preview_mode,omitempty"`
+	StatsEnabled         bool       `json:"stats_enabled,omitempty"`
+	IsEnabled            bool       `json:"is_enabled,omitempty"`
+	IsDraft              bool       `json:"is_draft,omitempty"`
+	ExpiresAt            *time.Time `json:"expires_at,omitempty"`
+	StartAt              *time.Time `json:"start_at,omitempty"`
+	EndAt                *time.Time `json:"end_at,omitempty"`
+	SkipUnhealthyTargets bool       `json:"skip_unhealthy_targets,omitempty"`
+	UnhealthyTargets     []string   `json:"unhealthy_targets,omitempty"`
+}
+
+// protectedPlaceholder stands in for the password hash of a protected link
+// read from Redis. It keeps IsPasswordProtected true and matches no password.
+const protectedPlaceholder = "cached"
+
+func encodeLink(link *store.URL) ([]byte, error) {
+	return json.Marshal(cachedLink{
+		ID: link.ID, UserID: link.UserID, ShortCode: link.ShortCode, LongURL: link.LongURL,
+		RotateTargets: link.RotateTargets, IOSTargetURL: link.IOSTargetURL, AndroidTargetURL: link.AndroidTargetURL,
+		PasswordProtected: link.IsPasswordProtected(), PreviewMode: link.PreviewMode, StatsEnabled: link.StatsEnabled,
+		IsEnabled: link.IsEnabled, IsDraft: link.IsDraft,
+		ExpiresAt: link.ExpiresAt, StartAt: link.StartAt, EndAt: link.EndAt,
+		SkipUnhealthyTargets: link.SkipUnhealthyTargets, UnhealthyTargets: link.UnhealthyTargets,
+	})
+}
+
+func decodeLink(b []byte) (*store.URL, error) {
+	var c cachedLink
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	link := &store.URL{
+		ID: c.ID, UserID: c.UserID, ShortCode: c.ShortCode, LongURL: c.LongURL,
+		RotateTargets: c.RotateTargets, IOSTargetURL: c.IOSTargetURL, AndroidTargetURL: c.AndroidTargetURL,
+		PreviewMode: c.PreviewMode, StatsEnabled: c.StatsEnabled, IsEnabled: c.IsEnabled, IsDraft: c.IsDraft,
+		ExpiresAt: c.ExpiresAt, StartAt: c.StartAt, EndAt: c.EndAt,
+		SkipUnhealthyTargets: c.SkipUnhealthyTargets, UnhealthyTargets: c.UnhealthyTargets,
+	}
+	if c.PasswordProtected {
+		link.PasswordHash = protectedPlaceholder
+	}
+	return link, nil
+}
+
+// Invalidate drops the codes from every tier, and with Redis tells the other
+// replicas to drop them as well. It is the store's OnURLChange hook.
+func (c *Cache) Invalidate(codes []string) {
+	c.drop(codes)
+	if c.redis == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*redisTimeout)
+	defer cancel()
+	keys := make([]string, len(codes))
+	for i, code := range codes {
+		keys[i] = redisKey(code)
+	}
+	pipe := c.redis.Pipeline()
+	pipe.Del(ctx, keys...)
+	for _, code := range codes {
+		// Outlives any load that could have read the old version.
+		pipe.Incr(ctx, versionKey(code))
+		pipe.Expire(ctx, versionKey(code), versionTTL)
+	}
+	pipe.Publish(ctx, channel, strings.Join(codes, " "))
+	if _, err := pipe.Exec(ctx); err != nil {
+		c.log.Warn("link cache invalidation failed; other replicas may serve the old link until it expires",
+			"codes", len(codes), "error", err)
+	}
+}
+
+// drop removes the codes from memory.
+func (c *Cache) drop(codes []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, code := range codes {
+		c.links.remove(code)
+		c.misses.remove(code)
+	}
+}
+
+// Listen drops the codes other replicas invalidate, until ctx is done. It
+// returns at once without Redis. A message lost while the connection is down
+// leaves the entry to expire on its own.
+func (c *Cache) Listen(ctx context.Context) {
+	if c.redis == nil {
+		return
+	}
+	sub := c.redis.Subscribe(ctx, channel)
+	defer sub.Close()
+	msgs := sub.Channel()
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			c.drop(strings.Fields(msg.Payload))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// lru is a size-bounded map of entries, evicting the least recently used.
+type lru struct {
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type entry struct {
+	code    string
+	link    *store.URL
+	expires time.Time
+}
+
+func newLRU(size int) *lru {
+	return &lru{size: size, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (l *lru) get(code string, now time.Time) (*store.URL, bool) {
+	el, ok := l.items[code]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if !now.Before(e.expires) {
+		l.order.Remove(el)
+		delete(l.items, code)
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return e.link, true
+}
+
+func (l *lru) put(code string, link *store.URL, expires time.Time) {
+	if el, ok := l.items[code]; ok {
+		el.Value = &entry{code, link, expires}
+		l.order.MoveToFront(el)
+		return
+	}
+	l.items[code] = l.order.PushFront(&entry{code, link, expires})
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*entry).code)
+	}
+}
+
+func (l *lru) remove(code string) {
+	if el, ok := l.items[code]; ok {
+		l.order.Remove(el)
+		delete(l.items, code)
+	}
+}
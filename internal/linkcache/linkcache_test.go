@@ -0,0 +1,186 @@
+package linkcache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arumes31/redrx/internal/security"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// fakeDB counts the loads a cache makes.
+type fakeDB struct {
+	mu    sync.Mutex
+	links map[string]string
+	loads atomic.Int64
+}
+
+func (f *fakeDB) load(_ context.Context, code string) (*store.URL, error) {
+	f.loads.Add(1)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	target, ok := f.links[code]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return &store.URL{ShortCode: code, LongURL: target}, nil
+}
+
+func (f *fakeDB) set(code, target string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.links[code] = target
+}
+
+func TestCacheAndInvalidate(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeDB{links: map[string]string{"AAA": "https://a.example/"}}
+	c := New(Options{Size: 2, TTL: time.Minute})
+
+	for range 3 {
+		link, err := c.Get(ctx, "AAA", db.load)
+		if err != nil || link.LongURL != "https://a.example/" {
+			t.Fatalf("Get = %v, %v", link, err)
+		}
+	}
+	if n := db.loads.Load(); n != 1 {
+		t.Errorf("%d loads for one link, want 1", n)
+	}
+
+	// An unknown code is remembered as such until a link takes it.
+	for range 3 {
+		if _, err := c.Get(ctx, "NEW", db.load); !errors.Is(err, store.ErrNotFound) {
+			t.Fatalf("unknown code: %v, want ErrNotFound", err)
+		}
+	}
+	if n := db.loads.Load(); n != 2 {
+		t.Errorf("%d loads after repeated misses, want 2", n)
+	}
+	db.set("NEW", "https://new.example/")
+	db.set("AAA", "https://changed.example/")
+	c.Invalidate([]string{"NEW", "AAA"})
+	if link, err := c.Get(ctx, "NEW", db.load); err != nil || link.LongURL != "https://new.example/" {
+		t.Errorf("created code: %v, %v", link, err)
+	}
+	if link, err := c.Get(ctx, "AAA", db.load); err != nil || link.LongURL != "https://changed.example/" {
+		t.Errorf("changed link: %v, %v", link, err)
+	}
+}
+
+func TestScanningKeepsLinksCached(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeDB{links: map[string]string{"AAA": "https://a.example/", "BBB": "https://b.example/"}}
+	c := New(Options{Size: 2, TTL: time.Minute})
+	for _, code := range []string{"AAA", "BBB", "X1", "X2", "X3", "X4", "AAA", "BBB"} {
+		_, _ = c.Get(ctx, code, db.load)
+	}
+	if n := db.loads.Load(); n != 6 {
+		t.Errorf("%d loads, want 6: the unknown codes evicted the links", n)
+	}
+
+	// The miss LRU holds two: the oldest unknown codes are loaded again.
+	_, _ = c.Get(ctx, "X4", db.load)
+	_, _ = c.Get(ctx, "X1", db.load)
+	if n := db.loads.Load(); n != 7 {
+		t.Errorf("%d loads, want 7: only X1 should have been evicted", n)
+	}
+}
+
+func TestEntriesExpire(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeDB{links: map[string]string{"AAA": "https://a.example/"}}
+	c := New(Options{Size: 10, TTL: time.Millisecond})
+	_, _ = c.Get(ctx, "AAA", db.load)
+	time.Sleep(5 * time.Millisecond)
+	_, _ = c.Get(ctx, "AAA", db.load)
+	if n := db.loads.Load(); n != 2 {
+		t.Errorf("%d loads, want 2 once the entry expired", n)
+	}
+}
+
+func TestInvalidationDuringLoadIsNotCached(t *testing.T) {
+	ctx := context.Background()
+	c := New(Options{Size: 10, TTL: time.Minute})
+	var loads atomic.Int64
+	load := func(_ context.Context, code string) (*store.URL, error) {
+		if loads.Add(1) == 1 {
+			// The link changes after this load read it.
+			c.Invalidate([]string{code})
+			return &store.URL{ShortCode: code, LongURL: "https://old.example/"}, nil
+		}
+		return &store.URL{ShortCode: code, LongURL: "https://new.example/"}, nil
+	}
+	if link, err := c.Get(ctx, "AAA", load); err != nil || link.LongURL != "https://old.example/" {
+		t.Fatalf("first Get = %v, %v", link, err)
+	}
+	if link, err := c.Get(ctx, "AAA", load); err != nil || link.LongURL != "https://new.example/" {
+		t.Errorf("second Get = %v, %v; the stale load was cached", link, err)
+	}
+}
+
+func TestConcurrentMissesShareALoad(t *testing.T) {
+	ctx := context.Background()
+	c := New(Options{Size: 10, TTL: time.Minute})
+	var loads atomic.Int64
+	release := make(chan struct{})
+	load := func(_ context.Context, code string) (*store.URL, error) {
+		loads.Add(1)
+		<-release
+		return &store.URL{ShortCode: code}, nil
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get(ctx, "AAA", load); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := loads.Load(); n != 1 {
+		t.Errorf("%d loads for concurrent misses, want 1", n)
+	}
+}
+
+// TestRedisEntriesHoldNoSecrets checks what goes to the shared Redis: the
+// fields a redirect reads, without the password hash.
+func TestRedisEntriesHoldNoSecrets(t *testing.T) {
+	owner := int64(7)
+	ends := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	link := &store.URL{
+		ID: 42, UserID: &owner, ShortCode: "SECRET", LongURL: "https://a.example/",
+		RotateTargets: []string{"https://b.example/"}, PasswordHash: "scrypt:32768:8:1$salt$digest",
+		IsEnabled: true, StatsEnabled: true, EndAt: &ends, QRColor: "#123456", ClicksCount: 99,
+	}
+	b, err := encodeLink(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leak := range []string{"scrypt", "digest", "#123456", "99"} {
+		if strings.Contains(string(b), leak) {
+			t.Errorf("the cache entry holds %q: %s", leak, b)
+		}
+	}
+
+	got, err := decodeLink(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 42 || *got.UserID != owner || got.LongURL != link.LongURL || len(got.RotateTargets) != 1 ||
+		!got.IsEnabled || !got.StatsEnabled || !got.EndAt.Equal(ends) {
+		t.Errorf("decoded %+v", got)
+	}
+	if !got.IsPasswordProtected() || security.CheckPasswordHash(got.PasswordHash, "") {
+		t.Errorf("a protected link decoded with hash %q", got.PasswordHash)
+	}
+}
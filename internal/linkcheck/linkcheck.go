@@ -0,0 +1,208 @@
+// Package linkcheck probes link destinations to find the ones that have died.
+//
+// A probe is a HEAD request, retried as a GET when the server does not support
+// HEAD. Anything that answers below 400 is healthy. Probes never reach private,
+// loopback or link-local addresses: the destinations are user-supplied, and a
+// probe that followed one inward would turn the dashboard's health badge into a
+// port scanner for the network this service runs on.
+package linkcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress means the destination resolved to an address the prober
+// refuses to contact. It says nothing about whether the link works, so callers
+// should not count it as a failure.
+var ErrPrivateAddress = errors.New("linkcheck: destination resolves to a private address")
+
+// Result is the outcome of probing one destination.
+type Result struct {
+	StatusCode int
+	Latency    time.Duration
+	CheckedAt  time.Time
+	Err        error
+}
+
+// Healthy reports whether the destination answered with a non-error status.
+func (r Result) Healthy() bool {
+	return r.Err == nil && r.StatusCode > 0 && r.StatusCode < 400
+}
+
+// Prober runs bounded, time-limited destination checks.
+type Prober struct {
+	client      *http.Client
+	concurrency int
+	userAgent   string
+}
+
+type Options struct {
+	// Concurrency caps how many probes run at once. Zero means 8.
+	Concurrency int
+	// Timeout bounds each probe, including redirects. Zero means 10s.
+	Timeout time.Duration
+	// UserAgent is sent with every probe, so a destination's operator can tell
+	// what is checking on them.
+	UserAgent string
+	// AllowPrivateNetworks lifts the private-address guard. Only tests, which
+	// serve from loopback, should need it.
+	AllowPrivateNetworks bool
+}
+
+func New(opts Options) *Prober {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 8
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = "redrx-linkcheck/1.0"
+	}
+
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	if !opts.AllowPrivateNetworks {
+		// Checked at connect time, on the address actually dialled, so a DNS
+		// answer that changes between a lookup and the connection cannot slip an
+		// internal address past the guard.
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivate(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		}
+	}
+
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   opts.Timeout,
+		ResponseHeaderTimeout: opts.Timeout,
+		MaxIdleConnsPerHost:   2,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &Prober{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   opts.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 5 {
+					return errors.New("linkcheck: too many redirects")
+				}
+				return nil
+			},
+		},
+		concurrency: opts.Concurrency,
+		userAgent:   opts.UserAgent,
+	}
+}
+
+// Check probes one destination.
+func (p *Prober) Check(ctx context.Context, target string) Result {
+	start := time.Now()
+	res := Result{CheckedAt: start.UTC()}
+
+	status, err := p.do(ctx, http.MethodHead, target)
+	// Plenty of servers answer HEAD with 405 or 501, and some CDNs refuse it
+	// outright with 403, while serving GET perfectly well. Only a GET failing
+	// too makes the destination unhealthy.
+	if err == nil && (status == http.StatusMethodNotAllowed ||
+		status == http.StatusNotImplemented || status == http.StatusForbidden) {
+		status, err = p.do(ctx, http.MethodGet, target)
+	}
+
+	res.Latency = time.Since(start)
+	res.StatusCode = status
+	res.Err = err
+	return res
+}
+
+func (p *Prober) do(ctx context.Context, method, target string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", p.userAgent)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrPrivateAddress) {
+			return 0, ErrPrivateAddress
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain a little so the connection can be reused, but never download a
+	// whole page just to learn its status.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	return resp.StatusCode, nil
+}
+
+// CheckAll probes every target at most once, running up to the configured
+// number of probes concurrently, and returns the results keyed by target.
+func (p *Prober) CheckAll(ctx context.Context, targets []string) map[string]Result {
+	unique := make([]string, 0, len(targets))
+	seen := make(map[string]struct{}, len(targets))
+	for _, t := range targets {
+		if _, ok := seen[t]; ok || t == "" {
+			continue
+		}
+		seen[t] = struct{}{}
+		unique = append(unique, t)
+	}
+
+	out := make(map[string]Result, len(unique))
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, p.concurrency)
+	)
+	for _, t := range unique {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return out
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res := p.Check(ctx, target)
+			mu.Lock()
+			out[target] = res
+			mu.Unlock()
+		}(t)
+	}
+	wg.Wait()
+	return out
+}
+
+// Describe renders a result as the short label the dashboard shows.
+func (r Result) Describe() string {
+	switch {
+	case r.Err != nil:
+		return r.Err.Error()
+	case r.StatusCode > 0:
+		return fmt.Sprintf("HTTP %d", r.StatusCode)
+	default:
+		return "not checked"
+	}
+}
+
+func isPrivate(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast()
+}
@@ -0,0 +1,95 @@
+package linkcheck
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckFallsBackToGETWhenHEADIsRefused(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	p := New(Options{AllowPrivateNetworks: true})
+	res := p.Check(context.Background(), ts.URL)
+	if !res.Healthy() || res.StatusCode != http.StatusOK {
+		t.Errorf("Check = %+v, want a healthy 200 from the GET retry", res)
+	}
+}
+
+func TestCheckReportsErrorStatusesAndTimeouts(t *testing.T) {
+	gone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer gone.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	p := New(Options{AllowPrivateNetworks: true, Timeout: 100 * time.Millisecond})
+	if res := p.Check(context.Background(), gone.URL); res.Healthy() || res.StatusCode != http.StatusGone {
+		t.Errorf("410 destination: %+v, want unhealthy with status 410", res)
+	}
+	if res := p.Check(context.Background(), slow.URL); res.Healthy() || res.Err == nil {
+		t.Errorf("slow destination: %+v, want a timeout error", res)
+	}
+}
+
+// TestCheckRefusesPrivateAddresses guards the SSRF boundary: destinations are
+// user-supplied, and the default prober must not reach loopback.
+func TestCheckRefusesPrivateAddresses(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer ts.Close()
+
+	res := New(Options{}).Check(context.Background(), ts.URL)
+	if !errors.Is(res.Err, ErrPrivateAddress) {
+		t.Errorf("Check(loopback) error = %v, want ErrPrivateAddress", res.Err)
+	}
+	if hits.Load() != 0 {
+		t.Error("the prober reached a loopback server")
+	}
+}
+
+func TestCheckAllProbesEachTargetOnceWithinTheConcurrencyCap(t *testing.T) {
+	var inFlight, peak, hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		n := inFlight.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		inFlight.Add(-1)
+	}))
+	defer ts.Close()
+
+	targets := []string{ts.URL + "/a", ts.URL + "/b", ts.URL + "/c", ts.URL + "/d", ts.URL + "/a", ""}
+	got := New(Options{AllowPrivateNetworks: true, Concurrency: 2}).CheckAll(context.Background(), targets)
+
+	if len(got) != 4 {
+		t.Errorf("CheckAll returned %d results, want one per distinct target (4)", len(got))
+	}
+	if hits.Load() != 4 {
+		t.Errorf("server saw %d probes, want 4", hits.Load())
+	}
+	if peak.Load() > 2 {
+		t.Errorf("peak concurrency %d exceeded the cap of 2", peak.Load())
+	}
+}
@@ -0,0 +1,257 @@
+// Package linkimport brings links in from files, in two ways.
+//
+// Parse reads the CSV or JSON a user can bulk-import links from into uniform
+// rows. It only parses: every row is still validated, checked against the
+// blocklist and created by the web layer, exactly as a link submitted through
+// the form would be.
+//
+// ParseExport reads the exports of other shorteners, and Migrate moves those
+// links over as they were — code, destination, title, tags, creation date and
+// click count — for an operator leaving that shortener.
+package linkimport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MaxRows caps one import. Each row can cost a password hash and a few
+// queries, and the import runs inside one request.
+const MaxRows = 1000
+
+// Formats a file can be read as.
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// Row is one link to import, with its values as written in the file.
+type Row struct {
+	// Line is the row's position in the file, counting from 1 and not
+	// counting a CSV header, so a report can point back at it.
+	Line          int
+	LongURL       string
+	CustomCode    string
+	ExpiryHours   string
+	StartAt       string
+	EndAt         string
+	RotateTargets []string
+	Password      string
+}
+
+// fields maps accepted column names to the Row field they fill. Names are
+// matched after normalise, so "Long URL" and "long-url" are long_url; the
+// aliases cover what redrx's own exports call the columns.
+var fields = map[string]func(*Row, string){
+	"long_url":       func(r *Row, v string) { r.LongURL = v },
+	"url":            func(r *Row, v string) { r.LongURL = v },
+	"custom_code":    func(r *Row, v string) { r.CustomCode = v },
+	"short_code":     func(r *Row, v string) { r.CustomCode = v },
+	"code":           func(r *Row, v string) { r.CustomCode = v },
+	"expiry_hours":   func(r *Row, v string) { r.ExpiryHours = v },
+	"start_at":       func(r *Row, v string) { r.StartAt = v },
+	"end_at":         func(r *Row, v string) { r.EndAt = v },
+	"rotate_targets": func(r *Row, v string) { r.RotateTargets = splitTargets(v) },
+	"password":       func(r *Row, v string) { r.Password = v },
+}
+
+// ErrTooManyRows is returned for a file with more than MaxRows links.
+var ErrTooManyRows = fmt.Errorf("linkimport: a file can hold at most %d links", MaxRows)
+
+// Parse reads rows in the given format, or guesses it from the content when
+// format is empty: JSON starts with a bracket or a brace, anything else is
+// taken as CSV.
+func Parse(r io.Reader, format string) ([]Row, error) {
+	br := bufio.NewReader(r)
+	// Spreadsheet programs like to start a CSV with a byte order mark, which
+	// would otherwise become part of the first column's name.
+	if bom, _ := br.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		_, _ = br.Discard(3)
+	}
+	if format == "" {
+		format = Detect(br)
+	}
+	switch format {
+	case FormatCSV:
+		return parseCSV(br)
+	case FormatJSON:
+		return parseJSON(br)
+	default:
+		return nil, fmt.Errorf("linkimport: unknown format %q", format)
+	}
+}
+
+// Detect peeks at the start of the input to tell JSON from CSV, without
+// consuming it.
+func Detect(br *bufio.Reader) string {
+	for n := 1; ; n++ {
+		peek, err := br.Peek(n)
+		if len(peek) < n || err != nil {
+			return FormatCSV
+		}
+		switch c := peek[n-1]; c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[', '{':
+			return FormatJSON
+		default:
+			return FormatCSV
+		}
+	}
+}
+
+func parseCSV(r io.Reader) ([]Row, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("linkimport: the file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("linkimport: read the CSV header: %w", err)
+	}
+	setters := make([]func(*Row, string), len(header))
+	hasURL := false
+	for i, name := range header {
+		name = normalise(name)
+		setters[i] = fields[name]
+		hasURL = hasURL || name == "long_url" || name == "url"
+	}
+	if !hasURL {
+		return nil, errors.New("linkimport: the CSV has no long_url column")
+	}
+
+	var rows []Row
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("linkimport: %w", err)
+		}
+		if blank(record) {
+			continue
+		}
+		if len(rows) == MaxRows {
+			return nil, ErrTooManyRows
+		}
+		row := Row{Line: line}
+		for i, v := range record {
+			if i < len(setters) && setters[i] != nil {
+				setters[i](&row, strings.TrimSpace(v))
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseJSON accepts an array of link objects, or an object holding one under
+// "links". Values may be strings, numbers or booleans; rotate_targets may also
+// be an array.
+func parseJSON(r io.Reader) ([]Row, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	raw = bytes.TrimSpace(raw)
+	var items []map[string]json.RawMessage
+	if len(raw) > 0 && raw[0] == '{' {
+		var wrapper struct {
+			Links []map[string]json.RawMessage `json:"links"`
+		}
+		if err := json.Unmarshal(raw, &wrapper); err != nil {
+			return nil, fmt.Errorf("linkimport: %w", err)
+		}
+		items = wrapper.Links
+	} else if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("linkimport: %w", err)
+	}
+	if len(items) > MaxRows {
+		return nil, ErrTooManyRows
+	}
+
+	rows := make([]Row, 0, len(items))
+	for i, item := range items {
+		row := Row{Line: i + 1}
+		for name, value := range item {
+			set := fields[normalise(name)]
+			if set == nil {
+				continue
+			}
+			v, err := jsonString(value)
+			if err != nil {
+				return nil, fmt.Errorf("linkimport: link %d: %s: %w", i+1, name, err)
+			}
+			set(&row, v)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// jsonString flattens a JSON value to the text a CSV cell would hold. An
+// array of strings becomes a comma-separated list.
+func jsonString(raw json.RawMessage) (string, error) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return strings.TrimSpace(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", errors.New("expected a list of strings")
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	default:
+		return "", errors.New("expected a string, number or list")
+	}
+}
+
+// splitTargets reads a list of URLs separated by commas, whitespace or both.
+// A URL cannot contain unencoded whitespace, so either separator is safe.
+func splitTargets(v string) []string {
+	targets := strings.FieldsFunc(v, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	if len(targets) == 0 {
+		return nil
+	}
+	return targets
+}
+
+func normalise(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+}
+
+func blank(record []string) bool {
+	for _, v := range record {
+		if strings.TrimSpace(v) != "" {
+			return false
+		}
+	}
+	return true
+}
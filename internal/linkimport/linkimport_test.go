@@ -0,0 +1,125 @@
+package linkimport
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCSVMatchesHeadersLoosely(t *testing.T) {
+	in := "\xef\xbb\xbf\"Long URL\",Short Code,expiry-hours,rotate_targets,notes\n" +
+		"https://a.example/,abc,24,\"https://b.example/, https://c.example/\",ignored\n" +
+		",,,,\n" +
+		"https://d.example/,,,,\n"
+	rows, err := Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Row{
+		{Line: 1, LongURL: "https://a.example/", CustomCode: "abc", ExpiryHours: "24",
+			RotateTargets: []string{"https://b.example/", "https://c.example/"}},
+		{Line: 3, LongURL: "https://d.example/"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("Parse = %+v\nwant %+v", rows, want)
+	}
+}
+
+func TestParseCSVNeedsAURLColumn(t *testing.T) {
+	if _, err := Parse(strings.NewReader("code,password\nabc,x\n"), FormatCSV); err == nil {
+		t.Error("a CSV without a long_url column was accepted")
+	}
+}
+
+func TestParseJSONArrayOrWrapper(t *testing.T) {
+	for _, in := range []string{
+		`[{"long_url": "https://a.example/", "expiry_hours": 0, "rotate_targets": ["https://b.example/"], "password": "pw"}]`,
+		` {"links": [{"url": "https://a.example/", "expiry_hours": "0", "rotate_targets": "https://b.example/", "password": "pw", "extra": {"x": 1}}]}`,
+	} {
+		rows, err := Parse(strings.NewReader(in), "")
+		if err != nil {
+			t.Fatalf("Parse(%s): %v", in, err)
+		}
+		want := []Row{{Line: 1, LongURL: "https://a.example/", ExpiryHours: "0",
+			RotateTargets: []string{"https://b.example/"}, Password: "pw"}}
+		if !reflect.DeepEqual(rows, want) {
+			t.Errorf("Parse(%s) = %+v\nwant %+v", in, rows, want)
+		}
+	}
+	if _, err := Parse(strings.NewReader(`[{"long_url": {"nested": true}}]`), ""); err == nil {
+		t.Error("an object value was accepted")
+	}
+}
+
+func TestParseRefusesTooManyRows(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("long_url\n")
+	for i := 0; i <= MaxRows; i++ {
+		b.WriteString("https://a.example/\n")
+	}
+	if _, err := Parse(strings.NewReader(b.String()), ""); !errors.Is(err, ErrTooManyRows) {
+		t.Errorf("Parse of %d rows = %v, want ErrTooManyRows", MaxRows+1, err)
+	}
+}
+
+func TestParseExportYOURLSDump(t *testing.T) {
+	in := "-- MySQL dump 10.13\n" +
+		"/*!40101 SET NAMES utf8mb4 */;\n" +
+		"CREATE TABLE `yourls_url` (`keyword` varchar(100), `url` text);\n" +
+		"INSERT INTO `yourls_options` VALUES (1,'version','1.9');\n" +
+		"INSERT INTO `yourls_url` VALUES ('abc','https://a.example/?x=1;y=2','It\\'s \"A\"','2019-03-04 05:06:07','1.2.3.4',42)," +
+		"('zz',\n'https://b.example/',NULL,'0000-00-00 00:00:00','::1',0);\n" +
+		"INSERT IGNORE INTO yourls_url (url, keyword, clicks) VALUES ('https://c.example/', 'ccc', 7);\n"
+	links, err := ParseExport(strings.NewReader(in), SourceYOURLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Link{
+		{Line: 1, ShortCode: "abc", LongURL: "https://a.example/?x=1;y=2", Title: `It's "A"`,
+			CreatedAt: time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC), Clicks: 42},
+		{Line: 2, ShortCode: "zz", LongURL: "https://b.example/"},
+		{Line: 3, ShortCode: "ccc", LongURL: "https://c.example/", Clicks: 7},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("ParseExport = %+v\nwant %+v", links, want)
+	}
+}
+
+func TestParseExportShlink(t *testing.T) {
+	v3 := `{"shortUrls": {"data": [{"shortCode": "promo", "shortUrl": "https://s.test/promo",
+		"longUrl": "https://a.example/", "dateCreated": "2023-05-01T10:00:00+02:00",
+		"visitsSummary": {"total": 12, "nonBots": 10, "bots": 2}, "tags": ["spring", "mail"],
+		"title": "Spring sale"}], "pagination": {"currentPage": 1}}}`
+	csv := "createdAt,domain,shortCode,shortUrl,longUrl,title,tags,visits\n" +
+		"2023-05-01T08:00:00Z,,promo,https://s.test/promo,https://a.example/,Spring sale,spring|mail,12\n"
+	want := []Link{{Line: 1, ShortCode: "promo", LongURL: "https://a.example/", Title: "Spring sale",
+		Tags: []string{"spring", "mail"}, CreatedAt: time.Date(2023, 5, 1, 8, 0, 0, 0, time.UTC), Clicks: 12}}
+	for _, in := range []string{v3, csv} {
+		links, err := ParseExport(strings.NewReader(in), SourceShlink)
+		if err != nil {
+			t.Fatalf("ParseExport(%.20q): %v", in, err)
+		}
+		if !reflect.DeepEqual(links, want) {
+			t.Errorf("ParseExport(%.20q) = %+v\nwant %+v", in, links, want)
+		}
+	}
+}
+
+func TestParseExportBitly(t *testing.T) {
+	in := "Title,Bitlink,Long URL,Created,Tags,Clicks\n" +
+		"Launch,bit.ly/3xYzAbC,https://a.example/,2022-01-02 03:04:05,\"news, launch\",\"1,204\"\n"
+	links, err := ParseExport(strings.NewReader(in), SourceBitly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Link{{Line: 1, ShortCode: "3xYzAbC", LongURL: "https://a.example/", Title: "Launch",
+		Tags: []string{"news", "launch"}, CreatedAt: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC), Clicks: 1204}}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("ParseExport = %+v\nwant %+v", links, want)
+	}
+	if _, err := ParseExport(strings.NewReader("Title,Clicks\nx,1\n"), SourceBitly); err == nil {
+		t.Error("a CSV without code and destination columns was accepted")
+	}
+}
@@ -0,0 +1,144 @@
+package linkimport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/arumes31/redrx/internal/safety"
+	"github.com/arumes31/redrx/internal/shortcode"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// What became of one migrated link. A dry run reports MigrateValid where a
+// real run would have created the link.
+const (
+	MigrateCreated  = "created"
+	MigrateValid    = "valid"
+	MigrateConflict = "conflict"
+	MigrateFailed   = "failed"
+)
+
+// Result is one link's line in a migration report.
+type Result struct {
+	Line      int    `json:"line"`
+	Status    string `json:"status"`
+	ShortCode string `json:"short_code"`
+	LongURL   string `json:"long_url"`
+	Message   string `json:"message,omitempty"`
+}
+
+// MigrateOptions says whose the migrated links become and how they are
+// checked.
+type MigrateOptions struct {
+	// Owner receives every link. Nil leaves them without an owner, like
+	// links shortened anonymously.
+	Owner  *store.User
+	Actor  store.Actor
+	DryRun bool
+	// Check vets a destination like safety.Checker.CheckURL: false for a
+	// blocked one, an error when the blocklist cannot be consulted. Nil
+	// accepts any absolute http(s) URL.
+	Check func(target string) (bool, error)
+}
+
+// Migrate creates the links of another shortener's export, keeping their
+// codes so the old short URLs go on working once the domain points here. A
+// code already in use — by an existing link or by an earlier line of the same
+// export — is reported as a conflict and left alone, never overwritten.
+//
+// A link that cannot be moved over only fails its own line. The returned
+// error is for the database or the blocklist being unavailable, and stops the
+// migration; the results so far are returned with it.
+func Migrate(ctx context.Context, db *store.DB, links []Link, opts MigrateOptions) ([]Result, error) {
+	results := make([]Result, 0, len(links))
+	seen := make(map[string]int, len(links))
+	for _, l := range links {
+		res, err := migrateLink(ctx, db, l, opts, seen)
+		if err != nil {
+			return results, fmt.Errorf("line %d: %w", l.Line, err)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func migrateLink(ctx context.Context, db *store.DB, l Link, opts MigrateOptions, seen map[string]int) (Result, error) {
+	res := Result{Line: l.Line, Status: MigrateFailed, ShortCode: l.ShortCode, LongURL: l.LongURL}
+	if l.ShortCode == "" {
+		res.Message = "The export gives no short code for this link."
+		return res, nil
+	}
+	// Codes are matched without regard to case here, so they are stored in
+	// the canonical form; a link keeps answering on its old URL either way.
+	code, err := shortcode.ValidateCustom(l.ShortCode)
+	if err != nil {
+		res.Message = "The code cannot be kept: " + err.Error() + "."
+		return res, nil
+	}
+	res.ShortCode = code
+	if !safety.IsAbsoluteHTTPURL(l.LongURL) {
+		res.Message = "The destination is not an absolute http(s) URL."
+		return res, nil
+	}
+	if opts.Check != nil {
+		ok, err := opts.Check(l.LongURL)
+		if err != nil {
+			return res, fmt.Errorf("check the destination against the blocklist: %w", err)
+		}
+		if !ok {
+			res.Message = "The destination is blocked for safety reasons."
+			return res, nil
+		}
+	}
+
+	if line, dup := seen[code]; dup {
+		res.Status = MigrateConflict
+		res.Message = fmt.Sprintf("Line %d has the same code; codes are not case-sensitive here.", line)
+		return res, nil
+	}
+	seen[code] = l.Line
+	taken, err := db.ShortCodeTaken(ctx, code)
+	if err != nil {
+		return res, err
+	}
+	if taken {
+		res.Status = MigrateConflict
+		res.Message = "An existing link already uses this code."
+		if existing, err := db.URLByShortCode(ctx, code); err == nil && existing.LongURL == l.LongURL {
+			res.Message = "Already here with the same destination, probably from an earlier run."
+		} else if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return res, err
+		}
+		return res, nil
+	}
+	if opts.DryRun {
+		res.Status = MigrateValid
+		return res, nil
+	}
+
+	// The link redirects straight away, as it did on the old shortener; a
+	// preview page would be a change its visitors never had.
+	link := &store.URL{
+		ShortCode:    code,
+		LongURL:      l.LongURL,
+		Title:        l.Title,
+		Tags:         l.Tags,
+		CreatedAt:    l.CreatedAt,
+		ClicksCount:  l.Clicks,
+		StatsEnabled: true,
+		IsEnabled:    true,
+	}
+	if opts.Owner != nil {
+		link.UserID = &opts.Owner.ID
+	}
+	if err := db.CreateURL(ctx, link, opts.Actor); err != nil {
+		if store.IsUniqueViolation(err) {
+			res.Status, res.Message = MigrateConflict, "An existing link already uses this code."
+			return res, nil
+		}
+		return res, err
+	}
+	res.Status = MigrateCreated
+	return res, nil
+}
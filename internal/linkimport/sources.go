@@ -0,0 +1,444 @@
+package linkimport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Shorteners whose exports ParseExport reads.
+const (
+	SourceYOURLS = "yourls"
+	SourceShlink = "shlink"
+	SourceBitly  = "bitly"
+)
+
+// Sources lists the accepted source names, in the order a form offers them.
+var Sources = []string{SourceYOURLS, SourceShlink, SourceBitly}
+
+// maxTitle is the width of urls.title; longer titles are cut to fit.
+const maxTitle = 255
+
+// Link is one link read from another shortener's export. Unlike a Row it is
+// already typed: it is moved over as it was, not submitted like a form.
+type Link struct {
+	// Line is the link's position in the export, counting from 1 and not
+	// counting a CSV header.
+	Line      int
+	ShortCode string
+	LongURL   string
+	Title     string
+	Tags      []string
+	// CreatedAt is zero when the export does not say.
+	CreatedAt time.Time
+	Clicks    int64
+}
+
+// ParseExport reads the export of the named shortener:
+//
+//   - yourls: a MySQL dump of the yourls_url table, or a CSV with its columns
+//     (keyword, url, title, timestamp, clicks)
+//   - shlink: the web client's CSV export, or the JSON of the REST API's
+//     short-urls list
+//   - bitly: the CSV export of the links list
+//
+// Which of a source's formats the input is, is told from its content.
+func ParseExport(r io.Reader, source string) ([]Link, error) {
+	br := bufio.NewReader(r)
+	if bom, _ := br.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		_, _ = br.Discard(3)
+	}
+	switch source {
+	case SourceYOURLS:
+		if looksLikeSQL(br) {
+			raw, err := io.ReadAll(br)
+			if err != nil {
+				return nil, err
+			}
+			return parseYOURLSSQL(raw)
+		}
+		return parseExportCSV(br, yourlsColumns)
+	case SourceShlink:
+		if Detect(br) == FormatJSON {
+			return parseShlinkJSON(br)
+		}
+		return parseExportCSV(br, shlinkColumns)
+	case SourceBitly:
+		return parseExportCSV(br, bitlyColumns)
+	default:
+		return nil, fmt.Errorf("linkimport: unknown source %q", source)
+	}
+}
+
+// The Link fields an export column can fill.
+const (
+	fieldCode    = "code"
+	fieldURL     = "url"
+	fieldTitle   = "title"
+	fieldTags    = "tags"
+	fieldCreated = "created"
+	fieldClicks  = "clicks"
+)
+
+// The CSV columns of each source, keyed by their normalised header. The
+// aliases cover the names the exports have used across versions.
+var (
+	yourlsColumns = map[string]string{
+		"keyword":   fieldCode,
+		"url":       fieldURL,
+		"title":     fieldTitle,
+		"timestamp": fieldCreated,
+		"clicks":    fieldClicks,
+	}
+	shlinkColumns = map[string]string{
+		"shortcode": fieldCode,
+		"shorturl":  fieldCode,
+		"longurl":   fieldURL,
+		"title":     fieldTitle,
+		"tags":      fieldTags,
+		"createdat": fieldCreated,
+		"visits":    fieldClicks,
+	}
+	bitlyColumns = map[string]string{
+		"bitlink":           fieldCode,
+		"link":              fieldCode,
+		"short_link":        fieldCode,
+		"short_url":         fieldCode,
+		"long_url":          fieldURL,
+		"destination":       fieldURL,
+		"destination_url":   fieldURL,
+		"title":             fieldTitle,
+		"tags":              fieldTags,
+		"created":           fieldCreated,
+		"created_at":        fieldCreated,
+		"date_created":      fieldCreated,
+		"clicks":            fieldClicks,
+		"total_clicks":      fieldClicks,
+		"engagements":       fieldClicks,
+		"total_engagements": fieldClicks,
+	}
+)
+
+// set fills one field from the text of an export cell.
+func (l *Link) set(field, v string) error {
+	var err error
+	switch field {
+	case fieldCode:
+		// A short URL is reduced to its code; where an export has both
+		// columns they agree, so their order does not matter.
+		if code := codeFromURL(v); code != "" {
+			l.ShortCode = code
+		}
+	case fieldURL:
+		l.LongURL = v
+	case fieldTitle:
+		l.Title = truncate(v, maxTitle)
+	case fieldTags:
+		l.Tags = splitTags(v)
+	case fieldCreated:
+		l.CreatedAt, err = parseTimestamp(v)
+	case fieldClicks:
+		l.Clicks, err = parseCount(v)
+	}
+	return err
+}
+
+func parseExportCSV(r io.Reader, columns map[string]string) ([]Link, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("linkimport: the file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("linkimport: read the CSV header: %w", err)
+	}
+	fields := make([]string, len(header))
+	hasCode, hasURL := false, false
+	for i, name := range header {
+		fields[i] = columns[normalise(name)]
+		hasCode = hasCode || fields[i] == fieldCode
+		hasURL = hasURL || fields[i] == fieldURL
+	}
+	if !hasCode || !hasURL {
+		return nil, errors.New("linkimport: the CSV needs a short code and a destination column; is it the right source?")
+	}
+
+	var links []Link
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("linkimport: %w", err)
+		}
+		if blank(record) {
+			continue
+		}
+		l := Link{Line: line}
+		for i, v := range record {
+			if i < len(fields) && fields[i] != "" {
+				if err := l.set(fields[i], strings.TrimSpace(v)); err != nil {
+					return nil, fmt.Errorf("linkimport: line %d: %s: %w", line, header[i], err)
+				}
+			}
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// shlinkShortURL is one entry of Shlink's short-urls list. visitsCount is
+// what API v2 reported; v3 moved the count to visitsSummary.
+type shlinkShortURL struct {
+	ShortCode     string   `json:"shortCode"`
+	LongURL       string   `json:"longUrl"`
+	Title         *string  `json:"title"`
+	Tags          []string `json:"tags"`
+	DateCreated   string   `json:"dateCreated"`
+	VisitsCount   *int64   `json:"visitsCount"`
+	VisitsSummary *struct {
+		Total int64 `json:"total"`
+	} `json:"visitsSummary"`
+}
+
+// parseShlinkJSON reads the body of GET /rest/v3/short-urls: an object with
+// the links under shortUrls.data. A bare array of links, or several pages'
+// data joined into one, is accepted too.
+func parseShlinkJSON(r io.Reader) ([]Link, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	raw = bytes.TrimSpace(raw)
+	var items []shlinkShortURL
+	if len(raw) > 0 && raw[0] == '{' {
+		var page struct {
+			ShortURLs struct {
+				Data []shlinkShortURL `json:"data"`
+			} `json:"shortUrls"`
+			Data []shlinkShortURL `json:"data"`
+		}
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return nil, fmt.Errorf("linkimport: %w", err)
+		}
+		items = append(page.ShortURLs.Data, page.Data...)
+	} else if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("linkimport: %w", err)
+	}
+
+	links := make([]Link, 0, len(items))
+	for i, item := range items {
+		l := Link{Line: i + 1, ShortCode: item.ShortCode, LongURL: strings.TrimSpace(item.LongURL)}
+		if item.Title != nil {
+			l.Title = truncate(strings.TrimSpace(*item.Title), maxTitle)
+		}
+		for _, tag := range item.Tags {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				l.Tags = append(l.Tags, tag)
+			}
+		}
+		switch {
+		case item.VisitsSummary != nil:
+			l.Clicks = item.VisitsSummary.Total
+		case item.VisitsCount != nil:
+			l.Clicks = *item.VisitsCount
+		}
+		if l.CreatedAt, err = parseTimestamp(item.DateCreated); err != nil {
+			return nil, fmt.Errorf("linkimport: link %d: dateCreated: %w", i+1, err)
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// yourlsDefaultColumns is the column order of yourls_url, for an INSERT that
+// does not name its columns — which is how mysqldump writes them.
+var yourlsDefaultColumns = []string{"keyword", "url", "title", "timestamp", "ip", "clicks"}
+
+// parseYOURLSSQL picks the rows of the YOURLS links table out of a SQL dump.
+// Every other statement, and the INSERTs into other tables, are skipped. The
+// table is recognised by name, "url" after YOURLS's configurable prefix.
+func parseYOURLSSQL(src []byte) ([]Link, error) {
+	toks, err := lexSQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{toks: toks}
+	var links []Link
+	for !p.done() {
+		if !p.word("INSERT") && !p.word("REPLACE") {
+			p.skipStatement()
+			continue
+		}
+		p.skipModifiers()
+		if !p.word("INTO") {
+			p.skipStatement()
+			continue
+		}
+		table := p.name()
+		for p.punct(".") {
+			table = p.name()
+		}
+		columns := yourlsDefaultColumns
+		if p.punct("(") {
+			columns = nil
+			for !p.done() && !p.punct(")") {
+				if name := p.name(); name != "" {
+					columns = append(columns, strings.ToLower(name))
+				}
+				p.punct(",")
+			}
+		}
+		if !p.word("VALUES") && !p.word("VALUE") {
+			p.skipStatement()
+			continue
+		}
+		wanted := table == "url" || strings.HasSuffix(strings.ToLower(table), "_url")
+		for p.punct("(") {
+			var values []sqlToken
+			for !p.done() && !p.punct(")") {
+				values = append(values, p.next())
+				p.punct(",")
+			}
+			if wanted {
+				l := Link{Line: len(links) + 1}
+				for i, v := range values {
+					if i >= len(columns) || v.kind == sqlNull {
+						continue
+					}
+					if field := yourlsColumns[columns[i]]; field != "" {
+						if err := l.set(field, strings.TrimSpace(v.text)); err != nil {
+							return nil, fmt.Errorf("linkimport: row %d: %s: %w", l.Line, columns[i], err)
+						}
+					}
+				}
+				links = append(links, l)
+			}
+			if !p.punct(",") {
+				break
+			}
+		}
+		p.skipStatement()
+	}
+	if links == nil {
+		return nil, errors.New("linkimport: the dump has no rows for the yourls_url table")
+	}
+	return links, nil
+}
+
+// looksLikeSQL tells a SQL dump from a CSV by how it starts: with a comment
+// or a statement keyword, which no CSV header of links does.
+func looksLikeSQL(br *bufio.Reader) bool {
+	peek, _ := br.Peek(512)
+	head := strings.ToUpper(strings.TrimSpace(string(peek)))
+	if strings.HasPrefix(head, "--") || strings.HasPrefix(head, "/*") || strings.HasPrefix(head, "#") {
+		return true
+	}
+	word, _, _ := strings.Cut(head, " ")
+	switch word {
+	case "INSERT", "REPLACE", "CREATE", "DROP", "SET", "LOCK", "USE", "START", "BEGIN":
+		return true
+	}
+	return false
+}
+
+// codeFromURL takes the code out of a short URL, "https://bit.ly/3xYz" or
+// "bit.ly/3xYz", and returns a bare code unchanged.
+func codeFromURL(v string) string {
+	v = strings.TrimSpace(v)
+	if !strings.Contains(v, "/") {
+		return v
+	}
+	if !strings.Contains(v, "://") {
+		v = "https://" + v
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return ""
+	}
+	segments := strings.FieldsFunc(u.Path, func(r rune) bool { return r == '/' })
+	if len(segments) == 0 {
+		return ""
+	}
+	return segments[len(segments)-1]
+}
+
+// splitTags reads a tag list. Shlink's CSV joins tags with "|", Bitly's with
+// commas; semicolons are accepted for spreadsheets that reformatted either.
+func splitTags(v string) []string {
+	var tags []string
+	for _, tag := range strings.FieldsFunc(v, func(r rune) bool { return r == '|' || r == ',' || r == ';' }) {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// timestampLayouts are the date formats the exports use: RFC 3339 from
+// Shlink, MySQL DATETIME from YOURLS, and the readable forms Bitly has
+// written over the years. A time without a zone is taken as UTC.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700 MST",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"01/02/2006 15:04:05",
+	"01/02/2006 15:04",
+	"01/02/2006",
+	"Jan 2, 2006",
+}
+
+// parseTimestamp reads an export date. Empty is no date, and so is MySQL's
+// zero date, which YOURLS leaves on rows whose time it never knew.
+func parseTimestamp(v string) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if v == "" || strings.HasPrefix(v, "0000-00-00") {
+		return time.Time{}, nil
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognised date %q", v)
+}
+
+// parseCount reads a click count, allowing the thousands separators a
+// spreadsheet may have added.
+func parseCount(v string) (int64, error) {
+	v = strings.NewReplacer(",", "", " ", "", "_", "").Replace(v)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("not a click count: %q", v)
+	}
+	return n, nil
+}
+
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
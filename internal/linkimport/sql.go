@@ -0,0 +1,191 @@
+package linkimport
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// Kinds of token in a SQL dump. Only as much of SQL is understood as reading
+// the values of INSERT statements takes.
+const (
+	sqlWord = iota
+	sqlIdent
+	sqlString
+	sqlNumber
+	sqlNull
+	sqlPunct
+)
+
+type sqlToken struct {
+	kind int
+	text string
+}
+
+// lexSQL splits a MySQL dump into tokens, dropping comments and whitespace.
+// Strings are returned unescaped. Double quotes delimit strings, as they do in
+// MySQL's default mode; identifiers are backquoted.
+func lexSQL(src []byte) ([]sqlToken, error) {
+	var toks []sqlToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#' || (c == '-' && i+1 < len(src) && src[i+1] == '-' &&
+			(i+2 == len(src) || src[i+2] == ' ' || src[i+2] == '\t' || src[i+2] == '\r' || src[i+2] == '\n')):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				return nil, errors.New("linkimport: unterminated comment in the SQL dump")
+			}
+			i += end + 4
+		case c == '\'' || c == '"':
+			text, n, err := lexQuoted(src[i:], c)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, sqlToken{sqlString, text})
+			i += n
+		case c == '`':
+			text, n, err := lexQuoted(src[i:], c)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, sqlToken{sqlIdent, text})
+			i += n
+		case isDigit(c) || (c == '-' && i+1 < len(src) && isDigit(src[i+1])):
+			start := i
+			i++
+			for i < len(src) && (isDigit(src[i]) || strings.IndexByte(".eE+-", src[i]) >= 0) {
+				i++
+			}
+			toks = append(toks, sqlToken{sqlNumber, string(src[start:i])})
+		case isWordByte(c):
+			start := i
+			for i < len(src) && isWordByte(src[i]) {
+				i++
+			}
+			word := string(src[start:i])
+			if strings.EqualFold(word, "NULL") {
+				toks = append(toks, sqlToken{sqlNull, word})
+			} else {
+				toks = append(toks, sqlToken{sqlWord, word})
+			}
+		default:
+			toks = append(toks, sqlToken{sqlPunct, string(c)})
+			i++
+		}
+	}
+	return toks, nil
+}
+
+// lexQuoted reads a quoted string or identifier starting at src[0], returning
+// its unescaped text and the bytes consumed. A doubled quote stands for
+// itself; in strings a backslash escapes the next character, as mysqldump
+// writes them.
+func lexQuoted(src []byte, quote byte) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == quote && i+1 < len(src) && src[i+1] == quote:
+			b.WriteByte(quote)
+			i++
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && quote != '`' && i+1 < len(src):
+			i++
+			switch src[i] {
+			case '0':
+				b.WriteByte(0)
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'b':
+				b.WriteByte('\b')
+			case 'Z':
+				b.WriteByte(0x1a)
+			default:
+				b.WriteByte(src[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("linkimport: unterminated string in the SQL dump")
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c|0x20 >= 'a' && c|0x20 <= 'z') || c >= 0x80
+}
+
+// sqlParser walks the tokens of a dump. Every method that matches consumes
+// the token it matched, and leaves the position alone otherwise.
+type sqlParser struct {
+	toks []sqlToken
+	pos  int
+}
+
+func (p *sqlParser) done() bool { return p.pos >= len(p.toks) }
+
+func (p *sqlParser) next() sqlToken {
+	if p.done() {
+		return sqlToken{kind: sqlPunct}
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	return t
+}
+
+// word matches a keyword, in any case.
+func (p *sqlParser) word(kw string) bool {
+	if !p.done() && p.toks[p.pos].kind == sqlWord && strings.EqualFold(p.toks[p.pos].text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) punct(s string) bool {
+	if !p.done() && p.toks[p.pos].kind == sqlPunct && p.toks[p.pos].text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// name consumes the next token and returns it if it can name a table or a
+// column, quoted or not.
+func (p *sqlParser) name() string {
+	switch t := p.next(); t.kind {
+	case sqlWord, sqlIdent, sqlString:
+		return t.text
+	default:
+		return ""
+	}
+}
+
+// skipModifiers passes over the options MySQL allows between INSERT and INTO.
+func (p *sqlParser) skipModifiers() {
+	for p.word("IGNORE") || p.word("LOW_PRIORITY") || p.word("DELAYED") || p.word("HIGH_PRIORITY") {
+		continue
+	}
+}
+
+// skipStatement moves past the next semicolon.
+func (p *sqlParser) skipStatement() {
+	for !p.done() {
+		if p.next() == (sqlToken{sqlPunct, ";"}) {
+			return
+		}
+	}
+}
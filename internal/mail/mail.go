@@ -0,0 +1,169 @@
+// Package mail sends the application's account mail over SMTP.
+//
+// Three transports are supported: STARTTLS on the submission port (the
+// default), implicit TLS on port 465, and plain SMTP for a relay on the same
+// host or network. Credentials are only ever sent over TLS; net/smtp refuses
+// PLAIN auth on an unencrypted connection to anything but localhost.
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TLS modes.
+const (
+	TLSStartTLS = "starttls"
+	TLSImplicit = "tls"
+	TLSNone     = "none"
+)
+
+// ErrDisabled is returned by a Sender that has no server configured.
+var ErrDisabled = errors.New("mail: no SMTP server configured")
+
+// Message is a plain-text email to one recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers messages. The web server depends on this rather than on
+// SMTP directly, so tests can capture what would have been sent.
+type Sender interface {
+	Send(ctx context.Context, m Message) error
+}
+
+type Options struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// TLS is TLSStartTLS, TLSImplicit or TLSNone. Empty means TLSStartTLS.
+	TLS string
+	// Timeout bounds the whole exchange. Zero means 30s.
+	Timeout time.Duration
+	// TLSConfig overrides the default client TLS settings. Only tests, which
+	// serve a self-signed certificate, should need it.
+	TLSConfig *tls.Config
+}
+
+// SMTP is a Sender that talks to one SMTP server. The zero Host disables it.
+type SMTP struct {
+	opts Options
+}
+
+func New(opts Options) *SMTP {
+	if opts.TLS == "" {
+		opts.TLS = TLSStartTLS
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	return &SMTP{opts: opts}
+}
+
+// Enabled reports whether a server is configured.
+func (s *SMTP) Enabled() bool { return s != nil && s.opts.Host != "" }
+
+// Send delivers m, opening a fresh connection for it. Account mail is rare
+// enough that a pooled connection would spend most of its life timed out.
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	if !s.Enabled() {
+		return ErrDisabled
+	}
+	// A CR or LF in a header value would let the value end the header and
+	// start another — a recipient's address is user input.
+	for _, v := range []string{m.To, m.Subject, s.opts.From} {
+		if strings.ContainsAny(v, "\r\n") {
+			return errors.New("mail: header value contains a line break")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(s.opts.Host, strconv.Itoa(s.opts.Port))
+	tlsConfig := s.opts.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: s.opts.Host, MinVersion: tls.VersionTLS12}
+	}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("mail: connect to %s: %w", addr, err)
+	}
+	if s.opts.TLS == TLSImplicit {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	// The deadline covers every command; net/smtp has no context support.
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, s.opts.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("mail: greeting from %s: %w", addr, err)
+	}
+	defer c.Close()
+
+	if s.opts.TLS == TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("mail: server does not offer STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("mail: starttls: %w", err)
+		}
+	}
+	if s.opts.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.opts.Username, s.opts.Password, s.opts.Host)); err != nil {
+			return fmt.Errorf("mail: auth: %w", err)
+		}
+	}
+	if err := c.Mail(s.opts.From); err != nil {
+		return fmt.Errorf("mail: MAIL FROM: %w", err)
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return fmt.Errorf("mail: RCPT TO: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("mail: DATA: %w", err)
+	}
+	if _, err := w.Write(s.compose(m)); err != nil {
+		return fmt.Errorf("mail: write body: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("mail: end of data: %w", err)
+	}
+	return c.Quit()
+}
+
+// compose renders the message with the headers a receiving server expects.
+func (s *SMTP) compose(m Message) []byte {
+	var b strings.Builder
+	header := func(k, v string) { b.WriteString(k + ": " + v + "\r\n") }
+	header("From", s.opts.From)
+	header("To", m.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "8bit")
+	b.WriteString("\r\n")
+	// SMTP lines end in CRLF; normalise whatever the template produced.
+	body := strings.ReplaceAll(m.Body, "\r\n", "\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,205 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer is just enough of an SMTP server to accept one message, with
+// optional STARTTLS. It records what the client sent.
+type fakeServer struct {
+	ln       net.Listener
+	tls      *tls.Config
+	received chan fakeDelivery
+}
+
+type fakeDelivery struct {
+	from, to, data, auth string
+	secure               bool
+}
+
+func newFakeServer(t *testing.T, tlsConfig *tls.Config) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &fakeServer{ln: ln, tls: tlsConfig, received: make(chan fakeDelivery, 1)}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) port() int { return s.ln.Addr().(*net.TCPAddr).Port }
+
+func (s *fakeServer) serve() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var d fakeDelivery
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(cmd, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			reply("250-fake")
+			if s.tls != nil && !d.secure {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN")
+		case "STARTTLS":
+			reply("220 go ahead")
+			tc := tls.Server(conn, s.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			conn, r, d.secure = tc, bufio.NewReader(tc), true
+			reply = func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+		case "AUTH":
+			raw, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(cmd, "AUTH PLAIN "))
+			d.auth = string(raw)
+			reply("235 ok")
+		case "MAIL":
+			d.from = cmd
+			reply("250 ok")
+		case "RCPT":
+			d.to = cmd
+			reply("250 ok")
+		case "DATA":
+			reply("354 send it")
+			var body strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				body.WriteString(l)
+			}
+			d.data = body.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			s.received <- d
+			return
+		default:
+			reply("502 unknown")
+		}
+	}
+}
+
+func selfSigned(t *testing.T) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, pool
+}
+
+func TestSendOverStartTLSWithAuth(t *testing.T) {
+	serverTLS, roots := selfSigned(t)
+	srv := newFakeServer(t, serverTLS)
+
+	s := New(Options{
+		Host: "127.0.0.1", Port: srv.port(), Username: "mailer", Password: "secret",
+		From: "no-reply@short.example.com", TLSConfig: &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"},
+	})
+	err := s.Send(context.Background(), Message{
+		To: "alice@example.com", Subject: "Reset your password", Body: "Line one\nLine two\n",
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	d := <-srv.received
+	if !d.secure {
+		t.Error("the message was sent before STARTTLS")
+	}
+	if d.auth != "\x00mailer\x00secret" {
+		t.Errorf("AUTH PLAIN = %q", d.auth)
+	}
+	if d.from != "MAIL FROM:<no-reply@short.example.com>" || !strings.HasPrefix(d.to, "RCPT TO:<alice@example.com>") {
+		t.Errorf("envelope = %q / %q", d.from, d.to)
+	}
+	for _, want := range []string{"Subject: Reset your password\r\n", "To: alice@example.com\r\n", "\r\n\r\nLine one\r\nLine two\r\n"} {
+		if !strings.Contains(d.data, want) {
+			t.Errorf("message is missing %q:\n%s", want, d.data)
+		}
+	}
+}
+
+func TestStartTLSRequired(t *testing.T) {
+	srv := newFakeServer(t, nil)
+	s := New(Options{Host: "127.0.0.1", Port: srv.port(), From: "no-reply@short.example.com"})
+	err := s.Send(context.Background(), Message{To: "alice@example.com", Subject: "x", Body: "x"})
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("Send to a server without STARTTLS = %v, want a refusal", err)
+	}
+}
+
+func TestSendPlainRelay(t *testing.T) {
+	srv := newFakeServer(t, nil)
+	s := New(Options{Host: "127.0.0.1", Port: srv.port(), From: "no-reply@short.example.com", TLS: TLSNone})
+	if err := s.Send(context.Background(), Message{To: "bob@example.com", Subject: "Hi", Body: "x"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if d := <-srv.received; d.secure || d.auth != "" {
+		t.Errorf("plain relay delivery = %+v", d)
+	}
+}
+
+func TestSendRejectsHeaderInjection(t *testing.T) {
+	s := New(Options{Host: "127.0.0.1", Port: 1, From: "no-reply@short.example.com"})
+	err := s.Send(context.Background(), Message{To: "a@example.com\r\nBcc: b@example.com", Subject: "x"})
+	if err == nil || !strings.Contains(err.Error(), "line break") {
+		t.Errorf("Send = %v, want the header rejected", err)
+	}
+}
+
+func TestDisabledSender(t *testing.T) {
+	if err := New(Options{}).Send(context.Background(), Message{To: "a@example.com"}); err != ErrDisabled {
+		t.Errorf("Send without a host = %v, want ErrDisabled", err)
+	}
+}
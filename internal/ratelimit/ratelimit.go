@@ -14,6 +14,11 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/arumes31/redrx/internal/telemetry"
 )
 
 // Rule is one parsed "N per window" clause.
@@ -129,6 +134,8 @@ type Backend interface {
 	Close() error
 }
 
+var tracer = telemetry.Tracer("ratelimit")
+
 // Limiter applies rule sets against a backend.
 type Limiter struct {
 	backend Backend
@@ -153,6 +160,9 @@ func (l *Limiter) Allow(ctx context.Context, scope, identity string, rules Rules
 		return Result{Allowed: true}
 	}
 
+	ctx, span := tracer.Start(ctx, "ratelimit.allow", trace.WithAttributes(attribute.String("ratelimit.scope", scope)))
+	defer span.End()
+
 	now := time.Now()
 	for _, r := range rules {
 		bucket := now.Truncate(r.Window).Unix()
@@ -160,13 +170,17 @@ func (l *Limiter) Allow(ctx context.Context, scope, identity string, rules Rules
 
 		count, err := l.backend.Incr(ctx, key, r.Window)
 		if err != nil {
+			// Failing open is no failure of the request, but worth seeing.
+			span.RecordError(err)
 			continue
 		}
 		if count > int64(r.Limit) {
+			span.SetAttributes(attribute.Bool("ratelimit.allowed", false))
 			reset := now.Truncate(r.Window).Add(r.Window)
 			return Result{Allowed: false, RetryAfter: time.Until(reset), Rule: r}
 		}
 	}
+	span.SetAttributes(attribute.Bool("ratelimit.allowed", true))
 	return Result{Allowed: true}
 }
 
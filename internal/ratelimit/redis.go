@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"github.com/arumes31/redrx/internal/telemetry"
 )
 
 // RedisBackend shares limit counters across replicas, matching the
@@ -24,7 +26,8 @@ const (
 	writeTimeout = 300 * time.Millisecond
 )
 
-// NewRedisBackend connects to a redis:// URL.
+// NewRedisBackend connects to a redis:// URL. Every command is traced,
+// whichever subsystem shares the client.
 func NewRedisBackend(url string) (*RedisBackend, error) {
 	opts, err := redis.ParseURL(url)
 	if err != nil {
@@ -35,7 +38,9 @@ func NewRedisBackend(url string) (*RedisBackend, error) {
 	opts.WriteTimeout = writeTimeout
 	opts.MaxRetries = -1 // -1 disables retries; 0 would mean "use the default"
 	opts.PoolTimeout = time.Second
-	return &RedisBackend{client: redis.NewClient(opts)}, nil
+	client := redis.NewClient(opts)
+	client.AddHook(telemetry.RedisHook{})
+	return &RedisBackend{client: client}, nil
 }
 
 // opTimeout is a hard ceiling on every Redis call. DialTimeout alone does not
@@ -21,8 +21,15 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/arumes31/redrx/internal/telemetry"
 )
 
+var tracer = telemetry.Tracer("safety")
+
 // ErrListUnavailable means the blocklist is configured but unreadable, so no
 // URL can be judged safe.
 var ErrListUnavailable = errors.New("safety: blocked domains list unavailable")
@@ -286,7 +293,7 @@ func parseDomainList(r io.Reader) (map[string]struct{}, error) {
 
 // Refresh downloads the phishing feeds when the cached file is older than the
 // configured interval. It is a no-op when the check is disabled.
-func (c *Checker) Refresh(ctx context.Context) error {
+func (c *Checker) Refresh(ctx context.Context) (err error) {
 	if !c.enabled || c.listPath == "" || len(c.feedURLs) == 0 {
 		return nil
 	}
@@ -304,6 +311,9 @@ func (c *Checker) Refresh(ctx context.Context) error {
 		}
 	}
 
+	ctx, span := tracer.Start(ctx, "safety.refresh")
+	defer func() { telemetry.End(span, err) }()
+
 	bodies := make([][]byte, len(c.feedURLs))
 	errs := make([]error, len(c.feedURLs))
 	var wg sync.WaitGroup
@@ -382,7 +392,14 @@ func (c *Checker) Refresh(ctx context.Context) error {
 	return nil
 }
 
-func fetch(ctx context.Context, client *http.Client, rawURL string) ([]byte, error) {
+func fetch(ctx context.Context, client *http.Client, rawURL string) (body []byte, err error) {
+	ctx, span := tracer.Start(ctx, "safety.fetch_feed", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("url.full", rawURL)))
+	defer func() {
+		span.SetAttributes(attribute.Int("safety.feed_bytes", len(body)))
+		telemetry.End(span, err)
+	}()
+
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
 	if err != nil {
 		return nil, err
@@ -392,6 +409,7 @@ func fetch(ctx context.Context, client *http.Client, rawURL string) ([]byte, err
 		return nil, err
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("status %s", resp.Status)
 	}
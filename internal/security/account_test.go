@@ -1,6 +1,9 @@
 package security
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestAccountSecretRoundTrip(t *testing.T) {
 	key := []byte("application-secret")
@@ -45,3 +48,29 @@ func TestRecoveryCodesAreUniqueAndNormalize(t *testing.T) {
 		t.Error("different application keys produced the same recovery hash")
 	}
 }
+
+func TestAccountTokens(t *testing.T) {
+	key := []byte("application-secret")
+	now := time.Unix(1_700_000_000, 0)
+	token := NewAccountToken(key, TokenPasswordReset, 42, "hash-1", now.Add(time.Hour))
+
+	if id, ok := AccountTokenUser(token); !ok || id != 42 {
+		t.Fatalf("AccountTokenUser = %d, %v", id, ok)
+	}
+	if !VerifyAccountToken(key, TokenPasswordReset, token, "hash-1", now) {
+		t.Fatal("a fresh token did not verify")
+	}
+
+	cases := map[string]bool{
+		"after the state changed": VerifyAccountToken(key, TokenPasswordReset, token, "hash-2", now),
+		"for another purpose":     VerifyAccountToken(key, TokenVerifyEmail, token, "hash-1", now),
+		"after it expired":        VerifyAccountToken(key, TokenPasswordReset, token, "hash-1", now.Add(2*time.Hour)),
+		"with another key":        VerifyAccountToken([]byte("other"), TokenPasswordReset, token, "hash-1", now),
+		"for another user":        VerifyAccountToken(key, TokenPasswordReset, "43"+token[2:], "hash-1", now),
+	}
+	for name, ok := range cases {
+		if ok {
+			t.Errorf("token verified %s", name)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore keeps the session registry in Redis, shared by every replica. A
+// session is a hash that expires with its cookie; a set per user indexes them
+// for listing and revoking.
+type RedisStore struct {
+	client *redis.Client
+}
+
+// opTimeout bounds each call, as the rate limiter's does, so a Redis outage
+// signs visitors out for a moment instead of stalling every request.
+const opTimeout = 2 * time.Second
+
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func sessionKey(id string) string { return "redrx:session:" + id }
+
+func userSessionsKey(userID int64) string {
+	return "redrx:user-sessions:" + strconv.FormatInt(userID, 10)
+}
+
+func (s *RedisStore) Create(ctx context.Context, rec *Record) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+
+	key := sessionKey(rec.ID)
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, key,
+		"uid", rec.UserID,
+		"ua", rec.UserAgent,
+		"ip", rec.IPAddress,
+		"country", rec.Country,
+		"created", rec.CreatedAt.Unix(),
+		"seen", rec.LastSeenAt.Unix(),
+	)
+	pipe.Expire(ctx, key, MaxAge)
+	pipe.SAdd(ctx, userSessionsKey(rec.UserID), rec.ID)
+	pipe.Expire(ctx, userSessionsKey(rec.UserID), MaxAge)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) Get(ctx context.Context, id string) (*Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+	return s.get(ctx, id)
+}
+
+func (s *RedisStore) get(ctx context.Context, id string) (*Record, error) {
+	fields, err := s.client.HGetAll(ctx, sessionKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return recordFromHash(id, fields), nil
+}
+
+func recordFromHash(id string, fields map[string]string) *Record {
+	userID, _ := strconv.ParseInt(fields["uid"], 10, 64)
+	created, _ := strconv.ParseInt(fields["created"], 10, 64)
+	seen, _ := strconv.ParseInt(fields["seen"], 10, 64)
+	return &Record{
+		ID:         id,
+		UserID:     userID,
+		UserAgent:  fields["ua"],
+		IPAddress:  fields["ip"],
+		Country:    fields["country"],
+		CreatedAt:  time.Unix(created, 0).UTC(),
+		LastSeenAt: time.Unix(seen, 0).UTC(),
+	}
+}
+
+// Seen also renews the expiry, which tracks the cookie's: Save reissues the
+// cookie for another MaxAge whenever the session changes.
+func (s *RedisStore) Seen(ctx context.Context, id string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+
+	key := sessionKey(id)
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, key, "seen", at.Unix())
+	pipe.Expire(ctx, key, MaxAge)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) List(ctx context.Context, userID int64) ([]*Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+
+	ids, err := s.client.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, sessionKey(id))
+	}
+	if len(ids) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var out, expired []*Record
+	for i, cmd := range cmds {
+		if fields := cmd.Val(); len(fields) > 0 {
+			out = append(out, recordFromHash(ids[i], fields))
+		} else {
+			expired = append(expired, &Record{ID: ids[i]})
+		}
+	}
+	// Hashes expire on their own; their entries in the index do not.
+	for _, rec := range expired {
+		s.client.SRem(ctx, userSessionsKey(userID), rec.ID)
+	}
+	sortBySeen(out)
+	return out, nil
+}
+
+func (s *RedisStore) Delete(ctx context.Context, userID int64, id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+
+	rec, err := s.get(ctx, id)
+	if err != nil || rec == nil || rec.UserID != userID {
+		return false, err
+	}
+	pipe := s.client.TxPipeline()
+	pipe.Del(ctx, sessionKey(id))
+	pipe.SRem(ctx, userSessionsKey(userID), id)
+	_, err = pipe.Exec(ctx)
+	return err == nil, err
+}
+
+func (s *RedisStore) DeleteAll(ctx context.Context, userID int64, except string) error {
+	ctx, cancel := context.WithTimeout(ctx, opTimeout)
+	defer cancel()
+
+	ids, err := s.client.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+	pipe := s.client.TxPipeline()
+	for _, id := range ids {
+		if id != except {
+			pipe.Del(ctx, sessionKey(id))
+			pipe.SRem(ctx, userSessionsKey(userID), id)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	return nil
+}
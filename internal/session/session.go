@@ -1,13 +1,21 @@
 // Package session implements signed cookie sessions.
 //
 // The payload is JSON, base64url-encoded and authenticated with HMAC-SHA256
-// keyed on SECRET_KEY. Nothing secret is stored in it — only a user id, flash
-// messages, a CSRF token, a short-lived pending login, an anonymous-work
-// challenge and the set of password-protected links this visitor has unlocked
-// — so signing without encryption is sufficient.
+// keyed on SECRET_KEY. Nothing secret is stored in it — only a user id and
+// session id, flash messages, a CSRF token, a short-lived pending login, an
+// anonymous-work challenge, the state of a WebAuthn ceremony in progress and
+// the set of password-protected links this visitor has unlocked — so signing
+// without encryption is sufficient.
+//
+// A signature alone cannot be withdrawn, so signed-in sessions are also
+// registered in a Store. A cookie whose session is no longer registered is
+// treated as signed out, which is how logging out, revoking a session and
+// changing credentials end a session that a copied cookie would otherwise
+// keep alive.
 package session
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
@@ -22,8 +30,9 @@ import (
 
 const (
 	cookieName = "redrx_session"
-	// maxAge bounds both the cookie lifetime and the signature's validity.
-	maxAge = 30 * 24 * time.Hour
+	// MaxAge bounds the cookie lifetime, the signature's validity and how
+	// long a registered session may sit idle.
+	MaxAge = 30 * 24 * time.Hour
 	// maxCookieBytes leaves headroom under the 4 KiB browser limit.
 	maxCookieBytes = 3800
 )
@@ -37,10 +46,13 @@ type Flash struct {
 // Data is the serialised session payload.
 type Data struct {
 	UserID        int64           `json:"uid,omitempty"`
+	SessionID     string          `json:"sid,omitempty"`
 	PendingUserID int64           `json:"puid,omitempty"`
 	PendingNext   string          `json:"pn,omitempty"`
 	PendingSince  int64           `json:"ps,omitempty"`
 	PoWChallenge  string          `json:"pow,omitempty"`
+	CeremonyKind  string          `json:"wak,omitempty"`
+	Ceremony      []byte          `json:"wa,omitempty"`
 	CSRF          string          `json:"csrf,omitempty"`
 	Flashes       []Flash         `json:"fl,omitempty"`
 	LinkAuth      map[string]bool `json:"la,omitempty"`
@@ -53,6 +65,10 @@ type Session struct {
 	Data
 	dirty  bool
 	secure bool
+	// unchecked marks a session whose registration could not be looked up.
+	// It is served as signed out, but its cookie is left alone so the
+	// sign-in survives the outage.
+	unchecked bool
 }
 
 // Manager signs and verifies session cookies.
@@ -60,47 +76,78 @@ type Manager struct {
 	key []byte
 	// secure marks cookies Secure; disabled in debug so plain-HTTP dev works.
 	secure bool
+	// store is the registry signed-in sessions are checked against. Nil
+	// skips the check, leaving the signature as the only proof.
+	store Store
 }
 
-func NewManager(secretKey []byte, secure bool) *Manager {
+func NewManager(secretKey []byte, secure bool, store Store) *Manager {
 	// Derive a distinct key so the session MAC is not the raw configured
 	// secret, which may be reused for other purposes.
 	sum := sha256.Sum256(append([]byte("redrx.session.v1|"), secretKey...))
-	return &Manager{key: sum[:], secure: secure}
+	return &Manager{key: sum[:], secure: secure, store: store}
 }
 
 // Load reads and verifies the session cookie, returning an empty session when
-// the cookie is absent, tampered with or expired.
-func (m *Manager) Load(r *http.Request) *Session {
+// the cookie is absent, tampered with or expired. A signed-in session must
+// also still be registered, or it is signed out. The error reports a failure
+// to reach the store; the session returned alongside it is still usable.
+func (m *Manager) Load(r *http.Request) (*Session, error) {
 	s := &Session{secure: m.secure}
 	s.LinkAuth = map[string]bool{}
 
 	c, err := r.Cookie(cookieName)
 	if err != nil || c.Value == "" {
-		return s
+		return s, nil
 	}
 	payload, ok := m.verify(c.Value)
 	if !ok {
-		return s
+		return s, nil
 	}
 	var d Data
 	if err := json.Unmarshal(payload, &d); err != nil {
-		return s
+		return s, nil
 	}
-	if d.Issued > 0 && time.Since(time.Unix(d.Issued, 0)) > maxAge {
-		return s
+	if d.Issued > 0 && time.Since(time.Unix(d.Issued, 0)) > MaxAge {
+		return s, nil
 	}
 	s.Data = d
 	if s.LinkAuth == nil {
 		s.LinkAuth = map[string]bool{}
 	}
-	return s
+	if s.UserID != 0 && m.store != nil {
+		return s, m.checkRegistered(r.Context(), s)
+	}
+	return s, nil
+}
+
+// checkRegistered signs the session out unless its registration is current.
+// A cookie from before sessions were registered carries no id, and is signed
+// out too: there is no record of it to list or revoke.
+func (m *Manager) checkRegistered(ctx context.Context, s *Session) error {
+	var rec *Record
+	if s.SessionID != "" {
+		var err error
+		if rec, err = m.store.Get(ctx, s.SessionID); err != nil {
+			s.UserID = 0
+			s.unchecked = true
+			return err
+		}
+	}
+	if rec == nil || rec.UserID != s.UserID || time.Since(rec.LastSeenAt) > MaxAge {
+		s.Logout()
+		return nil
+	}
+	if now := time.Now(); now.Sub(rec.LastSeenAt) > seenInterval {
+		return m.store.Seen(ctx, rec.ID, now)
+	}
+	return nil
 }
 
 // Save writes the cookie if the session changed. It must be called before any
 // response body is written.
 func (m *Manager) Save(w http.ResponseWriter, s *Session) {
-	if s == nil || !s.dirty {
+	if s == nil || !s.dirty || s.unchecked {
 		return
 	}
 	s.dirty = false
@@ -124,7 +171,7 @@ func (m *Manager) Save(w http.ResponseWriter, s *Session) {
 
 	http.SetCookie(w, &http.Cookie{ // #nosec G124 -- Secure is set from config, see NewManager
 		Name: cookieName, Value: value, Path: "/",
-		MaxAge: int(maxAge.Seconds()), HttpOnly: true,
+		MaxAge: int(MaxAge.Seconds()), HttpOnly: true,
 		Secure: m.secure, SameSite: http.SameSiteLaxMode,
 	})
 }
@@ -212,13 +259,15 @@ func (m *Manager) verify(value string) ([]byte, bool) {
 
 func (s *Session) isEmpty() bool {
 	return s.UserID == 0 && s.PendingUserID == 0 && s.PoWChallenge == "" &&
-		s.CSRF == "" && len(s.Flashes) == 0 && len(s.LinkAuth) == 0
+		s.CeremonyKind == "" && s.CSRF == "" && len(s.Flashes) == 0 && len(s.LinkAuth) == 0
 }
 
-// Login records the authenticated user and rotates the CSRF token, so a token
-// captured before login cannot be replayed afterwards.
+// Login records the authenticated user under a fresh session id and rotates
+// the CSRF token, so a token captured before login cannot be replayed
+// afterwards. The caller registers the new id with the store.
 func (s *Session) Login(userID int64) {
 	s.UserID = userID
+	s.SessionID = newID()
 	s.clearPendingLogin()
 	s.CSRF = ""
 	s.dirty = true
@@ -268,6 +317,28 @@ func (s *Session) ConsumePoWChallenge(challenge string) bool {
 	return true
 }
 
+// BeginCeremony stores the server half of a WebAuthn ceremony, replacing any
+// other ceremony in progress. kind names the ceremony, so state begun for one
+// cannot be finished as another.
+func (s *Session) BeginCeremony(kind string, state []byte) {
+	s.CeremonyKind = kind
+	s.Ceremony = state
+	s.dirty = true
+}
+
+// TakeCeremony returns the state of a ceremony of the given kind and clears
+// it, so each challenge is answered at most once.
+func (s *Session) TakeCeremony(kind string) ([]byte, bool) {
+	if s.CeremonyKind == "" {
+		return nil, false
+	}
+	state, ok := s.Ceremony, s.CeremonyKind == kind
+	s.CeremonyKind = ""
+	s.Ceremony = nil
+	s.dirty = true
+	return state, ok
+}
+
 // Logout clears all session state.
 func (s *Session) Logout() {
 	s.Data = Data{}
@@ -307,16 +378,24 @@ func (s *Session) IsLinkAuthorized(code string) bool { return s.LinkAuth[code] }
 // CSRFToken returns the session's CSRF token, minting one on first use.
 func (s *Session) CSRFToken() string {
 	if s.CSRF == "" {
-		b := make([]byte, 32)
-		if _, err := rand.Read(b); err != nil {
+		if s.CSRF = newID(); s.CSRF == "" {
 			return ""
 		}
-		s.CSRF = hex.EncodeToString(b)
 		s.dirty = true
 	}
 	return s.CSRF
 }
 
+// newID returns 32 random bytes, hex-encoded, or "" if the system's random
+// source fails.
+func newID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
 // ValidCSRF compares a submitted token against the session's in constant time.
 func (s *Session) ValidCSRF(token string) bool {
 	if s.CSRF == "" || token == "" {
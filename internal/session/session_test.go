@@ -1,18 +1,30 @@
 package session
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
+func load(t *testing.T, m *Manager, r *http.Request) *Session {
+	t.Helper()
+	s, err := m.Load(r)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return s
+}
+
 func roundTrip(t *testing.T, m *Manager, mutate func(*Session)) *Session {
 	t.Helper()
 
 	rec := httptest.NewRecorder()
-	s := m.Load(httptest.NewRequest(http.MethodGet, "/", nil))
+	s := load(t, m, httptest.NewRequest(http.MethodGet, "/", nil))
 	mutate(s)
 	m.Save(rec, s)
 
@@ -20,11 +32,11 @@ func roundTrip(t *testing.T, m *Manager, mutate func(*Session)) *Session {
 	for _, c := range rec.Result().Cookies() {
 		req.AddCookie(c)
 	}
-	return m.Load(req)
+	return load(t, m, req)
 }
 
 func TestSessionRoundTrip(t *testing.T) {
-	m := NewManager([]byte("secret"), true)
+	m := NewManager([]byte("secret"), true, nil)
 
 	got := roundTrip(t, m, func(s *Session) {
 		s.Login(42)
@@ -53,10 +65,10 @@ func TestSessionRoundTrip(t *testing.T) {
 }
 
 func TestTamperedCookieIsRejected(t *testing.T) {
-	m := NewManager([]byte("secret"), true)
+	m := NewManager([]byte("secret"), true, nil)
 
 	rec := httptest.NewRecorder()
-	s := m.Load(httptest.NewRequest(http.MethodGet, "/", nil))
+	s := load(t, m, httptest.NewRequest(http.MethodGet, "/", nil))
 	s.Login(7)
 	m.Save(rec, s)
 
@@ -69,17 +81,17 @@ func TestTamperedCookieIsRejected(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.AddCookie(&http.Cookie{Name: cookieName, Value: tampered})
 
-	if got := m.Load(req); got.UserID != 0 {
+	if got := load(t, m, req); got.UserID != 0 {
 		t.Errorf("a tampered cookie authenticated as user %d", got.UserID)
 	}
 }
 
 func TestCookieFromAnotherKeyIsRejected(t *testing.T) {
-	signer := NewManager([]byte("key-one"), true)
-	verifier := NewManager([]byte("key-two"), true)
+	signer := NewManager([]byte("key-one"), true, nil)
+	verifier := NewManager([]byte("key-two"), true, nil)
 
 	rec := httptest.NewRecorder()
-	s := signer.Load(httptest.NewRequest(http.MethodGet, "/", nil))
+	s := load(t, signer, httptest.NewRequest(http.MethodGet, "/", nil))
 	s.Login(9)
 	signer.Save(rec, s)
 
@@ -88,14 +100,14 @@ func TestCookieFromAnotherKeyIsRejected(t *testing.T) {
 		req.AddCookie(c)
 	}
 
-	if got := verifier.Load(req); got.UserID != 0 {
+	if got := load(t, verifier, req); got.UserID != 0 {
 		t.Errorf("a cookie signed with a different SECRET_KEY was accepted as user %d", got.UserID)
 	}
 }
 
 func TestCSRFTokenIsStableAndChecked(t *testing.T) {
-	m := NewManager([]byte("secret"), true)
-	s := m.Load(httptest.NewRequest(http.MethodGet, "/", nil))
+	m := NewManager([]byte("secret"), true, nil)
+	s := load(t, m, httptest.NewRequest(http.MethodGet, "/", nil))
 
 	token := s.CSRFToken()
 	if token == "" {
@@ -115,8 +127,8 @@ func TestCSRFTokenIsStableAndChecked(t *testing.T) {
 }
 
 func TestLoginRotatesCSRFToken(t *testing.T) {
-	m := NewManager([]byte("secret"), true)
-	s := m.Load(httptest.NewRequest(http.MethodGet, "/", nil))
+	m := NewManager([]byte("secret"), true, nil)
+	s := load(t, m, httptest.NewRequest(http.MethodGet, "/", nil))
 
 	before := s.CSRFToken()
 	s.Login(3)
@@ -128,10 +140,10 @@ func TestLoginRotatesCSRFToken(t *testing.T) {
 }
 
 func TestLogoutClearsTheCookie(t *testing.T) {
-	m := NewManager([]byte("secret"), true)
+	m := NewManager([]byte("secret"), true, nil)
 
 	rec := httptest.NewRecorder()
-	s := m.Load(httptest.NewRequest(http.MethodGet, "/", nil))
+	s := load(t, m, httptest.NewRequest(http.MethodGet, "/", nil))
 	s.Login(11)
 	s.Logout()
 	m.Save(rec, s)
@@ -146,10 +158,10 @@ func TestLogoutClearsTheCookie(t *testing.T) {
 }
 
 func TestCookieSecurityAttributes(t *testing.T) {
-	m := NewManager([]byte("secret"), true)
+	m := NewManager([]byte("secret"), true, nil)
 
 	rec := httptest.NewRecorder()
-	s := m.Load(httptest.NewRequest(http.MethodGet, "/", nil))
+	s := load(t, m, httptest.NewRequest(http.MethodGet, "/", nil))
 	s.Login(1)
 	m.Save(rec, s)
 
@@ -166,10 +178,10 @@ func TestCookieSecurityAttributes(t *testing.T) {
 }
 
 func TestUnchangedSessionWritesNoCookie(t *testing.T) {
-	m := NewManager([]byte("secret"), true)
+	m := NewManager([]byte("secret"), true, nil)
 
 	rec := httptest.NewRecorder()
-	s := m.Load(httptest.NewRequest(http.MethodGet, "/", nil))
+	s := load(t, m, httptest.NewRequest(http.MethodGet, "/", nil))
 	m.Save(rec, s)
 
 	if len(rec.Result().Cookies()) != 0 {
@@ -182,10 +194,10 @@ func TestUnchangedSessionWritesNoCookie(t *testing.T) {
 // oversized value would make the browser discard the whole cookie, logging them
 // out; the session must instead shed link authorisations and keep the identity.
 func TestOversizedSessionIsShrunkNotDropped(t *testing.T) {
-	m := NewManager([]byte("secret"), true)
+	m := NewManager([]byte("secret"), true, nil)
 
 	rec := httptest.NewRecorder()
-	s := m.Load(httptest.NewRequest(http.MethodGet, "/", nil))
+	s := load(t, m, httptest.NewRequest(http.MethodGet, "/", nil))
 	s.Login(42)
 	s.CSRFToken()
 	for i := 0; i < 400; i++ {
@@ -203,7 +215,7 @@ func TestOversizedSessionIsShrunkNotDropped(t *testing.T) {
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.AddCookie(cookies[0])
-	got := m.Load(req)
+	got := load(t, m, req)
 
 	if got.UserID != 42 {
 		t.Errorf("UserID = %d after shrinking, want 42 — the login was lost", got.UserID)
@@ -220,10 +232,10 @@ func TestOversizedSessionIsShrunkNotDropped(t *testing.T) {
 // authorisations in the eviction order: a flash is shown once, an unlocked link
 // costs a password re-entry.
 func TestOversizedFlashesAreDroppedFirst(t *testing.T) {
-	m := NewManager([]byte("secret"), true)
+	m := NewManager([]byte("secret"), true, nil)
 
 	rec := httptest.NewRecorder()
-	s := m.Load(httptest.NewRequest(http.MethodGet, "/", nil))
+	s := load(t, m, httptest.NewRequest(http.MethodGet, "/", nil))
 	s.Login(7)
 	s.AuthorizeLink("KEEPME")
 	for i := 0; i < 200; i++ {
@@ -241,7 +253,7 @@ func TestOversizedFlashesAreDroppedFirst(t *testing.T) {
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.AddCookie(cookies[0])
-	got := m.Load(req)
+	got := load(t, m, req)
 
 	if len(got.Flashes) != 0 {
 		t.Errorf("Flashes = %d, want 0 — they should be dropped first", len(got.Flashes))
@@ -250,3 +262,126 @@ func TestOversizedFlashesAreDroppedFirst(t *testing.T) {
 		t.Error("the link authorisation was evicted before the flashes were")
 	}
 }
+
+func TestCeremonyIsTakenOnceAndOnlyByItsKind(t *testing.T) {
+	m := NewManager([]byte("secret"), true, nil)
+
+	got := roundTrip(t, m, func(s *Session) { s.BeginCeremony("register", []byte(`{"challenge":"abc"}`)) })
+	if state, ok := got.TakeCeremony("register"); !ok || string(state) != `{"challenge":"abc"}` {
+		t.Fatalf("TakeCeremony = %q, %v", state, ok)
+	}
+	if _, ok := got.TakeCeremony("register"); ok {
+		t.Error("a ceremony was taken twice")
+	}
+
+	got = roundTrip(t, m, func(s *Session) { s.BeginCeremony("register", []byte("x")) })
+	if _, ok := got.TakeCeremony("login"); ok {
+		t.Error("a registration ceremony was finished as a login")
+	}
+	if _, ok := got.TakeCeremony("register"); ok {
+		t.Error("a ceremony survived an attempt to finish it as another kind")
+	}
+}
+
+// memoryStore is a Store for tests.
+type memoryStore struct {
+	recs map[string]*Record
+	err  error
+}
+
+func (m *memoryStore) Create(_ context.Context, rec *Record) error {
+	m.recs[rec.ID] = rec
+	return nil
+}
+
+func (m *memoryStore) Get(_ context.Context, id string) (*Record, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.recs[id], nil
+}
+
+func (m *memoryStore) Seen(_ context.Context, id string, at time.Time) error {
+	m.recs[id].LastSeenAt = at
+	return nil
+}
+
+func (m *memoryStore) List(_ context.Context, userID int64) ([]*Record, error) {
+	var out []*Record
+	for _, rec := range m.recs {
+		if rec.UserID == userID {
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryStore) Delete(_ context.Context, userID int64, id string) (bool, error) {
+	rec, ok := m.recs[id]
+	if !ok || rec.UserID != userID {
+		return false, nil
+	}
+	delete(m.recs, id)
+	return true, nil
+}
+
+func (m *memoryStore) DeleteAll(_ context.Context, userID int64, except string) error {
+	for id, rec := range m.recs {
+		if rec.UserID == userID && id != except {
+			delete(m.recs, id)
+		}
+	}
+	return nil
+}
+
+// TestRevokedSessionIsSignedOut checks a signed-in cookie only works while its
+// session is registered, and that an unreachable store neither signs the
+// visitor in nor throws the cookie away.
+func TestRevokedSessionIsSignedOut(t *testing.T) {
+	store := &memoryStore{recs: map[string]*Record{}}
+	m := NewManager([]byte("secret"), true, store)
+
+	rec := httptest.NewRecorder()
+	s := load(t, m, httptest.NewRequest(http.MethodGet, "/", nil))
+	s.Login(42)
+	if s.SessionID == "" {
+		t.Fatal("Login did not assign a session id")
+	}
+	stale := time.Now().Add(-time.Hour)
+	_ = store.Create(context.Background(), &Record{ID: s.SessionID, UserID: 42, CreatedAt: stale, LastSeenAt: stale})
+	m.Save(rec, s)
+	request := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		return req
+	}
+
+	if got := load(t, m, request()); got.UserID != 42 {
+		t.Fatalf("a registered session loaded as user %d", got.UserID)
+	}
+	if seen := store.recs[s.SessionID].LastSeenAt; !seen.After(stale) {
+		t.Error("loading the session did not move last seen forward")
+	}
+
+	store.err = errors.New("store down")
+	got, err := m.Load(request())
+	if err == nil || got.UserID != 0 {
+		t.Errorf("with the store down: user %d, error %v", got.UserID, err)
+	}
+	out := httptest.NewRecorder()
+	got.AddFlash("info", "hello")
+	m.Save(out, got)
+	if len(out.Result().Cookies()) != 0 {
+		t.Error("a session that could not be checked rewrote its cookie")
+	}
+	store.err = nil
+
+	if ok, _ := store.Delete(context.Background(), 42, s.SessionID); !ok {
+		t.Fatal("Delete found no session")
+	}
+	if got := load(t, m, request()); got.UserID != 0 {
+		t.Errorf("a revoked session still loaded as user %d", got.UserID)
+	}
+}
@@ -0,0 +1,45 @@
+package session
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Record is the server-side half of a signed-in session: the cookie carries
+// only its id, and the session is valid only while its record exists.
+type Record struct {
+	ID         string
+	UserID     int64
+	UserAgent  string
+	IPAddress  string
+	Country    string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+}
+
+// Store keeps the registry of signed-in sessions. Deleting a record revokes
+// the session: the next request carrying its cookie is treated as signed out.
+type Store interface {
+	// Create registers a session.
+	Create(ctx context.Context, rec *Record) error
+	// Get returns a session's record, or nil when there is none.
+	Get(ctx context.Context, id string) (*Record, error)
+	// Seen moves a session's last-seen time forward.
+	Seen(ctx context.Context, id string, at time.Time) error
+	// List returns the user's sessions, most recently seen first.
+	List(ctx context.Context, userID int64) ([]*Record, error)
+	// Delete revokes one of the user's sessions, reporting whether it existed.
+	Delete(ctx context.Context, userID int64, id string) (bool, error)
+	// DeleteAll revokes every session of the user but except, which may be
+	// empty.
+	DeleteAll(ctx context.Context, userID int64, except string) error
+}
+
+// seenInterval throttles last-seen updates, so an active session costs one
+// write every few minutes rather than one per request.
+const seenInterval = 5 * time.Minute
+
+func sortBySeen(recs []*Record) {
+	slices.SortFunc(recs, func(a, b *Record) int { return b.LastSeenAt.Compare(a.LastSeenAt) })
+}
@@ -0,0 +1,541 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// An archive is gzip-compressed JSON, one value per line: a header, then for
+// each table a line naming it and its columns followed by a line per row, and
+// a trailer with the row counts. Values are typed by the schema rather than
+// by the database they came from: timestamps are RFC 3339 in UTC, booleans
+// are JSON booleans, whatever text or integers a legacy SQLite row held.
+// Archives are read by any later version; columns added since are left NULL.
+const (
+	archiveFormat = "redrx-backup"
+	// ArchiveVersion is the archive format Export writes and the newest one
+	// Import reads.
+	ArchiveVersion = 1
+)
+
+type archiveHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Source    string    `json:"source"`
+}
+
+type archiveTable struct {
+	Table   string   `json:"table"`
+	Columns []string `json:"columns"`
+}
+
+type archiveTrailer struct {
+	End  bool             `json:"end"`
+	Rows map[string]int64 `json:"rows"`
+}
+
+// archiveLine is any line after the header that is not a row.
+type archiveLine struct {
+	archiveTable
+	archiveTrailer
+}
+
+// TableCount is how many rows of a table an export wrote or an import
+// stored. Skipped rows belonged to a user or link that no longer exists,
+// which SQLite never enforced; Detached links lost such an owner and were
+// kept as anonymous links.
+type TableCount struct {
+	Table    string
+	Rows     int64
+	Skipped  int64
+	Detached int64
+}
+
+// archivedTables are the tables a backup carries, in an order where every
+// row comes after the rows it references. The visitor salts stay behind:
+// each is meant to be gone after its day, and a copy in a backup would let
+// that day's visitor hashes be recomputed from addresses.
+func archivedTables() []table {
+	out := make([]table, 0, len(schema))
+	for _, t := range schema {
+		if t.name != "visitor_salts" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// columnKind is how a column's values are written to an archive.
+type columnKind int
+
+const (
+	kindText columnKind = iota
+	kindInt
+	kindBool
+	kindTime
+)
+
+func kindOf(c column) columnKind {
+	switch typ := strings.ToUpper(c.sqliteType); {
+	case strings.HasPrefix(typ, "DATETIME"):
+		return kindTime
+	case strings.HasPrefix(typ, "BOOLEAN"):
+		return kindBool
+	case strings.HasPrefix(typ, "INTEGER"), strings.HasPrefix(typ, "BIGINT"):
+		return kindInt
+	}
+	return kindText
+}
+
+// Export writes every archived table to w as an archive, reading them in one
+// transaction so the archive is a consistent snapshot. Columns the database
+// does not have yet, on a legacy file that was never migrated, are left out.
+func (d *DB) Export(ctx context.Context, w io.Writer) ([]TableCount, error) {
+	// Inspect first: on SQLite the transaction below holds the only
+	// connection.
+	present := map[string][]column{}
+	for _, t := range archivedTables() {
+		exists, err := d.tableExists(ctx, t.name)
+		if err != nil || !exists {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		names, err := d.columnNames(ctx, t.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range t.columns {
+			if _, ok := names[c.name]; ok {
+				present[t.name] = append(present[t.name], c)
+			}
+		}
+	}
+
+	opts := &sql.TxOptions{ReadOnly: true}
+	if d.dialect == Postgres {
+		opts.Isolation = sql.LevelRepeatableRead
+	}
+	tx, err := d.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+	if err := enc.Encode(archiveHeader{
+		Format: archiveFormat, Version: ArchiveVersion, CreatedAt: now(), Source: dialectSystem[d.dialect],
+	}); err != nil {
+		return nil, err
+	}
+	trailer := archiveTrailer{End: true, Rows: map[string]int64{}}
+	var counts []TableCount
+	for _, t := range archivedTables() {
+		cols, ok := present[t.name]
+		if !ok {
+			continue
+		}
+		n, err := d.exportTable(ctx, tx, enc, t.name, cols)
+		if err != nil {
+			return nil, fmt.Errorf("export %s: %w", t.name, err)
+		}
+		trailer.Rows[t.name] = n
+		counts = append(counts, TableCount{Table: t.name, Rows: n})
+	}
+	if err := enc.Encode(trailer); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return counts, tx.Commit()
+}
+
+func (d *DB) exportTable(ctx context.Context, tx *sql.Tx, enc *json.Encoder, name string, cols []column) (int64, error) {
+	names := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = c.name
+	}
+	if err := enc.Encode(archiveTable{Table: name, Columns: names}); err != nil {
+		return 0, err
+	}
+	query := "SELECT " + strings.Join(names, ", ") + " FROM " + name
+	if names[0] == "id" {
+		query += " ORDER BY id"
+	}
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	dest := make([]any, len(cols))
+	for i, c := range cols {
+		switch kindOf(c) {
+		case kindTime:
+			dest[i] = new(NullTime)
+		case kindBool:
+			dest[i] = new(nullBool)
+		case kindInt:
+			dest[i] = new(sql.NullInt64)
+		default:
+			dest[i] = new(sql.NullString)
+		}
+	}
+	values := make([]any, len(cols))
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		for i, v := range dest {
+			values[i] = nil
+			switch v := v.(type) {
+			case *NullTime:
+				if v.Valid {
+					values[i] = v.Time.UTC().Format(time.RFC3339Nano)
+				}
+			case *nullBool:
+				if v.Valid {
+					values[i] = v.Bool
+				}
+			case *sql.NullInt64:
+				if v.Valid {
+					values[i] = v.Int64
+				}
+			case *sql.NullString:
+				if v.Valid {
+					values[i] = v.String
+				}
+			}
+		}
+		if err := enc.Encode(values); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// foreignKeyPattern reads the references out of a table's extra clauses.
+var foreignKeyPattern = regexp.MustCompile(`FOREIGN KEY\((\w+)\) REFERENCES (\w+) \(id\)`)
+
+// importBatchParams caps the parameters of one multi-row INSERT, well under
+// both backends' limits.
+const importBatchParams = 900
+
+// Import restores an archive into the database, which must be migrated and
+// empty. Ids are kept, so every reference between rows still holds, and on
+// Postgres the id sequences are moved past them. It runs in one transaction:
+// an archive that fails part way leaves the database empty.
+func (d *DB) Import(ctx context.Context, r io.Reader) ([]TableCount, error) {
+	for _, t := range schema {
+		var one int
+		err := d.QueryRow(ctx, "SELECT 1 FROM "+t.name+" LIMIT 1").Scan(&one)
+		if err == nil {
+			return nil, fmt.Errorf("store: the database already holds %s; import needs an empty one", t.name)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("store: not a backup archive: %w", err)
+	}
+	dec := json.NewDecoder(bufio.NewReader(zr))
+	dec.UseNumber()
+	var header archiveHeader
+	if err := dec.Decode(&header); err != nil || header.Format != archiveFormat {
+		return nil, errors.New("store: not a backup archive")
+	}
+	if header.Version > ArchiveVersion {
+		return nil, fmt.Errorf("store: the archive is version %d; this build reads up to %d", header.Version, ArchiveVersion)
+	}
+
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	imp := &importer{d: d, tx: tx, ids: map[string]map[int64]struct{}{}}
+	var trailer *archiveTrailer
+	for trailer == nil {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("store: read archive: %w", err)
+		}
+		if raw[0] == '[' {
+			if err := imp.row(ctx, raw); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var line archiveLine
+		if err := json.Unmarshal(raw, &line); err != nil {
+			return nil, fmt.Errorf("store: read archive: %w", err)
+		}
+		if line.End {
+			trailer = &line.archiveTrailer
+		} else if err := imp.begin(ctx, line.archiveTable); err != nil {
+			return nil, err
+		}
+	}
+	if err := imp.flush(ctx); err != nil {
+		return nil, err
+	}
+	held := map[string]int64{}
+	for _, c := range imp.counts {
+		held[c.Table] = c.Rows + c.Skipped
+	}
+	for name, want := range trailer.Rows {
+		if held[name] != want {
+			return nil, fmt.Errorf("store: the archive lists %d rows of %s but holds %d", want, name, held[name])
+		}
+	}
+	if d.dialect == Postgres {
+		if err := resyncSequences(ctx, tx); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return imp.counts, nil
+}
+
+// importer inserts the rows of one table at a time, in batches.
+type importer struct {
+	d  *DB
+	tx *sql.Tx
+
+	table   table
+	columns []column
+	// refs maps a column index to the table its values must exist in, and
+	// nullable whether an orphan is detached rather than skipped.
+	refs     map[int]string
+	nullable map[int]bool
+	// ids holds the ids stored so far of each referenced table.
+	ids map[string]map[int64]struct{}
+
+	pending []any
+	counts  []TableCount
+}
+
+func (imp *importer) begin(ctx context.Context, at archiveTable) error {
+	if err := imp.flush(ctx); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(schema, func(t table) bool { return t.name == at.Table })
+	if i < 0 || at.Table == "visitor_salts" {
+		return fmt.Errorf("store: the archive holds an unknown table %q", at.Table)
+	}
+	if slices.ContainsFunc(imp.counts, func(c TableCount) bool { return c.Table == at.Table }) {
+		return fmt.Errorf("store: the archive holds %s twice", at.Table)
+	}
+	imp.table = schema[i]
+	imp.columns = imp.columns[:0]
+	for _, name := range at.Columns {
+		j := slices.IndexFunc(imp.table.columns, func(c column) bool { return c.name == name })
+		if j < 0 {
+			return fmt.Errorf("store: the archive's %s has a column %q this build does not know", at.Table, name)
+		}
+		imp.columns = append(imp.columns, imp.table.columns[j])
+	}
+
+	imp.refs, imp.nullable = map[int]string{}, map[int]bool{}
+	for _, extra := range imp.table.extra {
+		m := foreignKeyPattern.FindStringSubmatch(extra)
+		if m == nil {
+			continue
+		}
+		if j := slices.IndexFunc(imp.columns, func(c column) bool { return c.name == m[1] }); j >= 0 {
+			imp.refs[j] = m[2]
+			imp.nullable[j] = !strings.Contains(imp.columns[j].sqliteType, "NOT NULL")
+		}
+	}
+	if _, referenced := imp.ids[at.Table]; !referenced {
+		for _, t := range schema {
+			for _, extra := range t.extra {
+				if m := foreignKeyPattern.FindStringSubmatch(extra); m != nil && m[2] == at.Table {
+					imp.ids[at.Table] = map[int64]struct{}{}
+				}
+			}
+		}
+	}
+	imp.counts = append(imp.counts, TableCount{Table: at.Table})
+	return nil
+}
+
+func (imp *importer) row(ctx context.Context, line json.RawMessage) error {
+	if imp.columns == nil {
+		return errors.New("store: the archive has a row before its table")
+	}
+	var raw []any
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return fmt.Errorf("store: read archive: %w", err)
+	}
+	if len(raw) != len(imp.columns) {
+		return fmt.Errorf("store: a row of %s has %d values for %d columns", imp.table.name, len(raw), len(imp.columns))
+	}
+	count := &imp.counts[len(imp.counts)-1]
+	values := make([]any, len(raw))
+	for i, v := range raw {
+		value, err := imp.value(imp.columns[i], v)
+		if err != nil {
+			return fmt.Errorf("store: %s.%s: %w", imp.table.name, imp.columns[i].name, err)
+		}
+		values[i] = value
+	}
+	for i, parent := range imp.refs {
+		id, ok := values[i].(int64)
+		if !ok {
+			continue
+		}
+		if _, exists := imp.ids[parent][id]; exists {
+			continue
+		}
+		if !imp.nullable[i] {
+			count.Skipped++
+			return nil
+		}
+		values[i] = nil
+		count.Detached++
+	}
+	if ids, tracked := imp.ids[imp.table.name]; tracked && imp.columns[0].name == "id" {
+		if id, ok := values[0].(int64); ok {
+			ids[id] = struct{}{}
+		}
+	}
+	count.Rows++
+	imp.pending = append(imp.pending, values...)
+	if len(imp.pending)+len(values) > importBatchParams {
+		return imp.flush(ctx)
+	}
+	return nil
+}
+
+// value converts an archived value to what the column takes.
+func (imp *importer) value(c column, v any) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch kindOf(c) {
+	case kindTime:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("want a timestamp, got %v", v)
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		return NewTime(imp.d.dialect, t), nil
+	case kindBool:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("want a boolean, got %v", v)
+		}
+		return b, nil
+	case kindInt:
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("want an integer, got %v", v)
+		}
+		return n.Int64()
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("want text, got %v", v)
+	}
+	return s, nil
+}
+
+// flush inserts the pending rows in one statement.
+func (imp *importer) flush(ctx context.Context) error {
+	if len(imp.pending) == 0 {
+		return nil
+	}
+	names := make([]string, len(imp.columns))
+	for i, c := range imp.columns {
+		names[i] = c.name
+	}
+	tuple := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ") + ")"
+	rows := len(imp.pending) / len(names)
+	query := "INSERT INTO " + imp.table.name + " (" + strings.Join(names, ", ") + ") VALUES " +
+		strings.TrimSuffix(strings.Repeat(tuple+", ", rows), ", ")
+	if _, err := imp.tx.ExecContext(ctx, imp.d.rebind(query), imp.pending...); err != nil {
+		return fmt.Errorf("store: import %s: %w", imp.table.name, err)
+	}
+	imp.pending = imp.pending[:0]
+	return nil
+}
+
+// resyncSequences moves each SERIAL id's sequence past the ids an import
+// stored, so the next row inserted does not collide with one of them. SQLite
+// needs nothing: an explicit id already advances its counter.
+func resyncSequences(ctx context.Context, tx *sql.Tx) error {
+	for _, t := range schema {
+		if len(t.columns) == 0 || t.columns[0].name != "id" || !strings.Contains(t.columns[0].pgType, "SERIAL") {
+			continue
+		}
+		q := fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('%[1]s', 'id'),
+			COALESCE((SELECT MAX(id) FROM %[1]s), 1), (SELECT MAX(id) FROM %[1]s) IS NOT NULL)`, t.name)
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("store: resync the %s id sequence: %w", t.name, err)
+		}
+	}
+	return nil
+}
+
+// errCopyStopped ends the export half of a Copy whose import stopped
+// reading.
+var errCopyStopped = errors.New("store: copy stopped")
+
+// Copy moves every archived row of src into dst, which must be migrated and
+// empty, as an Export piped into an Import. It returns once both are done
+// with their database, so the caller may close src straight away.
+func Copy(ctx context.Context, src, dst *DB) ([]TableCount, error) {
+	pr, pw := io.Pipe()
+	exported := make(chan error, 1)
+	go func() {
+		_, err := src.Export(ctx, pw)
+		pw.CloseWithError(err)
+		exported <- err
+	}()
+	counts, err := dst.Import(ctx, pr)
+	// Unblocks the export if the import stopped reading early, whether it
+	// failed or had already read the trailer.
+	_ = pr.CloseWithError(errCopyStopped)
+	exportErr := <-exported
+	if err != nil {
+		// A failed export reaches the import as a broken archive; its own
+		// error says what went wrong.
+		if exportErr != nil && !errors.Is(exportErr, errCopyStopped) {
+			return nil, fmt.Errorf("store: read the source: %w", exportErr)
+		}
+		return nil, err
+	}
+	return counts, nil
+}
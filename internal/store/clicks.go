@@ -4,45 +4,278 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 )
 
 // RecordClick appends a click row and bumps the counter on the link. Both
 // writes happen in one transaction so the counter can never drift from the log.
-func (d *DB) RecordClick(ctx context.Context, c *Click) error {
+//
+// A click with a VisitorHash is unique unless the same visitor clicked the
+// link in the window before it; without one, or with no window, every click
+// is unique. c.Unique is set accordingly.
+func (d *DB) RecordClick(ctx context.Context, c *Click, window time.Duration) error {
+	return d.RecordClicks(ctx, []*Click{c}, nil, window)
+}
+
+// clickInsertRows is how many clicks go in one INSERT, well under the bound
+// parameter limit of either database.
+const clickInsertRows = 100
+
+// visitorLookupHashes is how many visitor hashes one dedupe lookup matches.
+const visitorLookupHashes = 500
+
+type visitorKey struct {
+	urlID int64
+	hash  string
+}
+
+// RecordClicks writes a batch of clicks in one transaction: the rows go in
+// with multi-row INSERTs, each link's counter is bumped once by its number of
+// clicks, and its last_accessed_at moves to the latest of accessed, which
+// may name links without clicks. Clicks are deduped as by RecordClick,
+// against the clicks stored and those earlier in the batch, and their
+// Timestamp, Unique and Traffic are filled in the same way. Clicks on a link
+// purged since they were queued are dropped rather than failing the batch.
+func (d *DB) RecordClicks(ctx context.Context, clicks []*Click, accessed map[int64]time.Time, window time.Duration) error {
+	if len(clicks) == 0 && len(accessed) == 0 {
+		return nil
+	}
 	tx, err := d.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer func() { _ = tx.Rollback() }()
 
-	if c.Timestamp.IsZero() {
-		c.Timestamp = now()
+	if clicks, err = d.liveClicks(ctx, tx, clicks); err != nil {
+		return err
+	}
+	for _, c := range clicks {
+		if c.Timestamp.IsZero() {
+			c.Timestamp = now()
+		}
+		if c.Traffic == "" {
+			c.Traffic = TrafficHuman
+		}
+		c.Unique = true
+	}
+	if window > 0 {
+		if err := d.dedupeClicks(ctx, tx, clicks, window); err != nil {
+			return err
+		}
 	}
 
-	const insert = `INSERT INTO clicks (url_id, timestamp, ip_address, country, browser, platform, referrer)
-	                VALUES (?, ?, ?, ?, ?, ?, ?)`
-	if _, err := tx.ExecContext(ctx, d.rebind(insert),
-		c.URLID, NewTime(d.dialect, c.Timestamp), c.IPAddress, c.Country,
-		c.Browser, c.Platform, c.Referrer); err != nil {
-		return fmt.Errorf("insert click: %w", err)
+	for start := 0; start < len(clicks); start += clickInsertRows {
+		chunk := clicks[start:min(start+clickInsertRows, len(clicks))]
+		var (
+			q    strings.Builder
+			args = make([]any, 0, len(chunk)*21)
+		)
+		q.WriteString(`INSERT INTO clicks (url_id, timestamp, ip_address, country, browser, platform, referrer, visitor_hash, is_unique, traffic,
+		                                   region, city, network, device, os_version, browser_version, language,
+		                                   channel, utm_source, utm_medium, utm_campaign) VALUES `)
+		for i, c := range chunk {
+			if i > 0 {
+				q.WriteString(", ")
+			}
+			q.WriteString("(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+			args = append(args, c.URLID, NewTime(d.dialect, c.Timestamp), c.IPAddress, c.Country,
+				c.Browser, c.Platform, c.Referrer, nullString(c.VisitorHash), c.Unique, c.Traffic,
+				nullString(c.Region), nullString(c.City), nullString(c.Network), nullString(c.Device),
+				nullString(c.OSVersion), nullString(c.BrowserVersion), nullString(c.Language),
+				nullString(c.Channel), nullString(c.UTMSource), nullString(c.UTMMedium), nullString(c.UTMCampaign))
+		}
+		if _, err := tx.ExecContext(ctx, d.rebind(q.String()), args...); err != nil {
+			return fmt.Errorf("insert clicks: %w", err)
+		}
 	}
 
-	if _, err := tx.ExecContext(ctx,
-		d.rebind("UPDATE urls SET clicks = COALESCE(clicks, 0) + 1 WHERE id = ?"),
-		c.URLID); err != nil {
-		return fmt.Errorf("increment click counter: %w", err)
+	counts := map[int64]int64{}
+	for _, c := range clicks {
+		counts[c.URLID]++
+	}
+	// Update the links in ID order, so two instances flushing at once take
+	// the row locks in the same order and cannot deadlock.
+	ids := make([]int64, 0, len(counts)+len(accessed))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	for id := range accessed {
+		if _, ok := counts[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		if n := counts[id]; n > 0 {
+			if _, err := tx.ExecContext(ctx,
+				d.rebind("UPDATE urls SET clicks = COALESCE(clicks, 0) + ? WHERE id = ?"), n, id); err != nil {
+				return fmt.Errorf("increment click counter: %w", err)
+			}
+		}
+		if at, ok := accessed[id]; ok {
+			// Another instance may have flushed a later access already.
+			last := NewTime(d.dialect, at)
+			if _, err := tx.ExecContext(ctx, d.rebind(
+				`UPDATE urls SET last_accessed_at = ?
+				 WHERE id = ? AND (last_accessed_at IS NULL OR last_accessed_at < ?)`), last, id, last); err != nil {
+				return fmt.Errorf("update last accessed: %w", err)
+			}
+		}
 	}
 
 	return tx.Commit()
 }
 
-// RecentClicks returns the newest clicks for a link.
-func (d *DB) RecentClicks(ctx context.Context, urlID int64, limit int) ([]*Click, error) {
+// liveClicks returns the clicks whose link still exists, so one purged
+// link's clicks cannot break the foreign key for the whole batch. On Postgres
+// the links found are locked against a purge until the transaction ends.
+func (d *DB) liveClicks(ctx context.Context, tx *sql.Tx, clicks []*Click) ([]*Click, error) {
+	var ids []int64
+	seen := map[int64]bool{}
+	for _, c := range clicks {
+		if !seen[c.URLID] {
+			seen[c.URLID] = true
+			ids = append(ids, c.URLID)
+		}
+	}
+	lock := ""
+	if d.dialect == Postgres {
+		lock = " FOR KEY SHARE"
+	}
+	live := make(map[int64]bool, len(ids))
+	for start := 0; start < len(ids); start += deleteBatchSize {
+		chunk := ids[start:min(start+deleteBatchSize, len(ids))]
+		args := make([]any, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+		rows, err := tx.QueryContext(ctx, d.rebind("SELECT id FROM urls WHERE id IN ("+placeholders+")"+lock), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			live[id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(live) == len(ids) {
+		return clicks, nil
+	}
+	kept := make([]*Click, 0, len(clicks))
+	for _, c := range clicks {
+		if live[c.URLID] {
+			kept = append(kept, c)
+		}
+	}
+	return kept, nil
+}
+
+// dedupeClicks clears Unique on the clicks whose visitor clicked the link in
+// the window before, looking the stored clicks up a run of hashes at a time.
+func (d *DB) dedupeClicks(ctx context.Context, tx *sql.Tx, clicks []*Click, window time.Duration) error {
+	var (
+		hashes   []string
+		earliest time.Time
+		seen     = map[string]bool{}
+	)
+	for _, c := range clicks {
+		if c.VisitorHash == "" {
+			continue
+		}
+		if !seen[c.VisitorHash] {
+			seen[c.VisitorHash] = true
+			hashes = append(hashes, c.VisitorHash)
+		}
+		if earliest.IsZero() || c.Timestamp.Before(earliest) {
+			earliest = c.Timestamp
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	last := map[visitorKey]time.Time{}
+	for start := 0; start < len(hashes); start += visitorLookupHashes {
+		chunk := hashes[start:min(start+visitorLookupHashes, len(hashes))]
+		args := make([]any, 0, len(chunk)+1)
+		args = append(args, NewTime(d.dialect, earliest.Add(-window)))
+		for _, h := range chunk {
+			args = append(args, h)
+		}
+		rows, err := tx.QueryContext(ctx, d.rebind(
+			`SELECT url_id, visitor_hash, MAX(timestamp) FROM clicks
+			 WHERE timestamp >= ? AND visitor_hash IN (?`+strings.Repeat(", ?", len(chunk)-1)+`)
+			 GROUP BY url_id, visitor_hash`), args...)
+		if err != nil {
+			return fmt.Errorf("look up the visitors: %w", err)
+		}
+		for rows.Next() {
+			var (
+				k  visitorKey
+				ts NullTime
+			)
+			if err := rows.Scan(&k.urlID, &k.hash, &ts); err != nil {
+				rows.Close()
+				return err
+			}
+			last[k] = ts.Time
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range clicks {
+		if c.VisitorHash == "" {
+			continue
+		}
+		k := visitorKey{c.URLID, c.VisitorHash}
+		prev, ok := last[k]
+		if ok && !prev.Before(c.Timestamp.Add(-window)) {
+			c.Unique = false
+		}
+		if !ok || c.Timestamp.After(prev) {
+			last[k] = c.Timestamp
+		}
+	}
+	return nil
+}
+
+// humanTraffic is the condition selecting human clicks, those from before
+// the classification included.
+const humanTraffic = "(traffic IS NULL OR traffic = '" + TrafficHuman + "')"
+
+// trafficCond returns the condition to AND into a clicks query: human
+// traffic, or everything.
+func trafficCond(humanOnly bool) string {
+	if humanOnly {
+		return " AND " + humanTraffic
+	}
+	return ""
+}
+
+// RecentClicks returns the newest clicks for a link, of human traffic alone
+// when humanOnly.
+func (d *DB) RecentClicks(ctx context.Context, urlID int64, limit int, humanOnly bool) ([]*Click, error) {
 	rows, err := d.Query(ctx,
 		`SELECT id, url_id, timestamp, COALESCE(ip_address, ''), COALESCE(country, 'Unknown'),
-		        COALESCE(browser, ''), COALESCE(platform, ''), COALESCE(referrer, 'Direct')
-		 FROM clicks WHERE url_id = ? ORDER BY timestamp DESC, id DESC LIMIT ?`, urlID, limit)
+		        COALESCE(browser, ''), COALESCE(platform, ''), COALESCE(referrer, 'Direct'), COALESCE(traffic, '`+TrafficHuman+`'),
+		        COALESCE(region, ''), COALESCE(city, ''), COALESCE(network, ''), COALESCE(device, ''),
+		        COALESCE(os_version, ''), COALESCE(browser_version, ''), COALESCE(language, ''), COALESCE(channel, ''),
+		        COALESCE(utm_source, ''), COALESCE(utm_medium, ''), COALESCE(utm_campaign, '')
+		 FROM clicks WHERE url_id = ?`+trafficCond(humanOnly)+` ORDER BY timestamp DESC, id DESC LIMIT ?`, urlID, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -55,7 +288,116 @@ func (d *DB) RecentClicks(ctx context.Context, urlID int64, limit int) ([]*Click
 			ts NullTime
 		)
 		if err := rows.Scan(&c.ID, &c.URLID, &ts, &c.IPAddress, &c.Country,
-			&c.Browser, &c.Platform, &c.Referrer); err != nil {
+			&c.Browser, &c.Platform, &c.Referrer, &c.Traffic, &c.Region, &c.City, &c.Network,
+			&c.Device, &c.OSVersion, &c.BrowserVersion, &c.Language,
+			&c.Channel, &c.UTMSource, &c.UTMMedium, &c.UTMCampaign); err != nil {
+			return nil, err
+		}
+		c.Timestamp = ts.Time
+		out = append(out, &c)
+	}
+	return out, rows.Err()
+}
+
+// ClickFilter selects the clicks EachClick reads. UserID is required: only
+// clicks on that account's links are ever read, so a filter built from a
+// request cannot reach another account's data.
+type ClickFilter struct {
+	UserID int64
+	// URLID narrows the clicks to one link; 0 takes every link of the user,
+	// the trash included.
+	URLID int64
+	// From and To bound the timestamp to [From, To). A zero time leaves that
+	// end open.
+	From, To time.Time
+	// After is a pagination cursor: only clicks with a greater ID are read.
+	After int64
+	// Limit caps the rows read; 0 reads them all.
+	Limit int
+}
+
+// clickChunk is how many clicks EachClick reads per query.
+const clickChunk = 1000
+
+// EachClick calls fn for every click the filter selects, in ID order — the
+// order they were recorded in, which a cursor can resume. A busy link can
+// have millions, so they are read a chunk at a time, each query closed
+// before fn sees its rows: a slow reader of an export then holds no
+// connection, which on SQLite would be the only one.
+func (d *DB) EachClick(ctx context.Context, f ClickFilter, fn func(*Click) error) error {
+	remaining := f.Limit
+	for {
+		chunk := f
+		chunk.Limit = clickChunk
+		if remaining > 0 {
+			chunk.Limit = min(remaining, clickChunk)
+		}
+		clicks, err := d.clicksChunk(ctx, chunk)
+		if err != nil {
+			return err
+		}
+		for _, c := range clicks {
+			if err := fn(c); err != nil {
+				return err
+			}
+		}
+		if len(clicks) < chunk.Limit {
+			return nil
+		}
+		if remaining > 0 {
+			if remaining -= len(clicks); remaining == 0 {
+				return nil
+			}
+		}
+		f.After = clicks[len(clicks)-1].ID
+	}
+}
+
+// clicksChunk reads the clicks of one EachClick query.
+func (d *DB) clicksChunk(ctx context.Context, f ClickFilter) ([]*Click, error) {
+	q := `SELECT c.id, c.url_id, u.short_code, c.timestamp, COALESCE(c.ip_address, ''), COALESCE(c.country, ''),
+	             COALESCE(c.browser, ''), COALESCE(c.platform, ''), COALESCE(c.referrer, ''),
+	             COALESCE(c.traffic, '` + TrafficHuman + `'), COALESCE(c.region, ''), COALESCE(c.city, ''),
+	             COALESCE(c.network, ''), COALESCE(c.device, ''), COALESCE(c.os_version, ''),
+	             COALESCE(c.browser_version, ''), COALESCE(c.language, ''), COALESCE(c.channel, ''),
+	             COALESCE(c.utm_source, ''), COALESCE(c.utm_medium, ''), COALESCE(c.utm_campaign, '')
+	      FROM clicks c JOIN urls u ON u.id = c.url_id
+	      WHERE u.user_id = ?`
+	args := []any{f.UserID}
+	if f.URLID != 0 {
+		q += " AND c.url_id = ?"
+		args = append(args, f.URLID)
+	}
+	if !f.From.IsZero() {
+		q += " AND c.timestamp >= ?"
+		args = append(args, NewTime(d.dialect, f.From))
+	}
+	if !f.To.IsZero() {
+		q += " AND c.timestamp < ?"
+		args = append(args, NewTime(d.dialect, f.To))
+	}
+	if f.After > 0 {
+		q += " AND c.id > ?"
+		args = append(args, f.After)
+	}
+	q += " ORDER BY c.id LIMIT ?"
+	args = append(args, f.Limit)
+
+	rows, err := d.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*Click
+	for rows.Next() {
+		var (
+			c  Click
+			ts NullTime
+		)
+		if err := rows.Scan(&c.ID, &c.URLID, &c.ShortCode, &ts, &c.IPAddress, &c.Country,
+			&c.Browser, &c.Platform, &c.Referrer, &c.Traffic, &c.Region, &c.City, &c.Network,
+			&c.Device, &c.OSVersion, &c.BrowserVersion, &c.Language,
+			&c.Channel, &c.UTMSource, &c.UTMMedium, &c.UTMCampaign); err != nil {
 			return nil, err
 		}
 		c.Timestamp = ts.Time
@@ -64,44 +406,261 @@ func (d *DB) RecentClicks(ctx context.Context, urlID int64, limit int) ([]*Click
 	return out, rows.Err()
 }
 
-// Bucket is one label/count pair from an aggregation query.
+// AccountFilter selects the links account-wide stats count: the live links
+// of UserID, or only those tagged Tag when it is set.
+type AccountFilter struct {
+	UserID int64
+	Tag    string
+}
+
+// clickScope is the condition on url_id choosing the links a stats query
+// counts, with its arguments.
+type clickScope struct {
+	cond string
+	args []any
+}
+
+func linkScope(urlID int64) clickScope {
+	return clickScope{"url_id = ?", []any{urlID}}
+}
+
+// accountScope matches a tag as a whole JSON string within the tags column,
+// quoted as encodeRotateTargets quotes it, so "promo" does not match
+// "promotions".
+func (d *DB) accountScope(f AccountFilter) clickScope {
+	links := "SELECT id FROM urls WHERE user_id = ? AND deleted_at IS NULL"
+	args := []any{f.UserID}
+	if f.Tag != "" {
+		encoded, _ := encodeRotateTargets([]string{f.Tag}).(string)
+		quoted := strings.TrimSuffix(strings.TrimPrefix(encoded, "["), "]")
+		if d.dialect == Postgres {
+			links += " AND strpos(tags, ?) > 0"
+		} else {
+			links += " AND instr(tags, ?) > 0"
+		}
+		args = append(args, quoted)
+	}
+	return clickScope{"url_id IN (" + links + ")", args}
+}
+
+// LinkClicks is one link's clicks in a range.
+type LinkClicks struct {
+	URLID     int64
+	ShortCode string
+	Title     string
+	LongURL   string
+	Clicks    int64
+	Unique    int64
+}
+
+// AccountTopLinks returns the limit links f selects with the most clicks in
+// [from, to), of human traffic alone when humanOnly, busiest first. Links
+// without clicks in the range are left out.
+func (d *DB) AccountTopLinks(ctx context.Context, f AccountFilter, from, to time.Time, limit int, humanOnly bool) ([]LinkClicks, error) {
+	scope := d.accountScope(f)
+	lo, hi, err := d.rollupSpan(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	args := append([]any{}, scope.args...)
+	args = append(args, NewTime(d.dialect, lo), NewTime(d.dialect, hi))
+	args = append(args, scope.args...)
+	args = append(args, NewTime(d.dialect, from), NewTime(d.dialect, to), NewTime(d.dialect, lo), NewTime(d.dialect, hi), limit)
+	rows, err := d.Query(ctx, fmt.Sprintf(
+		`SELECT u.id, u.short_code, COALESCE(u.title, ''), u.long_url, t.n, t.uq FROM (
+		   SELECT url_id, SUM(n) AS n, SUM(uq) AS uq FROM (
+		     SELECT url_id, clicks AS n, unique_clicks AS uq FROM click_rollups
+		     WHERE %s AND hour >= ? AND hour < ?%s
+		     UNION ALL
+		     SELECT url_id, 1, CASE WHEN is_unique IS NOT FALSE THEN 1 ELSE 0 END FROM clicks
+		     WHERE %s AND timestamp >= ? AND timestamp < ? AND %s%s
+		   ) all_clicks GROUP BY url_id
+		 ) t JOIN urls u ON u.id = t.url_id
+		 ORDER BY t.n DESC, u.short_code LIMIT ?`,
+		scope.cond, trafficCond(humanOnly), scope.cond, unrolledCond, trafficCond(humanOnly)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []LinkClicks
+	for rows.Next() {
+		var l LinkClicks
+		if err := rows.Scan(&l.URLID, &l.ShortCode, &l.Title, &l.LongURL, &l.Clicks, &l.Unique); err != nil {
+			return nil, err
+		}
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
+
+// Bucket is one label/count pair from an aggregation query. Unique is filled
+// in by ClicksByTimeBucket only.
 type Bucket struct {
-	Label string
-	Count int64
+	Label  string
+	Count  int64
+	Unique int64
 }
 
-// ClicksByTimeBucket groups clicks into hourly or daily buckets since cutoff.
-// hourly selects the '%H:00' bucket used by the 24h range; otherwise days.
-func (d *DB) ClicksByTimeBucket(ctx context.Context, urlID int64, cutoff time.Time, hourly bool) ([]Bucket, error) {
-	var expr string
+// Granularity is the width of a time-series bucket.
+type Granularity string
+
+const (
+	ByHour  Granularity = "hour"
+	ByDay   Granularity = "day"
+	ByWeek  Granularity = "week"
+	ByMonth Granularity = "month"
+)
+
+// ClicksByTimeBucket counts a link's clicks in [from, to), all and unique, per
+// bucket, of human traffic alone when humanOnly, in the wall-clock time of
+// loc, so a day is the owner's day rather than UTC's. Clicks rolled up by
+// the hour, before the rollups counted quarter hours, fall in the bucket
+// their hour starts in. The labels are "2006-01-02 15:00" for
+// hours, "2006-01-02" for days, the date of the Monday for weeks (ISO weeks),
+// and "2006-01" for months.
+func (d *DB) ClicksByTimeBucket(ctx context.Context, urlID int64, from, to time.Time, g Granularity, loc *time.Location, humanOnly bool) ([]Bucket, error) {
+	return d.clicksByTimeBucket(ctx, linkScope(urlID), from, to, g, loc, humanOnly)
+}
+
+// AccountClicksByTimeBucket is ClicksByTimeBucket over every link f selects.
+// Unique clicks are unique per link: a visitor of two links counts twice.
+func (d *DB) AccountClicksByTimeBucket(ctx context.Context, f AccountFilter, from, to time.Time, g Granularity, loc *time.Location, humanOnly bool) ([]Bucket, error) {
+	return d.clicksByTimeBucket(ctx, d.accountScope(f), from, to, g, loc, humanOnly)
+}
+
+func (d *DB) clicksByTimeBucket(ctx context.Context, scope clickScope, from, to time.Time, g Granularity, loc *time.Location, humanOnly bool) ([]Bucket, error) {
+	var label string
 	switch {
-	case d.dialect == SQLite && hourly:
-		expr = "strftime('%H:00', timestamp)"
-	case d.dialect == SQLite:
-		expr = "strftime('%Y-%m-%d', timestamp)"
-	case hourly:
-		expr = "to_char(timestamp, 'HH24:00')"
+	case d.dialect == SQLite && g == ByHour:
+		label = "strftime('%Y-%m-%d %H:00', lt)"
+	case d.dialect == SQLite && g == ByDay:
+		label = "strftime('%Y-%m-%d', lt)"
+	case d.dialect == SQLite && g == ByWeek:
+		// %w counts from Sunday; step back to the Monday.
+		label = "date(lt, '-' || ((CAST(strftime('%w', lt) AS INTEGER) + 6) % 7) || ' days')"
+	case d.dialect == SQLite && g == ByMonth:
+		label = "strftime('%Y-%m', lt)"
+	case g == ByHour:
+		label = "to_char(lt, 'YYYY-MM-DD HH24:00')"
+	case g == ByDay:
+		label = "to_char(lt, 'YYYY-MM-DD')"
+	case g == ByWeek:
+		label = "to_char(date_trunc('week', lt), 'YYYY-MM-DD')"
+	case g == ByMonth:
+		label = "to_char(lt, 'YYYY-MM')"
 	default:
-		expr = "to_char(timestamp, 'YYYY-MM-DD')"
+		return nil, fmt.Errorf("store: cannot bucket clicks by %q", g)
 	}
 
+	// Rolled-up clicks and the clicks recorded since are counted alike, each
+	// rollup row standing at the start of its quarter hour; the part rows at
+	// either end come from the clicks themselves.
+	lo, hi, err := d.rollupSpan(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	local, args := d.localTime(from, to, loc)
+	args = append(args, scope.args...)
+	args = append(args, NewTime(d.dialect, lo), NewTime(d.dialect, hi))
+	args = append(args, scope.args...)
+	args = append(args, NewTime(d.dialect, from), NewTime(d.dialect, to), NewTime(d.dialect, lo), NewTime(d.dialect, hi))
 	rows, err := d.Query(ctx, fmt.Sprintf(
-		"SELECT %s, COUNT(id) FROM clicks WHERE url_id = ? AND timestamp >= ? GROUP BY %s ORDER BY %s",
-		expr, expr, expr), urlID, NewTime(d.dialect, cutoff))
+		`SELECT %s, SUM(n), SUM(u) FROM (
+		   SELECT %s AS lt, n, u FROM (
+		     SELECT hour AS timestamp, clicks AS n, unique_clicks AS u FROM click_rollups
+		     WHERE %s AND hour >= ? AND hour < ?%s
+		     UNION ALL
+		     SELECT timestamp, 1, CASE WHEN is_unique IS NOT FALSE THEN 1 ELSE 0 END FROM clicks
+		     WHERE %s AND timestamp >= ? AND timestamp < ? AND %s%s
+		   ) all_clicks
+		 ) local_clicks GROUP BY 1 ORDER BY 1`,
+		label, local, scope.cond, trafficCond(humanOnly), scope.cond, unrolledCond, trafficCond(humanOnly)), args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	return collectBuckets(rows, "")
+
+	var out []Bucket
+	for rows.Next() {
+		var b Bucket
+		if err := rows.Scan(&b.Label, &b.Count, &b.Unique); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
 }
 
-// ClicksGroupedBy aggregates clicks over one of the categorical columns.
-func (d *DB) ClicksGroupedBy(ctx context.Context, urlID int64, cutoff time.Time, column string) ([]Bucket, error) {
-	// Only the fixed set of analytics columns is ever grouped on; anything else
-	// is a programming error, not user input.
-	switch column {
-	case "country", "browser", "platform", "referrer":
-	default:
+// localTime returns the SQL converting the stored UTC timestamp to loc's wall
+// clock, and its arguments. Postgres knows the IANA zones. SQLite knows only
+// fixed offsets, so the offset of each stretch between the zone's transitions
+// in [from, to) — daylight saving starting or ending — is spelled out.
+func (d *DB) localTime(from, to time.Time, loc *time.Location) (string, []any) {
+	if d.dialect == Postgres {
+		return "(timestamp AT TIME ZONE 'UTC') AT TIME ZONE ?", []any{loc.String()}
+	}
+	var (
+		when strings.Builder
+		args []any
+	)
+	t := from.In(loc)
+	for {
+		_, offset := t.Zone()
+		_, end := t.ZoneBounds()
+		if end.IsZero() || !end.Before(to) {
+			if when.Len() == 0 {
+				return fmt.Sprintf("datetime(timestamp, '%+d seconds')", offset), nil
+			}
+			return fmt.Sprintf("datetime(timestamp, CASE%s ELSE '%+d seconds' END)", when.String(), offset), args
+		}
+		fmt.Fprintf(&when, " WHEN timestamp < ? THEN '%+d seconds'", offset)
+		args = append(args, NewTime(d.dialect, end))
+		t = end.In(loc)
+	}
+}
+
+// clickDimensions maps each breakdown ClicksGroupedBy offers to the SQL for
+// its value in the clicks table. A city is labelled with its region, as a
+// city name alone is ambiguous.
+var clickDimensions = map[string]string{
+	"country":  "country",
+	"browser":  "browser",
+	"platform": "platform",
+	"referrer": "referrer",
+	"region":   "region",
+	"city": `CASE WHEN COALESCE(city, '') = '' THEN ''
+	              WHEN COALESCE(region, '') = '' THEN city
+	              ELSE city || ', ' || region END`,
+	"network":         "network",
+	"device":          "device",
+	"os_version":      "os_version",
+	"browser_version": "browser_version",
+	"language":        "language",
+	"channel":         "channel",
+	"utm_source":      "utm_source",
+	"utm_medium":      "utm_medium",
+	"utm_campaign":    "utm_campaign",
+}
+
+// ClicksGroupedBy aggregates a link's clicks in [from, to) over one of the
+// breakdowns in clickDimensions, of human traffic alone when humanOnly.
+// Clicks in the part rows at either end of the range are counted from the
+// clicks table, so once purged they drop out rather than being guessed at.
+func (d *DB) ClicksGroupedBy(ctx context.Context, urlID int64, from, to time.Time, column string, humanOnly bool) ([]Bucket, error) {
+	return d.clicksGroupedBy(ctx, linkScope(urlID), from, to, column, humanOnly)
+}
+
+// AccountClicksGroupedBy is ClicksGroupedBy over every link f selects.
+func (d *DB) AccountClicksGroupedBy(ctx context.Context, f AccountFilter, from, to time.Time, column string, humanOnly bool) ([]Bucket, error) {
+	return d.clicksGroupedBy(ctx, d.accountScope(f), from, to, column, humanOnly)
+}
+
+func (d *DB) clicksGroupedBy(ctx context.Context, scope clickScope, from, to time.Time, column string, humanOnly bool) ([]Bucket, error) {
+	// Only the fixed set of breakdowns is ever grouped on; anything else is a
+	// programming error, not user input.
+	value, ok := clickDimensions[column]
+	if !ok {
 		return nil, fmt.Errorf("store: cannot group clicks by %q", column)
 	}
 
@@ -110,9 +669,23 @@ func (d *DB) ClicksGroupedBy(ctx context.Context, urlID int64, cutoff time.Time,
 		fallback = "Direct"
 	}
 
+	lo, hi, err := d.rollupSpan(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	args := append([]any{}, scope.args...)
+	args = append(args, column, NewTime(d.dialect, lo), NewTime(d.dialect, hi))
+	args = append(args, scope.args...)
+	args = append(args, NewTime(d.dialect, from), NewTime(d.dialect, to), NewTime(d.dialect, lo), NewTime(d.dialect, hi))
 	rows, err := d.Query(ctx, fmt.Sprintf(
-		"SELECT %s, COUNT(id) FROM clicks WHERE url_id = ? AND timestamp >= ? GROUP BY %s ORDER BY %s",
-		column, column, column), urlID, NewTime(d.dialect, cutoff))
+		`SELECT value, SUM(n) FROM (
+		   SELECT value, clicks AS n FROM click_dimension_rollups
+		   WHERE %s AND dimension = ? AND hour >= ? AND hour < ?%s
+		   UNION ALL
+		   SELECT COALESCE(%s, ''), 1 FROM clicks
+		   WHERE %s AND timestamp >= ? AND timestamp < ? AND %s%s
+		 ) all_clicks GROUP BY value ORDER BY value`,
+		scope.cond, trafficCond(humanOnly), value, scope.cond, unrolledCond, trafficCond(humanOnly)), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LinkHealth mirrors a `link_health` row: the latest probe of one destination
+// of one link.
+type LinkHealth struct {
+	URLID               int64
+	Target              string
+	StatusCode          int
+	LatencyMS           int64
+	Error               string
+	CheckedAt           time.Time
+	ConsecutiveFailures int
+}
+
+// Healthy reports whether the latest probe succeeded.
+func (h *LinkHealth) Healthy() bool { return h.ConsecutiveFailures == 0 }
+
+func targetHash(target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return hex.EncodeToString(sum[:])
+}
+
+// RecordLinkHealth stores the outcome of a probe, replacing the previous one for
+// the same destination, and returns how many checks in a row have now failed.
+// The failure run lives in the database rather than in the monitor so that a
+// restart does not reset every link's count towards auto-pause.
+func (d *DB) RecordLinkHealth(ctx context.Context, h *LinkHealth, healthy bool) (int, error) {
+	if h.CheckedAt.IsZero() {
+		h.CheckedAt = now()
+	}
+	hash := targetHash(h.Target)
+
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Both dialects accept ON CONFLICT ... DO UPDATE (SQLite since 3.24), and the
+	// failure count is derived from the stored row inside the same statement,
+	// so two overlapping checks cannot both read the old count.
+	const upsert = `INSERT INTO link_health
+		(url_id, target, target_hash, status_code, latency_ms, error, checked_at, consecutive_failures)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (url_id, target_hash) DO UPDATE SET
+			status_code = excluded.status_code,
+			latency_ms = excluded.latency_ms,
+			error = excluded.error,
+			checked_at = excluded.checked_at,
+			consecutive_failures = CASE WHEN excluded.consecutive_failures = 0 THEN 0
+				ELSE COALESCE(link_health.consecutive_failures, 0) + 1 END`
+	initial := 0
+	if !healthy {
+		initial = 1
+	}
+	if _, err := tx.ExecContext(ctx, d.rebind(upsert),
+		h.URLID, h.Target, hash, h.StatusCode, h.LatencyMS, nullString(truncateString(h.Error, 255)),
+		NewTime(d.dialect, h.CheckedAt), initial); err != nil {
+		return 0, fmt.Errorf("record link health: %w", err)
+	}
+
+	var failures int
+	if err := tx.QueryRowContext(ctx, d.rebind(
+		"SELECT COALESCE(consecutive_failures, 0) FROM link_health WHERE url_id = ? AND target_hash = ?"),
+		h.URLID, hash).Scan(&failures); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	h.ConsecutiveFailures = failures
+	return failures, nil
+}
+
+// PruneLinkHealth deletes the health rows of a link whose target is no longer
+// one of keep, so an edited-away destination stops counting against the link.
+func (d *DB) PruneLinkHealth(ctx context.Context, urlID int64, keep []string) error {
+	if len(keep) == 0 {
+		_, err := d.Exec(ctx, "DELETE FROM link_health WHERE url_id = ?", urlID)
+		return err
+	}
+	args := make([]any, 0, len(keep)+1)
+	args = append(args, urlID)
+	for _, t := range keep {
+		args = append(args, targetHash(t))
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(keep)), ",")
+	_, err := d.Exec(ctx, fmt.Sprintf(
+		"DELETE FROM link_health WHERE url_id = ? AND target_hash NOT IN (%s)", placeholders), args...)
+	return err
+}
+
+// SetUnhealthyTargets records which rotation targets the last check found
+// failing; the redirect path reads it back with the link.
+func (d *DB) SetUnhealthyTargets(ctx context.Context, urlID int64, targets []string) error {
+	if _, err := d.Exec(ctx, "UPDATE urls SET unhealthy_targets = ? WHERE id = ?",
+		encodeRotateTargets(targets), urlID); err != nil {
+		return err
+	}
+	d.urlChangedByID(ctx, urlID)
+	return nil
+}
+
+// LinkHealthFor returns the health rows of the given links, keyed by link id.
+// Links never checked are simply absent from the map.
+func (d *DB) LinkHealthFor(ctx context.Context, urlIDs []int64) (map[int64][]*LinkHealth, error) {
+	out := make(map[int64][]*LinkHealth, len(urlIDs))
+	for start := 0; start < len(urlIDs); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(urlIDs) {
+			end = len(urlIDs)
+		}
+		chunk := urlIDs[start:end]
+
+		args := make([]any, 0, len(chunk))
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+		rows, err := d.Query(ctx, fmt.Sprintf(
+			`SELECT url_id, target, COALESCE(status_code, 0), COALESCE(latency_ms, 0),
+			        COALESCE(error, ''), checked_at, COALESCE(consecutive_failures, 0)
+			 FROM link_health WHERE url_id IN (%s) ORDER BY url_id, id`, placeholders), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var (
+				h         LinkHealth
+				checkedAt NullTime
+			)
+			if err := rows.Scan(&h.URLID, &h.Target, &h.StatusCode, &h.LatencyMS,
+				&h.Error, &checkedAt, &h.ConsecutiveFailures); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			h.CheckedAt = checkedAt.Time
+			out[h.URLID] = append(out[h.URLID], &h)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// truncateString cuts s to at most n runes, keeping it valid UTF-8 for
+// Postgres' VARCHAR checks.
+func truncateString(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
@@ -168,7 +168,7 @@ func TestNewRowsMatchLegacyTimestampFormat(t *testing.T) {
 	db := openLegacyFixture(t)
 
 	link := &URL{ShortCode: "GONEW1", LongURL: "https://new.example.com/", IsEnabled: true}
-	if err := db.CreateURL(ctx, link); err != nil {
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
 		t.Fatalf("CreateURL: %v", err)
 	}
 
@@ -212,7 +212,7 @@ func TestLegacyClickAnalytics(t *testing.T) {
 		t.Fatalf("URLByShortCode: %v", err)
 	}
 
-	recent, err := db.RecentClicks(ctx, link.ID, 10)
+	recent, err := db.RecentClicks(ctx, link.ID, 10, false)
 	if err != nil {
 		t.Fatalf("RecentClicks: %v", err)
 	}
@@ -227,7 +227,8 @@ func TestLegacyClickAnalytics(t *testing.T) {
 	}
 
 	cutoff := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
-	countries, err := db.ClicksGroupedBy(ctx, link.ID, cutoff, "country")
+	end := cutoff.AddDate(0, 1, 0)
+	countries, err := db.ClicksGroupedBy(ctx, link.ID, cutoff, end, "country", false)
 	if err != nil {
 		t.Fatalf("ClicksGroupedBy: %v", err)
 	}
@@ -239,7 +240,7 @@ func TestLegacyClickAnalytics(t *testing.T) {
 		t.Errorf("country buckets total %d, want 5", total)
 	}
 
-	daily, err := db.ClicksByTimeBucket(ctx, link.ID, cutoff, false)
+	daily, err := db.ClicksByTimeBucket(ctx, link.ID, cutoff, end, ByDay, time.UTC, false)
 	if err != nil {
 		t.Fatalf("ClicksByTimeBucket: %v", err)
 	}
@@ -260,7 +261,7 @@ func TestRecordClickUpdatesCounterAndLog(t *testing.T) {
 	if err := db.RecordClick(ctx, &Click{
 		URLID: link.ID, IPAddress: "198.51.xxx.xxx", Country: "France",
 		Browser: "Safari", Platform: "iOS", Referrer: "Direct",
-	}); err != nil {
+	}, 0); err != nil {
 		t.Fatalf("RecordClick: %v", err)
 	}
 
@@ -272,7 +273,7 @@ func TestRecordClickUpdatesCounterAndLog(t *testing.T) {
 		t.Errorf("ClicksCount = %d after one click, want 43", after.ClicksCount)
 	}
 
-	recent, err := db.RecentClicks(ctx, link.ID, 1)
+	recent, err := db.RecentClicks(ctx, link.ID, 1, false)
 	if err != nil {
 		t.Fatalf("RecentClicks: %v", err)
 	}
@@ -36,6 +36,23 @@ var schema = []table{
 			{"totp_secret", "TEXT", "TEXT"},
 			{"totp_enabled", "BOOLEAN", "BOOLEAN"},
 			{"created_at", "DATETIME", "TIMESTAMP"},
+			// email_verified_at is when the owner proved they receive mail at
+			// email. NULL, including every account that predates it, is
+			// unverified.
+			{"email_verified_at", "DATETIME", "TIMESTAMP"},
+			// timezone is the IANA zone the owner's analytics are bucketed
+			// in. NULL or empty is UTC.
+			{"timezone", "VARCHAR(64)", "VARCHAR(64)"},
+			// excluded_networks are the owner's own addresses and CIDR
+			// blocks, space-separated, whose clicks on their links count as
+			// internal traffic.
+			{"excluded_networks", "TEXT", "TEXT"},
+			// is_admin grants the admin pages on top of ADMIN_USERS, set
+			// with `redrx user make-admin`.
+			{"is_admin", "BOOLEAN", "BOOLEAN"},
+			// disabled_at is when an operator disabled the account; it
+			// cannot sign in or use its API key until enabled again.
+			{"disabled_at", "DATETIME", "TIMESTAMP"},
 		},
 	},
 	{
@@ -61,6 +78,24 @@ var schema = []table{
 			{"start_at", "DATETIME", "TIMESTAMP"},
 			{"end_at", "DATETIME", "TIMESTAMP"},
 			{"last_accessed_at", "DATETIME", "TIMESTAMP"},
+			// Destination health: auto_pause_after is the number of consecutive
+			// failed checks that pauses the link once every primary target —
+			// the rotation targets when there are any, long_url otherwise — has
+			// failed that many (NULL or 0 never does), and unhealthy_targets
+			// is a JSON array of the rotation targets the last check found
+			// failing, kept on the row so the redirect path needs no extra
+			// query to skip them.
+			{"auto_pause_after", "INTEGER", "INTEGER"},
+			{"skip_unhealthy_targets", "BOOLEAN", "BOOLEAN"},
+			{"unhealthy_targets", "TEXT", "TEXT"},
+			// deleted_at marks a link as in the trash: it no longer resolves
+			// and is hidden from the dashboard, but keeps its code and clicks
+			// until the retention purge removes it. NULL is a live link.
+			{"deleted_at", "DATETIME", "TIMESTAMP"},
+			// title and tags come with links imported from other shorteners;
+			// tags is a JSON array, encoded like rotate_targets.
+			{"title", "VARCHAR(255)", "VARCHAR(255)"},
+			{"tags", "TEXT", "TEXT"},
 		},
 		extra: []string{"FOREIGN KEY(user_id) REFERENCES users (id)"},
 	},
@@ -85,9 +120,191 @@ var schema = []table{
 			{"browser", "VARCHAR(50)", "VARCHAR(50)"},
 			{"platform", "VARCHAR(50)", "VARCHAR(50)"},
 			{"referrer", "VARCHAR(255)", "VARCHAR(255)"},
+			// visitor_hash tells one visitor's clicks apart within a day
+			// without storing who they are: a keyed hash of the anonymised
+			// address and user agent, under a salt that is discarded after
+			// the day. It is cleared once the dedupe window has passed;
+			// is_unique records what it was for. NULL is_unique, on clicks
+			// from before visitors were counted, counts as unique.
+			{"visitor_hash", "VARCHAR(64)", "VARCHAR(64)"},
+			{"is_unique", "BOOLEAN", "BOOLEAN"},
+			// traffic classifies the click as human, bot or internal (the
+			// operator's or the owner's own). NULL, on clicks from before
+			// the classification, counts as human.
+			{"traffic", "VARCHAR(16)", "VARCHAR(16)"},
+			// region, city and network are resolved only when the operator
+			// provides the City and ASN databases; network is the autonomous
+			// system, as "AS64496 Example Networks".
+			{"region", "VARCHAR(100)", "VARCHAR(100)"},
+			{"city", "VARCHAR(100)", "VARCHAR(100)"},
+			{"network", "VARCHAR(255)", "VARCHAR(255)"},
+			// device is the class of the visitor's device: mobile, tablet,
+			// desktop or bot. os_version and browser_version carry their
+			// name, as "Android 14" and "Chrome 126", and language is the
+			// visitor's preferred Accept-Language tag.
+			{"device", "VARCHAR(16)", "VARCHAR(16)"},
+			{"os_version", "VARCHAR(50)", "VARCHAR(50)"},
+			{"browser_version", "VARCHAR(50)", "VARCHAR(50)"},
+			{"language", "VARCHAR(35)", "VARCHAR(35)"},
+			// channel is the kind of traffic that brought the click (see
+			// package channel); the utm_ columns are the campaign parameters
+			// the short URL was visited with.
+			{"channel", "VARCHAR(16)", "VARCHAR(16)"},
+			{"utm_source", "VARCHAR(100)", "VARCHAR(100)"},
+			{"utm_medium", "VARCHAR(100)", "VARCHAR(100)"},
+			{"utm_campaign", "VARCHAR(100)", "VARCHAR(100)"},
 		},
 		extra: []string{"FOREIGN KEY(url_id) REFERENCES urls (id)"},
 	},
+	{
+		// url_revisions is the change history of every link. There is no
+		// foreign key on url_id: a deletion is recorded here, and its revision
+		// has to outlive the row it describes. snapshot is the link's editable
+		// state after the change, as JSON, which is what a revert restores.
+		name: "url_revisions",
+		columns: []column{
+			{"id", "INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT", "SERIAL PRIMARY KEY"},
+			{"url_id", "INTEGER NOT NULL", "INTEGER NOT NULL"},
+			{"short_code", "VARCHAR(20) NOT NULL", "VARCHAR(20) NOT NULL"},
+			{"action", "VARCHAR(20) NOT NULL", "VARCHAR(20) NOT NULL"},
+			{"actor_user_id", "INTEGER", "INTEGER"},
+			{"actor", "VARCHAR(80)", "VARCHAR(80)"},
+			{"source", "VARCHAR(20)", "VARCHAR(20)"},
+			{"changes", "TEXT", "TEXT"},
+			{"snapshot", "TEXT", "TEXT"},
+			{"created_at", "DATETIME", "TIMESTAMP"},
+		},
+	},
+	{
+		// link_health holds the latest probe of each destination of a link: one
+		// row per (url_id, target), overwritten on every check. Rows are keyed
+		// on a SHA-256 of the target rather than the target itself, because
+		// destinations are unbounded TEXT and Postgres refuses to index a value
+		// past roughly 2.7kB.
+		name: "link_health",
+		columns: []column{
+			{"id", "INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT", "SERIAL PRIMARY KEY"},
+			{"url_id", "INTEGER NOT NULL", "INTEGER NOT NULL"},
+			{"target", "TEXT NOT NULL", "TEXT NOT NULL"},
+			{"target_hash", "VARCHAR(64) NOT NULL", "VARCHAR(64) NOT NULL"},
+			{"status_code", "INTEGER", "INTEGER"},
+			{"latency_ms", "INTEGER", "INTEGER"},
+			{"error", "VARCHAR(255)", "VARCHAR(255)"},
+			{"checked_at", "DATETIME", "TIMESTAMP"},
+			{"consecutive_failures", "INTEGER", "INTEGER"},
+		},
+		extra: []string{"FOREIGN KEY(url_id) REFERENCES urls (id)"},
+	},
+	{
+		// security_events is each account's audit trail: sign-ins, failed
+		// attempts and changes to its credentials. The address is stored
+		// anonymised, as click addresses are.
+		name: "security_events",
+		columns: []column{
+			{"id", "INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT", "SERIAL PRIMARY KEY"},
+			{"user_id", "INTEGER NOT NULL", "INTEGER NOT NULL"},
+			{"event", "VARCHAR(40) NOT NULL", "VARCHAR(40) NOT NULL"},
+			{"ip_address", "VARCHAR(45)", "VARCHAR(45)"},
+			{"country", "VARCHAR(100)", "VARCHAR(100)"},
+			{"user_agent", "VARCHAR(255)", "VARCHAR(255)"},
+			{"new_country", "BOOLEAN", "BOOLEAN"},
+			{"created_at", "DATETIME", "TIMESTAMP"},
+			{"detail", "VARCHAR(255)", "VARCHAR(255)"},
+		},
+		extra: []string{"FOREIGN KEY(user_id) REFERENCES users (id)"},
+	},
+	{
+		// webauthn_credentials holds each account's security keys and passkeys.
+		// credential is the library's credential record as JSON, opaque to the
+		// store; sign_count is copied out of it so the counter can be checked
+		// and shown without decoding. passwordless marks a key its owner allowed
+		// to sign in without a password.
+		name: "webauthn_credentials",
+		columns: []column{
+			{"id", "INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT", "SERIAL PRIMARY KEY"},
+			{"user_id", "INTEGER NOT NULL", "INTEGER NOT NULL"},
+			{"credential_id", "VARCHAR(1400) NOT NULL", "VARCHAR(1400) NOT NULL"},
+			{"name", "VARCHAR(64) NOT NULL", "VARCHAR(64) NOT NULL"},
+			{"credential", "TEXT NOT NULL", "TEXT NOT NULL"},
+			{"sign_count", "BIGINT", "BIGINT"},
+			{"passwordless", "BOOLEAN", "BOOLEAN"},
+			{"created_at", "DATETIME", "TIMESTAMP"},
+			{"last_used_at", "DATETIME", "TIMESTAMP"},
+		},
+		extra: []string{"FOREIGN KEY(user_id) REFERENCES users (id)"},
+	},
+	{
+		// visitor_salts keys the visitor hashes of one UTC day. A salt is
+		// random and deleted once its day is over, after which no hash made
+		// under it can be recomputed from an address, even by the operator.
+		name: "visitor_salts",
+		columns: []column{
+			{"day", "VARCHAR(10) NOT NULL PRIMARY KEY", "VARCHAR(10) PRIMARY KEY"},
+			{"salt", "VARCHAR(64) NOT NULL", "VARCHAR(64) NOT NULL"},
+		},
+	},
+	{
+		// click_rollups counts each link's clicks per UTC quarter hour (per
+		// hour before rollup_state's quarter_hours_from) and traffic class,
+		// all and unique, so the time series reads a row a quarter hour
+		// rather than a row a click, and outlives the raw clicks' retention.
+		// hour is the start of the row's stretch.
+		name: "click_rollups",
+		columns: []column{
+			{"url_id", "INTEGER NOT NULL", "INTEGER NOT NULL"},
+			{"hour", "DATETIME NOT NULL", "TIMESTAMP NOT NULL"},
+			{"traffic", "VARCHAR(16) NOT NULL", "VARCHAR(16) NOT NULL"},
+			{"clicks", "INTEGER NOT NULL", "INTEGER NOT NULL"},
+			{"unique_clicks", "INTEGER NOT NULL", "INTEGER NOT NULL"},
+		},
+		extra: []string{"PRIMARY KEY (url_id, hour, traffic)"},
+	},
+	{
+		// click_dimension_rollups counts the same clicks by the value of each
+		// breakdown the stats page charts: dimension is the breakdown
+		// (country, browser, platform, referrer, region, city, network,
+		// device, os_version, browser_version, language, channel,
+		// utm_source, utm_medium or utm_campaign), value what the click held,
+		// '' for nothing.
+		name: "click_dimension_rollups",
+		columns: []column{
+			{"url_id", "INTEGER NOT NULL", "INTEGER NOT NULL"},
+			{"hour", "DATETIME NOT NULL", "TIMESTAMP NOT NULL"},
+			{"traffic", "VARCHAR(16) NOT NULL", "VARCHAR(16) NOT NULL"},
+			{"dimension", "VARCHAR(16) NOT NULL", "VARCHAR(16) NOT NULL"},
+			{"value", "VARCHAR(255) NOT NULL", "VARCHAR(255) NOT NULL"},
+			{"clicks", "INTEGER NOT NULL", "INTEGER NOT NULL"},
+		},
+		extra: []string{"PRIMARY KEY (url_id, hour, traffic, dimension, value)"},
+	},
+	{
+		// rollup_state holds the ID of the last click folded into the
+		// rollups. Clicks after it are counted from the clicks table.
+		// quarter_hours_from is where the rollups went from an hour a row to
+		// a quarter hour, set on first use after the change.
+		name: "rollup_state",
+		columns: []column{
+			{"name", "VARCHAR(32) NOT NULL PRIMARY KEY", "VARCHAR(32) PRIMARY KEY"},
+			{"last_id", "BIGINT NOT NULL", "BIGINT NOT NULL"},
+			{"quarter_hours_from", "DATETIME", "TIMESTAMP"},
+		},
+	},
+	{
+		// user_sessions registers every signed-in browser, so a session can be
+		// listed and revoked before its cookie expires. id is the random
+		// session id carried in the signed cookie.
+		name: "user_sessions",
+		columns: []column{
+			{"id", "VARCHAR(64) NOT NULL PRIMARY KEY", "VARCHAR(64) PRIMARY KEY"},
+			{"user_id", "INTEGER NOT NULL", "INTEGER NOT NULL"},
+			{"user_agent", "VARCHAR(255)", "VARCHAR(255)"},
+			{"ip_address", "VARCHAR(45)", "VARCHAR(45)"},
+			{"country", "VARCHAR(100)", "VARCHAR(100)"},
+			{"created_at", "DATETIME", "TIMESTAMP"},
+			{"last_seen_at", "DATETIME", "TIMESTAMP"},
+		},
+		extra: []string{"FOREIGN KEY(user_id) REFERENCES users (id)"},
+	},
 }
 
 // indexes reproduces the indexes the SQLAlchemy models declared. Names match so
@@ -98,9 +315,17 @@ var indexes = []struct{ name, ddl string }{
 	{"ix_users_api_key", "CREATE UNIQUE INDEX IF NOT EXISTS ix_users_api_key ON users (api_key)"},
 	{"ix_urls_short_code", "CREATE UNIQUE INDEX IF NOT EXISTS ix_urls_short_code ON urls (short_code)"},
 	{"idx_url_user_created", "CREATE INDEX IF NOT EXISTS idx_url_user_created ON urls (user_id, created_at)"},
+	{"idx_url_deleted", "CREATE INDEX IF NOT EXISTS idx_url_deleted ON urls (deleted_at)"},
 	{"idx_url_code_enabled", "CREATE INDEX IF NOT EXISTS idx_url_code_enabled ON urls (short_code, is_enabled)"},
 	{"idx_click_url_timestamp", "CREATE INDEX IF NOT EXISTS idx_click_url_timestamp ON clicks (url_id, timestamp)"},
+	{"idx_click_visitor", "CREATE INDEX IF NOT EXISTS idx_click_visitor ON clicks (visitor_hash)"},
 	{"idx_recovery_user_hash", "CREATE UNIQUE INDEX IF NOT EXISTS idx_recovery_user_hash ON recovery_codes (user_id, code_hash)"},
+	{"idx_revision_url", "CREATE INDEX IF NOT EXISTS idx_revision_url ON url_revisions (url_id, id)"},
+	{"idx_security_event_user", "CREATE INDEX IF NOT EXISTS idx_security_event_user ON security_events (user_id, id)"},
+	{"idx_webauthn_credential_id", "CREATE UNIQUE INDEX IF NOT EXISTS idx_webauthn_credential_id ON webauthn_credentials (credential_id)"},
+	{"idx_webauthn_user", "CREATE INDEX IF NOT EXISTS idx_webauthn_user ON webauthn_credentials (user_id)"},
+	{"idx_user_sessions_user", "CREATE INDEX IF NOT EXISTS idx_user_sessions_user ON user_sessions (user_id)"},
+	{"idx_link_health_url_target", "CREATE UNIQUE INDEX IF NOT EXISTS idx_link_health_url_target ON link_health (url_id, target_hash)"},
 }
 
 // Migrate creates any missing tables, columns and indexes. It is additive only:
@@ -15,6 +15,44 @@ type User struct {
 	TOTPSecret   string
 	TOTPEnabled  bool
 	CreatedAt    time.Time
+	// EmailVerifiedAt is nil until the owner follows a verification link.
+	EmailVerifiedAt *time.Time
+	// Timezone is the IANA zone analytics are shown in; empty is UTC.
+	Timezone string
+	// ExcludedNetworks are the addresses and CIDR blocks whose clicks on the
+	// user's links count as internal traffic.
+	ExcludedNetworks []string
+	// IsAdmin grants the admin pages whatever ADMIN_USERS says.
+	IsAdmin bool
+	// DisabledAt is set while an operator has the account disabled.
+	DisabledAt *time.Time
+}
+
+// WebAuthnCredential mirrors a `webauthn_credentials` row. CredentialID is the
+// authenticator's credential id, base64url-encoded; Data is the full
+// credential record as JSON, which only the web layer decodes.
+type WebAuthnCredential struct {
+	ID           int64
+	UserID       int64
+	CredentialID string
+	Name         string
+	Data         string
+	SignCount    uint32
+	Passwordless bool
+	CreatedAt    time.Time
+	LastUsedAt   *time.Time
+}
+
+// UserSession mirrors a `user_sessions` row: one signed-in browser. IPAddress
+// is stored anonymised, like the audit log's.
+type UserSession struct {
+	ID         string
+	UserID     int64
+	UserAgent  string
+	IPAddress  string
+	Country    string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
 }
 
 // URL mirrors the `urls` table. RotateTargets is stored as a JSON array in the
@@ -43,6 +81,19 @@ type URL struct {
 	StartAt        *time.Time
 	EndAt          *time.Time
 	LastAccessedAt *time.Time
+	// AutoPauseAfter pauses the link once every one of its PrimaryTargets —
+	// the rotation targets when there are any, LongURL otherwise — has failed
+	// this many health checks in a row. Zero disables auto-pause.
+	AutoPauseAfter int
+	// SkipUnhealthyTargets drops the rotation targets listed in
+	// UnhealthyTargets from the rotation until a later check clears them.
+	SkipUnhealthyTargets bool
+	UnhealthyTargets     []string
+	// DeletedAt is set while the link is in the trash.
+	DeletedAt *time.Time
+	// Title and Tags describe the link; so far only imports set them.
+	Title string
+	Tags  []string
 }
 
 // IsActive reports whether the link should currently redirect, applying the
@@ -83,6 +134,62 @@ func (u *URL) Status() string {
 	return "active"
 }
 
+// Destinations lists every distinct URL the link can send a visitor to: the
+// main URL, the rotation targets and the device-specific targets.
+func (u *URL) Destinations() []string {
+	all := make([]string, 0, len(u.RotateTargets)+3)
+	seen := make(map[string]struct{}, cap(all))
+	add := func(t string) {
+		if _, dup := seen[t]; t == "" || dup {
+			return
+		}
+		seen[t] = struct{}{}
+		all = append(all, t)
+	}
+	add(u.LongURL)
+	for _, t := range u.RotateTargets {
+		add(t)
+	}
+	add(u.IOSTargetURL)
+	add(u.AndroidTargetURL)
+	return all
+}
+
+// PrimaryTargets lists the destinations that serve ordinary traffic: the
+// rotation when there is one — the main URL is then only a fallback — and the
+// main URL otherwise. The link as a whole is down when all of these are.
+func (u *URL) PrimaryTargets() []string {
+	if len(u.RotateTargets) > 0 {
+		return u.RotateTargets
+	}
+	return []string{u.LongURL}
+}
+
+// HealthyRotateTargets returns the rotation targets to serve from. When the
+// owner opted in to skipping unhealthy targets, the ones the last health check
+// found failing are left out — unless that would leave none. A check can fail
+// transiently for every target at once (our own network, say), and emptying the
+// rotation would quietly send all traffic somewhere the owner did not choose.
+func (u *URL) HealthyRotateTargets() []string {
+	if !u.SkipUnhealthyTargets || len(u.UnhealthyTargets) == 0 {
+		return u.RotateTargets
+	}
+	unhealthy := make(map[string]struct{}, len(u.UnhealthyTargets))
+	for _, t := range u.UnhealthyTargets {
+		unhealthy[t] = struct{}{}
+	}
+	healthy := make([]string, 0, len(u.RotateTargets))
+	for _, t := range u.RotateTargets {
+		if _, bad := unhealthy[t]; !bad {
+			healthy = append(healthy, t)
+		}
+	}
+	if len(healthy) == 0 {
+		return u.RotateTargets
+	}
+	return healthy
+}
+
 // IsPasswordProtected reports whether the link requires a password.
 func (u *URL) IsPasswordProtected() bool { return u.PasswordHash != "" }
 
@@ -96,8 +203,55 @@ type Click struct {
 	Browser   string
 	Platform  string
 	Referrer  string
+	// Region, City and Network are empty unless the operator resolves them;
+	// Network is the autonomous system, as "AS64496 Example Networks".
+	Region  string
+	City    string
+	Network string
+	// Device is DeviceMobile, DeviceTablet, DeviceDesktop, DeviceBot or empty
+	// when unknown. OSVersion and BrowserVersion carry their name, as
+	// "Android 14" and "Chrome 126"; Language is the preferred
+	// Accept-Language tag, as "de-AT".
+	Device         string
+	OSVersion      string
+	BrowserVersion string
+	Language       string
+	// Channel is the kind of traffic that brought the click: direct,
+	// search, social, email, messaging, internal or referral. The UTM fields
+	// are the campaign parameters the short URL was visited with.
+	Channel     string
+	UTMSource   string
+	UTMMedium   string
+	UTMCampaign string
+	// ShortCode is the code of the clicked link, filled in by EachClick only.
+	ShortCode string
+	// VisitorHash identifies the visitor for the day without saying who they
+	// are; empty when unknown. It is only ever written, never read back.
+	VisitorHash string
+	// Unique is whether this was the visitor's first click on the link in the
+	// dedupe window. RecordClick and RecordClicks set it.
+	Unique bool
+	// Traffic is TrafficHuman, TrafficBot or TrafficInternal; empty is
+	// stored as human.
+	Traffic string
 }
 
+// Device classes of a click.
+const (
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceDesktop = "desktop"
+	DeviceBot     = "bot"
+)
+
+// Traffic classes of a click. The stats show human traffic unless asked for
+// all of it.
+const (
+	TrafficHuman    = "human"
+	TrafficBot      = "bot"
+	TrafficInternal = "internal"
+)
+
 // encodeRotateTargets renders the JSON stored in `urls.rotate_targets`. An
 // empty list becomes SQL NULL, matching the Python property setter.
 func encodeRotateTargets(targets []string) any {
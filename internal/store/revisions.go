@@ -0,0 +1,323 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where a change came from, recorded with each revision.
+const (
+	SourceWeb    = "web"
+	SourceAPI    = "api"
+	SourceSystem = "system"
+)
+
+// Actor identifies who made a change to a link.
+type Actor struct {
+	UserID *int64
+	Name   string
+	Source string
+}
+
+// UserActor attributes a change to an account, or to an anonymous visitor
+// when u is nil.
+func UserActor(u *User, source string) Actor {
+	if u == nil {
+		return Actor{Name: "anonymous", Source: source}
+	}
+	id := u.ID
+	return Actor{UserID: &id, Name: u.Username, Source: source}
+}
+
+// SystemActor attributes a change to a background job.
+func SystemActor(job string) Actor {
+	return Actor{Name: job, Source: SourceSystem}
+}
+
+// Revision actions.
+const (
+	ActionCreate  = "create"
+	ActionEdit    = "edit"
+	ActionEnable  = "enable"
+	ActionDisable = "disable"
+	ActionPublish = "publish"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+	ActionRevert  = "revert"
+	// ActionTransfer records a link moving to another account, when its
+	// owner deleted theirs or an operator moved it.
+	ActionTransfer = "transfer"
+)
+
+// deletedActor replaces the name on revisions made by an account that has
+// since been deleted.
+const deletedActor = "deleted account"
+
+// FieldChange is one field's before and after value, rendered for display.
+// From is empty for a create.
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// Revision mirrors a `url_revisions` row: one change to one link. Revisions
+// outlive the link they describe, so a deletion stays on record.
+type Revision struct {
+	ID          int64
+	URLID       int64
+	ShortCode   string
+	Action      string
+	ActorUserID *int64
+	Actor       string
+	Source      string
+	Changes     []FieldChange
+	CreatedAt   time.Time
+	// Revertible reports whether the revision carries a state to go back to.
+	// Deletions do not: there is no link left to revert.
+	Revertible bool
+}
+
+// linkState is the part of a link a revision snapshots: everything an owner
+// can change after creation. The password hash is left out on purpose — the
+// history is shown in the UI, and a hash does not belong there.
+type linkState struct {
+	LongURL              string     `json:"long_url"`
+	RotateTargets        []string   `json:"rotate_targets,omitempty"`
+	IOSTargetURL         string     `json:"ios_target_url,omitempty"`
+	AndroidTargetURL     string     `json:"android_target_url,omitempty"`
+	PreviewMode          bool       `json:"preview_mode"`
+	StatsEnabled         bool       `json:"stats_enabled"`
+	IsEnabled            bool       `json:"is_enabled"`
+	IsDraft              bool       `json:"is_draft"`
+	ExpiresAt            *time.Time `json:"expires_at,omitempty"`
+	StartAt              *time.Time `json:"start_at,omitempty"`
+	EndAt                *time.Time `json:"end_at,omitempty"`
+	AutoPauseAfter       int        `json:"auto_pause_after,omitempty"`
+	SkipUnhealthyTargets bool       `json:"skip_unhealthy_targets,omitempty"`
+}
+
+func stateOf(u *URL) *linkState {
+	return &linkState{
+		LongURL:              u.LongURL,
+		RotateTargets:        u.RotateTargets,
+		IOSTargetURL:         u.IOSTargetURL,
+		AndroidTargetURL:     u.AndroidTargetURL,
+		PreviewMode:          u.PreviewMode,
+		StatsEnabled:         u.StatsEnabled,
+		IsEnabled:            u.IsEnabled,
+		IsDraft:              u.IsDraft,
+		ExpiresAt:            u.ExpiresAt,
+		StartAt:              u.StartAt,
+		EndAt:                u.EndAt,
+		AutoPauseAfter:       u.AutoPauseAfter,
+		SkipUnhealthyTargets: u.SkipUnhealthyTargets,
+	}
+}
+
+// applyTo copies the snapshot onto a link for a revert. is_enabled is left as
+// it is: pausing is its own control, and reverting a destination should not
+// silently bring a link the owner paused back online.
+func (s *linkState) applyTo(u *URL) {
+	u.LongURL = s.LongURL
+	u.RotateTargets = s.RotateTargets
+	u.IOSTargetURL = s.IOSTargetURL
+	u.AndroidTargetURL = s.AndroidTargetURL
+	u.PreviewMode = s.PreviewMode
+	u.StatsEnabled = s.StatsEnabled
+	u.IsDraft = s.IsDraft
+	u.ExpiresAt = s.ExpiresAt
+	u.StartAt = s.StartAt
+	u.EndAt = s.EndAt
+	u.AutoPauseAfter = s.AutoPauseAfter
+	u.SkipUnhealthyTargets = s.SkipUnhealthyTargets
+}
+
+// fields renders the snapshot as ordered field/value pairs for diffing.
+func (s *linkState) fields() [][2]string {
+	ts := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format("2006-01-02 15:04 UTC")
+	}
+	pause := ""
+	if s.AutoPauseAfter > 0 {
+		pause = strconv.Itoa(s.AutoPauseAfter)
+	}
+	return [][2]string{
+		{"long_url", s.LongURL},
+		{"rotate_targets", strings.Join(s.RotateTargets, ", ")},
+		{"ios_target_url", s.IOSTargetURL},
+		{"android_target_url", s.AndroidTargetURL},
+		{"preview_mode", yesNo(s.PreviewMode)},
+		{"stats_enabled", yesNo(s.StatsEnabled)},
+		{"is_enabled", yesNo(s.IsEnabled)},
+		{"is_draft", yesNo(s.IsDraft)},
+		{"expires_at", ts(s.ExpiresAt)},
+		{"start_at", ts(s.StartAt)},
+		{"end_at", ts(s.EndAt)},
+		{"auto_pause_after", pause},
+		{"skip_unhealthy_targets", yesNo(s.SkipUnhealthyTargets)},
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// diffStates lists the fields that differ. A nil before describes a creation,
+// which lists every field that has a value.
+func diffStates(before, after *linkState) []FieldChange {
+	var out []FieldChange
+	next := after.fields()
+	if before == nil {
+		for _, f := range next {
+			if f[1] != "" && f[1] != "no" {
+				out = append(out, FieldChange{Field: f[0], To: f[1]})
+			}
+		}
+		return out
+	}
+	prev := before.fields()
+	for i, f := range next {
+		if prev[i][1] != f[1] {
+			out = append(out, FieldChange{Field: f[0], From: prev[i][1], To: f[1]})
+		}
+	}
+	return out
+}
+
+// recordRevision appends a revision inside the caller's transaction, so a
+// change and its history entry commit or roll back together. A nil snapshot
+// marks the revision as not revertible.
+func (d *DB) recordRevision(ctx context.Context, tx *sql.Tx, u *URL, action string, actor Actor, changes []FieldChange, snapshot *linkState) error {
+	var changesJSON, snapshotJSON any
+	if len(changes) > 0 {
+		b, err := json.Marshal(changes)
+		if err != nil {
+			return err
+		}
+		changesJSON = string(b)
+	}
+	if snapshot != nil {
+		b, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		snapshotJSON = string(b)
+	}
+
+	const q = `INSERT INTO url_revisions
+		(url_id, short_code, action, actor_user_id, actor, source, changes, snapshot, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := tx.ExecContext(ctx, d.rebind(q),
+		u.ID, u.ShortCode, action, nullInt64(actor.UserID), truncateString(actor.Name, 80),
+		actor.Source, changesJSON, snapshotJSON, NewTime(d.dialect, now())); err != nil {
+		return fmt.Errorf("record revision: %w", err)
+	}
+	return nil
+}
+
+// urlTx reads a link inside a transaction.
+func (d *DB) urlTx(ctx context.Context, tx *sql.Tx, id int64) (*URL, error) {
+	return scanURL(tx.QueryRowContext(ctx, d.rebind("SELECT "+urlColumns+" FROM urls WHERE id = ?"), id))
+}
+
+// Revisions returns a link's history, newest first.
+func (d *DB) Revisions(ctx context.Context, urlID int64, limit int) ([]*Revision, error) {
+	rows, err := d.Query(ctx,
+		`SELECT id, url_id, short_code, action, actor_user_id, COALESCE(actor, ''),
+		        COALESCE(source, ''), COALESCE(changes, ''), snapshot IS NOT NULL, created_at
+		 FROM url_revisions WHERE url_id = ? ORDER BY id DESC LIMIT ?`, urlID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*Revision
+	for rows.Next() {
+		var (
+			r          Revision
+			actorID    sql.NullInt64
+			changesRaw string
+			createdAt  NullTime
+		)
+		if err := rows.Scan(&r.ID, &r.URLID, &r.ShortCode, &r.Action, &actorID, &r.Actor,
+			&r.Source, &changesRaw, &r.Revertible, &createdAt); err != nil {
+			return nil, err
+		}
+		if actorID.Valid {
+			id := actorID.Int64
+			r.ActorUserID = &id
+		}
+		if changesRaw != "" {
+			// A row that fails to parse still shows its action and actor.
+			_ = json.Unmarshal([]byte(changesRaw), &r.Changes)
+		}
+		r.CreatedAt = createdAt.Time
+		r.Revertible = r.Revertible && r.Action != ActionDelete
+		out = append(out, &r)
+	}
+	return out, rows.Err()
+}
+
+// RevertURL restores a link to the state recorded by one of its revisions, and
+// records the revert as a revision of its own so it can itself be undone.
+// validate sees the link as it would be after the revert and can veto it —
+// a destination that was fine when first saved may be blocked by now.
+func (d *DB) RevertURL(ctx context.Context, urlID, revisionID int64, actor Actor, validate func(*URL) error) (*URL, error) {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var raw sql.NullString
+	err = tx.QueryRowContext(ctx, d.rebind(
+		"SELECT snapshot FROM url_revisions WHERE id = ? AND url_id = ? AND action <> ?"),
+		revisionID, urlID, ActionDelete).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !raw.Valid) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot linkState
+	if err := json.Unmarshal([]byte(raw.String), &snapshot); err != nil {
+		return nil, fmt.Errorf("decode revision %d: %w", revisionID, err)
+	}
+
+	link, err := d.urlTx(ctx, tx, urlID)
+	if err != nil {
+		return nil, err
+	}
+	before := stateOf(link)
+	snapshot.applyTo(link)
+	if validate != nil {
+		if err := validate(link); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.updateURLTx(ctx, tx, link); err != nil {
+		return nil, err
+	}
+	after := stateOf(link)
+	if err := d.recordRevision(ctx, tx, link, ActionRevert, actor, diffStates(before, after), after); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	d.urlsChanged(link.ShortCode)
+	return link, nil
+}
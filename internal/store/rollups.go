@@ -0,0 +1,245 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// rollupName is the rollup_state row of the click rollups.
+const rollupName = "clicks"
+
+// rolledUpID is the SQL for the last click in the rollups; clicks after it
+// are counted from the clicks table.
+const rolledUpID = "(SELECT COALESCE(MAX(last_id), 0) FROM rollup_state WHERE name = '" + rollupName + "')"
+
+// unrolledCond is the SQL for the clicks a stats query counts from the clicks
+// table rather than the rollups: those not rolled up yet, and those outside
+// the span of whole rollup rows rollupSpan returns, bound as its two
+// arguments.
+const unrolledCond = "(id > " + rolledUpID + " OR timestamp < ? OR timestamp >= ?)"
+
+// rollupSettle is how old a click must be before it is rolled up. IDs are
+// handed out before the insert commits, so on Postgres a click can become
+// visible after one with a higher ID; waiting until the recent inserts have
+// committed keeps the cursor from passing one by.
+const rollupSettle = 5 * time.Minute
+
+// rollupStep is the stretch of time a rollup row counts. Every zone's offset
+// is a whole number of quarter hours, so a day, week or month in any of them
+// starts on a row's boundary.
+const rollupStep = 15 * time.Minute
+
+// rollupDimensions are the breakdowns counted in click_dimension_rollups:
+// the ones ClicksGroupedBy groups on.
+var rollupDimensions = []string{"country", "browser", "platform", "referrer", "region", "city", "network",
+	"device", "os_version", "browser_version", "language", "channel", "utm_source", "utm_medium", "utm_campaign"}
+
+// rollupSpan returns the whole rollup rows [lo, hi) inside [from, to). Stats
+// read the rollups for those rows only and the clicks table for the part
+// rows at either end, so a range starting or ending mid-row counts each of
+// its clicks once and no click outside it.
+func (d *DB) rollupSpan(ctx context.Context, from, to time.Time) (lo, hi time.Time, err error) {
+	quarters, err := d.quarterHoursFrom(ctx)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	step := rollupSlot(from, quarters)
+	lo = from.UTC().Truncate(step)
+	if lo.Before(from) {
+		lo = lo.Add(step)
+	}
+	return lo, to.UTC().Truncate(rollupSlot(to, quarters)), nil
+}
+
+// rollupSlot is the stretch the rollup row counting a click at t covers:
+// rollupStep, or a whole hour before quarters, where rollups made before they
+// counted quarter hours end.
+func rollupSlot(t, quarters time.Time) time.Duration {
+	if t.Before(quarters) {
+		return time.Hour
+	}
+	return rollupStep
+}
+
+// quarterHoursFrom returns when the rollups start counting quarter hours,
+// settling it on first use: the end of the last hour rolled up before they
+// did, or the Unix epoch when nothing was.
+func (d *DB) quarterHoursFrom(ctx context.Context) (time.Time, error) {
+	var from NullTime
+	err := d.QueryRow(ctx, "SELECT quarter_hours_from FROM rollup_state WHERE name = ?", rollupName).Scan(&from)
+	if err == nil && from.Valid {
+		return from.Time, nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, err
+	}
+
+	var last NullTime
+	if err := d.QueryRow(ctx, "SELECT MAX(hour) FROM click_rollups").Scan(&last); err != nil {
+		return time.Time{}, err
+	}
+	from = NewTime(d.dialect, time.Unix(0, 0))
+	if last.Valid {
+		from = NewTime(d.dialect, last.Time.Add(time.Hour))
+	}
+	if _, err := d.Exec(ctx,
+		`INSERT INTO rollup_state (name, last_id, quarter_hours_from) VALUES (?, 0, ?)
+		 ON CONFLICT (name) DO UPDATE SET quarter_hours_from = excluded.quarter_hours_from
+		 WHERE rollup_state.quarter_hours_from IS NULL`, rollupName, from); err != nil {
+		return time.Time{}, err
+	}
+	// Read it back: another instance may have settled it first.
+	if err := d.QueryRow(ctx, "SELECT quarter_hours_from FROM rollup_state WHERE name = ?", rollupName).Scan(&from); err != nil {
+		return time.Time{}, err
+	}
+	return from.Time, nil
+}
+
+type hourKey struct {
+	urlID   int64
+	hour    time.Time
+	traffic string
+}
+
+type hourCount struct{ clicks, unique int64 }
+
+type dimensionKey struct {
+	hourKey
+	dimension, value string
+}
+
+// RollupClicks folds up to batch clicks recorded since the last call into the
+// rollups, oldest first, and returns how many it folded; fewer than batch
+// means it has caught up. Instances running it at once do not double count:
+// the cursor only moves from where each read it, and the loser's batch is
+// dropped.
+func (d *DB) RollupClicks(ctx context.Context, batch int) (int, error) {
+	// This also creates the cursor on the first run.
+	quarters, err := d.quarterHoursFrom(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var from int64
+	if err := d.QueryRow(ctx, "SELECT last_id FROM rollup_state WHERE name = ?", rollupName).Scan(&from); err != nil {
+		return 0, err
+	}
+
+	// Read the batch in full before writing: on SQLite the rows hold the only
+	// connection.
+	values := make([]string, len(rollupDimensions))
+	for i, dim := range rollupDimensions {
+		values[i] = "COALESCE(" + clickDimensions[dim] + ", '')"
+	}
+	rows, err := d.Query(ctx,
+		`SELECT id, url_id, timestamp, COALESCE(traffic, '`+TrafficHuman+`'), is_unique, `+strings.Join(values, ", ")+`
+		 FROM clicks WHERE id > ? ORDER BY id LIMIT ?`, from, batch)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		hours  = map[hourKey]*hourCount{}
+		dims   = map[dimensionKey]int64{}
+		to     = from
+		n      int
+		settle = now().Add(-rollupSettle)
+	)
+	for rows.Next() {
+		var (
+			id, urlID int64
+			ts        NullTime
+			traffic   string
+			unique    nullBool
+			values    = make([]string, len(rollupDimensions))
+			dest      = []any{&id, &urlID, &ts, &traffic, &unique}
+		)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		// Stop at the first click still settling, so none is passed over.
+		if !ts.Time.Before(settle) {
+			break
+		}
+		k := hourKey{urlID, ts.Time.UTC().Truncate(rollupSlot(ts.Time, quarters)), traffic}
+		c := hours[k]
+		if c == nil {
+			c = &hourCount{}
+			hours[k] = c
+		}
+		c.clicks++
+		if unique.orDefault(true) {
+			c.unique++
+		}
+		for i, dim := range rollupDimensions {
+			dims[dimensionKey{k, dim, values[i]}]++
+		}
+		to = id
+		n++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Moving the cursor first takes its row lock, so a second instance with
+	// the same batch waits here and then finds the cursor gone from under it.
+	res, err := tx.ExecContext(ctx, d.rebind("UPDATE rollup_state SET last_id = ? WHERE name = ? AND last_id = ?"), to, rollupName, from)
+	if err != nil {
+		return 0, fmt.Errorf("move the rollup cursor: %w", err)
+	}
+	if moved, err := res.RowsAffected(); err != nil || moved == 0 {
+		return 0, err
+	}
+	for k, c := range hours {
+		if _, err := tx.ExecContext(ctx, d.rebind(
+			`INSERT INTO click_rollups (url_id, hour, traffic, clicks, unique_clicks) VALUES (?, ?, ?, ?, ?)
+			 ON CONFLICT (url_id, hour, traffic) DO UPDATE SET
+			   clicks = click_rollups.clicks + excluded.clicks,
+			   unique_clicks = click_rollups.unique_clicks + excluded.unique_clicks`),
+			k.urlID, NewTime(d.dialect, k.hour), k.traffic, c.clicks, c.unique); err != nil {
+			return 0, fmt.Errorf("roll up clicks: %w", err)
+		}
+	}
+	for k, count := range dims {
+		if _, err := tx.ExecContext(ctx, d.rebind(
+			`INSERT INTO click_dimension_rollups (url_id, hour, traffic, dimension, value, clicks) VALUES (?, ?, ?, ?, ?, ?)
+			 ON CONFLICT (url_id, hour, traffic, dimension, value) DO UPDATE SET
+			   clicks = click_dimension_rollups.clicks + excluded.clicks`),
+			k.urlID, NewTime(d.dialect, k.hour), k.traffic, k.dimension, k.value, count); err != nil {
+			return 0, fmt.Errorf("roll up click %s: %w", k.dimension, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// PurgeClicks deletes the raw clicks recorded before cutoff that are already
+// in the rollups, and returns how many it deleted. The stats keep counting
+// them from the rollups; the click log, its exports and the recent clicks
+// lose them.
+func (d *DB) PurgeClicks(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := d.Exec(ctx, "DELETE FROM clicks WHERE timestamp < ? AND id <= "+rolledUpID,
+		NewTime(d.dialect, cutoff))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
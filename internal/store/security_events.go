@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Security event types.
+const (
+	EventLogin             = "login"
+	EventLoginFailed       = "login_failed"
+	EventSecondFactorFail  = "second_factor_failed"
+	EventLogout            = "logout"
+	EventTOTPEnabled       = "totp_enabled"
+	EventTOTPDisabled      = "totp_disabled"
+	EventRecoveryCodeUsed  = "recovery_code_used"
+	EventAPIKeyRegenerated = "api_key_regenerated"
+	EventPasswordReset     = "password_reset"
+	EventEmailVerified     = "email_verified"
+	EventWebAuthnAdded     = "webauthn_added"
+	EventWebAuthnRemoved   = "webauthn_removed"
+	EventSessionRevoked    = "session_revoked"
+	EventSessionsRevoked   = "sessions_revoked"
+	EventPasswordChanged   = "password_changed"
+	EventUsernameChanged   = "username_changed"
+	EventEmailChanged      = "email_changed"
+)
+
+// SecurityEvent mirrors a `security_events` row: one entry in an account's
+// audit trail.
+type SecurityEvent struct {
+	ID        int64
+	UserID    int64
+	Event     string
+	IPAddress string // anonymised
+	Country   string
+	UserAgent string
+	// NewCountry marks a sign-in from a country the account had not signed in
+	// from before.
+	NewCountry bool
+	// Detail says what an account change changed, e.g. the old and new
+	// username.
+	Detail    string
+	CreatedAt time.Time
+}
+
+// RecordSecurityEvent appends an event to the user's audit trail.
+func (d *DB) RecordSecurityEvent(ctx context.Context, e *SecurityEvent) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = now()
+	}
+	const q = `INSERT INTO security_events
+		(user_id, event, ip_address, country, user_agent, new_country, detail, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := d.Exec(ctx, q,
+		e.UserID, e.Event, nullString(truncateString(e.IPAddress, 45)),
+		nullString(truncateString(e.Country, 100)), nullString(truncateString(e.UserAgent, 255)),
+		e.NewCountry, nullString(truncateString(e.Detail, 255)), NewTime(d.dialect, e.CreatedAt)); err != nil {
+		return fmt.Errorf("record security event: %w", err)
+	}
+	return nil
+}
+
+// SecurityEvents returns a user's audit trail, newest first.
+func (d *DB) SecurityEvents(ctx context.Context, userID int64, limit int) ([]*SecurityEvent, error) {
+	rows, err := d.Query(ctx,
+		`SELECT id, user_id, event, COALESCE(ip_address, ''), COALESCE(country, ''),
+		        COALESCE(user_agent, ''), new_country, COALESCE(detail, ''), created_at
+		 FROM security_events WHERE user_id = ? ORDER BY id DESC LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*SecurityEvent
+	for rows.Next() {
+		var (
+			e          SecurityEvent
+			newCountry nullBool
+			createdAt  NullTime
+		)
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Event, &e.IPAddress, &e.Country,
+			&e.UserAgent, &newCountry, &e.Detail, &createdAt); err != nil {
+			return nil, err
+		}
+		e.NewCountry = newCountry.orDefault(false)
+		e.CreatedAt = createdAt.Time
+		out = append(out, &e)
+	}
+	return out, rows.Err()
+}
+
+// LoginFromNewCountry reports whether a sign-in from country would be the
+// account's first from there. The very first recorded sign-in is not: every
+// country is new to an account with no history, and flagging it would only
+// teach the owner to ignore the warning.
+func (d *DB) LoginFromNewCountry(ctx context.Context, userID int64, country string) (bool, error) {
+	var total, fromCountry int
+	if err := d.QueryRow(ctx,
+		`SELECT COUNT(*), COALESCE(SUM(CASE WHEN country = ? THEN 1 ELSE 0 END), 0)
+		 FROM security_events WHERE user_id = ? AND event = ?`,
+		country, userID, EventLogin).Scan(&total, &fromCountry); err != nil {
+		return false, err
+	}
+	return total > 0 && fromCountry == 0, nil
+}
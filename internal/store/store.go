@@ -15,8 +15,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.opentelemetry.io/otel/attribute"
 	"modernc.org/sqlite"
 )
 
@@ -36,13 +38,45 @@ var ErrNotFound = errors.New("store: not found")
 // so all SQLite timestamp writes go through it.
 const pyDatetimeLayout = "2006-01-02 15:04:05.000000"
 
+// dialectSystem names each dialect in the db.system.name span attribute.
+var dialectSystem = map[Dialect]string{SQLite: "sqlite", Postgres: "postgresql"}
+
 type DB struct {
 	*sql.DB
 	dialect Dialect
+	// urlChanged is told the codes of links whose row changed; see
+	// OnURLChange.
+	urlChanged func(codes []string)
 }
 
 func (d *DB) Dialect() Dialect { return d.dialect }
 
+// OnURLChange registers fn to be told the short codes of the links a write
+// changed, created or removed, once it has committed, so copies of them held
+// elsewhere can be dropped. Clicks and access times are not reported. Register
+// it before the DB is shared: it is read without locking.
+func (d *DB) OnURLChange(fn func(codes []string)) { d.urlChanged = fn }
+
+// urlsChanged reports codes to the OnURLChange hook.
+func (d *DB) urlsChanged(codes ...string) {
+	if d.urlChanged != nil && len(codes) > 0 {
+		d.urlChanged(codes)
+	}
+}
+
+// urlChangedByID is urlsChanged for a link known only by its ID. The code
+// costs a lookup, made only when a hook is registered; if it fails, the hook
+// is not told.
+func (d *DB) urlChangedByID(ctx context.Context, id int64) {
+	if d.urlChanged == nil {
+		return
+	}
+	var code string
+	if err := d.QueryRow(ctx, "SELECT short_code FROM urls WHERE id = ?", id).Scan(&code); err == nil {
+		d.urlsChanged(code)
+	}
+}
+
 // Open connects to the database named by a SQLAlchemy-style URL. Both the
 // `sqlite:///path` and `postgresql://...` forms used by the Python config are
 // accepted so existing DATABASE_URL values keep working.
@@ -52,7 +86,11 @@ func Open(ctx context.Context, databaseURL string) (*DB, error) {
 		return nil, err
 	}
 
-	sqlDB, err := sql.Open(driver, dsn)
+	// Every statement is traced, inside transactions too. The statement text
+	// is recorded but never its arguments, which hold addresses and hashes.
+	sqlDB, err := otelsql.Open(driver, dsn,
+		otelsql.WithAttributes(attribute.String("db.system.name", dialectSystem[dialect])),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitConnResetSession: true, OmitRows: true}))
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
@@ -3,6 +3,11 @@ package store
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -15,11 +20,11 @@ func TestIsUniqueViolationOnDuplicateShortCode(t *testing.T) {
 	ctx := context.Background()
 	db := openLegacyFixture(t)
 
-	if err := db.CreateURL(ctx, &URL{ShortCode: "DUPE01", LongURL: "https://a.example.com/"}); err != nil {
+	if err := db.CreateURL(ctx, &URL{ShortCode: "DUPE01", LongURL: "https://a.example.com/"}, SystemActor("test")); err != nil {
 		t.Fatalf("first insert: %v", err)
 	}
 
-	err := db.CreateURL(ctx, &URL{ShortCode: "DUPE01", LongURL: "https://b.example.com/"})
+	err := db.CreateURL(ctx, &URL{ShortCode: "DUPE01", LongURL: "https://b.example.com/"}, SystemActor("test"))
 	if err == nil {
 		t.Fatal("second insert with the same short code succeeded; the unique index is missing")
 	}
@@ -39,7 +44,7 @@ func TestIsUniqueViolationIgnoresOtherErrors(t *testing.T) {
 	ctx := context.Background()
 	db := openLegacyFixture(t)
 	// A foreign-key failure is a constraint error, but not a unique one.
-	err := db.RecordClick(ctx, &Click{URLID: 999999, Country: "France"})
+	err := db.RecordClick(ctx, &Click{URLID: 999999, Country: "France"}, 0)
 	if err != nil && IsUniqueViolation(err) {
 		t.Errorf("foreign-key failure %v reported as a unique violation", err)
 	}
@@ -86,3 +91,1558 @@ func TestURLByShortCodeRejectsNulByte(t *testing.T) {
 		}
 	}
 }
+
+// TestRecordLinkHealthCountsConsecutiveFailures checks that the failure run the
+// auto-pause threshold is compared against grows across checks, resets on
+// success, and disappears with the link.
+func TestRecordLinkHealthCountsConsecutiveFailures(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+
+	link := &URL{ShortCode: "HLTH01", LongURL: "https://down.example.com/", IsEnabled: true}
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	record := func(healthy bool) int {
+		t.Helper()
+		n, err := db.RecordLinkHealth(ctx, &LinkHealth{URLID: link.ID, Target: link.LongURL, StatusCode: 503}, healthy)
+		if err != nil {
+			t.Fatalf("RecordLinkHealth: %v", err)
+		}
+		return n
+	}
+	for want := 1; want <= 3; want++ {
+		if got := record(false); got != want {
+			t.Fatalf("after %d failures the run is %d", want, got)
+		}
+	}
+	if got := record(true); got != 0 {
+		t.Errorf("a healthy check left the run at %d, want 0", got)
+	}
+
+	health, err := db.LinkHealthFor(ctx, []int64{link.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := health[link.ID]; len(rows) != 1 || rows[0].Target != link.LongURL {
+		t.Fatalf("health rows = %+v, want one row for the long URL", rows)
+	}
+
+	if err := db.DeleteURL(ctx, link.ID, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PurgeDeletedURLs(ctx, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	health, err = db.LinkHealthFor(ctx, []int64{link.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(health) != 0 {
+		t.Errorf("health rows survived purging the link: %+v", health)
+	}
+}
+
+// TestRevisionsRecordEveryChangeAndRevert walks a link through create, edit,
+// toggle and revert, and checks the history names each step and its actor, and
+// that a revert restores the earlier destination.
+func TestRevisionsRecordEveryChangeAndRevert(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	alice, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor := UserActor(alice, SourceWeb)
+
+	link := &URL{UserID: &alice.ID, ShortCode: "REV001", LongURL: "https://first.example/", IsEnabled: true, StatsEnabled: true}
+	if err := db.CreateURL(ctx, link, actor); err != nil {
+		t.Fatal(err)
+	}
+	link.LongURL = "https://second.example/"
+	if err := db.UpdateURL(ctx, link, actor); err != nil {
+		t.Fatal(err)
+	}
+	// An edit that changes nothing leaves no trace.
+	if err := db.UpdateURL(ctx, link, actor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SetURLEnabledToggle(ctx, link.ID, SystemActor("health check")); err != nil {
+		t.Fatal(err)
+	}
+
+	revs, err := db.Revisions(ctx, link.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, r := range revs {
+		actions = append(actions, r.Action)
+	}
+	if got, want := strings.Join(actions, ","), "disable,edit,create"; got != want {
+		t.Fatalf("actions newest first = %s, want %s", got, want)
+	}
+	if revs[0].Actor != "health check" || revs[0].Source != SourceSystem {
+		t.Errorf("toggle attributed to %q via %q", revs[0].Actor, revs[0].Source)
+	}
+	edit := revs[1]
+	if edit.Actor != "alice" || edit.ActorUserID == nil || *edit.ActorUserID != alice.ID {
+		t.Errorf("edit attributed to %q (%v), want alice", edit.Actor, edit.ActorUserID)
+	}
+	if len(edit.Changes) != 1 || edit.Changes[0].Field != "long_url" ||
+		edit.Changes[0].From != "https://first.example/" || edit.Changes[0].To != "https://second.example/" {
+		t.Errorf("edit changes = %+v", edit.Changes)
+	}
+
+	reverted, err := db.RevertURL(ctx, link.ID, revs[2].ID, actor, nil)
+	if err != nil {
+		t.Fatalf("RevertURL: %v", err)
+	}
+	if reverted.LongURL != "https://first.example/" {
+		t.Errorf("reverted LongURL = %q", reverted.LongURL)
+	}
+	if reverted.IsEnabled {
+		t.Error("revert re-enabled a link that was paused after the revision")
+	}
+
+	if err := db.DeleteURL(ctx, link.ID, actor); err != nil {
+		t.Fatal(err)
+	}
+	revs, err = db.Revisions(ctx, link.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 5 || revs[0].Action != ActionDelete || revs[0].Revertible {
+		t.Errorf("after delete the history is %d entries, newest %+v", len(revs), revs[0])
+	}
+}
+
+// TestTrashRestoreAndPurge moves links to the trash and checks they stop
+// resolving but keep their code and clicks, that restoring brings one back and
+// a validate veto keeps another in the trash, and that the purge removes only
+// links past the cutoff.
+func TestTrashRestoreAndPurge(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	alice, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor := UserActor(alice, SourceWeb)
+
+	var ids []int64
+	for _, code := range []string{"TRASH1", "TRASH2", "TRASH3"} {
+		link := &URL{UserID: &alice.ID, ShortCode: code, LongURL: "https://" + strings.ToLower(code) + ".example/", IsEnabled: true}
+		if err := db.CreateURL(ctx, link, actor); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, link.ID)
+	}
+	if err := db.RecordClick(ctx, &Click{URLID: ids[0]}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := db.DeleteUserURLs(ctx, alice.ID, ids, actor)
+	if err != nil || n != 3 {
+		t.Fatalf("DeleteUserURLs = %d, %v; want 3", n, err)
+	}
+	if _, err := db.URLByShortCode(ctx, "TRASH1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("a trashed link still resolves: %v", err)
+	}
+	if taken, err := db.ShortCodeTaken(ctx, "TRASH1"); err != nil || !taken {
+		t.Errorf("a trashed link's code was released (taken=%v, %v)", taken, err)
+	}
+	trash, err := db.TrashedUserURLs(ctx, alice.ID)
+	if err != nil || len(trash) != 3 {
+		t.Fatalf("TrashedUserURLs = %d links, %v; want 3", len(trash), err)
+	}
+	// Deleting again moves nothing.
+	if n, err := db.DeleteUserURLs(ctx, alice.ID, ids, actor); err != nil || n != 0 {
+		t.Errorf("second DeleteUserURLs = %d, %v; want 0", n, err)
+	}
+
+	blocked := errors.New("blocked")
+	n, err = db.RestoreUserURLs(ctx, alice.ID, ids[:2], actor, func(u *URL) error {
+		if u.ShortCode == "TRASH2" {
+			return blocked
+		}
+		return nil
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("RestoreUserURLs = %d, %v; want 1", n, err)
+	}
+	restored, err := db.URLByShortCode(ctx, "TRASH1")
+	if err != nil {
+		t.Fatalf("restored link does not resolve: %v", err)
+	}
+	if restored.ClicksCount != 1 || restored.DeletedAt != nil {
+		t.Errorf("restored link = clicks %d, deleted %v", restored.ClicksCount, restored.DeletedAt)
+	}
+	revs, err := db.Revisions(ctx, ids[0], 1)
+	if err != nil || len(revs) != 1 || revs[0].Action != ActionRestore {
+		t.Errorf("newest revision after restore = %+v, %v", revs, err)
+	}
+
+	// A cutoff before the deletions purges nothing; one after purges the two
+	// links still in the trash and leaves the restored one alone.
+	if n, err := db.PurgeDeletedURLs(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("early purge = %d, %v; want 0", n, err)
+	}
+	if n, err := db.PurgeDeletedURLs(ctx, time.Now().Add(time.Minute)); err != nil || n != 2 {
+		t.Errorf("purge = %d, %v; want 2", n, err)
+	}
+	if taken, err := db.ShortCodeTaken(ctx, "TRASH2"); err != nil || taken {
+		t.Errorf("a purged link's code is still taken (taken=%v, %v)", taken, err)
+	}
+	if _, err := db.URLByShortCode(ctx, "TRASH1"); err != nil {
+		t.Errorf("the purge removed a live link: %v", err)
+	}
+}
+
+// TestSecurityEventsAndNewCountry records a few events and checks they come
+// back newest first, and that only a sign-in from an unseen country after the
+// first is reported as new.
+func TestSecurityEventsAndNewCountry(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	alice, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isNew := func(country string) bool {
+		t.Helper()
+		ok, err := db.LoginFromNewCountry(ctx, alice.ID, country)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	record := func(event, country string) {
+		t.Helper()
+		if err := db.RecordSecurityEvent(ctx, &SecurityEvent{
+			UserID: alice.ID, Event: event, IPAddress: "192.0.xxx.xxx", Country: country,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if isNew("AT") {
+		t.Error("the first sign-in was reported as from a new country")
+	}
+	record(EventLogin, "AT")
+	// A failed attempt from elsewhere does not make that country familiar.
+	record(EventLoginFailed, "DE")
+	if isNew("AT") {
+		t.Error("a sign-in from a known country was reported as new")
+	}
+	if !isNew("DE") {
+		t.Error("a sign-in from an unseen country was not reported as new")
+	}
+
+	events, err := db.SecurityEvents(ctx, alice.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Event != EventLoginFailed || events[1].Country != "AT" {
+		t.Errorf("events = %+v", events)
+	}
+}
+
+// TestWebAuthnCredentialsAndRecoveryCodes checks a first key brings recovery
+// codes with it, and that removing the last key takes them away again.
+func TestWebAuthnCredentialsAndRecoveryCodes(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	alice, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := &WebAuthnCredential{
+		UserID: alice.ID, CredentialID: "Y3JlZC0x", Name: "YubiKey", Data: `{"id":"Y3JlZC0x"}`, Passwordless: true,
+	}
+	if err := db.AddWebAuthnCredential(ctx, key, []string{"hash-a", "hash-b"}); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := db.HasWebAuthnCredentials(ctx, alice.ID); err != nil || !has {
+		t.Fatalf("HasWebAuthnCredentials = %v, %v", has, err)
+	}
+	// The same authenticator cannot be registered twice.
+	dup := *key
+	if err := db.AddWebAuthnCredential(ctx, &dup, nil); err == nil {
+		t.Error("a duplicate credential id was accepted")
+	}
+
+	if err := db.RecordWebAuthnUse(ctx, key.ID, `{"id":"Y3JlZC0x","n":7}`, 7); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.WebAuthnCredentialByCredentialID(ctx, "Y3JlZC0x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != key.ID || got.SignCount != 7 || !got.Passwordless || got.LastUsedAt == nil || got.Name != "YubiKey" {
+		t.Errorf("credential = %+v", got)
+	}
+	if used, err := db.ConsumeRecoveryCode(ctx, alice.ID, "hash-a"); err != nil || !used {
+		t.Errorf("the key's recovery code was not stored (used=%v, %v)", used, err)
+	}
+
+	if ok, err := db.DeleteWebAuthnCredential(ctx, alice.ID+1, key.ID); err != nil || ok {
+		t.Errorf("another user deleted the key (ok=%v, %v)", ok, err)
+	}
+	if ok, err := db.DeleteWebAuthnCredential(ctx, alice.ID, key.ID); err != nil || !ok {
+		t.Fatalf("DeleteWebAuthnCredential = %v, %v", ok, err)
+	}
+	if keys, err := db.WebAuthnCredentials(ctx, alice.ID); err != nil || len(keys) != 0 {
+		t.Errorf("keys after delete = %v, %v", keys, err)
+	}
+	if used, err := db.ConsumeRecoveryCode(ctx, alice.ID, "hash-b"); err != nil || used {
+		t.Errorf("recovery codes outlived the last second factor (used=%v, %v)", used, err)
+	}
+}
+
+// TestUserSessionsRegistry registers sessions and checks listing, touching,
+// revoking one, revoking the rest and purging idle ones.
+func TestUserSessionsRegistry(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	alice, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	for _, s := range []*UserSession{
+		{ID: "sess-a", UserID: alice.ID, UserAgent: "Firefox", IPAddress: "192.0.xxx.xxx", Country: "AT", CreatedAt: old},
+		{ID: "sess-b", UserID: alice.ID, UserAgent: "Safari"},
+		{ID: "sess-c", UserID: alice.ID},
+	} {
+		if err := db.CreateUserSession(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := db.UserSession(ctx, "sess-a")
+	if err != nil || got.UserAgent != "Firefox" || got.Country != "AT" || !got.LastSeenAt.Equal(got.CreatedAt) {
+		t.Fatalf("UserSession = %+v, %v", got, err)
+	}
+	if err := db.TouchUserSession(ctx, "sess-a", time.Now().UTC().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	list, err := db.UserSessions(ctx, alice.ID)
+	if err != nil || len(list) != 3 || list[0].ID != "sess-a" {
+		t.Fatalf("UserSessions = %v, %v; want sess-a, just touched, first", list, err)
+	}
+
+	if ok, err := db.DeleteUserSession(ctx, alice.ID+1, "sess-b"); err != nil || ok {
+		t.Errorf("another user revoked the session (ok=%v, %v)", ok, err)
+	}
+	if ok, err := db.DeleteUserSession(ctx, alice.ID, "sess-b"); err != nil || !ok {
+		t.Errorf("DeleteUserSession = %v, %v", ok, err)
+	}
+	if _, err := db.UserSession(ctx, "sess-b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("a revoked session still loads: %v", err)
+	}
+	if err := db.DeleteUserSessions(ctx, alice.ID, "sess-a"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := db.UserSessions(ctx, alice.ID); len(list) != 1 || list[0].ID != "sess-a" {
+		t.Errorf("after revoking the rest: %v", list)
+	}
+
+	if n, err := db.PurgeUserSessions(ctx, time.Now().UTC().Add(2*time.Minute)); err != nil || n != 1 {
+		t.Errorf("PurgeUserSessions = %d, %v", n, err)
+	}
+}
+
+// TestDeleteUserTransfersOrRemovesEverything deletes one account handing its
+// links to another, then deletes the heir without one, checking nothing of
+// either is left behind.
+func TestDeleteUserTransfersOrRemovesEverything(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	alice, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.UserByLogin(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor := UserActor(alice, SourceWeb)
+	trashed := &URL{UserID: &alice.ID, ShortCode: "TRASH1", LongURL: "https://trash.example/"}
+	if err := db.CreateURL(ctx, trashed, actor); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteURL(ctx, trashed.ID, actor); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.EnableTOTP(ctx, alice.ID, []string{"hash"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordSecurityEvent(ctx, &SecurityEvent{UserID: alice.ID, Event: EventLogin}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateUserSession(ctx, &UserSession{ID: "sess-a", UserID: alice.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := db.ExportUserURLs(ctx, alice.ID)
+	if err != nil || len(links) != 2 {
+		t.Fatalf("ExportUserURLs = %d links, %v; want the live link and the trashed one", len(links), err)
+	}
+	var clicks int
+	if err := db.EachClick(ctx, ClickFilter{UserID: alice.ID}, func(*Click) error { clicks++; return nil }); err != nil || clicks != 5 {
+		t.Fatalf("EachClick saw %d clicks, %v; want 5", clicks, err)
+	}
+
+	if err := db.DeleteUser(ctx, alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.UserByID(ctx, alice.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("the account is still there: %v", err)
+	}
+	link, err := db.URLByShortCode(ctx, "ABC123")
+	if err != nil || link.UserID == nil || *link.UserID != bob.ID {
+		t.Fatalf("ABC123 after the transfer = %+v, %v; want it owned by bob", link, err)
+	}
+	if taken, _ := db.ShortCodeTaken(ctx, "TRASH1"); taken {
+		t.Error("the trashed link was transferred rather than deleted")
+	}
+	revs, err := db.Revisions(ctx, link.ID, 10)
+	if err != nil || revs[0].Action != ActionTransfer || revs[0].Changes[0].To != "bob" {
+		t.Fatalf("newest revision = %+v, %v; want the transfer", revs[0], err)
+	}
+	for _, rev := range revs {
+		if rev.ActorUserID != nil && *rev.ActorUserID == alice.ID || rev.Actor == "alice" {
+			t.Errorf("revision %d still names the deleted account", rev.ID)
+		}
+	}
+	for _, table := range []string{"recovery_codes", "security_events", "user_sessions"} {
+		if n := countRows(t, db, "SELECT COUNT(*) FROM "+table+" WHERE user_id = ?", alice.ID); n != 0 {
+			t.Errorf("%d %s rows survived", n, table)
+		}
+	}
+	clicks = 0
+	if err := db.EachClick(ctx, ClickFilter{UserID: bob.ID}, func(*Click) error { clicks++; return nil }); err != nil || clicks != 5 {
+		t.Errorf("the heir has %d clicks, %v; want the 5 that came with ABC123", clicks, err)
+	}
+
+	if err := db.DeleteUser(ctx, bob, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM urls WHERE user_id IS NOT NULL"); n != 0 {
+		t.Errorf("%d owned links survived", n)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM clicks WHERE url_id = ?", link.ID); n != 0 {
+		t.Errorf("%d clicks survived their link", n)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM url_revisions WHERE url_id = ?", link.ID); n != 0 {
+		t.Errorf("%d revisions survived their link", n)
+	}
+}
+
+// TestClicksByTimeBucketInTimezone buckets clicks either side of the start of
+// daylight saving in New York, where a UTC day and a local day disagree.
+func TestClicksByTimeBucketInTimezone(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	link := &URL{ShortCode: "TZTEST", LongURL: "https://tz.example/"}
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []string{"2026-03-08T04:30:00Z", "2026-03-08T12:00:00Z", "2026-03-09T03:30:00Z", "2026-03-09T04:30:00Z"} {
+		at, _ := time.Parse(time.RFC3339, ts)
+		if err := db.RecordClick(ctx, &Click{URLID: link.ID, Timestamp: at}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no zone database:", err)
+	}
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, ny)
+	to := from.AddDate(0, 1, 0)
+
+	for _, tc := range []struct {
+		g    Granularity
+		loc  *time.Location
+		want string
+	}{
+		{ByDay, ny, "2026-03-07:1 2026-03-08:2 2026-03-09:1"},
+		{ByDay, time.UTC, "2026-03-08:2 2026-03-09:2"},
+		{ByHour, ny, "2026-03-07 23:00:1 2026-03-08 08:00:1 2026-03-08 23:00:1 2026-03-09 00:00:1"},
+		{ByWeek, ny, "2026-03-02:3 2026-03-09:1"},
+		{ByMonth, ny, "2026-03:4"},
+	} {
+		buckets, err := db.ClicksByTimeBucket(ctx, link.ID, from, to, tc.g, tc.loc, false)
+		if err != nil {
+			t.Fatalf("%s in %s: %v", tc.g, tc.loc, err)
+		}
+		var got []string
+		for _, b := range buckets {
+			got = append(got, fmt.Sprintf("%s:%d", b.Label, b.Count))
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%s in %s = %v, want %s", tc.g, tc.loc, got, tc.want)
+		}
+	}
+}
+
+func TestUniqueVisitorsWithinWindow(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	link := &URL{ShortCode: "UNIQ01", LongURL: "https://uniq.example/"}
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 5, 4, 9, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		after time.Duration
+		hash  string
+		want  bool
+	}{
+		{0, "aaa", true},
+		{10 * time.Minute, "aaa", false},
+		{20 * time.Minute, "bbb", true},
+		{90 * time.Minute, "aaa", true}, // the first click is outside the hour
+		{95 * time.Minute, "", true},    // no hash, no dedupe
+		{96 * time.Minute, "", true},
+	} {
+		click := &Click{URLID: link.ID, Timestamp: start.Add(c.after), VisitorHash: c.hash}
+		if err := db.RecordClick(ctx, click, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if click.Unique != c.want {
+			t.Errorf("click at +%s by %q: unique = %v, want %v", c.after, c.hash, click.Unique, c.want)
+		}
+	}
+
+	buckets, err := db.ClicksByTimeBucket(ctx, link.ID, start, start.Add(2*time.Hour), ByHour, time.UTC, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, b := range buckets {
+		got = append(got, fmt.Sprintf("%s:%d/%d", b.Label, b.Count, b.Unique))
+	}
+	if want := "2026-05-04 09:00:3/2 2026-05-04 10:00:3/3"; strings.Join(got, " ") != want {
+		t.Errorf("buckets = %v, want %s", got, want)
+	}
+
+	salt, err := db.VisitorSalt(ctx, "2026-05-04")
+	if err != nil || salt == "" {
+		t.Fatalf("VisitorSalt = %q, %v", salt, err)
+	}
+	if again, err := db.VisitorSalt(ctx, "2026-05-04"); err != nil || again != salt {
+		t.Errorf("second VisitorSalt = %q, %v; want the stored %q", again, err, salt)
+	}
+	if other, _ := db.VisitorSalt(ctx, "2026-05-05"); other == salt {
+		t.Error("the next day reused the salt")
+	}
+
+	n, err := db.ForgetVisitors(ctx, start.Add(time.Hour), "2026-05-05")
+	if err != nil || n != 3 {
+		t.Fatalf("ForgetVisitors = %d, %v; want the 3 hashes before the cutoff", n, err)
+	}
+	if left := countRows(t, db, "SELECT COUNT(*) FROM clicks WHERE visitor_hash IS NOT NULL"); left != 1 {
+		t.Errorf("%d hashes left, want 1", left)
+	}
+	if salts := countRows(t, db, "SELECT COUNT(*) FROM visitor_salts"); salts != 1 {
+		t.Errorf("%d salts left, want only today's", salts)
+	}
+	// Forgetting the hash keeps the click's verdict.
+	buckets, _ = db.ClicksByTimeBucket(ctx, link.ID, start, start.Add(time.Hour), ByHour, time.UTC, false)
+	if len(buckets) != 1 || buckets[0].Unique != 2 {
+		t.Errorf("after forgetting, buckets = %+v", buckets)
+	}
+}
+
+// TestClickRollupsAndRetention rolls clicks up in small batches, purges the
+// old raw rows, and checks the stats read the same throughout.
+func TestRecordClicksBatch(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	var links []*URL
+	for _, code := range []string{"BATCH1", "BATCH2", "BATCH3"} {
+		link := &URL{ShortCode: code, LongURL: "https://batch.example/"}
+		if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+			t.Fatal(err)
+		}
+		links = append(links, link)
+	}
+	a, b, c := links[0].ID, links[1].ID, links[2].ID
+	start := time.Date(2026, 5, 4, 9, 0, 0, 0, time.UTC)
+	if err := db.RecordClick(ctx, &Click{URLID: a, Timestamp: start, VisitorHash: "aaa"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	clicks := []*Click{
+		{URLID: a, Timestamp: start.Add(10 * time.Minute), VisitorHash: "aaa"}, // stored before
+		{URLID: a, Timestamp: start.Add(11 * time.Minute), VisitorHash: "bbb"},
+		{URLID: a, Timestamp: start.Add(12 * time.Minute), VisitorHash: "bbb"}, // earlier in the batch
+		{URLID: b, Timestamp: start.Add(13 * time.Minute), VisitorHash: "aaa"}, // another link
+		{URLID: b, Timestamp: start.Add(14 * time.Minute), Traffic: TrafficBot},
+	}
+	accessed := map[int64]time.Time{a: start.Add(12 * time.Minute), b: start.Add(14 * time.Minute), c: start.Add(15 * time.Minute)}
+	if err := db.RecordClicks(ctx, clicks, accessed, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{false, true, false, true, true} {
+		if clicks[i].Unique != want {
+			t.Errorf("click %d: unique = %v, want %v", i, clicks[i].Unique, want)
+		}
+	}
+	if clicks[1].Traffic != TrafficHuman {
+		t.Errorf("traffic = %q, want the human default", clicks[1].Traffic)
+	}
+
+	// An older access flushed late must not move last_accessed_at back.
+	if err := db.RecordClicks(ctx, nil, map[int64]time.Time{a: start}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		link   *URL
+		clicks int64
+		at     time.Time
+	}{
+		{links[0], 4, start.Add(12 * time.Minute)},
+		{links[1], 2, start.Add(14 * time.Minute)},
+		{links[2], 0, start.Add(15 * time.Minute)},
+	} {
+		got, err := db.URLByShortCode(ctx, want.link.ShortCode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ClicksCount != want.clicks {
+			t.Errorf("%s: clicks = %d, want %d", want.link.ShortCode, got.ClicksCount, want.clicks)
+		}
+		if got.LastAccessedAt == nil || !got.LastAccessedAt.Equal(want.at) {
+			t.Errorf("%s: last accessed = %v, want %s", want.link.ShortCode, got.LastAccessedAt, want.at)
+		}
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM clicks WHERE visitor_hash IN ('aaa', 'bbb') OR traffic = 'bot'"); n != 6 {
+		t.Errorf("%d clicks stored, want 6", n)
+	}
+
+	// A link purged while its clicks were queued loses them, not the batch.
+	if err := db.DeleteURL(ctx, c, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.PurgeDeletedURLs(ctx, time.Now().Add(time.Hour)); err != nil || n != 1 {
+		t.Fatalf("PurgeDeletedURLs = %d, %v", n, err)
+	}
+	late := []*Click{
+		{URLID: a, Timestamp: start.Add(20 * time.Minute), VisitorHash: "ccc"},
+		{URLID: c, Timestamp: start.Add(21 * time.Minute), VisitorHash: "ccc"},
+	}
+	if err := db.RecordClicks(ctx, late, map[int64]time.Time{c: start.Add(21 * time.Minute)}, time.Hour); err != nil {
+		t.Fatalf("batch with a purged link: %v", err)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM clicks WHERE visitor_hash = 'ccc'"); n != 1 {
+		t.Errorf("%d clicks stored, want only the live link's", n)
+	}
+}
+
+func TestURLChangesAreReported(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	var got []string
+	db.OnURLChange(func(codes []string) { got = append(got, codes...) })
+	expect := func(step string, want ...string) {
+		t.Helper()
+		if !slices.Equal(got, want) {
+			t.Errorf("%s reported %v, want %v", step, got, want)
+		}
+		got = nil
+	}
+
+	owner, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &URL{ShortCode: "HOOK01", LongURL: "https://hook.example/", UserID: &owner.ID, IsEnabled: true}
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	expect("CreateURL", "HOOK01")
+
+	link.LongURL = "https://hook.example/edited"
+	if err := db.UpdateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	expect("UpdateURL", "HOOK01")
+	if _, err := db.SetURLEnabledToggle(ctx, link.ID, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	expect("SetURLEnabledToggle", "HOOK01")
+	if err := db.SetURLEnabled(ctx, link.ID, true, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	expect("SetURLEnabled", "HOOK01")
+	if err := db.SetUnhealthyTargets(ctx, link.ID, []string{"https://down.example/"}); err != nil {
+		t.Fatal(err)
+	}
+	expect("SetUnhealthyTargets", "HOOK01")
+	if err := db.RecordClick(ctx, &Click{URLID: link.ID}, 0); err != nil {
+		t.Fatal(err)
+	}
+	expect("RecordClick")
+
+	if err := db.DeleteURL(ctx, link.ID, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	expect("DeleteURL", "HOOK01")
+	if _, err := db.RestoreUserURLs(ctx, owner.ID, []int64{link.ID}, SystemActor("test"), nil); err != nil {
+		t.Fatal(err)
+	}
+	expect("RestoreUserURLs", "HOOK01")
+	if _, err := db.DeleteUserURLs(ctx, owner.ID, []int64{link.ID}, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	expect("DeleteUserURLs", "HOOK01")
+	if _, err := db.PurgeDeletedURLs(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	expect("PurgeDeletedURLs", "HOOK01")
+}
+
+func TestRolledUpStatsOverPartHours(t *testing.T) {
+	ctx := context.Background()
+	db := openEmptyDB(t)
+	link := &URL{ShortCode: "PARTHR", LongURL: "https://part-hour.example/"}
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Now().UTC().Truncate(time.Hour).AddDate(0, 0, -1)
+	for _, minutes := range []int{0, 20, 40, 70, 130} {
+		c := &Click{URLID: link.ID, Country: "AT", Timestamp: base.Add(time.Duration(minutes) * time.Minute)}
+		if err := db.RecordClick(ctx, c, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := db.RollupClicks(ctx, 100); err != nil || n != 5 {
+		t.Fatalf("RollupClicks = %d, %v", n, err)
+	}
+
+	for _, tc := range []struct {
+		from, to time.Duration
+		want     int64
+	}{
+		{10 * time.Minute, 60 * time.Minute, 2},
+		{30 * time.Minute, 80 * time.Minute, 2},
+		{10 * time.Minute, 140 * time.Minute, 4},
+		{0, 120 * time.Minute, 4},
+		{45 * time.Minute, 50 * time.Minute, 0},
+	} {
+		from, to := base.Add(tc.from), base.Add(tc.to)
+		countries, err := db.ClicksGroupedBy(ctx, link.ID, from, to, "country", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var grouped int64
+		for _, b := range countries {
+			grouped += b.Count
+		}
+		series, err := db.ClicksByTimeBucket(ctx, link.ID, from, to, ByDay, time.UTC, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bucketed int64
+		for _, b := range series {
+			bucketed += b.Count
+		}
+		if grouped != tc.want || bucketed != tc.want {
+			t.Errorf("[+%v, +%v): grouped %d, bucketed %d clicks, want %d", tc.from, tc.to, grouped, bucketed, tc.want)
+		}
+	}
+}
+
+func TestRolledUpClicksInPartHourZone(t *testing.T) {
+	ctx := context.Background()
+	db := openEmptyDB(t)
+	link := &URL{ShortCode: "KOLKATA", LongURL: "https://kolkata.example/"}
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	// Midnight in Kolkata is 18:30 UTC.
+	for _, ts := range []string{"2026-03-08T18:20:00Z", "2026-03-08T18:40:00Z", "2026-03-08T19:10:00Z"} {
+		at, _ := time.Parse(time.RFC3339, ts)
+		if err := db.RecordClick(ctx, &Click{URLID: link.ID, Timestamp: at}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip("no zone database:", err)
+	}
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, kolkata)
+	to := from.AddDate(0, 1, 0)
+	days := func() string {
+		t.Helper()
+		buckets, err := db.ClicksByTimeBucket(ctx, link.ID, from, to, ByDay, kolkata, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, b := range buckets {
+			got = append(got, fmt.Sprintf("%s:%d", b.Label, b.Count))
+		}
+		return strings.Join(got, " ")
+	}
+
+	const want = "2026-03-08:1 2026-03-09:2"
+	if got := days(); got != want {
+		t.Fatalf("raw days = %s, want %s", got, want)
+	}
+	if n, err := db.RollupClicks(ctx, 100); err != nil || n != 3 {
+		t.Fatalf("RollupClicks = %d, %v", n, err)
+	}
+	if got := days(); got != want {
+		t.Errorf("rolled-up days = %s, want %s", got, want)
+	}
+}
+
+func TestHourlyRollupsBeforeQuarterHours(t *testing.T) {
+	ctx := context.Background()
+	db := openEmptyDB(t)
+	link := &URL{ShortCode: "HOURLY", LongURL: "https://hourly.example/"}
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		t.Helper()
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	// A row an earlier version rolled up for the whole of 10:00.
+	if _, err := db.Exec(ctx, "INSERT INTO click_rollups (url_id, hour, traffic, clicks, unique_clicks) VALUES (?, ?, ?, 3, 3)",
+		link.ID, NewTime(db.Dialect(), at("2026-03-08T10:00:00Z")), TrafficHuman); err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []string{"2026-03-08T10:20:00Z", "2026-03-08T11:20:00Z"} {
+		if err := db.RecordClick(ctx, &Click{URLID: link.ID, Timestamp: at(ts)}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := db.RollupClicks(ctx, 100); err != nil || n != 2 {
+		t.Fatalf("RollupClicks = %d, %v", n, err)
+	}
+	if got, err := db.quarterHoursFrom(ctx); err != nil || !got.Equal(at("2026-03-08T11:00:00Z")) {
+		t.Fatalf("quarter hours from %v, %v; want the end of the last hourly row", got, err)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM click_rollups WHERE url_id = ?", link.ID); n != 2 {
+		t.Errorf("%d rollup rows, want the hour's and the 11:15 quarter's", n)
+	}
+
+	for _, tc := range []struct {
+		from, to string
+		want     int64
+	}{
+		{"2026-03-08T10:00:00Z", "2026-03-08T12:00:00Z", 5},
+		{"2026-03-08T10:10:00Z", "2026-03-08T12:00:00Z", 2},
+		{"2026-03-08T10:00:00Z", "2026-03-08T11:25:00Z", 5},
+		{"2026-03-08T10:00:00Z", "2026-03-08T11:15:00Z", 4},
+	} {
+		buckets, err := db.ClicksByTimeBucket(ctx, link.ID, at(tc.from), at(tc.to), ByDay, time.UTC, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int64
+		for _, b := range buckets {
+			n += b.Count
+		}
+		if n != tc.want {
+			t.Errorf("[%s, %s) = %d clicks, want %d", tc.from, tc.to, n, tc.want)
+		}
+	}
+}
+
+func TestClickRollupsAndRetention(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	link := &URL{ShortCode: "ROLLUP", LongURL: "https://rollup.example/"}
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Now().UTC().Truncate(time.Hour).AddDate(0, 0, -10)
+	for i, c := range []Click{
+		{Country: "AT", Traffic: TrafficHuman},
+		{Country: "AT", Traffic: TrafficHuman, VisitorHash: "v1"},
+		{Country: "AT", Traffic: TrafficHuman, VisitorHash: "v1"},
+		{Country: "DE", Traffic: TrafficBot},
+		{Country: "", Traffic: TrafficHuman},
+		{Country: "DE", Traffic: TrafficInternal},
+	} {
+		c.URLID = link.ID
+		c.Timestamp = base.Add(time.Duration(i) * 20 * time.Minute)
+		if err := db.RecordClick(ctx, &c, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from, to := base.AddDate(0, 0, -1), time.Now().Add(time.Hour)
+	snapshot := func() string {
+		t.Helper()
+		var out []string
+		for _, human := range []bool{true, false} {
+			series, err := db.ClicksByTimeBucket(ctx, link.ID, from, to, ByHour, time.UTC, human)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range series {
+				out = append(out, fmt.Sprintf("%s=%d/%d", b.Label, b.Count, b.Unique))
+			}
+			countries, err := db.ClicksGroupedBy(ctx, link.ID, from, to, "country", human)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range countries {
+				out = append(out, fmt.Sprintf("%s=%d", b.Label, b.Count))
+			}
+		}
+		return strings.Join(out, " ")
+	}
+	raw := snapshot()
+	if want := fmt.Sprintf("%s=3/2 %s=1/1 Unknown=1 AT=3 %s=3/2 %s=3/3 Unknown=1 AT=3 DE=2",
+		base.Format("2006-01-02 15:00"), base.Add(time.Hour).Format("2006-01-02 15:00"),
+		base.Format("2006-01-02 15:00"), base.Add(time.Hour).Format("2006-01-02 15:00")); raw != want {
+		t.Fatalf("raw stats = %s\nwant %s", raw, want)
+	}
+
+	var rolled int
+	for {
+		n, err := db.RollupClicks(ctx, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rolled += n
+		if n < 4 {
+			break
+		}
+	}
+	// The fixture's own clicks are rolled up with these.
+	if rolled < 6 {
+		t.Errorf("rolled up %d clicks, want at least the 6 old ones", rolled)
+	}
+	if rolledUp := snapshot(); rolledUp != raw {
+		t.Errorf("rolled-up stats = %s\nwant %s", rolledUp, raw)
+	}
+
+	// A click still settling is left to the next run, and counted raw.
+	if err := db.RecordClick(ctx, &Click{URLID: link.ID, Country: "FR"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := db.RollupClicks(ctx, 4); n != 0 {
+		t.Errorf("a second rollup folded %d clicks", n)
+	}
+	rolledUp := snapshot()
+	if !strings.Contains(rolledUp, "FR=1") {
+		t.Errorf("the settling click is not counted: %s", rolledUp)
+	}
+
+	if _, err := db.PurgeClicks(ctx, base.Add(40*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM clicks WHERE url_id = ?", link.ID); n != 5 {
+		t.Errorf("%d raw clicks left, want the 4 after the cutoff and the settling one", n)
+	}
+	if n, err := db.PurgeClicks(ctx, time.Now().Add(time.Hour)); err != nil || n == 0 {
+		t.Fatalf("PurgeClicks = %d, %v", n, err)
+	}
+	if n := countRows(t, db, "SELECT COUNT(*) FROM clicks WHERE url_id = ?", link.ID); n != 1 {
+		t.Errorf("%d raw clicks left, want only the one not yet rolled up", n)
+	}
+	if after := snapshot(); after != rolledUp {
+		t.Errorf("stats after the purge = %s\nwant %s", after, rolledUp)
+	}
+}
+
+func countRows(t *testing.T, db *DB, query string, args ...any) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(context.Background(), query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestAccountAnalytics(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	alice, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.UserByLogin(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A day without the fixture's clicks.
+	base := time.Date(2026, 4, 13, 9, 0, 0, 0, time.UTC)
+	links := map[string]*URL{}
+	for _, l := range []struct {
+		code  string
+		owner *User
+		tags  []string
+		// clicks are the countries of the link's clicks, "bot:" marking a bot's.
+		clicks []string
+	}{
+		{"ACCT01", alice, []string{"promo"}, []string{"AT", "AT", "DE"}},
+		{"ACCT02", alice, []string{"promotions", "spring"}, []string{"DE"}},
+		{"ACCT03", alice, nil, []string{"FR", "bot:FR"}},
+		{"ACCT04", alice, []string{"promo"}, []string{"IT"}},
+		{"ACCT05", bob, []string{"promo"}, []string{"ES"}},
+	} {
+		link := &URL{ShortCode: l.code, LongURL: "https://" + strings.ToLower(l.code) + ".example/",
+			UserID: &l.owner.ID, Tags: l.tags, IsEnabled: true, StatsEnabled: true}
+		if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+			t.Fatal(err)
+		}
+		links[l.code] = link
+		for i, country := range l.clicks {
+			traffic := TrafficHuman
+			if c, ok := strings.CutPrefix(country, "bot:"); ok {
+				country, traffic = c, TrafficBot
+			}
+			c := &Click{URLID: link.ID, Timestamp: base.Add(time.Duration(i) * time.Hour),
+				Country: country, Traffic: traffic, VisitorHash: "v1"}
+			if err := db.RecordClick(ctx, c, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// A trashed link no longer counts.
+	if err := db.DeleteURL(ctx, links["ACCT04"].ID, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := db.UserTags(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"promo", "promotions", "spring"}; !slices.Equal(tags, want) {
+		t.Errorf("UserTags = %v, want %v", tags, want)
+	}
+
+	from, to := base.Truncate(24*time.Hour), base.Truncate(24*time.Hour).AddDate(0, 0, 1)
+	snapshot := func(tag string, human bool) string {
+		t.Helper()
+		f := AccountFilter{UserID: alice.ID, Tag: tag}
+		var out []string
+		series, err := db.AccountClicksByTimeBucket(ctx, f, from, to, ByDay, time.UTC, human)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range series {
+			out = append(out, fmt.Sprintf("%s=%d/%d", b.Label, b.Count, b.Unique))
+		}
+		countries, err := db.AccountClicksGroupedBy(ctx, f, from, to, "country", human)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range countries {
+			out = append(out, fmt.Sprintf("%s=%d", b.Label, b.Count))
+		}
+		top, err := db.AccountTopLinks(ctx, f, from, to, 2, human)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range top {
+			out = append(out, fmt.Sprintf("%s=%d/%d", l.ShortCode, l.Clicks, l.Unique))
+		}
+		return strings.Join(out, " ")
+	}
+	cases := []struct {
+		tag   string
+		human bool
+		want  string
+	}{
+		{"", true, "2026-04-13=5/3 AT=2 DE=2 FR=1 ACCT01=3/1 ACCT02=1/1"},
+		{"", false, "2026-04-13=6/3 AT=2 DE=2 FR=2 ACCT01=3/1 ACCT03=2/1"},
+		{"promo", true, "2026-04-13=3/1 AT=2 DE=1 ACCT01=3/1"},
+		{"promotions", true, "2026-04-13=1/1 DE=1 ACCT02=1/1"},
+		{"prom", true, ""},
+	}
+	for _, tc := range cases {
+		if got := snapshot(tc.tag, tc.human); got != tc.want {
+			t.Errorf("tag %q, human %v = %s\nwant %s", tc.tag, tc.human, got, tc.want)
+		}
+	}
+
+	// Rolled-up clicks count alike.
+	for {
+		n, err := db.RollupClicks(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < 100 {
+			break
+		}
+	}
+	for _, tc := range cases {
+		if got := snapshot(tc.tag, tc.human); got != tc.want {
+			t.Errorf("rolled up: tag %q, human %v = %s\nwant %s", tc.tag, tc.human, got, tc.want)
+		}
+	}
+}
+
+func TestClickPlaces(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	link := &URL{ShortCode: "PLACES", LongURL: "https://places.example/"}
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 4, 20, 9, 0, 0, 0, time.UTC)
+	for i, c := range []Click{
+		{Region: "Vienna", City: "Vienna", Network: "AS64496 Example Networks"},
+		{Region: "Vienna", City: "Vienna", Network: "AS64496 Example Networks"},
+		{Region: "Illinois", City: "Springfield", Network: "AS64497 Other Carrier"},
+		{Region: "Missouri", City: "Springfield"},
+		{Region: "Tyrol"},
+		{},
+	} {
+		c.URLID = link.ID
+		c.Timestamp = base.Add(time.Duration(i) * time.Minute)
+		if err := db.RecordClick(ctx, &c, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recent, err := db.RecentClicks(ctx, link.ID, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := recent[len(recent)-1]; c.City != "Vienna" || c.Region != "Vienna" || c.Network != "AS64496 Example Networks" {
+		t.Errorf("oldest recent click = %+v, want its region, city and network", c)
+	}
+
+	from, to := base.Add(-time.Hour), base.Add(time.Hour)
+	snapshot := func() string {
+		t.Helper()
+		var out []string
+		for _, column := range []string{"region", "city", "network"} {
+			buckets, err := db.ClicksGroupedBy(ctx, link.ID, from, to, column, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range buckets {
+				out = append(out, fmt.Sprintf("%s=%d", b.Label, b.Count))
+			}
+		}
+		return strings.Join(out, " ")
+	}
+	want := "Unknown=1 Illinois=1 Missouri=1 Tyrol=1 Vienna=2 " +
+		"Unknown=2 Springfield, Illinois=1 Springfield, Missouri=1 Vienna, Vienna=2 " +
+		"Unknown=3 AS64496 Example Networks=2 AS64497 Other Carrier=1"
+	if got := snapshot(); got != want {
+		t.Errorf("raw breakdowns = %s\nwant %s", got, want)
+	}
+	for {
+		n, err := db.RollupClicks(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < 100 {
+			break
+		}
+	}
+	if got := snapshot(); got != want {
+		t.Errorf("rolled-up breakdowns = %s\nwant %s", got, want)
+	}
+}
+
+func TestClickAudience(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	link := &URL{ShortCode: "AUDNCE", LongURL: "https://audience.example/"}
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 4, 27, 9, 0, 0, 0, time.UTC)
+	for i, c := range []Click{
+		{Device: DeviceMobile, OSVersion: "iOS 17.4", BrowserVersion: "Safari 17", Language: "de-AT"},
+		{Device: DeviceMobile, OSVersion: "Android 14", BrowserVersion: "Chrome 126", Language: "de-AT"},
+		{Device: DeviceDesktop, OSVersion: "Windows 10", BrowserVersion: "Chrome 126", Language: "en-US"},
+		{Device: DeviceTablet, OSVersion: "iOS 17.4", BrowserVersion: "Safari 17"},
+		{},
+	} {
+		c.URLID = link.ID
+		c.Timestamp = base.Add(time.Duration(i) * time.Minute)
+		if err := db.RecordClick(ctx, &c, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recent, err := db.RecentClicks(ctx, link.ID, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := recent[len(recent)-1]; c.Device != DeviceMobile || c.OSVersion != "iOS 17.4" || c.BrowserVersion != "Safari 17" || c.Language != "de-AT" {
+		t.Errorf("oldest recent click = %+v, want its device, versions and language", c)
+	}
+
+	from, to := base.Add(-time.Hour), base.Add(time.Hour)
+	snapshot := func() string {
+		t.Helper()
+		var out []string
+		for _, column := range []string{"device", "os_version", "browser_version", "language"} {
+			buckets, err := db.ClicksGroupedBy(ctx, link.ID, from, to, column, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range buckets {
+				out = append(out, fmt.Sprintf("%s=%d", b.Label, b.Count))
+			}
+		}
+		return strings.Join(out, " ")
+	}
+	want := "Unknown=1 desktop=1 mobile=2 tablet=1 " +
+		"Unknown=1 Android 14=1 Windows 10=1 iOS 17.4=2 " +
+		"Unknown=1 Chrome 126=2 Safari 17=2 " +
+		"Unknown=2 de-AT=2 en-US=1"
+	if got := snapshot(); got != want {
+		t.Errorf("raw breakdowns = %s\nwant %s", got, want)
+	}
+	for {
+		n, err := db.RollupClicks(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < 100 {
+			break
+		}
+	}
+	if got := snapshot(); got != want {
+		t.Errorf("rolled-up breakdowns = %s\nwant %s", got, want)
+	}
+}
+
+func TestClickChannels(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	link := &URL{ShortCode: "CHANNL", LongURL: "https://channels.example/"}
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 5, 11, 9, 0, 0, 0, time.UTC)
+	for i, c := range []Click{
+		{Channel: "email", UTMSource: "newsletter", UTMMedium: "email", UTMCampaign: "june"},
+		{Channel: "email", UTMSource: "newsletter", UTMMedium: "email", UTMCampaign: "june"},
+		{Channel: "social", UTMSource: "linkedin", UTMCampaign: "june"},
+		{Channel: "direct"},
+	} {
+		c.URLID = link.ID
+		c.Timestamp = base.Add(time.Duration(i) * time.Minute)
+		if err := db.RecordClick(ctx, &c, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recent, err := db.RecentClicks(ctx, link.ID, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := recent[len(recent)-1]; c.Channel != "email" || c.UTMSource != "newsletter" || c.UTMMedium != "email" || c.UTMCampaign != "june" {
+		t.Errorf("oldest recent click = %+v, want its channel and UTM values", c)
+	}
+
+	from, to := base.Add(-time.Hour), base.Add(time.Hour)
+	snapshot := func() string {
+		t.Helper()
+		var out []string
+		for _, column := range []string{"channel", "utm_source", "utm_medium", "utm_campaign"} {
+			buckets, err := db.ClicksGroupedBy(ctx, link.ID, from, to, column, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range buckets {
+				out = append(out, fmt.Sprintf("%s=%d", b.Label, b.Count))
+			}
+		}
+		return strings.Join(out, " ")
+	}
+	want := "direct=1 email=2 social=1 " +
+		"Unknown=1 linkedin=1 newsletter=2 " +
+		"Unknown=2 email=2 " +
+		"Unknown=1 june=3"
+	if got := snapshot(); got != want {
+		t.Errorf("raw breakdowns = %s\nwant %s", got, want)
+	}
+	for {
+		n, err := db.RollupClicks(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < 100 {
+			break
+		}
+	}
+	if got := snapshot(); got != want {
+		t.Errorf("rolled-up breakdowns = %s\nwant %s", got, want)
+	}
+}
+
+func TestUserAdministration(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	alice, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.UserByLogin(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.IsAdmin || alice.DisabledAt != nil {
+		t.Fatalf("a legacy account reads as admin %v, disabled %v", alice.IsAdmin, alice.DisabledAt)
+	}
+
+	if err := db.CreateUserSession(ctx, &UserSession{ID: "sess-a", UserID: alice.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetUserAdmin(ctx, alice.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetUserDisabled(ctx, alice.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	users, err := db.Users(ctx)
+	if err != nil || len(users) < 2 {
+		t.Fatalf("Users = %v, %v", users, err)
+	}
+	for _, u := range users {
+		if mine := u.ID == alice.ID; u.IsAdmin != mine || (u.DisabledAt != nil) != mine {
+			t.Errorf("%s: admin %v, disabled %v", u.Username, u.IsAdmin, u.DisabledAt)
+		}
+	}
+	if sessions, _ := db.UserSessions(ctx, alice.ID); len(sessions) != 0 {
+		t.Errorf("disabling left %d sessions", len(sessions))
+	}
+	if err := db.SetUserDisabled(ctx, alice.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := db.UserByID(ctx, alice.ID); u.DisabledAt != nil {
+		t.Error("the account is still disabled")
+	}
+
+	link, err := db.URLByShortCode(ctx, "ABC123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TransferURL(ctx, link.ID, bob, SystemActor("command line")); err != nil {
+		t.Fatal(err)
+	}
+	if link, _ = db.URLByShortCode(ctx, "ABC123"); link.UserID == nil || *link.UserID != bob.ID {
+		t.Fatalf("ABC123 after the transfer = %+v; want it owned by bob", link)
+	}
+	revs, err := db.Revisions(ctx, link.ID, 10)
+	if err != nil || revs[0].Action != ActionTransfer || revs[0].Changes[0].From != "alice" || revs[0].Changes[0].To != "bob" {
+		t.Fatalf("newest revision = %+v, %v; want the transfer from alice", revs[0], err)
+	}
+	// Moving it to its owner again records nothing.
+	if err := db.TransferURL(ctx, link.ID, bob, SystemActor("command line")); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := db.Revisions(ctx, link.ID, 10); len(again) != len(revs) {
+		t.Errorf("a transfer to the current owner recorded a revision")
+	}
+}
+
+// TestExportImportRoundTrip moves the legacy fixture through an archive into
+// a fresh database and checks ids, booleans and timestamps survive, that rows
+// SQLite let outlive their owner are left out, and that new rows get fresh
+// ids.
+func TestExportImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := openLegacyFixture(t)
+	alice, err := src.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetUserAdmin(ctx, alice.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	// The Python release never enforced foreign keys, so old files can hold
+	// rows pointing at nothing.
+	if _, err := src.Exec(ctx, "PRAGMA foreign_keys=OFF"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Exec(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES (999, 'gone')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Exec(ctx, "INSERT INTO urls (user_id, short_code, long_url) VALUES (999, 'ORPHAN', 'https://example.com/')"); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive strings.Builder
+	exported, err := src.Export(ctx, &archive)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if i := slices.IndexFunc(exported, func(c TableCount) bool { return c.Table == "clicks" }); i < 0 || exported[i].Rows != 5 {
+		t.Fatalf("exported %+v; want the fixture's 5 clicks", exported)
+	}
+
+	dst := openEmptyDB(t)
+	imported, err := dst.Import(ctx, strings.NewReader(archive.String()))
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	for _, c := range imported {
+		switch c.Table {
+		case "recovery_codes":
+			if c.Skipped != 1 {
+				t.Errorf("recovery_codes: skipped %d, want the orphan", c.Skipped)
+			}
+		case "urls":
+			if c.Rows != 4 || c.Detached != 1 {
+				t.Errorf("urls: %d rows, %d detached; want 4 and 1", c.Rows, c.Detached)
+			}
+		}
+	}
+
+	for _, code := range []string{"ABC123", "ORPHAN"} {
+		want, err := src.URLByShortCode(ctx, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := dst.URLByShortCode(ctx, code)
+		if err != nil {
+			t.Fatalf("%s after the import: %v", code, err)
+		}
+		if got.ID != want.ID || !got.CreatedAt.Equal(want.CreatedAt) || got.ClicksCount != want.ClicksCount ||
+			got.IsEnabled != want.IsEnabled || (got.LastAccessedAt == nil) != (want.LastAccessedAt == nil) {
+			t.Errorf("%s: imported %+v, exported %+v", code, got, want)
+		}
+		if code == "ORPHAN" && got.UserID != nil {
+			t.Errorf("ORPHAN kept the missing owner %d", *got.UserID)
+		}
+	}
+	got, err := dst.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != alice.ID || got.PasswordHash != alice.PasswordHash || !got.IsAdmin || !got.CreatedAt.Equal(alice.CreatedAt) {
+		t.Errorf("alice imported as %+v", got)
+	}
+
+	u := &User{Username: "carol", Email: "carol@example.com", PasswordHash: "x", APIKey: "k"}
+	if err := dst.CreateUser(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID <= alice.ID {
+		t.Errorf("a new account got id %d, at or below the imported %d", u.ID, alice.ID)
+	}
+	if _, err := dst.Import(ctx, strings.NewReader(archive.String())); err == nil {
+		t.Error("an import into a database holding rows succeeded")
+	}
+}
+
+// TestCopyFromUnmigratedDatabase copies a Python-era file that was never
+// migrated, as `redrx import -from` reads it.
+func TestCopyFromUnmigratedDatabase(t *testing.T) {
+	ctx := context.Background()
+	raw, err := os.ReadFile(filepath.Join("testdata", "legacy_python.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	src, err := Open(ctx, "sqlite:///"+filepath.ToSlash(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	dst := openEmptyDB(t)
+	if _, err := Copy(ctx, src, dst); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	var clicks int
+	if err := dst.QueryRow(ctx, "SELECT COUNT(*) FROM clicks").Scan(&clicks); err != nil || clicks != 5 {
+		t.Errorf("copied %d clicks, %v; want 5", clicks, err)
+	}
+	if u, err := dst.UserByLogin(ctx, "bob@example.com"); err != nil || u.IsAdmin || u.DisabledAt != nil {
+		t.Errorf("bob copied as %+v, %v", u, err)
+	}
+
+	// The import refuses at once; the export it leaves waiting is wound up
+	// before Copy returns.
+	if _, err := Copy(ctx, src, dst); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("a copy into a database holding rows = %v", err)
+	}
+	// A source that cannot be read is reported as such, not as a broken
+	// archive.
+	src.Close()
+	if _, err := Copy(ctx, src, openEmptyDB(t)); err == nil || !strings.Contains(err.Error(), "read the source") {
+		t.Errorf("a copy from a closed database = %v", err)
+	}
+}
+
+func openEmptyDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open(context.Background(), "sqlite:///"+filepath.ToSlash(filepath.Join(t.TempDir(), "empty.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestEachClickReadsInChunks reads across chunk boundaries, with and without
+// a limit, and uses the database from fn: on SQLite that would wait forever
+// for the connection if a query were still open.
+func TestEachClickReadsInChunks(t *testing.T) {
+	ctx := context.Background()
+	db := openLegacyFixture(t)
+	alice, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &URL{UserID: &alice.ID, ShortCode: "CHUNKS", LongURL: "https://chunks.example/"}
+	if err := db.CreateURL(ctx, link, SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	clicks := make([]*Click, 2*clickChunk+5)
+	for i := range clicks {
+		clicks[i] = &Click{URLID: link.ID}
+	}
+	if err := db.RecordClicks(ctx, clicks, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limit := range []int{0, clickChunk, clickChunk + 1} {
+		var (
+			n    int
+			last int64
+		)
+		err := db.EachClick(ctx, ClickFilter{UserID: alice.ID, URLID: link.ID, Limit: limit}, func(c *Click) error {
+			if c.ID <= last {
+				return fmt.Errorf("click %d after %d", c.ID, last)
+			}
+			last = c.ID
+			n++
+			_, err := db.URLByShortCode(ctx, c.ShortCode)
+			return err
+		})
+		want := limit
+		if want == 0 {
+			want = len(clicks)
+		}
+		if err != nil || n != want {
+			t.Errorf("limit %d: read %d clicks, %v; want %d", limit, n, err, want)
+		}
+	}
+}
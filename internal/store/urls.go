@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 	"time"
 )
@@ -13,16 +15,21 @@ const urlColumns = `id, user_id, short_code, long_url, COALESCE(rotate_targets,
 	COALESCE(ios_target_url, ''), COALESCE(android_target_url, ''), COALESCE(password_hash, ''),
 	preview_mode, stats_enabled, is_enabled, is_draft, COALESCE(clicks, 0),
 	COALESCE(qr_color, ''), COALESCE(qr_background, ''),
-	created_at, expires_at, start_at, end_at, last_accessed_at`
+	created_at, expires_at, start_at, end_at, last_accessed_at,
+	COALESCE(auto_pause_after, 0), skip_unhealthy_targets, COALESCE(unhealthy_targets, ''),
+	deleted_at, COALESCE(title, ''), COALESCE(tags, '')`
 
 func scanURL(row interface{ Scan(...any) error }) (*URL, error) {
 	var (
 		u                              URL
 		userID                         sql.NullInt64
-		rotateRaw                      string
+		rotateRaw, unhealthyRaw        string
+		tagsRaw                        string
 		preview, stats, enabled, draft nullBool
+		skipUnhealthy                  nullBool
 		createdAt, expiresAt           NullTime
 		startAt, endAt, lastAccessedAt NullTime
+		deletedAt                      NullTime
 	)
 	err := row.Scan(
 		&u.ID, &userID, &u.ShortCode, &u.LongURL, &rotateRaw,
@@ -30,6 +37,8 @@ func scanURL(row interface{ Scan(...any) error }) (*URL, error) {
 		&preview, &stats, &enabled, &draft, &u.ClicksCount,
 		&u.QRColor, &u.QRBackground,
 		&createdAt, &expiresAt, &startAt, &endAt, &lastAccessedAt,
+		&u.AutoPauseAfter, &skipUnhealthy, &unhealthyRaw,
+		&deletedAt, &u.Title, &tagsRaw,
 	)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, ErrNotFound
@@ -53,6 +62,11 @@ func scanURL(row interface{ Scan(...any) error }) (*URL, error) {
 	u.StartAt = startAt.Ptr()
 	u.EndAt = endAt.Ptr()
 	u.LastAccessedAt = lastAccessedAt.Ptr()
+	u.SkipUnhealthyTargets = skipUnhealthy.orDefault(false)
+	// Same JSON-array encoding as rotate_targets.
+	u.UnhealthyTargets = decodeRotateTargets(unhealthyRaw)
+	u.DeletedAt = deletedAt.Ptr()
+	u.Tags = decodeRotateTargets(tagsRaw)
 	return &u, nil
 }
 
@@ -61,71 +75,214 @@ func (d *DB) URLByShortCode(ctx context.Context, code string) (*URL, error) {
 	// and Postgres rejects it in a text parameter outright, turning what should
 	// be a plain miss into a query error and a 500. Every lookup path funnels
 	// through here, so guarding once covers the redirect, stats, QR and API
-	// handlers. Treat it as simply not found.
+	// handlers. Treat it as simply not found. A link in the trash is not found
+	// either, for the same reason: every one of those paths should stop serving it.
 	if strings.IndexByte(code, 0) >= 0 {
 		return nil, ErrNotFound
 	}
-	return scanURL(d.QueryRow(ctx, "SELECT "+urlColumns+" FROM urls WHERE short_code = ?", code))
+	return scanURL(d.QueryRow(ctx, "SELECT "+urlColumns+
+		" FROM urls WHERE short_code = ? AND deleted_at IS NULL", code))
 }
 
+// ShortCodeTaken counts links in the trash too: a trashed link keeps its code
+// so it can be restored, until the purge releases it.
 func (d *DB) ShortCodeTaken(ctx context.Context, code string) (bool, error) {
 	return d.exists(ctx, "SELECT COUNT(*) FROM urls WHERE short_code = ?", code)
 }
 
-func (d *DB) CreateURL(ctx context.Context, u *URL) error {
-	createdAt := NewTime(d.dialect, now())
+// CreateURL inserts a link and records its creation in the link's history.
+// The creation time is now unless u.CreatedAt is already set, as it is for a
+// link imported from another shortener.
+func (d *DB) CreateURL(ctx context.Context, u *URL, actor Actor) error {
+	at := now()
+	if !u.CreatedAt.IsZero() {
+		at = u.CreatedAt
+	}
+	createdAt := NewTime(d.dialect, at)
 	u.CreatedAt = createdAt.Time
 
 	const q = `INSERT INTO urls (
 		user_id, short_code, long_url, rotate_targets, ios_target_url, android_target_url,
 		password_hash, preview_mode, stats_enabled, is_enabled, is_draft, clicks,
 		qr_color, qr_background,
-		created_at, expires_at, start_at, end_at, last_accessed_at
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		created_at, expires_at, start_at, end_at, last_accessed_at,
+		auto_pause_after, skip_unhealthy_targets, title, tags
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
 
-	id, err := d.insertReturningID(ctx, q, "urls",
+	id, err := d.insertReturningID(ctx, tx, q, "urls",
 		nullInt64(u.UserID), u.ShortCode, u.LongURL, encodeRotateTargets(u.RotateTargets),
 		nullString(u.IOSTargetURL), nullString(u.AndroidTargetURL), nullString(u.PasswordHash),
 		u.PreviewMode, u.StatsEnabled, u.IsEnabled, u.IsDraft, u.ClicksCount,
 		nullString(u.QRColor), nullString(u.QRBackground),
 		createdAt, NewNullTime(d.dialect, u.ExpiresAt), NewNullTime(d.dialect, u.StartAt),
 		NewNullTime(d.dialect, u.EndAt), NewNullTime(d.dialect, u.LastAccessedAt),
+		u.AutoPauseAfter, u.SkipUnhealthyTargets, nullString(u.Title), encodeRotateTargets(u.Tags),
 	)
 	if err != nil {
 		return fmt.Errorf("create url: %w", err)
 	}
 	u.ID = id
+
+	state := stateOf(u)
+	if err := d.recordRevision(ctx, tx, u, ActionCreate, actor, diffStates(nil, state), state); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.urlsChanged(u.ShortCode)
+	return nil
+}
+
+// UpdateURL persists the fields the edit form can change, recording what
+// changed. An edit that changes nothing leaves no revision.
+func (d *DB) UpdateURL(ctx context.Context, u *URL, actor Actor) error {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// The before state is read inside the transaction rather than taken from
+	// the caller, whose copy was loaded when the form was opened and may
+	// predate a change made since.
+	current, err := d.urlTx(ctx, tx, u.ID)
+	if err != nil {
+		return err
+	}
+	before := stateOf(current)
+	if err := d.updateURLTx(ctx, tx, u); err != nil {
+		return err
+	}
+	after, err := d.urlTx(ctx, tx, u.ID)
+	if err != nil {
+		return err
+	}
+	if changes := diffStates(before, stateOf(after)); len(changes) > 0 {
+		if err := d.recordRevision(ctx, tx, after, ActionEdit, actor, changes, stateOf(after)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.urlsChanged(current.ShortCode)
 	return nil
 }
 
-// UpdateURL persists the fields the edit form can change.
+// updateURLTx writes the editable fields.
 //
 // is_enabled is deliberately absent: no edit-form field sets it, so writing it
 // back would carry whatever value was read when the form was opened and undo a
-// toggle made from the dashboard in the meantime.
-func (d *DB) UpdateURL(ctx context.Context, u *URL) error {
+// toggle made from the dashboard in the meantime. unhealthy_targets is absent
+// for the same reason; only the health monitor writes it.
+func (d *DB) updateURLTx(ctx context.Context, tx *sql.Tx, u *URL) error {
 	const q = `UPDATE urls SET
 		long_url = ?, ios_target_url = ?, android_target_url = ?, rotate_targets = ?,
-		preview_mode = ?, stats_enabled = ?, expires_at = ?, start_at = ?, end_at = ?, is_draft = ?
+		preview_mode = ?, stats_enabled = ?, expires_at = ?, start_at = ?, end_at = ?, is_draft = ?,
+		auto_pause_after = ?, skip_unhealthy_targets = ?
 		WHERE id = ?`
-	_, err := d.Exec(ctx, q,
+	_, err := tx.ExecContext(ctx, d.rebind(q),
 		u.LongURL, nullString(u.IOSTargetURL), nullString(u.AndroidTargetURL),
 		encodeRotateTargets(u.RotateTargets),
 		u.PreviewMode, u.StatsEnabled,
 		NewNullTime(d.dialect, u.ExpiresAt), NewNullTime(d.dialect, u.StartAt),
-		NewNullTime(d.dialect, u.EndAt), u.IsDraft, u.ID)
+		NewNullTime(d.dialect, u.EndAt), u.IsDraft,
+		u.AutoPauseAfter, u.SkipUnhealthyTargets, u.ID)
 	return err
 }
 
 // PublishURL makes a saved draft eligible for normal schedule-aware routing.
-func (d *DB) PublishURL(ctx context.Context, id int64) error {
-	_, err := d.Exec(ctx, "UPDATE urls SET is_draft = ?, is_enabled = ? WHERE id = ?", false, true, id)
-	return err
+func (d *DB) PublishURL(ctx context.Context, id int64, actor Actor) error {
+	return d.changeURL(ctx, id, actor, ActionPublish,
+		"UPDATE urls SET is_draft = ?, is_enabled = ? WHERE id = ?", false, true, id)
 }
 
-func (d *DB) SetURLEnabled(ctx context.Context, id int64, enabled bool) error {
-	_, err := d.Exec(ctx, "UPDATE urls SET is_enabled = ? WHERE id = ?", enabled, id)
-	return err
+// SetURLEnabled pauses or resumes a link.
+func (d *DB) SetURLEnabled(ctx context.Context, id int64, enabled bool, actor Actor) error {
+	action := ActionDisable
+	if enabled {
+		action = ActionEnable
+	}
+	return d.changeURL(ctx, id, actor, action, "UPDATE urls SET is_enabled = ? WHERE id = ?", enabled, id)
+}
+
+// TransferURL moves a link, with its click history, to another account and
+// records the move. Moving a link to the account that already owns it does
+// nothing.
+func (d *DB) TransferURL(ctx context.Context, id int64, to *User, actor Actor) error {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	link, err := d.urlTx(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if link.UserID != nil && *link.UserID == to.ID {
+		return nil
+	}
+	from := "anonymous"
+	if link.UserID != nil {
+		if err := tx.QueryRowContext(ctx, d.rebind("SELECT username FROM users WHERE id = ?"),
+			*link.UserID).Scan(&from); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, d.rebind("UPDATE urls SET user_id = ? WHERE id = ?"), to.ID, id); err != nil {
+		return fmt.Errorf("transfer url: %w", err)
+	}
+	change := []FieldChange{{Field: "owner", From: from, To: to.Username}}
+	if err := d.recordRevision(ctx, tx, link, ActionTransfer, actor, change, stateOf(link)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.urlsChanged(link.ShortCode)
+	return nil
+}
+
+// changeURL runs a single-row UPDATE and records the resulting change, in one
+// transaction. Nothing is recorded when the statement changed nothing, such as
+// pausing a link that was already paused.
+func (d *DB) changeURL(ctx context.Context, id int64, actor Actor, action, query string, args ...any) error {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	current, err := d.urlTx(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	before := stateOf(current)
+	if _, err := tx.ExecContext(ctx, d.rebind(query), args...); err != nil {
+		return err
+	}
+	after, err := d.urlTx(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if changes := diffStates(before, stateOf(after)); len(changes) > 0 {
+		if err := d.recordRevision(ctx, tx, after, action, actor, changes, stateOf(after)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.urlsChanged(current.ShortCode)
+	return nil
 }
 
 func (d *DB) TouchLastAccessed(ctx context.Context, id int64, at time.Time) error {
@@ -134,23 +291,36 @@ func (d *DB) TouchLastAccessed(ctx context.Context, id int64, at time.Time) erro
 	return err
 }
 
-// DeleteURL removes a link and its click history in one transaction, so an
-// interruption between the two statements cannot leave the link live with its
-// history gone — which is the opposite of what every caller intends.
-func (d *DB) DeleteURL(ctx context.Context, id int64) error {
+// DeleteURL moves a link to the trash. It stops resolving at once but keeps
+// its code and click history until PurgeDeletedURLs removes it, so a mistaken
+// delete can be undone with RestoreUserURLs. Deleting a link that is already
+// in the trash, or gone, does nothing.
+func (d *DB) DeleteURL(ctx context.Context, id int64, actor Actor) error {
 	tx, err := d.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = tx.Rollback() }()
 
-	if _, err := tx.ExecContext(ctx, d.rebind("DELETE FROM clicks WHERE url_id = ?"), id); err != nil {
-		return fmt.Errorf("delete clicks: %w", err)
+	link, err := d.urlTx(ctx, tx, id)
+	if errors.Is(err, ErrNotFound) || (err == nil && link.DeletedAt != nil) {
+		return nil
 	}
-	if _, err := tx.ExecContext(ctx, d.rebind("DELETE FROM urls WHERE id = ?"), id); err != nil {
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, d.rebind("UPDATE urls SET deleted_at = ? WHERE id = ?"),
+		NewTime(d.dialect, now()), id); err != nil {
 		return fmt.Errorf("delete url: %w", err)
 	}
-	return tx.Commit()
+	if err := d.recordRevision(ctx, tx, link, ActionDelete, actor, nil, stateOf(link)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.urlsChanged(link.ShortCode)
+	return nil
 }
 
 // SetURLEnabledToggle flips is_enabled in a single statement and reports the new
@@ -158,44 +328,60 @@ func (d *DB) DeleteURL(ctx context.Context, id int64) error {
 // both read the old value and both write the same new one, so the link ends up
 // in the state one click should have produced, and the JSON response describes a
 // state the row may not be in.
-func (d *DB) SetURLEnabledToggle(ctx context.Context, id int64) (bool, error) {
+func (d *DB) SetURLEnabledToggle(ctx context.Context, id int64, actor Actor) (bool, error) {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var enabled nullBool
 	if d.dialect == Postgres {
 		// RETURNING reads back the value this UPDATE wrote, in the same
 		// statement, so an interleaving toggle cannot slip between the write and
 		// the read.
-		var enabled nullBool
-		if err := d.QueryRow(ctx,
-			"UPDATE urls SET is_enabled = NOT COALESCE(is_enabled, ?) WHERE id = ? RETURNING is_enabled",
+		if err := tx.QueryRowContext(ctx, d.rebind(
+			"UPDATE urls SET is_enabled = NOT COALESCE(is_enabled, ?) WHERE id = ? RETURNING is_enabled"),
 			true, id).Scan(&enabled); err != nil {
 			return false, err
 		}
-		return enabled.orDefault(true), nil
+	} else {
+		// SQLite has no NOT operator for its integer booleans in this position,
+		// so the flip and the read-back go in one transaction — otherwise two
+		// toggles racing could each read the other's value and report a state
+		// this call did not produce.
+		if _, err := tx.ExecContext(ctx,
+			d.rebind("UPDATE urls SET is_enabled = CASE WHEN COALESCE(is_enabled, ?) THEN 0 ELSE 1 END WHERE id = ?"),
+			true, id); err != nil {
+			return false, err
+		}
+		if err := tx.QueryRowContext(ctx,
+			d.rebind("SELECT is_enabled FROM urls WHERE id = ?"), id).Scan(&enabled); err != nil {
+			return false, err
+		}
 	}
+	on := enabled.orDefault(true)
 
-	// SQLite has no NOT operator for its integer booleans in this position, so
-	// the flip and the read-back go in one transaction — otherwise two toggles
-	// racing could each read the other's value and report a state this call did
-	// not produce.
-	tx, err := d.BeginTx(ctx, nil)
+	// The row is locked by the UPDATE above, so this read sees exactly the
+	// state the toggle produced.
+	link, err := d.urlTx(ctx, tx, id)
 	if err != nil {
 		return false, err
 	}
-	defer func() { _ = tx.Rollback() }()
-
-	if _, err := tx.ExecContext(ctx,
-		d.rebind("UPDATE urls SET is_enabled = CASE WHEN COALESCE(is_enabled, ?) THEN 0 ELSE 1 END WHERE id = ?"),
-		true, id); err != nil {
-		return false, err
+	action := ActionDisable
+	if on {
+		action = ActionEnable
 	}
-	var enabled nullBool
-	if err := tx.QueryRowContext(ctx,
-		d.rebind("SELECT is_enabled FROM urls WHERE id = ?"), id).Scan(&enabled); err != nil {
+	change := []FieldChange{{Field: "is_enabled", From: yesNo(!on), To: yesNo(on)}}
+	if err := d.recordRevision(ctx, tx, link, action, actor, change, stateOf(link)); err != nil {
 		return false, err
 	}
+
 	if err := tx.Commit(); err != nil {
 		return false, err
 	}
-	return enabled.orDefault(true), nil
+	d.urlsChanged(link.ShortCode)
+	return on, nil
 }
 
 // deleteBatchSize caps how many ids go into one IN clause, so a large
@@ -204,11 +390,134 @@ func (d *DB) SetURLEnabledToggle(ctx context.Context, id int64) (bool, error) {
 // one parameter and the query adds one for user_id, so 500 is safe everywhere.
 const deleteBatchSize = 500
 
-// DeleteUserURLs removes the given links, ignoring any not owned by the user.
-// It returns the number of links actually deleted. Everything runs in one
-// transaction, matching DeleteURL, so an interruption cannot leave a link's
-// click history deleted while the link itself survives.
-func (d *DB) DeleteUserURLs(ctx context.Context, userID int64, ids []int64) (int64, error) {
+// DeleteUserURLs moves the given links to the trash, ignoring any not owned by
+// the user or already there. It returns the number of links actually moved.
+func (d *DB) DeleteUserURLs(ctx context.Context, userID int64, ids []int64, actor Actor) (int64, error) {
+	deletedAt := NewTime(d.dialect, now())
+	return d.eachUserURL(ctx, userID, ids, "deleted_at IS NULL", func(tx *sql.Tx, link *URL) error {
+		if _, err := tx.ExecContext(ctx, d.rebind("UPDATE urls SET deleted_at = ? WHERE id = ?"),
+			deletedAt, link.ID); err != nil {
+			return err
+		}
+		return d.recordRevision(ctx, tx, link, ActionDelete, actor, nil, stateOf(link))
+	})
+}
+
+// RestoreUserURLs takes the given links out of the trash, ignoring any not
+// owned by the user or not in the trash. validate sees each link before it is
+// restored and can keep it in the trash — a link the phishing sweep removed
+// should stay there while its destination is still blocked. It returns the
+// number of links restored.
+func (d *DB) RestoreUserURLs(ctx context.Context, userID int64, ids []int64, actor Actor, validate func(*URL) error) (int64, error) {
+	return d.eachUserURL(ctx, userID, ids, "deleted_at IS NOT NULL", func(tx *sql.Tx, link *URL) error {
+		if validate != nil {
+			if err := validate(link); err != nil {
+				return errSkip
+			}
+		}
+		if _, err := tx.ExecContext(ctx, d.rebind("UPDATE urls SET deleted_at = NULL WHERE id = ?"),
+			link.ID); err != nil {
+			return err
+		}
+		return d.recordRevision(ctx, tx, link, ActionRestore, actor, nil, stateOf(link))
+	})
+}
+
+// PurgeUserURLs permanently removes the given links from the user's trash,
+// with their click history. Live links are never touched.
+func (d *DB) PurgeUserURLs(ctx context.Context, userID int64, ids []int64) (int64, error) {
+	return d.eachUserURL(ctx, userID, ids, "deleted_at IS NOT NULL", func(tx *sql.Tx, link *URL) error {
+		return d.purgeURLTx(ctx, tx, link.ID)
+	})
+}
+
+// PurgeDeletedURLs permanently removes every link that went into the trash
+// before cutoff, with its click history, and returns how many it removed.
+// The links' revisions are kept, so the history still records the deletion.
+func (d *DB) PurgeDeletedURLs(ctx context.Context, cutoff time.Time) (int64, error) {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Clear the child rows first; SQLite files created by SQLAlchemy have no
+	// ON DELETE CASCADE on this foreign key.
+	before := NewTime(d.dialect, cutoff)
+	const expired = "SELECT id FROM urls WHERE deleted_at IS NOT NULL AND deleted_at < ?"
+	codes, err := d.codesTx(ctx, tx, "SELECT short_code FROM urls WHERE deleted_at IS NOT NULL AND deleted_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, d.rebind("DELETE FROM clicks WHERE url_id IN ("+expired+")"), before); err != nil {
+		return 0, fmt.Errorf("purge clicks: %w", err)
+	}
+	for _, child := range linkChildren {
+		if _, err := tx.ExecContext(ctx, d.rebind("DELETE FROM "+child+" WHERE url_id IN ("+expired+")"), before); err != nil {
+			return 0, fmt.Errorf("purge %s: %w", child, err)
+		}
+	}
+	res, err := tx.ExecContext(ctx, d.rebind(
+		"DELETE FROM urls WHERE deleted_at IS NOT NULL AND deleted_at < ?"), before)
+	if err != nil {
+		return 0, fmt.Errorf("purge urls: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	d.urlsChanged(codes...)
+	return n, nil
+}
+
+// codesTx returns the short codes a query selects.
+func (d *DB) codesTx(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, d.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+// linkChildren are the tables besides clicks whose rows go with a purged
+// link.
+var linkChildren = []string{"link_health", "click_rollups", "click_dimension_rollups"}
+
+// purgeURLTx removes one link and its child rows.
+func (d *DB) purgeURLTx(ctx context.Context, tx *sql.Tx, id int64) error {
+	if _, err := tx.ExecContext(ctx, d.rebind("DELETE FROM clicks WHERE url_id = ?"), id); err != nil {
+		return fmt.Errorf("delete clicks: %w", err)
+	}
+	for _, child := range linkChildren {
+		if _, err := tx.ExecContext(ctx, d.rebind("DELETE FROM "+child+" WHERE url_id = ?"), id); err != nil {
+			return fmt.Errorf("delete %s: %w", child, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, d.rebind("DELETE FROM urls WHERE id = ?"), id); err != nil {
+		return fmt.Errorf("delete url: %w", err)
+	}
+	return nil
+}
+
+// errSkip tells eachUserURL to leave a link alone without failing the batch.
+var errSkip = errors.New("skip")
+
+// eachUserURL loads the user's links among ids that match state, and calls fn
+// for each inside one transaction, so a batch either applies in full or not at
+// all. It returns how many links fn handled without returning errSkip.
+func (d *DB) eachUserURL(ctx context.Context, userID int64, ids []int64, state string, fn func(*sql.Tx, *URL) error) (int64, error) {
 	if len(ids) == 0 {
 		return 0, nil
 	}
@@ -219,7 +528,10 @@ func (d *DB) DeleteUserURLs(ctx context.Context, userID int64, ids []int64) (int
 	}
 	defer func() { _ = tx.Rollback() }()
 
-	var deleted int64
+	var (
+		handled int64
+		codes   []string
+	)
 	for start := 0; start < len(ids); start += deleteBatchSize {
 		end := start + deleteBatchSize
 		if end > len(ids) {
@@ -234,36 +546,54 @@ func (d *DB) DeleteUserURLs(ctx context.Context, userID int64, ids []int64) (int
 		}
 		args = append(args, userID)
 
-		// Clear the child rows first; SQLite files created by SQLAlchemy have no
-		// ON DELETE CASCADE on this foreign key.
-		if _, err := tx.ExecContext(ctx, d.rebind(fmt.Sprintf(
-			"DELETE FROM clicks WHERE url_id IN (SELECT id FROM urls WHERE id IN (%s) AND user_id = ?)",
-			placeholders)), args...); err != nil {
-			return 0, err
-		}
-
-		res, err := tx.ExecContext(ctx, d.rebind(fmt.Sprintf(
-			"DELETE FROM urls WHERE id IN (%s) AND user_id = ?", placeholders)), args...)
+		// Read the links fully before running fn: on SQLite the transaction
+		// holds the pool's only connection.
+		rows, err := tx.QueryContext(ctx, d.rebind(fmt.Sprintf(
+			"SELECT "+urlColumns+" FROM urls WHERE id IN (%s) AND user_id = ? AND "+state, placeholders)), args...)
 		if err != nil {
 			return 0, err
 		}
-		n, err := res.RowsAffected()
+		links, err := collectURLs(rows)
+		rows.Close()
 		if err != nil {
 			return 0, err
 		}
-		deleted += n
+		for _, link := range links {
+			err := fn(tx, link)
+			if errors.Is(err, errSkip) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			handled++
+			codes = append(codes, link.ShortCode)
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		return 0, err
 	}
-	return deleted, nil
+	d.urlsChanged(codes...)
+	return handled, nil
+}
+
+// TrashedUserURLs returns the links in a user's trash, most recently deleted
+// first.
+func (d *DB) TrashedUserURLs(ctx context.Context, userID int64) ([]*URL, error) {
+	rows, err := d.Query(ctx, "SELECT "+urlColumns+
+		" FROM urls WHERE user_id = ? AND deleted_at IS NOT NULL ORDER BY deleted_at DESC, id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return collectURLs(rows)
 }
 
 // UserURLs returns one page of a user's links, newest first.
 func (d *DB) UserURLs(ctx context.Context, userID int64, limit, offset int) ([]*URL, error) {
 	rows, err := d.Query(ctx, "SELECT "+urlColumns+
-		" FROM urls WHERE user_id = ? ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?",
+		" FROM urls WHERE user_id = ? AND deleted_at IS NULL ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?",
 		userID, limit, offset)
 	if err != nil {
 		return nil, err
@@ -275,7 +605,42 @@ func (d *DB) UserURLs(ctx context.Context, userID int64, limit, offset int) ([]*
 // AllUserURLs returns every link owned by a user, for CSV export.
 func (d *DB) AllUserURLs(ctx context.Context, userID int64) ([]*URL, error) {
 	rows, err := d.Query(ctx, "SELECT "+urlColumns+
-		" FROM urls WHERE user_id = ? ORDER BY created_at DESC, id DESC", userID)
+		" FROM urls WHERE user_id = ? AND deleted_at IS NULL ORDER BY created_at DESC, id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return collectURLs(rows)
+}
+
+// UserTags returns the tags on a user's live links, sorted.
+func (d *DB) UserTags(ctx context.Context, userID int64) ([]string, error) {
+	rows, err := d.Query(ctx,
+		"SELECT tags FROM urls WHERE user_id = ? AND deleted_at IS NULL AND tags IS NOT NULL", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	seen := map[string]bool{}
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		for _, tag := range decodeRotateTargets(raw) {
+			seen[tag] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return slices.Sorted(maps.Keys(seen)), nil
+}
+
+// ExportUserURLs returns every link owned by a user, the trash included, for
+// the account data export.
+func (d *DB) ExportUserURLs(ctx context.Context, userID int64) ([]*URL, error) {
+	rows, err := d.Query(ctx, "SELECT "+urlColumns+" FROM urls WHERE user_id = ? ORDER BY id", userID)
 	if err != nil {
 		return nil, err
 	}
@@ -307,7 +672,7 @@ func (d *DB) DashboardStats(ctx context.Context, userID int64) (*DashboardStats,
 	var s DashboardStats
 
 	if err := d.QueryRow(ctx,
-		"SELECT COUNT(*), COALESCE(SUM(clicks), 0) FROM urls WHERE user_id = ?", userID,
+		"SELECT COUNT(*), COALESCE(SUM(clicks), 0) FROM urls WHERE user_id = ? AND deleted_at IS NULL", userID,
 	).Scan(&s.TotalLinks, &s.TotalClicks); err != nil {
 		return nil, err
 	}
@@ -321,6 +686,7 @@ func (d *DB) DashboardStats(ctx context.Context, userID int64) (*DashboardStats,
 	if err := d.QueryRow(ctx,
 		`SELECT COUNT(*) FROM urls
 		 WHERE user_id = ?
+		   AND deleted_at IS NULL
 		   AND COALESCE(is_enabled, ?) = ?
 		   AND COALESCE(is_draft, ?) = ?
 		   AND (start_at IS NULL OR start_at <= ?)
@@ -332,7 +698,7 @@ func (d *DB) DashboardStats(ctx context.Context, userID int64) (*DashboardStats,
 	}
 
 	top, err := scanURL(d.QueryRow(ctx, "SELECT "+urlColumns+
-		" FROM urls WHERE user_id = ? ORDER BY clicks DESC, id ASC LIMIT 1", userID))
+		" FROM urls WHERE user_id = ? AND deleted_at IS NULL ORDER BY clicks DESC, id ASC LIMIT 1", userID))
 	if err != nil && !errors.Is(err, ErrNotFound) {
 		return nil, err
 	}
@@ -342,10 +708,11 @@ func (d *DB) DashboardStats(ctx context.Context, userID int64) (*DashboardStats,
 	return &s, nil
 }
 
-// EachURL calls fn for every link, for the phishing sweep. The rows are fully
-// materialised and the query closed before any callback runs: on SQLite the
-// pool is a single connection, so a callback that touched the database while the
-// rows were still open would deadlock.
+// EachURL calls fn for every link outside the trash, for the phishing sweep and
+// the health monitor. The rows are fully materialised and the query closed
+// before any callback runs: on SQLite the pool is a single connection, so a
+// callback that touched the database while the rows were still open would
+// deadlock.
 func (d *DB) EachURL(ctx context.Context, fn func(*URL) error) error {
 	urls, err := d.allURLs(ctx)
 	if err != nil {
@@ -362,7 +729,7 @@ func (d *DB) EachURL(ctx context.Context, fn func(*URL) error) error {
 // allURLs reads every link into memory, closing the query before returning so
 // the caller can iterate without holding the connection open.
 func (d *DB) allURLs(ctx context.Context) ([]*URL, error) {
-	rows, err := d.Query(ctx, "SELECT "+urlColumns+" FROM urls ORDER BY id")
+	rows, err := d.Query(ctx, "SELECT "+urlColumns+" FROM urls WHERE deleted_at IS NULL ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const userSessionColumns = `id, user_id, COALESCE(user_agent, ''), COALESCE(ip_address, ''),
+	COALESCE(country, ''), created_at, last_seen_at`
+
+func scanUserSession(row interface{ Scan(...any) error }) (*UserSession, error) {
+	var (
+		s          UserSession
+		createdAt  NullTime
+		lastSeenAt NullTime
+	)
+	err := row.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IPAddress, &s.Country, &createdAt, &lastSeenAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.CreatedAt = createdAt.Time
+	s.LastSeenAt = lastSeenAt.Time
+	return &s, nil
+}
+
+// CreateUserSession registers a newly signed-in session.
+func (d *DB) CreateUserSession(ctx context.Context, s *UserSession) error {
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = now()
+	}
+	if s.LastSeenAt.IsZero() {
+		s.LastSeenAt = s.CreatedAt
+	}
+	_, err := d.Exec(ctx, `INSERT INTO user_sessions
+		(id, user_id, user_agent, ip_address, country, created_at, last_seen_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		s.ID, s.UserID, truncateString(s.UserAgent, 255), truncateString(s.IPAddress, 45),
+		truncateString(s.Country, 100), NewTime(d.dialect, s.CreatedAt), NewTime(d.dialect, s.LastSeenAt))
+	return err
+}
+
+// UserSession loads a registered session, or ErrNotFound once it has been
+// revoked.
+func (d *DB) UserSession(ctx context.Context, id string) (*UserSession, error) {
+	return scanUserSession(d.QueryRow(ctx, "SELECT "+userSessionColumns+" FROM user_sessions WHERE id = ?", id))
+}
+
+// TouchUserSession records that the session was used at the given time.
+func (d *DB) TouchUserSession(ctx context.Context, id string, at time.Time) error {
+	_, err := d.Exec(ctx, "UPDATE user_sessions SET last_seen_at = ? WHERE id = ?", NewTime(d.dialect, at), id)
+	return err
+}
+
+// UserSessions lists a user's sessions, most recently used first.
+func (d *DB) UserSessions(ctx context.Context, userID int64) ([]*UserSession, error) {
+	rows, err := d.Query(ctx, "SELECT "+userSessionColumns+
+		" FROM user_sessions WHERE user_id = ? ORDER BY last_seen_at DESC, created_at DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*UserSession
+	for rows.Next() {
+		s, err := scanUserSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// DeleteUserSession revokes one of the user's sessions and reports whether it
+// existed.
+func (d *DB) DeleteUserSession(ctx context.Context, userID int64, id string) (bool, error) {
+	res, err := d.Exec(ctx, "DELETE FROM user_sessions WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteUserSessions revokes every session of the user except the one with id
+// except, which may be empty to revoke them all.
+func (d *DB) DeleteUserSessions(ctx context.Context, userID int64, except string) error {
+	_, err := d.Exec(ctx, "DELETE FROM user_sessions WHERE user_id = ? AND id <> ?", userID, except)
+	return err
+}
+
+// PurgeUserSessions removes sessions idle since before cutoff, whose cookies
+// have expired anyway, and reports how many went.
+func (d *DB) PurgeUserSessions(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := d.Exec(ctx, "DELETE FROM user_sessions WHERE last_seen_at < ?", NewTime(d.dialect, cutoff))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -5,19 +5,26 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 )
 
 const userColumns = `id, username, email, password_hash, COALESCE(api_key, ''),
-	COALESCE(totp_secret, ''), totp_enabled, created_at`
+	COALESCE(totp_secret, ''), totp_enabled, created_at, email_verified_at, COALESCE(timezone, ''),
+	COALESCE(excluded_networks, ''), is_admin, disabled_at`
 
 func scanUser(row interface{ Scan(...any) error }) (*User, error) {
 	var (
-		u           User
-		createdAt   NullTime
-		totpEnabled nullBool
+		u               User
+		createdAt       NullTime
+		totpEnabled     nullBool
+		emailVerifiedAt NullTime
+		excluded        string
+		isAdmin         nullBool
+		disabledAt      NullTime
 	)
 	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.PasswordHash, &u.APIKey,
-		&u.TOTPSecret, &totpEnabled, &createdAt)
+		&u.TOTPSecret, &totpEnabled, &createdAt, &emailVerifiedAt, &u.Timezone, &excluded,
+		&isAdmin, &disabledAt)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, ErrNotFound
 	}
@@ -26,6 +33,10 @@ func scanUser(row interface{ Scan(...any) error }) (*User, error) {
 	}
 	u.CreatedAt = createdAt.Time
 	u.TOTPEnabled = totpEnabled.orDefault(false)
+	u.EmailVerifiedAt = emailVerifiedAt.Ptr()
+	u.ExcludedNetworks = strings.Fields(excluded)
+	u.IsAdmin = isAdmin.orDefault(false)
+	u.DisabledAt = disabledAt.Ptr()
 	return &u, nil
 }
 
@@ -44,6 +55,15 @@ func (d *DB) UserByLogin(ctx context.Context, login string) (*User, error) {
 		login, login, login))
 }
 
+// UserByEmail finds the account registered to an address, for a password
+// reset request.
+func (d *DB) UserByEmail(ctx context.Context, email string) (*User, error) {
+	if email == "" {
+		return nil, ErrNotFound
+	}
+	return scanUser(d.QueryRow(ctx, "SELECT "+userColumns+" FROM users WHERE email = ?", email))
+}
+
 func (d *DB) UserByAPIKey(ctx context.Context, key string) (*User, error) {
 	if key == "" {
 		return nil, ErrNotFound
@@ -84,7 +104,7 @@ func (d *DB) CreateUser(ctx context.Context, u *User) error {
 	const q = `INSERT INTO users (username, email, password_hash, api_key, created_at)
 	           VALUES (?, ?, ?, ?, ?)`
 
-	id, err := d.insertReturningID(ctx, q, "users", u.Username, u.Email, u.PasswordHash, apiKey, createdAt)
+	id, err := d.insertReturningID(ctx, d.DB, q, "users", u.Username, u.Email, u.PasswordHash, apiKey, createdAt)
 	if err != nil {
 		return fmt.Errorf("create user: %w", err)
 	}
@@ -92,6 +112,52 @@ func (d *DB) CreateUser(ctx context.Context, u *User) error {
 	return nil
 }
 
+// Users returns every account, oldest first.
+func (d *DB) Users(ctx context.Context) ([]*User, error) {
+	rows, err := d.Query(ctx, "SELECT "+userColumns+" FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []*User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// SetUserAdmin grants or revokes the admin pages.
+func (d *DB) SetUserAdmin(ctx context.Context, userID int64, admin bool) error {
+	_, err := d.Exec(ctx, "UPDATE users SET is_admin = ? WHERE id = ?", admin, userID)
+	return err
+}
+
+// SetUserDisabled disables or re-enables an account. Disabling also ends the
+// sessions registered in the database; the web server turns away any other
+// session of a disabled account on its next request.
+func (d *DB) SetUserDisabled(ctx context.Context, userID int64, disabled bool) error {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var at any
+	if disabled {
+		at = NewTime(d.dialect, now())
+		if _, err := tx.ExecContext(ctx, d.rebind("DELETE FROM user_sessions WHERE user_id = ?"), userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, d.rebind("UPDATE users SET disabled_at = ? WHERE id = ?"), at, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (d *DB) SetAPIKey(ctx context.Context, userID int64, key string) error {
 	_, err := d.Exec(ctx, "UPDATE users SET api_key = ? WHERE id = ?", key, userID)
 	return err
@@ -102,6 +168,69 @@ func (d *DB) SetUserPasswordHash(ctx context.Context, userID int64, hash string)
 	return err
 }
 
+// ChangeUsername renames the account. A name taken in the meantime fails the
+// unique index; callers check UsernameTaken first for a friendly message.
+func (d *DB) ChangeUsername(ctx context.Context, userID int64, username string) error {
+	_, err := d.Exec(ctx, "UPDATE users SET username = ? WHERE id = ?", username, userID)
+	return err
+}
+
+// SetUserTimezone records the IANA zone the user's analytics are shown in.
+// The caller validates it; empty resets to UTC.
+func (d *DB) SetUserTimezone(ctx context.Context, userID int64, tz string) error {
+	_, err := d.Exec(ctx, "UPDATE users SET timezone = ? WHERE id = ?", nullString(tz), userID)
+	return err
+}
+
+// SetUserExcludedNetworks records the addresses and CIDR blocks whose clicks
+// on the user's links are internal traffic. The caller validates them.
+func (d *DB) SetUserExcludedNetworks(ctx context.Context, userID int64, networks []string) error {
+	_, err := d.Exec(ctx, "UPDATE users SET excluded_networks = ? WHERE id = ?",
+		nullString(strings.Join(networks, " ")), userID)
+	return err
+}
+
+// ChangeEmail moves the account to newEmail if its address is still oldEmail,
+// and reports whether it did, so a confirmation link works once. verified
+// records that newEmail was proved by a link sent to it; otherwise the new
+// address starts out unverified.
+func (d *DB) ChangeEmail(ctx context.Context, userID int64, oldEmail, newEmail string, verified bool) (bool, error) {
+	var verifiedAt any
+	if verified {
+		verifiedAt = NewTime(d.dialect, now())
+	}
+	res, err := d.Exec(ctx, "UPDATE users SET email = ?, email_verified_at = ? WHERE id = ? AND email = ?",
+		newEmail, verifiedAt, userID, oldEmail)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ResetUserPassword replaces the password hash only if it is still oldHash,
+// and reports whether it did. Two requests racing to use the same reset link
+// cannot both succeed: the first changes the hash the second is conditioned on.
+func (d *DB) ResetUserPassword(ctx context.Context, userID int64, oldHash, newHash string) (bool, error) {
+	res, err := d.Exec(ctx, "UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?",
+		newHash, userID, oldHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// MarkEmailVerified records that the owner of email received a verification
+// link. Nothing changes if the account's address has changed since the link
+// was sent, or if it is already verified.
+func (d *DB) MarkEmailVerified(ctx context.Context, userID int64, email string) error {
+	_, err := d.Exec(ctx,
+		"UPDATE users SET email_verified_at = ? WHERE id = ? AND email = ? AND email_verified_at IS NULL",
+		NewTime(d.dialect, now()), userID, email)
+	return err
+}
+
 // SetTOTPPending stores an encrypted enrollment secret without enabling 2FA.
 func (d *DB) SetTOTPPending(ctx context.Context, userID int64, encryptedSecret string) error {
 	_, err := d.Exec(ctx,
@@ -137,7 +266,8 @@ func (d *DB) EnableTOTP(ctx context.Context, userID int64, codeHashes []string)
 	return tx.Commit()
 }
 
-// DisableTOTP clears the secret and every unused recovery code together.
+// DisableTOTP clears the secret, and the unused recovery codes with it unless
+// a security key still needs them.
 func (d *DB) DisableTOTP(ctx context.Context, userID int64) error {
 	tx, err := d.BeginTx(ctx, nil)
 	if err != nil {
@@ -149,7 +279,8 @@ func (d *DB) DisableTOTP(ctx context.Context, userID int64) error {
 		return err
 	}
 	if _, err := tx.ExecContext(ctx, d.rebind(
-		"DELETE FROM recovery_codes WHERE user_id = ?"), userID); err != nil {
+		`DELETE FROM recovery_codes WHERE user_id = ?
+		 AND NOT EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = ?)`), userID, userID); err != nil {
 		return err
 	}
 	return tx.Commit()
@@ -167,15 +298,99 @@ func (d *DB) ConsumeRecoveryCode(ctx context.Context, userID int64, codeHash str
 	return n == 1, err
 }
 
+// DeleteUser removes an account and everything stored about it, in one
+// transaction: a failure part way leaves the account as it was.
+//
+// With an heir, the account's live links move to the heir with their click
+// history, each with a revision recording the transfer; without one they are
+// deleted with their clicks and history. Links in the trash are deleted either
+// way. Revisions the account made on links that survive it keep the change but
+// no longer name who made it.
+func (d *DB) DeleteUser(ctx context.Context, user, heir *User) error {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Read the links fully before writing: on SQLite the transaction holds the
+	// pool's only connection.
+	rows, err := tx.QueryContext(ctx, d.rebind("SELECT "+urlColumns+" FROM urls WHERE user_id = ?"), user.ID)
+	if err != nil {
+		return err
+	}
+	links, err := collectURLs(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	actor := Actor{Name: deletedActor, Source: SourceSystem}
+	for _, link := range links {
+		if heir == nil || link.DeletedAt != nil {
+			if err := d.purgeURLTx(ctx, tx, link.ID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, d.rebind("DELETE FROM url_revisions WHERE url_id = ?"), link.ID); err != nil {
+				return fmt.Errorf("delete revisions: %w", err)
+			}
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, d.rebind("UPDATE urls SET user_id = ? WHERE id = ?"), heir.ID, link.ID); err != nil {
+			return fmt.Errorf("transfer url: %w", err)
+		}
+		change := []FieldChange{{Field: "owner", From: user.Username, To: heir.Username}}
+		if err := d.recordRevision(ctx, tx, link, ActionTransfer, actor, change, stateOf(link)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, d.rebind(
+		"UPDATE url_revisions SET actor_user_id = NULL, actor = ? WHERE actor_user_id = ?"),
+		deletedActor, user.ID); err != nil {
+		return fmt.Errorf("anonymise revisions: %w", err)
+	}
+	for _, table := range []string{"recovery_codes", "webauthn_credentials", "user_sessions", "security_events"} {
+		if _, err := tx.ExecContext(ctx, d.rebind("DELETE FROM "+table+" WHERE user_id = ?"), user.ID); err != nil {
+			return fmt.Errorf("delete %s: %w", table, err)
+		}
+	}
+	res, err := tx.ExecContext(ctx, d.rebind("DELETE FROM users WHERE id = ?"), user.ID)
+	if err != nil {
+		return fmt.Errorf("delete user: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	codes := make([]string, len(links))
+	for i, link := range links {
+		codes[i] = link.ShortCode
+	}
+	d.urlsChanged(codes...)
+	return nil
+}
+
+// execer is what *sql.DB and *sql.Tx have in common, so a write helper can run
+// on its own or inside a caller's transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 // insertReturningID runs an INSERT and reports the new primary key, using
 // whichever mechanism the backend provides.
-func (d *DB) insertReturningID(ctx context.Context, query, table string, args ...any) (int64, error) {
+func (d *DB) insertReturningID(ctx context.Context, ex execer, query, table string, args ...any) (int64, error) {
 	if d.dialect == Postgres {
 		var id int64
-		err := d.QueryRow(ctx, query+" RETURNING id", args...).Scan(&id)
+		err := ex.QueryRowContext(ctx, d.rebind(query+" RETURNING id"), args...).Scan(&id)
 		return id, err
 	}
-	res, err := d.Exec(ctx, query, args...)
+	res, err := ex.ExecContext(ctx, d.rebind(query), args...)
 	if err != nil {
 		return 0, err
 	}
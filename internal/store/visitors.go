@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// VisitorSalt returns the salt visitor hashes are keyed with on day, a UTC
+// date as "2006-01-02", creating it on first use. Every instance asking for
+// the same day gets the same salt, so a visitor hashes alike whichever
+// replica serves them.
+func (d *DB) VisitorSalt(ctx context.Context, day string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// Both dialects accept ON CONFLICT ... DO NOTHING; the first writer wins
+	// and everyone reads its salt back.
+	if _, err := d.Exec(ctx, "INSERT INTO visitor_salts (day, salt) VALUES (?, ?) ON CONFLICT (day) DO NOTHING",
+		day, hex.EncodeToString(b)); err != nil {
+		return "", err
+	}
+	var salt string
+	err := d.QueryRow(ctx, "SELECT salt FROM visitor_salts WHERE day = ?", day).Scan(&salt)
+	return salt, err
+}
+
+// ForgetVisitors clears the visitor hashes of clicks before cutoff, whose
+// dedupe window has passed, and deletes the salts of days before today, so
+// yesterday's hashes can no longer be matched to anyone. It returns the
+// clicks cleared.
+func (d *DB) ForgetVisitors(ctx context.Context, cutoff time.Time, today string) (int64, error) {
+	res, err := d.Exec(ctx, "UPDATE clicks SET visitor_hash = NULL WHERE visitor_hash IS NOT NULL AND timestamp < ?",
+		NewTime(d.dialect, cutoff))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = d.Exec(ctx, "DELETE FROM visitor_salts WHERE day < ?", today)
+	return n, err
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+const webauthnColumns = `id, user_id, credential_id, name, credential, COALESCE(sign_count, 0),
+	passwordless, created_at, last_used_at`
+
+func scanWebAuthnCredential(row interface{ Scan(...any) error }) (*WebAuthnCredential, error) {
+	var (
+		c            WebAuthnCredential
+		signCount    int64
+		passwordless nullBool
+		createdAt    NullTime
+		lastUsedAt   NullTime
+	)
+	err := row.Scan(&c.ID, &c.UserID, &c.CredentialID, &c.Name, &c.Data, &signCount,
+		&passwordless, &createdAt, &lastUsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.SignCount = uint32(signCount) // #nosec G115 -- written from a uint32
+	c.Passwordless = passwordless.orDefault(false)
+	c.CreatedAt = createdAt.Time
+	c.LastUsedAt = lastUsedAt.Ptr()
+	return &c, nil
+}
+
+// AddWebAuthnCredential stores a newly registered credential. recoveryHashes,
+// when given, become the account's recovery codes in the same transaction:
+// a first security key on an account without TOTP is its first second factor,
+// and needs a way back in if the key is lost.
+func (d *DB) AddWebAuthnCredential(ctx context.Context, c *WebAuthnCredential, recoveryHashes []string) error {
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = now()
+	}
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	const q = `INSERT INTO webauthn_credentials
+		(user_id, credential_id, name, credential, sign_count, passwordless, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	id, err := d.insertReturningID(ctx, tx, q, "webauthn_credentials",
+		c.UserID, c.CredentialID, truncateString(c.Name, 64), c.Data, int64(c.SignCount),
+		c.Passwordless, NewTime(d.dialect, c.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("insert webauthn credential: %w", err)
+	}
+	c.ID = id
+
+	if len(recoveryHashes) > 0 {
+		if _, err := tx.ExecContext(ctx, d.rebind(
+			"DELETE FROM recovery_codes WHERE user_id = ?"), c.UserID); err != nil {
+			return err
+		}
+		createdAt := NewTime(d.dialect, now())
+		for _, hash := range recoveryHashes {
+			if _, err := tx.ExecContext(ctx, d.rebind(
+				"INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)"),
+				c.UserID, hash, createdAt); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// WebAuthnCredentials lists a user's credentials, oldest first.
+func (d *DB) WebAuthnCredentials(ctx context.Context, userID int64) ([]*WebAuthnCredential, error) {
+	rows, err := d.Query(ctx,
+		"SELECT "+webauthnColumns+" FROM webauthn_credentials WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*WebAuthnCredential
+	for rows.Next() {
+		c, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// WebAuthnCredentialByCredentialID finds a credential by the id the
+// authenticator presented, for a passwordless sign-in.
+func (d *DB) WebAuthnCredentialByCredentialID(ctx context.Context, credentialID string) (*WebAuthnCredential, error) {
+	return scanWebAuthnCredential(d.QueryRow(ctx,
+		"SELECT "+webauthnColumns+" FROM webauthn_credentials WHERE credential_id = ?", credentialID))
+}
+
+// HasWebAuthnCredentials reports whether the user has registered any
+// credential, which makes a second step part of every password sign-in.
+func (d *DB) HasWebAuthnCredentials(ctx context.Context, userID int64) (bool, error) {
+	var n int
+	err := d.QueryRow(ctx, "SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = ?", userID).Scan(&n)
+	return n > 0, err
+}
+
+// RecordWebAuthnUse stores the credential record and signature counter after a
+// successful assertion.
+func (d *DB) RecordWebAuthnUse(ctx context.Context, id int64, data string, signCount uint32) error {
+	_, err := d.Exec(ctx,
+		"UPDATE webauthn_credentials SET credential = ?, sign_count = ?, last_used_at = ? WHERE id = ?",
+		data, int64(signCount), NewTime(d.dialect, now()), id)
+	return err
+}
+
+// DeleteWebAuthnCredential removes one of the user's credentials and reports
+// whether it existed. Removing the last second factor of an account — no
+// credential left and TOTP off — also removes its recovery codes, which would
+// otherwise guard nothing.
+func (d *DB) DeleteWebAuthnCredential(ctx context.Context, userID, id int64) (bool, error) {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, d.rebind(
+		"DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?"), id, userID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, d.rebind(
+		`DELETE FROM recovery_codes WHERE user_id = ?
+		 AND NOT EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = ?)
+		 AND NOT EXISTS (SELECT 1 FROM users WHERE id = ? AND totp_enabled = ?)`),
+		userID, userID, userID, true); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,106 @@
+// Package telemetry traces requests with OpenTelemetry and exports the spans
+// over OTLP/HTTP to a collector.
+//
+// The other packages start their spans on the global tracer provider, which
+// does nothing until Setup installs an exporting one, so with no endpoint
+// configured tracing costs next to nothing. Setup also installs the W3C trace
+// context propagator, so a request arriving from a traced proxy continues
+// its trace rather than starting one.
+package telemetry
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Options configures Setup.
+type Options struct {
+	// Endpoint is the collector's base URL, as http://collector:4318; the
+	// traces path is appended. Empty leaves tracing off.
+	Endpoint    string
+	ServiceName string
+	// SampleRatio is the share of new traces kept, from 0 to 1.
+	SampleRatio float64
+}
+
+// Setup installs the tracer provider and propagator, and returns the
+// function that flushes the spans still buffered and stops exporting. The
+// OTEL_EXPORTER_OTLP_HEADERS and related variables the exporter reads
+// itself still apply, for a collector that wants a token.
+func Setup(ctx context.Context, opts Options) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(strings.TrimSuffix(opts.Endpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", opts.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Tracer returns the tracer a package starts its spans on, named after it.
+func Tracer(pkg string) trace.Tracer {
+	return otel.Tracer("github.com/arumes31/redrx/internal/" + pkg)
+}
+
+// End ends span, marking it failed when err is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// LogHandler adds the trace_id and span_id of the span in a record's context
+// to the record, so a log line can be looked up beside its trace. Records
+// logged without a context, or outside any span, are passed on unchanged.
+type LogHandler struct {
+	Inner slog.Handler
+}
+
+func (h LogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.Inner.Enabled(ctx, level)
+}
+
+func (h LogHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec = rec.Clone()
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Inner.Handle(ctx, rec)
+}
+
+func (h LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return LogHandler{h.Inner.WithAttrs(attrs)}
+}
+
+func (h LogHandler) WithGroup(name string) slog.Handler {
+	return LogHandler{h.Inner.WithGroup(name)}
+}
@@ -0,0 +1,99 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector stands in for an OpenTelemetry collector's OTLP/HTTP receiver,
+// keeping the names of the spans it is sent.
+type collector struct {
+	mu    sync.Mutex
+	spans map[string]string // name to trace id
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var req collectortrace.ExportTraceServiceRequest
+	if r.URL.Path != "/v1/traces" || proto.Unmarshal(body, &req) != nil {
+		http.Error(w, "bad export", http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				c.spans[span.Name] = string(span.TraceId)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestExportAndLogTraceIDs(t *testing.T) {
+	col := &collector{spans: map[string]string{}}
+	srv := httptest.NewServer(col)
+	defer srv.Close()
+
+	ctx := context.Background()
+	shutdown, err := Setup(ctx, Options{Endpoint: srv.URL + "/", ServiceName: "redrx-test", SampleRatio: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	log := slog.New(LogHandler{Inner: slog.NewJSONHandler(&out, nil)})
+	spanCtx, span := Tracer("test").Start(ctx, "outer")
+	_, child := Tracer("test").Start(spanCtx, "inner")
+	child.End()
+	log.InfoContext(spanCtx, "inside")
+	span.End()
+	log.Info("outside")
+
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	col.mu.Lock()
+	outer, inner := col.spans["outer"], col.spans["inner"]
+	col.mu.Unlock()
+	if outer == "" || outer != inner {
+		t.Errorf("collector received %v, want outer and inner in one trace", col.spans)
+	}
+
+	dec := json.NewDecoder(&out)
+	var inside, outside map[string]any
+	if err := dec.Decode(&inside); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&outside); err != nil {
+		t.Fatal(err)
+	}
+	if inside["trace_id"] != span.SpanContext().TraceID().String() || inside["span_id"] != span.SpanContext().SpanID().String() {
+		t.Errorf("record in a span = %v, want its trace and span ids", inside)
+	}
+	if _, ok := outside["trace_id"]; ok {
+		t.Errorf("record outside any span = %v, want no trace id", outside)
+	}
+}
+
+func TestSetupWithoutEndpoint(t *testing.T) {
+	shutdown, err := Setup(context.Background(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown without tracing: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// clickWriteTimeout bounds one batch write, so a stalled database holds up
+// the queue, and shutdown, for no longer than this.
+const clickWriteTimeout = 30 * time.Second
+
+// redirectRecord is what a redirect leaves to be written: the link's new
+// last-access time and, when the redirect is tracked, its click.
+type redirectRecord struct {
+	linkID int64
+	at     time.Time
+	click  *store.Click
+}
+
+// clickQueue takes the writes off the redirect path. Redirects are queued in
+// memory and a single worker writes them in batches, one transaction per
+// batch with a counter and last-access update per link rather than per click.
+// The queue is bounded: when the database falls behind, redirects keep being
+// served and the ones that do not fit are dropped and counted instead.
+type clickQueue struct {
+	db        *store.DB
+	log       *slog.Logger
+	window    time.Duration
+	batchSize int
+	interval  time.Duration
+
+	// mu guards closed against add, so nothing is sent on ch once it is
+	// closed.
+	mu     sync.RWMutex
+	closed bool
+	ch     chan redirectRecord
+	done   chan struct{}
+	// dropped counts the redirects dropped since the last flush, to log them
+	// once rather than per redirect.
+	dropped atomic.Int64
+
+	droppedTotal *prometheus.CounterVec
+	written      prometheus.Counter
+	batches      prometheus.Histogram
+	flushes      prometheus.Histogram
+}
+
+func newClickQueue(db *store.DB, log *slog.Logger, reg prometheus.Registerer, size, batchSize int, interval, window time.Duration) *clickQueue {
+	q := &clickQueue{
+		db:        db,
+		log:       log,
+		window:    window,
+		batchSize: batchSize,
+		interval:  interval,
+		ch:        make(chan redirectRecord, size),
+		done:      make(chan struct{}),
+		droppedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "redrx_clicks_dropped_total",
+			Help: "Redirects whose click and last access were never written: the queue was full or closed, or the batch write failed",
+		}, []string{"reason"}),
+		written: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "redrx_clicks_written_total",
+			Help: "Clicks written to the database from the click queue",
+		}),
+		batches: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "redrx_click_batch_size",
+			Help:    "Redirects written per batch",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 7),
+		}),
+		flushes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "redrx_click_flush_duration_seconds",
+			Help:    "Time taken to write a batch of redirects",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	reg.MustRegister(q.droppedTotal, q.written, q.batches, q.flushes,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "redrx_click_queue_depth",
+			Help: "Redirects waiting in the click queue",
+		}, func() float64 { return float64(len(q.ch)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "redrx_click_queue_capacity",
+			Help: "Redirects the click queue holds before dropping",
+		}, func() float64 { return float64(cap(q.ch)) }),
+	)
+	go q.run()
+	return q
+}
+
+// add queues a redirect without waiting. It reports false, and counts the
+// drop, when the queue is full or already closed.
+func (q *clickQueue) add(rec redirectRecord) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		q.droppedTotal.WithLabelValues("closed").Inc()
+		return false
+	}
+	select {
+	case q.ch <- rec:
+		return true
+	default:
+		q.droppedTotal.WithLabelValues("queue_full").Inc()
+		q.dropped.Add(1)
+		return false
+	}
+}
+
+func (q *clickQueue) run() {
+	defer close(q.done)
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	batch := make([]redirectRecord, 0, q.batchSize)
+	for {
+		select {
+		case rec, ok := <-q.ch:
+			if !ok {
+				q.flush(batch)
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) >= q.batchSize {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			q.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes a batch. A failed write is not retried: the batch may have
+// been committed all the same, and writing it again would count it twice.
+func (q *clickQueue) flush(batch []redirectRecord) {
+	if n := q.dropped.Swap(0); n > 0 {
+		q.log.Warn("click queue full, redirects not recorded", "dropped", n)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	var (
+		clicks   []*store.Click
+		accessed = make(map[int64]time.Time, len(batch))
+	)
+	for _, rec := range batch {
+		if rec.click != nil {
+			clicks = append(clicks, rec.click)
+		}
+		if rec.at.After(accessed[rec.linkID]) {
+			accessed[rec.linkID] = rec.at
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clickWriteTimeout)
+	defer cancel()
+	start := time.Now()
+	err := q.db.RecordClicks(ctx, clicks, accessed, q.window)
+	q.flushes.Observe(time.Since(start).Seconds())
+	q.batches.Observe(float64(len(batch)))
+	if err != nil {
+		q.droppedTotal.WithLabelValues("write_failed").Add(float64(len(batch)))
+		q.log.Error("write clicks", "redirects", len(batch), "error", err)
+		return
+	}
+	q.written.Add(float64(len(clicks)))
+}
+
+// close stops taking redirects and writes the ones queued, waiting until
+// they are written or ctx ends.
+func (q *clickQueue) close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
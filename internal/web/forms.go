@@ -257,48 +257,62 @@ type EditForm struct {
 	EndDate          string
 	EndTime          string
 	IsDraft          bool
-	Errors           errorMap
+	// AutoPauseAfter is the failed-health-check count that pauses the link;
+	// blank or 0 disables auto-pause.
+	AutoPauseAfter       string
+	SkipUnhealthyTargets bool
+	Errors               errorMap
 }
 
 func bindEditForm(r *http.Request) *EditForm {
 	return &EditForm{
-		LongURL:          strings.TrimSpace(r.FormValue("long_url")),
-		IOSTargetURL:     strings.TrimSpace(r.FormValue("ios_target_url")),
-		AndroidTargetURL: strings.TrimSpace(r.FormValue("android_target_url")),
-		ExpiryHours:      strings.TrimSpace(r.FormValue("expiry_hours")),
-		PreviewMode:      checkboxChecked(r, "preview_mode"),
-		StatsEnabled:     checkboxChecked(r, "stats_enabled"),
-		StartDate:        strings.TrimSpace(r.FormValue("start_date")),
-		StartTime:        strings.TrimSpace(r.FormValue("start_time")),
-		EndDate:          strings.TrimSpace(r.FormValue("end_date")),
-		EndTime:          strings.TrimSpace(r.FormValue("end_time")),
-		IsDraft:          checkboxChecked(r, "draft"),
-		Errors:           errorMap{},
+		LongURL:              strings.TrimSpace(r.FormValue("long_url")),
+		IOSTargetURL:         strings.TrimSpace(r.FormValue("ios_target_url")),
+		AndroidTargetURL:     strings.TrimSpace(r.FormValue("android_target_url")),
+		ExpiryHours:          strings.TrimSpace(r.FormValue("expiry_hours")),
+		PreviewMode:          checkboxChecked(r, "preview_mode"),
+		StatsEnabled:         checkboxChecked(r, "stats_enabled"),
+		StartDate:            strings.TrimSpace(r.FormValue("start_date")),
+		StartTime:            strings.TrimSpace(r.FormValue("start_time")),
+		EndDate:              strings.TrimSpace(r.FormValue("end_date")),
+		EndTime:              strings.TrimSpace(r.FormValue("end_time")),
+		IsDraft:              checkboxChecked(r, "draft"),
+		AutoPauseAfter:       strings.TrimSpace(r.FormValue("auto_pause_after")),
+		SkipUnhealthyTargets: checkboxChecked(r, "skip_unhealthy_targets"),
+		Errors:               errorMap{},
 	}
 }
 
 // editInput is the validated result of an EditForm submission.
 type editInput struct {
-	LongURL          string
-	IOSTargetURL     string
-	AndroidTargetURL string
-	PreviewMode      bool
-	StatsEnabled     bool
-	ExpiresAt        *time.Time
-	ExpiryGiven      bool
-	ExpiryNever      bool
-	StartAt          *time.Time
-	EndAt            *time.Time
-	IsDraft          bool
+	LongURL              string
+	IOSTargetURL         string
+	AndroidTargetURL     string
+	PreviewMode          bool
+	StatsEnabled         bool
+	ExpiresAt            *time.Time
+	ExpiryGiven          bool
+	ExpiryNever          bool
+	StartAt              *time.Time
+	EndAt                *time.Time
+	IsDraft              bool
+	AutoPauseAfter       int
+	SkipUnhealthyTargets bool
 }
 
+// maxAutoPauseAfter bounds the auto-pause threshold. A run that long at the
+// default hourly interval is over four days of failures; anyone wanting more
+// patience than that does not want auto-pause.
+const maxAutoPauseAfter = 100
+
 func (f *EditForm) Validate() (*editInput, bool) {
 	f.Errors = errorMap{}
 	in := &editInput{
-		LongURL:      f.LongURL,
-		PreviewMode:  f.PreviewMode,
-		StatsEnabled: f.StatsEnabled,
-		IsDraft:      f.IsDraft,
+		LongURL:              f.LongURL,
+		PreviewMode:          f.PreviewMode,
+		StatsEnabled:         f.StatsEnabled,
+		IsDraft:              f.IsDraft,
+		SkipUnhealthyTargets: f.SkipUnhealthyTargets,
 	}
 
 	if f.LongURL == "" {
@@ -355,6 +369,15 @@ func (f *EditForm) Validate() (*editInput, bool) {
 		f.Errors.add("expiry_hours", "The link would expire before it starts.")
 	}
 
+	if f.AutoPauseAfter != "" {
+		n, err := strconv.Atoi(f.AutoPauseAfter)
+		if err != nil || n < 0 || n > maxAutoPauseAfter {
+			f.Errors.add("auto_pause_after", "Enter a number of failed checks between 0 and 100.")
+		} else {
+			in.AutoPauseAfter = n
+		}
+	}
+
 	return in, !f.Errors.any()
 }
 
@@ -0,0 +1,707 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/arumes31/redrx/internal/mail"
+	"github.com/arumes31/redrx/internal/security"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// emailVerificationTTL is how long a verification link stays valid. It only
+// proves the address receives mail, so unlike a reset link it can live for a
+// while in an inbox.
+const emailVerificationTTL = 7 * 24 * time.Hour
+
+// resetRequestedMessage is shown whether or not the address has an account,
+// so the form cannot be used to find out which addresses are registered.
+const resetRequestedMessage = "If an account uses that address, a password reset link is on its way."
+
+func (s *Server) handleForgotPasswordForm(w http.ResponseWriter, r *http.Request) {
+	if s.mailer == nil {
+		s.renderError(w, r, http.StatusNotFound)
+		return
+	}
+	if userFrom(r) != nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	data := s.newPageData(r)
+	data.Data["errors"] = errorMap{}
+	s.render(w, r, http.StatusOK, "forgot_password.html", data)
+}
+
+func (s *Server) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if s.mailer == nil {
+		s.renderError(w, r, http.StatusNotFound)
+		return
+	}
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	if !looksLikeEmail(email) {
+		data := s.newPageData(r)
+		errs := errorMap{}
+		errs.add("email", "Invalid email address.")
+		data.Data["errors"] = errs
+		data.Data["email"] = email
+		s.render(w, r, http.StatusOK, "forgot_password.html", data)
+		return
+	}
+
+	user, err := s.db.UserByEmail(r.Context(), email)
+	switch {
+	case err == nil:
+		token := security.NewAccountToken(s.cfg.SecretKey, security.TokenPasswordReset, user.ID,
+			user.PasswordHash, time.Now().Add(time.Duration(s.cfg.PasswordResetTTL)*time.Minute))
+		s.sendMail(mail.Message{
+			To:      user.Email,
+			Subject: "Reset your Redrx password",
+			Body: fmt.Sprintf("Hello %s,\n\n"+
+				"Someone asked to reset the password for your Redrx account. To choose a new one, open this link:\n\n"+
+				"%s\n\n"+
+				"The link works once and expires in %d minutes. If you did not ask for it, ignore this email; "+
+				"your password has not changed.\n",
+				user.Username, s.siteURL("/reset-password/"+token), s.cfg.PasswordResetTTL),
+		})
+	case !errors.Is(err, store.ErrNotFound):
+		s.log.ErrorContext(r.Context(), "look up user for password reset", "error", err)
+	}
+
+	sessionFrom(r).AddFlash("info", resetRequestedMessage)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// resetUser loads the account a reset link was issued for. It fails once the
+// link has expired or the password has changed since it was sent.
+func (s *Server) resetUser(r *http.Request) (*store.User, bool) {
+	token := r.PathValue("token")
+	id, ok := security.AccountTokenUser(token)
+	if !ok {
+		return nil, false
+	}
+	user, err := s.db.UserByID(r.Context(), id)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			s.log.ErrorContext(r.Context(), "load user for password reset", "error", err)
+		}
+		return nil, false
+	}
+	if !security.VerifyAccountToken(s.cfg.SecretKey, security.TokenPasswordReset, token, user.PasswordHash, time.Now()) {
+		return nil, false
+	}
+	return user, true
+}
+
+func (s *Server) rejectResetLink(w http.ResponseWriter, r *http.Request) {
+	sessionFrom(r).AddFlash("danger", "That password reset link is invalid or has expired. Request a new one below.")
+	http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+}
+
+func (s *Server) handleResetPasswordForm(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if s.mailer == nil {
+		s.renderError(w, r, http.StatusNotFound)
+		return
+	}
+	user, ok := s.resetUser(r)
+	if !ok {
+		s.rejectResetLink(w, r)
+		return
+	}
+	twoStep, err := s.hasSecondFactor(r.Context(), user)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "check second factor", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	s.renderResetForm(w, r, user, twoStep, errorMap{})
+}
+
+func (s *Server) renderResetForm(w http.ResponseWriter, r *http.Request, user *store.User, twoStep bool, errs errorMap) {
+	data := s.newPageData(r)
+	data.Data["errors"] = errs
+	data.Data["second_factor"] = twoStep
+	data.Data["totp"] = user.TOTPEnabled
+	s.render(w, r, http.StatusOK, "reset_password.html", data)
+}
+
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if s.mailer == nil {
+		s.renderError(w, r, http.StatusNotFound)
+		return
+	}
+	user, ok := s.resetUser(r)
+	if !ok {
+		s.rejectResetLink(w, r)
+		return
+	}
+
+	twoStep, err := s.hasSecondFactor(r.Context(), user)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "check second factor", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	password := r.PostFormValue("password")
+	if len(password) < 6 {
+		errs := errorMap{}
+		errs.add("password", "Field must be at least 6 characters long.")
+		s.renderResetForm(w, r, user, twoStep, errs)
+		return
+	}
+	// A reset link proves control of the mailbox, not of the second factor;
+	// with 2FA on, the mailbox alone must not be enough to take the account.
+	// An account secured only by security keys answers with a recovery code.
+	if twoStep {
+		valid, err := s.validateSecondFactor(r, user, r.PostFormValue("code"))
+		if err != nil {
+			s.log.ErrorContext(r.Context(), "validate second factor for password reset", "user", user.ID, "error", err)
+			s.renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			s.recordSecurityEvent(r, user.ID, store.EventSecondFactorFail)
+			errs := errorMap{}
+			errs.add("code", "Enter a valid authenticator or unused recovery code.")
+			s.renderResetForm(w, r, user, twoStep, errs)
+			return
+		}
+	}
+
+	hash, err := security.GeneratePasswordHash(password)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "hash password", "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	changed, err := s.db.ResetUserPassword(r.Context(), user.ID, user.PasswordHash, hash)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "reset password", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if !changed {
+		// Another request used the link first.
+		s.rejectResetLink(w, r)
+		return
+	}
+	s.recordSecurityEvent(r, user.ID, store.EventPasswordReset)
+	s.revokeSessions(r, user.ID, false)
+	// The link arrived at the account's address, which is all a verification
+	// link would have proved.
+	if err := s.db.MarkEmailVerified(r.Context(), user.ID, user.Email); err != nil {
+		s.log.WarnContext(r.Context(), "mark email verified after reset", "user", user.ID, "error", err)
+	}
+
+	sessionFrom(r).AddFlash("success", "Your password has been reset and every session signed out. You can now log in.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	sess := sessionFrom(r)
+	next := "/login"
+	if userFrom(r) != nil {
+		next = "/dashboard"
+	}
+
+	token := r.PathValue("token")
+	var user *store.User
+	if id, ok := security.AccountTokenUser(token); ok {
+		u, err := s.db.UserByID(r.Context(), id)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			s.log.ErrorContext(r.Context(), "load user for email verification", "error", err)
+		}
+		if err == nil && security.VerifyAccountToken(s.cfg.SecretKey, security.TokenVerifyEmail, token, u.Email, time.Now()) {
+			user = u
+		}
+	}
+	switch {
+	case user == nil:
+		sess.AddFlash("danger", "That verification link is invalid or has expired.")
+	case user.EmailVerifiedAt != nil:
+		sess.AddFlash("info", "Your email address is already verified.")
+	default:
+		if err := s.db.MarkEmailVerified(r.Context(), user.ID, user.Email); err != nil {
+			s.log.ErrorContext(r.Context(), "mark email verified", "user", user.ID, "error", err)
+			s.renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		s.recordSecurityEvent(r, user.ID, store.EventEmailVerified)
+		sess.AddFlash("success", "Thanks, your email address is verified.")
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (s *Server) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	if s.mailer != nil && user.EmailVerifiedAt == nil {
+		s.sendVerification(user)
+		sessionFrom(r).AddFlash("info", "A verification link has been sent to "+user.Email+".")
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// sendVerification mails the user a link confirming they receive mail at
+// their registered address.
+func (s *Server) sendVerification(user *store.User) {
+	token := security.NewAccountToken(s.cfg.SecretKey, security.TokenVerifyEmail, user.ID,
+		user.Email, time.Now().Add(emailVerificationTTL))
+	s.sendMail(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your Redrx email address",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Please confirm this is your email address by opening this link:\n\n"+
+			"%s\n\n"+
+			"The link expires in 7 days. If you did not create a Redrx account, ignore this email.\n",
+			user.Username, s.siteURL("/verify-email/"+token)),
+	})
+}
+
+// sendMail delivers m in the background. Waiting on the SMTP server would
+// hold the request open for seconds, and on the reset form the delay would
+// reveal whether the address has an account. Shutdown waits for sends in
+// flight.
+func (s *Server) sendMail(m mail.Message) {
+	s.mailWG.Add(1)
+	go func() {
+		defer s.mailWG.Done()
+		if err := s.mailer.Send(context.Background(), m); err != nil {
+			s.log.Error("send account mail", "subject", m.Subject, "error", err)
+		}
+	}()
+}
+
+// siteURL builds an absolute link to path on the canonical host, for mail.
+func (s *Server) siteURL(path string) string {
+	return "https://" + s.cfg.CanonicalHost() + path
+}
+
+// emailChangeTTL is how long a link confirming a new email address stays
+// valid.
+const emailChangeTTL = 24 * time.Hour
+
+func (s *Server) handleAccountSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	s.renderAccountSettings(w, r, "", errorMap{})
+}
+
+// renderAccountSettings renders the account page. form names the form errs
+// belong to, so each message lands next to the form that was submitted.
+func (s *Server) renderAccountSettings(w http.ResponseWriter, r *http.Request, form string, errs errorMap) {
+	data := s.newPageData(r)
+	data.Data["errors"] = map[string]errorMap{form: errs}
+	// Redisplay what was typed, but never a password.
+	switch form {
+	case "username", "email", "timezone":
+		data.Data[form] = strings.TrimSpace(r.PostFormValue(form))
+	case "delete":
+		data.Data["transfer_to"] = strings.TrimSpace(r.PostFormValue("transfer_to"))
+	}
+	if form == "networks" {
+		data.Data["networks"] = strings.TrimSpace(r.PostFormValue("networks"))
+	} else {
+		data.Data["networks"] = strings.Join(userFrom(r).ExcludedNetworks, "\n")
+	}
+	data.Data["client_ip"] = s.geo.ClientIP(r)
+	keys, err := s.db.HasWebAuthnCredentials(r.Context(), userFrom(r).ID)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "check security keys", "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	data.Data["security_keys"] = keys
+	s.render(w, r, http.StatusOK, "account_settings.html", data)
+}
+
+// reauthenticate checks the current password, and the second factor when the
+// account has one — an authenticator or recovery code, or a security key —
+// before an account change. A stolen session alone must not be enough to take
+// over the account by changing its credentials. Failures are added to errs.
+func (s *Server) reauthenticate(r *http.Request, user *store.User, errs errorMap) error {
+	if !security.CheckPasswordHash(user.PasswordHash, r.PostFormValue("current_password")) {
+		errs.add("current_password", "The password was incorrect.")
+		return nil
+	}
+	second, err := s.hasSecondFactor(r.Context(), user)
+	if err != nil || !second {
+		return err
+	}
+	var valid bool
+	if assertion := r.PostFormValue("webauthn_assertion"); assertion != "" {
+		valid, err = s.validateReauthAssertion(r, user, assertion)
+	} else {
+		valid, err = s.validateSecondFactor(r, user, r.PostFormValue("code"))
+	}
+	if err != nil {
+		return err
+	}
+	if !valid {
+		s.recordSecurityEvent(r, user.ID, store.EventSecondFactorFail)
+		if user.TOTPEnabled {
+			errs.add("code", "Enter a valid authenticator or unused recovery code.")
+		} else {
+			errs.add("code", "Use your security key, or enter an unused recovery code.")
+		}
+	}
+	return nil
+}
+
+// recordAccountChange adds an account change to the audit trail, with what
+// changed.
+func (s *Server) recordAccountChange(r *http.Request, userID int64, event, detail string) {
+	e := s.securityEvent(r, userID, event)
+	e.Detail = detail
+	if err := s.db.RecordSecurityEvent(r.Context(), e); err != nil {
+		s.log.WarnContext(r.Context(), "record security event", "user", userID, "event", event, "error", err)
+	}
+}
+
+func (s *Server) handleChangeUsername(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	username := strings.TrimSpace(r.PostFormValue("username"))
+	errs := errorMap{}
+	switch n := len([]rune(username)); {
+	case n < 4 || n > 20:
+		errs.add("username", "Field must be between 4 and 20 characters long.")
+	case username == user.Username:
+		errs.add("username", "That is already your username.")
+	default:
+		taken, err := s.db.UsernameTaken(r.Context(), username)
+		if err != nil {
+			s.log.ErrorContext(r.Context(), "check username", "error", err)
+			s.renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		// An administrator's name is held for them, whether or not they
+		// have registered it yet.
+		if taken || s.cfg.IsAdmin(username) {
+			errs.add("username", "That username is already taken.")
+		}
+	}
+	if !errs.any() {
+		if err := s.reauthenticate(r, user, errs); err != nil {
+			s.log.ErrorContext(r.Context(), "reauthenticate", "user", user.ID, "error", err)
+			s.renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+	if errs.any() {
+		s.renderAccountSettings(w, r, "username", errs)
+		return
+	}
+
+	if err := s.db.ChangeUsername(r.Context(), user.ID, username); err != nil {
+		if store.IsUniqueViolation(err) {
+			errs.add("username", "That username is already taken.")
+			s.renderAccountSettings(w, r, "username", errs)
+			return
+		}
+		s.log.ErrorContext(r.Context(), "change username", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	s.recordAccountChange(r, user.ID, store.EventUsernameChanged, user.Username+" → "+username)
+	sessionFrom(r).AddFlash("success", "Your username is now "+username+".")
+	http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+}
+
+func (s *Server) handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	errs := errorMap{}
+	switch {
+	case !looksLikeEmail(email):
+		errs.add("email", "Invalid email address.")
+	case strings.EqualFold(email, user.Email):
+		errs.add("email", "That is already your email address.")
+	default:
+		// UsernameTaken also matches usernames, which sign-in accepts in the
+		// same field as addresses.
+		taken, err := s.db.UsernameTaken(r.Context(), email)
+		if err != nil {
+			s.log.ErrorContext(r.Context(), "check email", "error", err)
+			s.renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			errs.add("email", "That email is already registered.")
+		}
+	}
+	if !errs.any() {
+		if err := s.reauthenticate(r, user, errs); err != nil {
+			s.log.ErrorContext(r.Context(), "reauthenticate", "user", user.ID, "error", err)
+			s.renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+	if errs.any() {
+		s.renderAccountSettings(w, r, "email", errs)
+		return
+	}
+
+	// Without mail there is no way to prove the new address, so it is
+	// switched straight away and left unverified, as a new account's is.
+	if s.mailer == nil {
+		s.applyEmailChange(w, r, user, email, false)
+		return
+	}
+	token := security.NewAccountToken(s.cfg.SecretKey, security.TokenChangeEmail, user.ID,
+		emailChangeState(user.Email, email), time.Now().Add(emailChangeTTL))
+	s.sendMail(mail.Message{
+		To:      email,
+		Subject: "Confirm your new Redrx email address",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"To use this address for your Redrx account, open this link:\n\n"+
+			"%s\n\n"+
+			"The link expires in 24 hours. Until then your account keeps using %s. "+
+			"If you did not ask for this, ignore this email.\n",
+			user.Username, s.siteURL("/confirm-email/"+token+"?email="+url.QueryEscape(email)), user.Email),
+	})
+	sessionFrom(r).AddFlash("info", "We sent a confirmation link to "+email+". Your address changes once you open it.")
+	http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+}
+
+// emailChangeState binds a confirmation link to both addresses: it stops
+// working once the account's address changes, and cannot be pointed at an
+// address other than the one it was sent to.
+func emailChangeState(oldEmail, newEmail string) string {
+	return oldEmail + "\n" + newEmail
+}
+
+func (s *Server) handleConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	email := r.URL.Query().Get("email")
+	var user *store.User
+	if id, ok := security.AccountTokenUser(token); ok && email != "" {
+		u, err := s.db.UserByID(r.Context(), id)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			s.log.ErrorContext(r.Context(), "load user for email change", "error", err)
+		}
+		if err == nil && security.VerifyAccountToken(s.cfg.SecretKey, security.TokenChangeEmail, token,
+			emailChangeState(u.Email, email), time.Now()) {
+			user = u
+		}
+	}
+	if user == nil {
+		sessionFrom(r).AddFlash("danger", "That confirmation link is invalid or has expired.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	taken, err := s.db.UsernameTaken(r.Context(), email)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "check email", "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		sessionFrom(r).AddFlash("danger", "That email address has been registered to another account since the link was sent.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	s.applyEmailChange(w, r, user, email, true)
+}
+
+// applyEmailChange moves the account to email and tells the old address, so
+// an owner who did not make the change hears about it.
+func (s *Server) applyEmailChange(w http.ResponseWriter, r *http.Request, user *store.User, email string, verified bool) {
+	changed, err := s.db.ChangeEmail(r.Context(), user.ID, user.Email, email, verified)
+	if err != nil {
+		if store.IsUniqueViolation(err) {
+			sessionFrom(r).AddFlash("danger", "That email is already registered.")
+			http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+			return
+		}
+		s.log.ErrorContext(r.Context(), "change email", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if !changed {
+		sessionFrom(r).AddFlash("danger", "That confirmation link has already been used.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	s.recordAccountChange(r, user.ID, store.EventEmailChanged, user.Email+" → "+email)
+	if s.mailer != nil {
+		s.sendMail(mail.Message{
+			To:      user.Email,
+			Subject: "Your Redrx email address was changed",
+			Body: fmt.Sprintf("Hello %s,\n\n"+
+				"The email address of your Redrx account was changed from this address to %s.\n\n"+
+				"If you did not make this change, reset your password and review the activity "+
+				"in your security settings.\n",
+				user.Username, email),
+		})
+	}
+	sessionFrom(r).AddFlash("success", "Your email address is now "+email+".")
+	http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+}
+
+// handleChangeTimezone sets the zone the account's statistics are bucketed
+// in. It is a display preference, so it asks for no password.
+func (s *Server) handleChangeTimezone(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	tz := strings.TrimSpace(r.PostFormValue("timezone"))
+	if tz != "" {
+		loc, err := loadTimezone(tz)
+		if err != nil {
+			errs := errorMap{}
+			errs.add("timezone", "Enter an IANA timezone such as Europe/Vienna, or leave it empty for UTC.")
+			s.renderAccountSettings(w, r, "timezone", errs)
+			return
+		}
+		tz = loc.String()
+	}
+	if err := s.db.SetUserTimezone(r.Context(), user.ID, tz); err != nil {
+		s.log.ErrorContext(r.Context(), "set timezone", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if tz == "" {
+		tz = "UTC"
+	}
+	sessionFrom(r).AddFlash("success", "Statistics are now shown in "+tz+".")
+	http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+}
+
+// handleChangeExcludedNetworks sets the addresses whose clicks on the user's
+// links count as their own traffic rather than their visitors'.
+func (s *Server) handleChangeExcludedNetworks(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	networks, err := parseExcludedNetworks(r.PostFormValue("networks"))
+	if err != nil {
+		errs := errorMap{}
+		errs.add("networks", err.Error())
+		s.renderAccountSettings(w, r, "networks", errs)
+		return
+	}
+	if err := s.db.SetUserExcludedNetworks(r.Context(), user.ID, networks); err != nil {
+		s.log.ErrorContext(r.Context(), "set excluded networks", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if len(networks) == 0 {
+		sessionFrom(r).AddFlash("success", "Only your signed-in visits now count as your own traffic.")
+	} else {
+		sessionFrom(r).AddFlash("success", "Clicks from the networks you listed now count as your own traffic.")
+	}
+	http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+}
+
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	password := r.PostFormValue("password")
+	errs := errorMap{}
+	if len(password) < 6 {
+		errs.add("password", "Field must be at least 6 characters long.")
+	} else if password != r.PostFormValue("confirm_password") {
+		errs.add("confirm_password", "The passwords do not match.")
+	}
+	if !errs.any() {
+		if err := s.reauthenticate(r, user, errs); err != nil {
+			s.log.ErrorContext(r.Context(), "reauthenticate", "user", user.ID, "error", err)
+			s.renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+	if errs.any() {
+		s.renderAccountSettings(w, r, "password", errs)
+		return
+	}
+
+	hash, err := security.GeneratePasswordHash(password)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "hash password", "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if err := s.db.SetUserPasswordHash(r.Context(), user.ID, hash); err != nil {
+		s.log.ErrorContext(r.Context(), "change password", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	s.recordAccountChange(r, user.ID, store.EventPasswordChanged, "")
+	s.revokeSessions(r, user.ID, true)
+	sessionFrom(r).AddFlash("success", "Your password has been changed and your other sessions signed out.")
+	http.Redirect(w, r, "/settings/account", http.StatusSeeOther)
+}
+
+// handleDeleteAccount deletes the signed-in account for good, after the owner
+// has typed their username and re-authenticated. The links can go to another
+// account first; otherwise they are deleted with their clicks.
+func (s *Server) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	errs := errorMap{}
+	if r.PostFormValue("confirm") != user.Username {
+		errs.add("confirm", "Type your username exactly to confirm.")
+	}
+	var heir *store.User
+	if to := strings.TrimSpace(r.PostFormValue("transfer_to")); to != "" {
+		u, err := s.db.UserByLogin(r.Context(), to)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			errs.add("transfer_to", "No account has that username or email address.")
+		case err != nil:
+			s.log.ErrorContext(r.Context(), "load transfer account", "error", err)
+			s.renderError(w, r, http.StatusInternalServerError)
+			return
+		case u.ID == user.ID:
+			errs.add("transfer_to", "Choose an account other than this one.")
+		default:
+			heir = u
+		}
+	}
+	if !errs.any() {
+		if err := s.reauthenticate(r, user, errs); err != nil {
+			s.log.ErrorContext(r.Context(), "reauthenticate", "user", user.ID, "error", err)
+			s.renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+	if errs.any() {
+		s.renderAccountSettings(w, r, "delete", errs)
+		return
+	}
+
+	if err := s.db.DeleteUser(r.Context(), user, heir); err != nil {
+		s.log.ErrorContext(r.Context(), "delete account", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	// The database registry went with the account; a Redis one has to be
+	// cleared separately.
+	s.revokeSessions(r, user.ID, false)
+	if heir != nil {
+		s.log.InfoContext(r.Context(), "account deleted", "user", user.ID, "links_to", heir.ID)
+	} else {
+		s.log.InfoContext(r.Context(), "account deleted", "user", user.ID)
+	}
+
+	if s.mailer != nil {
+		s.sendMail(mail.Message{
+			To:      user.Email,
+			Subject: "Your Redrx account has been deleted",
+			Body: fmt.Sprintf("Hello %s,\n\n"+
+				"Your Redrx account and the data stored with it have been deleted, as you asked.\n", user.Username),
+		})
+		if heir != nil {
+			s.sendMail(mail.Message{
+				To:      heir.Email,
+				Subject: "Links were transferred to your Redrx account",
+				Body: fmt.Sprintf("Hello %s,\n\n"+
+					"The account %s was deleted and its links, with their click history, now belong "+
+					"to your account. You will find them on your dashboard.\n", heir.Username, user.Username),
+			})
+		}
+	}
+
+	sess := sessionFrom(r)
+	sess.Logout()
+	sess.AddFlash("info", "Your account has been deleted.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
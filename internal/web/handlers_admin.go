@@ -0,0 +1,117 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/arumes31/redrx/internal/linkimport"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// migrationReport is a migration's results with their totals, for the page.
+type migrationReport struct {
+	DryRun    bool
+	Source    string
+	Owner     string
+	Created   int
+	Valid     int
+	Conflicts int
+	Failed    int
+	Results   []linkimport.Result
+}
+
+func newMigrationReport(results []linkimport.Result) *migrationReport {
+	report := &migrationReport{Results: results}
+	for _, res := range results {
+		switch res.Status {
+		case linkimport.MigrateCreated:
+			report.Created++
+		case linkimport.MigrateValid:
+			report.Valid++
+		case linkimport.MigrateConflict:
+			report.Conflicts++
+		default:
+			report.Failed++
+		}
+	}
+	return report
+}
+
+func (s *Server) handleAdminImportForm(w http.ResponseWriter, r *http.Request) {
+	data := s.newPageData(r)
+	data.Data["errors"] = errorMap{}
+	data.Data["sources"] = linkimport.Sources
+	data.Data["owner"] = userFrom(r).Username
+	s.render(w, r, http.StatusOK, "admin_import.html", data)
+}
+
+// handleAdminImport moves the links of another shortener's export into an
+// account, keeping their codes. Unlike the user import it creates links as
+// they were on the old service rather than as the create form would, which is
+// why it is for administrators only.
+func (s *Server) handleAdminImport(w http.ResponseWriter, r *http.Request) {
+	data := s.newPageData(r)
+	errs := errorMap{}
+	data.Data["errors"] = errs
+	data.Data["sources"] = linkimport.Sources
+	render := func() { s.render(w, r, http.StatusOK, "admin_import.html", data) }
+
+	if err := r.ParseMultipartForm(s.cfg.MaxUploadSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		errs.add("file", "The upload is too large or could not be read.")
+		render()
+		return
+	}
+	source := r.FormValue("source")
+	login := strings.TrimSpace(r.FormValue("owner"))
+	dryRun := checkboxChecked(r, "dry_run")
+	data.Data["source"] = source
+	data.Data["owner"] = login
+	data.Data["dry_run"] = dryRun
+
+	if !slices.Contains(linkimport.Sources, source) {
+		errs.add("source", "Choose the shortener the export comes from.")
+	}
+	owner, err := s.db.UserByLogin(r.Context(), login)
+	if errors.Is(err, store.ErrNotFound) {
+		errs.add("owner", "No account has that username or email address.")
+	} else if err != nil {
+		s.log.ErrorContext(r.Context(), "admin import: look up owner", "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		errs.add("file", "Choose the export file.")
+	} else {
+		defer file.Close()
+	}
+	if errs.any() {
+		render()
+		return
+	}
+
+	links, err := linkimport.ParseExport(file, source)
+	if err != nil {
+		errs.add("file", importParseError(err))
+		render()
+		return
+	}
+	results, err := linkimport.Migrate(r.Context(), s.db, links, linkimport.MigrateOptions{
+		Owner:  owner,
+		Actor:  actorFrom(r),
+		DryRun: dryRun,
+		Check:  s.safety.CheckURL,
+	})
+	report := newMigrationReport(results)
+	report.DryRun, report.Source, report.Owner = dryRun, source, owner.Username
+	data.Data["report"] = report
+	if err != nil {
+		// The links before the failure are in; the report shows which.
+		s.log.ErrorContext(r.Context(), "admin import", "source", source, "error", err)
+		data.Data["stopped"] = "The import stopped part way: " + err.Error() + ". The links listed were handled; run it again to continue."
+	}
+	s.metrics.shortened.Add(float64(report.Created))
+	render()
+}
@@ -0,0 +1,267 @@
+package web
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// analyticsTop is how many links, countries, referrers and platforms the
+// account analytics list.
+const analyticsTop = 10
+
+// accountReport is the account analytics over a range: the clicks of every
+// link the filter selects, over time and broken down.
+type accountReport struct {
+	keys, labels       []string
+	clicks, unique     []int64
+	total, totalUnique int64
+	topLinks           []store.LinkClicks
+	countryLabels      []string
+	countryValues      []int64
+	referrerLabels     []string
+	referrerValues     []int64
+	platformLabels     []string
+	platformValues     []int64
+}
+
+// accountReport runs the grouped queries behind the analytics page and API.
+func (s *Server) accountReport(ctx context.Context, f store.AccountFilter, sr statsRange, humanOnly bool) (*accountReport, error) {
+	rep := &accountReport{}
+	rep.keys, rep.labels = timeBuckets(sr)
+	series, err := s.db.AccountClicksByTimeBucket(ctx, f, sr.From, sr.To, sr.Granularity, sr.Location, humanOnly)
+	if err != nil {
+		return nil, err
+	}
+	rep.clicks, rep.unique, rep.total, rep.totalUnique = fillBuckets(rep.keys, series)
+
+	if rep.topLinks, err = s.db.AccountTopLinks(ctx, f, sr.From, sr.To, analyticsTop, humanOnly); err != nil {
+		return nil, err
+	}
+
+	grouped := func(column string) ([]string, []int64, error) {
+		buckets, err := s.db.AccountClicksGroupedBy(ctx, f, sr.From, sr.To, column, humanOnly)
+		if err != nil {
+			return nil, nil, err
+		}
+		if column == "referrer" {
+			buckets = byReferrerHost(buckets)
+		}
+		labels, values, err := sortBuckets(buckets)
+		return topN(labels), topN(values), err
+	}
+	if rep.countryLabels, rep.countryValues, err = grouped("country"); err != nil {
+		return nil, err
+	}
+	if rep.referrerLabels, rep.referrerValues, err = grouped("referrer"); err != nil {
+		return nil, err
+	}
+	if rep.platformLabels, rep.platformValues, err = grouped("platform"); err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+func topN[T any](s []T) []T {
+	return s[:min(len(s), analyticsTop)]
+}
+
+// handleAnalytics shows the clicks of all the user's links, or of those with
+// one tag, taking the stats page's range, from, to, g, tz and traffic
+// parameters.
+func (s *Server) handleAnalytics(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	q := r.URL.Query()
+
+	// As on the stats page, a bad input charts the default rather than
+	// failing the page.
+	tzParam := strings.TrimSpace(q.Get("tz"))
+	loc, err := analyticsLocation(user, tzParam)
+	rangeErr := ""
+	if err != nil {
+		rangeErr, tzParam = err.Error(), ""
+	}
+	now := time.Now()
+	sr, err := resolveStatsRange(q, now, loc)
+	if err != nil {
+		rangeErr = err.Error()
+		sr, _ = resolveStatsRange(nil, now, loc)
+	}
+	humanOnly, err := parseTraffic(q)
+	if err != nil {
+		rangeErr, humanOnly = err.Error(), true
+	}
+	tag := strings.TrimSpace(q.Get("tag"))
+
+	tags, err := s.db.UserTags(r.Context(), user.ID)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "analytics: load tags", "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	rep, err := s.accountReport(r.Context(), store.AccountFilter{UserID: user.ID, Tag: tag}, sr, humanOnly)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "account analytics", "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	elapsed := sr.To
+	if now.Before(elapsed) {
+		elapsed = now
+	}
+	days := math.Max(elapsed.Sub(sr.From).Hours()/24, 1)
+
+	// The range buttons keep the timezone, traffic and tag but start a new
+	// range.
+	rangeURL := func(preset string) string {
+		next := url.Values{"range": {preset}}
+		if tzParam != "" {
+			next.Set("tz", tzParam)
+		}
+		if !humanOnly {
+			next.Set("traffic", "all")
+		}
+		if tag != "" {
+			next.Set("tag", tag)
+		}
+		return "/analytics?" + next.Encode()
+	}
+
+	data := s.newPageData(r)
+	data.Data["range_type"] = sr.Preset
+	data.Data["range_from"] = sr.From.Format("2006-01-02")
+	data.Data["range_to"] = sr.To.Add(-time.Nanosecond).Format("2006-01-02")
+	data.Data["range_urls"] = map[string]string{
+		"24h": rangeURL("24h"), "7d": rangeURL("7d"), "30d": rangeURL("30d"),
+	}
+	data.Data["granularity"] = string(sr.Granularity)
+	data.Data["granularities"] = statsGranularities
+	data.Data["g_param"] = q.Get("g")
+	data.Data["timezone"] = sr.Location.String()
+	data.Data["tz_param"] = tzParam
+	data.Data["range_error"] = rangeErr
+	data.Data["human_only"] = humanOnly
+	if !humanOnly {
+		data.Data["traffic_param"] = "all"
+	}
+	data.Data["traffic_human_url"] = withQuery(r.URL, "traffic", "")
+	data.Data["traffic_all_url"] = withQuery(r.URL, "traffic", "all")
+	data.Data["tag"] = tag
+	// A tag no longer on any link still shows as selected.
+	if tag != "" && !slices.Contains(tags, tag) {
+		tags = append(tags, tag)
+	}
+	data.Data["tags"] = tags
+	data.Data["total_clicks"] = rep.total
+	data.Data["unique_clicks"] = rep.totalUnique
+	data.Data["avg_daily"] = math.Round(float64(rep.total)/days*10) / 10
+	data.Data["time_labels"] = rep.labels
+	data.Data["time_values"] = rep.clicks
+	data.Data["time_unique"] = rep.unique
+	data.Data["top_links"] = rep.topLinks
+	data.Data["country_labels"] = rep.countryLabels
+	data.Data["country_values"] = rep.countryValues
+	data.Data["referrer_labels"] = rep.referrerLabels
+	data.Data["referrer_values"] = rep.referrerValues
+	data.Data["platform_labels"] = rep.platformLabels
+	data.Data["platform_values"] = rep.platformValues
+
+	s.render(w, r, http.StatusOK, "analytics.html", data)
+}
+
+// analyticsCount is one entry of a breakdown in the analytics API.
+type analyticsCount struct {
+	Label  string `json:"label"`
+	Clicks int64  `json:"clicks"`
+}
+
+// analyticsLink is one of the top links in the analytics API.
+type analyticsLink struct {
+	ShortCode string `json:"short_code"`
+	ShortURL  string `json:"short_url"`
+	Title     string `json:"title"`
+	LongURL   string `json:"long_url"`
+	Clicks    int64  `json:"clicks"`
+	Unique    int64  `json:"unique"`
+}
+
+func analyticsCounts(labels []string, values []int64) []analyticsCount {
+	out := make([]analyticsCount, len(labels))
+	for i, label := range labels {
+		out[i] = analyticsCount{Label: label, Clicks: values[i]}
+	}
+	return out
+}
+
+// handleAPIAnalytics returns the clicks of all the key owner's links, or of
+// those with the tag parameter, taking the stats API's parameters.
+func (s *Server) handleAPIAnalytics(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.authenticateAPI(r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, "Valid API Key required. Access denied.")
+		return
+	}
+
+	q := r.URL.Query()
+	loc, err := analyticsLocation(user, strings.TrimSpace(q.Get("tz")))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "Unknown timezone.")
+		return
+	}
+	sr, err := resolveStatsRange(q, time.Now(), loc)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	humanOnly, err := parseTraffic(q)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tag := strings.TrimSpace(q.Get("tag"))
+
+	rep, err := s.accountReport(r.Context(), store.AccountFilter{UserID: user.ID, Tag: tag}, sr, humanOnly)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "api analytics", "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not load the analytics")
+		return
+	}
+	points := make([]statsPoint, len(rep.keys))
+	for i, k := range rep.keys {
+		points[i] = statsPoint{Bucket: k, Clicks: rep.clicks[i], Unique: rep.unique[i]}
+	}
+	links := make([]analyticsLink, len(rep.topLinks))
+	for i, l := range rep.topLinks {
+		links[i] = analyticsLink{
+			ShortCode: l.ShortCode,
+			ShortURL:  s.cfg.ShortURL(l.ShortCode),
+			Title:     l.Title,
+			LongURL:   l.LongURL,
+			Clicks:    l.Clicks,
+			Unique:    l.Unique,
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"from":          sr.From.Format(time.RFC3339),
+		"to":            sr.To.Format(time.RFC3339),
+		"granularity":   string(sr.Granularity),
+		"timezone":      sr.Location.String(),
+		"traffic":       trafficName(humanOnly),
+		"tag":           tag,
+		"clicks":        rep.total,
+		"unique_clicks": rep.totalUnique,
+		"series":        points,
+		"top_links":     links,
+		"countries":     analyticsCounts(rep.countryLabels, rep.countryValues),
+		"referrers":     analyticsCounts(rep.referrerLabels, rep.referrerValues),
+		"platforms":     analyticsCounts(rep.platformLabels, rep.platformValues),
+	})
+}
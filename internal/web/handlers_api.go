@@ -41,10 +41,13 @@ func (s *Server) authenticateAPI(r *http.Request) (*store.User, bool) {
 	user, err := s.db.UserByAPIKey(r.Context(), key)
 	if err != nil {
 		if !errors.Is(err, store.ErrNotFound) {
-			s.log.Error("api key lookup", "error", err)
+			s.log.ErrorContext(r.Context(), "api key lookup", "error", err)
 		}
 		return nil, false
 	}
+	if user.DisabledAt != nil {
+		return nil, false
+	}
 	return user, true
 }
 
@@ -111,7 +114,7 @@ func (s *Server) handleAPIShorten(w http.ResponseWriter, r *http.Request) {
 			apiError(w, http.StatusConflict, "Custom code already taken")
 			return
 		}
-		s.log.Error("allocate short code", "error", err)
+		s.log.ErrorContext(r.Context(), "allocate short code", "error", err)
 		apiError(w, http.StatusInternalServerError, "Could not allocate a short code")
 		return
 	}
@@ -206,14 +209,14 @@ func (s *Server) handleAPIShorten(w http.ResponseWriter, r *http.Request) {
 	if password != "" {
 		hash, err := security.GeneratePasswordHash(password)
 		if err != nil {
-			s.log.Error("hash link password", "error", err)
+			s.log.ErrorContext(r.Context(), "hash link password", "error", err)
 			apiError(w, http.StatusInternalServerError, "Could not create the link")
 			return
 		}
 		link.PasswordHash = hash
 	}
 
-	if err := s.db.CreateURL(r.Context(), link); err != nil {
+	if err := s.db.CreateURL(r.Context(), link, store.UserActor(user, store.SourceAPI)); err != nil {
 		// resolveShortCode checked availability a moment ago, but a concurrent
 		// request can claim the same code in between. The unique index on
 		// urls.short_code settles it, and the loser gets the same conflict it
@@ -222,7 +225,7 @@ func (s *Server) handleAPIShorten(w http.ResponseWriter, r *http.Request) {
 			apiError(w, http.StatusConflict, "Custom code already taken")
 			return
 		}
-		s.log.Error("create link via api", "error", err)
+		s.log.ErrorContext(r.Context(), "create link via api", "error", err)
 		apiError(w, http.StatusInternalServerError, "Could not create the link")
 		return
 	}
@@ -259,7 +262,7 @@ func (s *Server) handleAPIGetURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		s.log.Error("api load link", "code", code, "error", err)
+		s.log.ErrorContext(r.Context(), "api load link", "code", code, "error", err)
 		apiError(w, http.StatusInternalServerError, "Could not load the link")
 		return
 	}
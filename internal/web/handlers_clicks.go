@@ -0,0 +1,278 @@
+package web
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arumes31/redrx/internal/shortcode"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// Page sizes of the click API. A page is buffered to learn whether another
+// follows before the headers go out, so the cap bounds the memory a request
+// can take however many clicks a link has.
+const (
+	clickPageDefault = 1000
+	clickPageMax     = 10000
+)
+
+// Formats of a click export.
+const (
+	clickFormatCSV    = "csv"
+	clickFormatNDJSON = "ndjson"
+)
+
+// clickQuery is a click export as asked for in the query string.
+type clickQuery struct {
+	Code   string
+	Format string
+	From   time.Time
+	To     time.Time
+}
+
+// parseClickQuery reads code, format, from and to. A date alone takes the
+// whole day in loc, so to=2026-03-31 includes the 31st; an RFC 3339 time is
+// taken exactly, with to exclusive. The error is the message to show.
+func parseClickQuery(q url.Values, defaultFormat string, loc *time.Location) (clickQuery, error) {
+	cq := clickQuery{Code: shortcode.Normalize(q.Get("code")), Format: strings.ToLower(strings.TrimSpace(q.Get("format")))}
+	switch cq.Format {
+	case "":
+		cq.Format = defaultFormat
+	case clickFormatCSV, clickFormatNDJSON:
+	default:
+		return cq, errors.New("Format must be csv or ndjson.")
+	}
+	var err error
+	if cq.From, err = parseClickBound(q.Get("from"), false, loc); err != nil {
+		return cq, errors.New("From must be a date (YYYY-MM-DD) or an RFC 3339 time.")
+	}
+	if cq.To, err = parseClickBound(q.Get("to"), true, loc); err != nil {
+		return cq, errors.New("To must be a date (YYYY-MM-DD) or an RFC 3339 time.")
+	}
+	if !cq.From.IsZero() && !cq.To.IsZero() && !cq.From.Before(cq.To) {
+		return cq, errors.New("From must be before to.")
+	}
+	return cq, nil
+}
+
+func parseClickBound(raw string, end bool, loc *time.Location) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", raw, loc); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	return t.UTC(), err
+}
+
+// clickWriter writes exported clicks as CSV or as NDJSON, one JSON object a
+// line, in the shape of the account export's clicks files.
+type clickWriter struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+// newClickWriter starts an export; a CSV begins with its header.
+func newClickWriter(w io.Writer, format string) (*clickWriter, error) {
+	if format == clickFormatNDJSON {
+		return &clickWriter{json: json.NewEncoder(w)}, nil
+	}
+	cw := &clickWriter{csv: csv.NewWriter(w)}
+	return cw, cw.csv.Write(clickCSVHeader)
+}
+
+func (cw *clickWriter) write(c *exportClick) error {
+	if cw.json != nil {
+		return cw.json.Encode(c)
+	}
+	return cw.csv.Write(c.csvRecord())
+}
+
+func (cw *clickWriter) flush() error {
+	if cw.csv == nil {
+		return nil
+	}
+	cw.csv.Flush()
+	return cw.csv.Error()
+}
+
+func setClickContentType(w http.ResponseWriter, format string) {
+	if format == clickFormatNDJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	}
+}
+
+// handleExportClicks downloads the clicks of one of the user's links, or of
+// all of them, as they are recorded — addresses stay anonymised as stored.
+// Rows are streamed straight from the database, so an error part way can only
+// be logged, and leaves a truncated download.
+func (s *Server) handleExportClicks(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	sess := sessionFrom(r)
+
+	loc, err := analyticsLocation(user, strings.TrimSpace(r.URL.Query().Get("tz")))
+	var cq clickQuery
+	if err == nil {
+		cq, err = parseClickQuery(r.URL.Query(), clickFormatCSV, loc)
+	}
+	if err != nil {
+		back := "/dashboard"
+		if code := shortcode.Normalize(r.URL.Query().Get("code")); code != "" {
+			back = "/" + url.PathEscape(code) + "/stats"
+		}
+		sess.AddFlash("warning", err.Error())
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	filter := store.ClickFilter{UserID: user.ID, From: cq.From, To: cq.To}
+	name := "clicks"
+	if cq.Code != "" {
+		link, err := s.db.URLByShortCode(r.Context(), cq.Code)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			s.log.ErrorContext(r.Context(), "export clicks: load link", "code", cq.Code, "error", err)
+			s.renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		if err != nil || link.UserID == nil || *link.UserID != user.ID {
+			s.renderError(w, r, http.StatusNotFound)
+			return
+		}
+		filter.URLID = link.ID
+		name = "clicks-" + link.ShortCode
+	}
+
+	setClickContentType(w, cq.Format)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+"."+cq.Format+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+	cw, err := newClickWriter(w, cq.Format)
+	if err == nil {
+		err = s.db.EachClick(r.Context(), filter, func(c *store.Click) error {
+			return cw.write(newExportClick(c))
+		})
+	}
+	if err == nil {
+		err = cw.flush()
+	}
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "export clicks", "user", user.ID, "code", cq.Code, "error", err)
+	}
+}
+
+// handleAPIClicks returns a page of clicks, of every link of the key's owner
+// or of one of them at /api/v1/{code}/clicks. When more follow, X-Next-Cursor
+// (and a Link header with rel="next") gives the cursor parameter to pass for
+// the next page; its absence means the export is complete. The cursor is the
+// position in the click log, so clicks recorded while paging are picked up at
+// the end rather than shifting pages.
+func (s *Server) handleAPIClicks(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.authenticateAPI(r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, "Valid API Key required. Access denied.")
+		return
+	}
+
+	q := r.URL.Query()
+	q.Set("code", r.PathValue("code"))
+	loc, err := analyticsLocation(user, strings.TrimSpace(q.Get("tz")))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "Unknown timezone.")
+		return
+	}
+	cq, err := parseClickQuery(q, clickFormatNDJSON, loc)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter := store.ClickFilter{UserID: user.ID, From: cq.From, To: cq.To, Limit: clickPageDefault}
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > clickPageMax {
+			apiError(w, http.StatusBadRequest, "Limit must be a whole number from 1 to "+strconv.Itoa(clickPageMax)+".")
+			return
+		}
+		filter.Limit = n
+	}
+	if raw := q.Get("cursor"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			apiError(w, http.StatusBadRequest, "Invalid cursor.")
+			return
+		}
+		filter.After = n
+	}
+
+	if cq.Code != "" {
+		// 404 for someone else's link, as for its details.
+		link, err := s.db.URLByShortCode(r.Context(), cq.Code)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			s.log.ErrorContext(r.Context(), "api clicks: load link", "code", cq.Code, "error", err)
+			apiError(w, http.StatusInternalServerError, "Could not load the link")
+			return
+		}
+		if err != nil || link.UserID == nil || *link.UserID != user.ID {
+			apiError(w, http.StatusNotFound, "URL not found")
+			return
+		}
+		filter.URLID = link.ID
+	}
+
+	// One row past the page says whether another page follows.
+	page := make([]*exportClick, 0, min(filter.Limit, 256))
+	limit := filter.Limit
+	filter.Limit++
+	var (
+		more bool
+		last int64
+	)
+	err = s.db.EachClick(r.Context(), filter, func(c *store.Click) error {
+		if len(page) == limit {
+			more = true
+			return nil
+		}
+		page = append(page, newExportClick(c))
+		last = c.ID
+		return nil
+	})
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "api clicks", "user", user.ID, "code", cq.Code, "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not load the clicks")
+		return
+	}
+
+	if more {
+		cursor := strconv.FormatInt(last, 10)
+		next := *r.URL
+		nq := r.URL.Query()
+		nq.Set("cursor", cursor)
+		next.RawQuery = nq.Encode()
+		w.Header().Set("X-Next-Cursor", cursor)
+		w.Header().Set("Link", `<`+next.RequestURI()+`>; rel="next"`)
+	}
+	setClickContentType(w, cq.Format)
+	w.Header().Set("Cache-Control", "no-store")
+	cw, err := newClickWriter(w, cq.Format)
+	for i := 0; err == nil && i < len(page); i++ {
+		err = cw.write(page[i])
+	}
+	if err == nil {
+		err = cw.flush()
+	}
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "api clicks: write", "user", user.ID, "error", err)
+	}
+}
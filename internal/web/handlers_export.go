@@ -0,0 +1,327 @@
+package web
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// exportProfile is profile.json in the account data export. Secrets — the
+// password hash, the TOTP secret, the API key and the key material of security
+// keys — are left out: they are credentials, not data about the owner, and an
+// archive that leaks from a downloads folder should not hand over the account.
+type exportProfile struct {
+	Username        string            `json:"username"`
+	Email           string            `json:"email"`
+	EmailVerifiedAt *time.Time        `json:"email_verified_at"`
+	Timezone        string            `json:"timezone"`
+	CreatedAt       time.Time         `json:"created_at"`
+	TOTPEnabled     bool              `json:"totp_enabled"`
+	HasAPIKey       bool              `json:"has_api_key"`
+	SecurityKeys    []exportKey       `json:"security_keys"`
+	Activity        []exportEvent     `json:"recent_security_activity"`
+	Links           int               `json:"links"`
+	ExportedAt      time.Time         `json:"exported_at"`
+	Files           map[string]string `json:"files"`
+}
+
+type exportKey struct {
+	Name         string     `json:"name"`
+	Passwordless bool       `json:"passwordless"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+type exportEvent struct {
+	Event     string    `json:"event"`
+	Detail    string    `json:"detail,omitempty"`
+	IPAddress string    `json:"ip_address"`
+	Country   string    `json:"country"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// exportLink is one entry of links.json: every setting of the link. A link
+// password is reported as set or not; its hash is useless to the owner.
+type exportLink struct {
+	ShortCode            string     `json:"short_code"`
+	LongURL              string     `json:"long_url"`
+	Title                string     `json:"title"`
+	Tags                 []string   `json:"tags"`
+	RotateTargets        []string   `json:"rotate_targets"`
+	IOSTargetURL         string     `json:"ios_target_url"`
+	AndroidTargetURL     string     `json:"android_target_url"`
+	PasswordProtected    bool       `json:"password_protected"`
+	PreviewMode          bool       `json:"preview_mode"`
+	StatsEnabled         bool       `json:"stats_enabled"`
+	QRColor              string     `json:"qr_color"`
+	QRBackground         string     `json:"qr_background"`
+	Status               string     `json:"status"`
+	IsEnabled            bool       `json:"is_enabled"`
+	IsDraft              bool       `json:"is_draft"`
+	Clicks               int64      `json:"clicks"`
+	CreatedAt            time.Time  `json:"created_at"`
+	ExpiresAt            *time.Time `json:"expires_at"`
+	StartAt              *time.Time `json:"start_at"`
+	EndAt                *time.Time `json:"end_at"`
+	LastAccessedAt       *time.Time `json:"last_accessed_at"`
+	AutoPauseAfter       int        `json:"auto_pause_after"`
+	SkipUnhealthyTargets bool       `json:"skip_unhealthy_targets"`
+	DeletedAt            *time.Time `json:"deleted_at"`
+}
+
+// exportClick is one entry of clicks.json. The address is stored anonymised,
+// and exported as stored.
+type exportClick struct {
+	ShortCode      string    `json:"short_code"`
+	Timestamp      time.Time `json:"timestamp"`
+	IPAddress      string    `json:"ip_address"`
+	Country        string    `json:"country"`
+	Browser        string    `json:"browser"`
+	Platform       string    `json:"platform"`
+	Referrer       string    `json:"referrer"`
+	Traffic        string    `json:"traffic"`
+	Region         string    `json:"region"`
+	City           string    `json:"city"`
+	Network        string    `json:"network"`
+	Device         string    `json:"device"`
+	OSVersion      string    `json:"os_version"`
+	BrowserVersion string    `json:"browser_version"`
+	Language       string    `json:"language"`
+	Channel        string    `json:"channel"`
+	UTMSource      string    `json:"utm_source"`
+	UTMMedium      string    `json:"utm_medium"`
+	UTMCampaign    string    `json:"utm_campaign"`
+}
+
+func newExportClick(c *store.Click) *exportClick {
+	return &exportClick{
+		ShortCode: c.ShortCode, Timestamp: c.Timestamp, IPAddress: c.IPAddress,
+		Country: c.Country, Browser: c.Browser, Platform: c.Platform, Referrer: c.Referrer,
+		Traffic: c.Traffic, Region: c.Region, City: c.City, Network: c.Network,
+		Device: c.Device, OSVersion: c.OSVersion, BrowserVersion: c.BrowserVersion, Language: c.Language,
+		Channel: c.Channel, UTMSource: c.UTMSource, UTMMedium: c.UTMMedium, UTMCampaign: c.UTMCampaign,
+	}
+}
+
+// clickCSVHeader names the columns of csvRecord, in every CSV of clicks.
+var clickCSVHeader = []string{"short_code", "timestamp", "ip_address", "country", "browser", "platform", "referrer", "traffic",
+	"region", "city", "network", "device", "os_version", "browser_version", "language",
+	"channel", "utm_source", "utm_medium", "utm_campaign"}
+
+func (c *exportClick) csvRecord() []string {
+	return csvRow(c.ShortCode, exportTime(&c.Timestamp), c.IPAddress, c.Country, c.Browser, c.Platform, c.Referrer, c.Traffic,
+		c.Region, c.City, c.Network, c.Device, c.OSVersion, c.BrowserVersion, c.Language,
+		c.Channel, c.UTMSource, c.UTMMedium, c.UTMCampaign)
+}
+
+// exportActivityLimit caps the audit log entries in the export. The log is
+// unbounded, and its older entries say little about the owner.
+const exportActivityLimit = 1000
+
+var exportFiles = map[string]string{
+	"profile.json": "this file: the account and its security settings",
+	"links.json":   "every link with all of its settings, the trash included",
+	"links.csv":    "the same links as a spreadsheet",
+	"clicks.json":  "every recorded click on those links",
+	"clicks.csv":   "the same clicks as a spreadsheet",
+}
+
+// handleExportData streams a zip of everything stored about the account. The
+// archive is written as it is read, so the clicks of a busy account are never
+// held in memory; an error part way can only be logged, and leaves a
+// truncated download the browser reports as failed.
+func (s *Server) handleExportData(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	ctx := r.Context()
+
+	links, err := s.db.ExportUserURLs(ctx, user.ID)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "export data: links", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	keys, err := s.db.WebAuthnCredentials(ctx, user.ID)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "export data: security keys", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	events, err := s.db.SecurityEvents(ctx, user.ID, exportActivityLimit)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "export data: security events", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	profile := exportProfile{
+		Username: user.Username, Email: user.Email, EmailVerifiedAt: user.EmailVerifiedAt, Timezone: user.Timezone,
+		CreatedAt: user.CreatedAt, TOTPEnabled: user.TOTPEnabled, HasAPIKey: user.APIKey != "",
+		SecurityKeys: []exportKey{}, Activity: []exportEvent{},
+		Links: len(links), ExportedAt: time.Now().UTC(), Files: exportFiles,
+	}
+	for _, k := range keys {
+		profile.SecurityKeys = append(profile.SecurityKeys, exportKey{
+			Name: k.Name, Passwordless: k.Passwordless, CreatedAt: k.CreatedAt, LastUsedAt: k.LastUsedAt,
+		})
+	}
+	for _, e := range events {
+		profile.Activity = append(profile.Activity, exportEvent{
+			Event: e.Event, Detail: e.Detail, IPAddress: e.IPAddress, Country: e.Country,
+			UserAgent: e.UserAgent, CreatedAt: e.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="redrx-export-`+time.Now().UTC().Format("20060102")+`.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	zw := zip.NewWriter(w)
+	err = writeExport(zw, profile, links, func(fn func(*exportClick) error) error {
+		return s.db.EachClick(ctx, store.ClickFilter{UserID: user.ID}, func(c *store.Click) error {
+			return fn(newExportClick(c))
+		})
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "export data", "user", user.ID, "error", err)
+	}
+}
+
+// writeExport writes the archive's files in order. eachClick is called once
+// per clicks file, since a zip entry must be finished before the next begins.
+func writeExport(zw *zip.Writer, profile exportProfile, links []*store.URL, eachClick func(func(*exportClick) error) error) error {
+	if err := writeZipJSON(zw, "profile.json", profile); err != nil {
+		return err
+	}
+
+	out := make([]exportLink, 0, len(links))
+	for _, l := range links {
+		out = append(out, exportLink{
+			ShortCode: l.ShortCode, LongURL: l.LongURL, Title: l.Title, Tags: l.Tags,
+			RotateTargets: l.RotateTargets, IOSTargetURL: l.IOSTargetURL, AndroidTargetURL: l.AndroidTargetURL,
+			PasswordProtected: l.IsPasswordProtected(), PreviewMode: l.PreviewMode,
+			StatsEnabled: l.StatsEnabled, QRColor: l.QRColor, QRBackground: l.QRBackground,
+			Status: l.Status(), IsEnabled: l.IsEnabled, IsDraft: l.IsDraft, Clicks: l.ClicksCount,
+			CreatedAt: l.CreatedAt, ExpiresAt: l.ExpiresAt, StartAt: l.StartAt, EndAt: l.EndAt,
+			LastAccessedAt: l.LastAccessedAt, AutoPauseAfter: l.AutoPauseAfter,
+			SkipUnhealthyTargets: l.SkipUnhealthyTargets, DeletedAt: l.DeletedAt,
+		})
+	}
+	if err := writeZipJSON(zw, "links.json", out); err != nil {
+		return err
+	}
+	if err := writeZipCSV(zw, "links.csv", func(cw *csv.Writer) error {
+		if err := cw.Write([]string{"short_code", "long_url", "title", "tags", "rotate_targets", "ios_target_url",
+			"android_target_url", "password_protected", "preview_mode", "stats_enabled", "qr_color",
+			"qr_background", "status", "is_enabled", "is_draft", "clicks", "created_at", "expires_at",
+			"start_at", "end_at", "last_accessed_at", "auto_pause_after", "skip_unhealthy_targets",
+			"deleted_at"}); err != nil {
+			return err
+		}
+		for _, l := range out {
+			if err := cw.Write(csvRow(l.ShortCode, l.LongURL, l.Title, strings.Join(l.Tags, "|"),
+				strings.Join(l.RotateTargets, " "),
+				l.IOSTargetURL, l.AndroidTargetURL, l.PasswordProtected, l.PreviewMode, l.StatsEnabled,
+				l.QRColor, l.QRBackground, l.Status, l.IsEnabled, l.IsDraft, l.Clicks,
+				exportTime(&l.CreatedAt), exportTime(l.ExpiresAt), exportTime(l.StartAt),
+				exportTime(l.EndAt), exportTime(l.LastAccessedAt), l.AutoPauseAfter,
+				l.SkipUnhealthyTargets, exportTime(l.DeletedAt))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	f, err := zw.Create("clicks.json")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, "["); err != nil {
+		return err
+	}
+	sep := "\n"
+	if err := eachClick(func(c *exportClick) error {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, sep); err != nil {
+			return err
+		}
+		sep = ",\n"
+		_, err = f.Write(b)
+		return err
+	}); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, "\n]\n"); err != nil {
+		return err
+	}
+
+	return writeZipCSV(zw, "clicks.csv", func(cw *csv.Writer) error {
+		if err := cw.Write(clickCSVHeader); err != nil {
+			return err
+		}
+		return eachClick(func(c *exportClick) error {
+			return cw.Write(c.csvRecord())
+		})
+	})
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func writeZipCSV(zw *zip.Writer, name string, fill func(*csv.Writer) error) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(f)
+	if err := fill(cw); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvRow renders values as a CSV record, defused against formula injection
+// like the dashboard's link export.
+func csvRow(values ...any) []string {
+	row := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case bool:
+			row[i] = strconv.FormatBool(v)
+		default:
+			row[i] = sanitizeCSVField(v)
+		}
+	}
+	return row
+}
+
+// exportTime formats a timestamp as RFC 3339 in UTC, or empty for none.
+func exportTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,314 @@
+package web
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arumes31/redrx/internal/linkimport"
+	"github.com/arumes31/redrx/internal/security"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// What became of one imported row. A dry run reports importValid where a real
+// import would have created the link.
+const (
+	importCreated = "created"
+	importValid   = "valid"
+	importSkipped = "skipped"
+	importFailed  = "failed"
+)
+
+// importResult is one row of the import report.
+type importResult struct {
+	Row       int    `json:"row"`
+	Status    string `json:"status"`
+	LongURL   string `json:"long_url"`
+	ShortCode string `json:"short_code,omitempty"`
+	ShortURL  string `json:"short_url,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// importReport is the outcome of an import, row by row.
+type importReport struct {
+	DryRun  bool           `json:"dry_run"`
+	Created int            `json:"created"`
+	Valid   int            `json:"valid"`
+	Skipped int            `json:"skipped"`
+	Failed  int            `json:"failed"`
+	Rows    []importResult `json:"rows"`
+}
+
+func (s *Server) handleImportForm(w http.ResponseWriter, r *http.Request) {
+	data := s.newPageData(r)
+	data.Data["errors"] = errorMap{}
+	data.Data["max_rows"] = linkimport.MaxRows
+	s.render(w, r, http.StatusOK, "import.html", data)
+}
+
+// handleImport imports the uploaded file, or the pasted text when no file was
+// chosen, and shows the report.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	data := s.newPageData(r)
+	errs := errorMap{}
+	data.Data["errors"] = errs
+	data.Data["max_rows"] = linkimport.MaxRows
+
+	if err := r.ParseMultipartForm(s.cfg.MaxUploadSize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		errs.add("file", "The upload is too large or could not be read.")
+		s.render(w, r, http.StatusOK, "import.html", data)
+		return
+	}
+	dryRun := checkboxChecked(r, "dry_run")
+	data.Data["dry_run"] = dryRun
+	var src io.Reader = strings.NewReader(r.FormValue("data"))
+	if file, _, err := r.FormFile("file"); err == nil {
+		defer file.Close()
+		src = file
+	} else if strings.TrimSpace(r.FormValue("data")) == "" {
+		errs.add("file", "Choose a file or paste the links to import.")
+		s.render(w, r, http.StatusOK, "import.html", data)
+		return
+	}
+
+	rows, err := linkimport.Parse(src, importFormat(r.FormValue("format")))
+	if err != nil {
+		errs.add("file", importParseError(err))
+		s.render(w, r, http.StatusOK, "import.html", data)
+		return
+	}
+	report := s.importLinks(r, user, rows, actorFrom(r), dryRun)
+
+	var csvReport bytes.Buffer
+	if err := writeImportReport(&csvReport, report); err != nil {
+		s.log.ErrorContext(r.Context(), "write import report", "error", err)
+	}
+	data.Data["report"] = report
+	data.Data["report_csv"] = csvReport.String()
+	s.render(w, r, http.StatusOK, "import.html", data)
+}
+
+// handleAPIImport is the API counterpart of the import page. The body is the
+// file itself; its format follows the Content-Type, or is detected. dry_run=1
+// validates without creating anything, and report=csv answers with the report
+// as CSV instead of JSON.
+func (s *Server) handleAPIImport(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.authenticateAPI(r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, "Valid API Key required. Access denied.")
+		return
+	}
+
+	format := ""
+	switch ct := r.Header.Get("Content-Type"); {
+	case strings.HasPrefix(ct, "text/csv"):
+		format = linkimport.FormatCSV
+	case strings.HasPrefix(ct, "application/json"):
+		format = linkimport.FormatJSON
+	}
+	rows, err := linkimport.Parse(http.MaxBytesReader(w, r.Body, s.cfg.MaxUploadSize), format)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			apiError(w, http.StatusRequestEntityTooLarge, "The file is too large")
+			return
+		}
+		apiError(w, http.StatusBadRequest, importParseError(err))
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	report := s.importLinks(r, user, rows, store.UserActor(user, store.SourceAPI), dryRun)
+
+	if r.URL.Query().Get("report") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="import-report.csv"`)
+		if err := writeImportReport(w, report); err != nil {
+			s.log.ErrorContext(r.Context(), "write import report", "error", err)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func importFormat(v string) string {
+	switch v {
+	case linkimport.FormatCSV, linkimport.FormatJSON:
+		return v
+	}
+	return ""
+}
+
+// importParseError words a parse failure for the person who uploaded the
+// file; the package's own errors carry its name as a prefix.
+func importParseError(err error) string {
+	msg := strings.TrimPrefix(err.Error(), "linkimport: ")
+	return "Could not read the file: " + msg + "."
+}
+
+// importLinks runs every row through the checks the create form applies and,
+// unless this is a dry run, creates the links that pass. A row never fails the
+// whole import: each gets its own outcome in the report.
+func (s *Server) importLinks(r *http.Request, user *store.User, rows []linkimport.Row, actor store.Actor, dryRun bool) *importReport {
+	report := &importReport{DryRun: dryRun, Rows: make([]importResult, 0, len(rows))}
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		res := s.importLink(r, user, row, actor, dryRun, seen)
+		switch res.Status {
+		case importCreated:
+			report.Created++
+		case importValid:
+			report.Valid++
+		case importSkipped:
+			report.Skipped++
+		default:
+			report.Failed++
+		}
+		report.Rows = append(report.Rows, res)
+	}
+	return report
+}
+
+func (s *Server) importLink(r *http.Request, user *store.User, row linkimport.Row, actor store.Actor, dryRun bool, seen map[string]bool) importResult {
+	res := importResult{Row: row.Line, LongURL: row.LongURL, Status: importFailed}
+
+	// Build the form a person would have submitted, so an imported link meets
+	// exactly the rules of one created by hand.
+	form := &ShortenForm{
+		LongURL:       row.LongURL,
+		PreviewMode:   true,
+		StatsEnabled:  true,
+		CustomCode:    row.CustomCode,
+		RotateTargets: strings.Join(row.RotateTargets, ","),
+		Password:      row.Password,
+		ExpiryHours:   row.ExpiryHours,
+	}
+	form.StartDate, form.StartTime = splitDateTime(row.StartAt)
+	form.EndDate, form.EndTime = splitDateTime(row.EndAt)
+	in, ok := form.Validate(s.cfg.ShortCodeLength, true)
+	if !ok {
+		res.Message = describeErrors(form.Errors)
+		return res
+	}
+	if field, msg := s.blockedTarget(in); field != "" {
+		res.Message = msg
+		return res
+	}
+	s.applyDefaultExpiry(in)
+
+	if in.CustomCode != "" {
+		res.ShortCode = in.CustomCode
+		if seen[in.CustomCode] {
+			res.Status, res.Message = importSkipped, "The code appears earlier in the file."
+			return res
+		}
+		seen[in.CustomCode] = true
+		taken, err := s.db.ShortCodeTaken(r.Context(), in.CustomCode)
+		if err != nil {
+			s.log.ErrorContext(r.Context(), "import: check code", "error", err)
+			res.Message = "Could not check whether the code is free."
+			return res
+		}
+		if taken {
+			res.Status, res.Message = importSkipped, "Code '"+in.CustomCode+"' is already taken."
+			return res
+		}
+	}
+	if dryRun {
+		res.Status = importValid
+		return res
+	}
+
+	code, err := s.resolveShortCode(r, in.CustomCode, in.CodeLength)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "import: allocate short code", "error", err)
+		res.Message = "Could not allocate a short code."
+		return res
+	}
+	link := &store.URL{
+		UserID:        &user.ID,
+		ShortCode:     code,
+		LongURL:       in.LongURL,
+		RotateTargets: in.RotateTargets,
+		PreviewMode:   in.PreviewMode,
+		StatsEnabled:  in.StatsEnabled,
+		IsEnabled:     true,
+		ExpiresAt:     in.ExpiresAt,
+		StartAt:       in.StartAt,
+		EndAt:         in.EndAt,
+	}
+	if in.Password != "" {
+		hash, err := security.GeneratePasswordHash(in.Password)
+		if err != nil {
+			s.log.ErrorContext(r.Context(), "import: hash link password", "error", err)
+			res.Message = "Could not set the password."
+			return res
+		}
+		link.PasswordHash = hash
+	}
+	if err := s.db.CreateURL(r.Context(), link, actor); err != nil {
+		if store.IsUniqueViolation(err) {
+			res.Status, res.Message = importSkipped, "Code '"+code+"' is already taken."
+			return res
+		}
+		s.log.ErrorContext(r.Context(), "import: create link", "error", err)
+		res.Message = "Could not save the link."
+		return res
+	}
+	s.metrics.shortened.Inc()
+	res.Status, res.ShortCode, res.ShortURL = importCreated, code, s.cfg.ShortURL(code)
+	return res
+}
+
+// splitDateTime turns an imported timestamp into the separate date and time
+// the form takes. RFC 3339 values are converted to UTC; "2026-06-05 22:00",
+// "2026-06-05T22:00" and a bare date, read as midnight, are taken as UTC. What
+// cannot be split is passed on whole, for the form to reject.
+func splitDateTime(v string) (date, clock string) {
+	if v == "" {
+		return "", ""
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		t = t.UTC()
+		return t.Format("2006-01-02"), t.Format("15:04:05")
+	}
+	date, clock, found := strings.Cut(strings.Replace(v, "T", " ", 1), " ")
+	if !found {
+		return date, "00:00"
+	}
+	return date, strings.TrimSuffix(strings.TrimSpace(clock), "Z")
+}
+
+// describeErrors joins a form's messages, in field order, for one report cell.
+func describeErrors(errs errorMap) string {
+	fields := make([]string, 0, len(errs))
+	for f := range errs {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	msgs := make([]string, 0, len(fields))
+	for _, f := range fields {
+		msgs = append(msgs, f+": "+errs[f])
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func writeImportReport(w io.Writer, report *importReport) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"row", "status", "long_url", "short_code", "short_url", "message"}); err != nil {
+		return err
+	}
+	for _, res := range report.Rows {
+		if err := cw.Write(csvRow(res.Row, res.Status, res.LongURL, res.ShortCode, res.ShortURL, res.Message)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -74,43 +74,19 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !s.safety.IsSafeURL(in.LongURL) {
-		sess.AddFlash("danger", "That destination URL is blocked for safety reasons.")
+	switch field, msg := s.blockedTarget(in); field {
+	case "":
+	case "long_url":
+		sess.AddFlash("danger", msg)
 		data.Flashes = sess.TakeFlashes()
 		renderIndex()
 		return
-	}
-	for _, t := range in.RotateTargets {
-		if !s.safety.IsSafeURL(t) {
-			form.Errors.add("rotate_targets", "One or more rotate target URLs are blocked or invalid.")
-			renderIndex()
-			return
-		}
-	}
-	if in.IOSTargetURL != "" && !s.safety.IsSafeURL(in.IOSTargetURL) {
-		form.Errors.add("ios_target_url", "iOS target URL is blocked or invalid.")
-		renderIndex()
-		return
-	}
-	if in.AndroidTargetURL != "" && !s.safety.IsSafeURL(in.AndroidTargetURL) {
-		form.Errors.add("android_target_url", "Android target URL is blocked or invalid.")
+	default:
+		form.Errors.add(field, msg)
 		renderIndex()
 		return
 	}
-
-	// An empty expiry field means "not specified", not "never". Without this,
-	// clearing the box produced a nil ExpiresAt and so a permanent link — which
-	// is exactly what the "Please log in to create permanent links" check on the
-	// explicit 0 exists to prevent. The default window counts from a future
-	// start, so a scheduled link is not born already expired.
-	if in.ExpiresAt == nil && !in.ExpiryNever && s.cfg.ExpiryHours > 0 {
-		base := nowUTC()
-		if in.StartAt != nil && in.StartAt.After(base) {
-			base = *in.StartAt
-		}
-		expires := base.Add(time.Duration(s.cfg.ExpiryHours) * time.Hour)
-		in.ExpiresAt = &expires
-	}
+	s.applyDefaultExpiry(in)
 
 	code, err := s.resolveShortCode(r, in.CustomCode, in.CodeLength)
 	if err != nil {
@@ -119,7 +95,7 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 			renderIndex()
 			return
 		}
-		s.log.Error("allocate short code", "error", err)
+		s.log.ErrorContext(r.Context(), "allocate short code", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -148,14 +124,14 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 	if in.Password != "" {
 		hash, err := security.GeneratePasswordHash(in.Password)
 		if err != nil {
-			s.log.Error("hash link password", "error", err)
+			s.log.ErrorContext(r.Context(), "hash link password", "error", err)
 			s.renderError(w, r, http.StatusInternalServerError)
 			return
 		}
 		link.PasswordHash = hash
 	}
 
-	if err := s.db.CreateURL(r.Context(), link); err != nil {
+	if err := s.db.CreateURL(r.Context(), link, actorFrom(r)); err != nil {
 		// The availability check above can be raced by a concurrent request;
 		// the unique index decides, and the loser sees the ordinary "taken"
 		// field error rather than a 500.
@@ -164,7 +140,7 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 			renderIndex()
 			return
 		}
-		s.log.Error("create link", "error", err)
+		s.log.ErrorContext(r.Context(), "create link", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -178,7 +154,7 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
 	shortURL := s.cfg.ShortURL(code)
 	qrPayload, err := s.renderQRForForm(r, shortURL, form)
 	if err != nil {
-		s.log.Warn("render qr code", "error", err)
+		s.log.WarnContext(r.Context(), "render qr code", "error", err)
 	}
 
 	sess.AddFlash("success", "URL Shortened Successfully!")
@@ -206,7 +182,7 @@ func (s *Server) renderQRForForm(r *http.Request, shortURL string, form *Shorten
 				if img, err := qr.DecodeLogo(buf); err == nil {
 					opts.Logo = img
 				} else {
-					s.log.Debug("uploaded logo could not be decoded", "error", err)
+					s.log.DebugContext(r.Context(), "uploaded logo could not be decoded", "error", err)
 				}
 			}
 		}
@@ -218,6 +194,45 @@ func (s *Server) renderQRForForm(r *http.Request, shortURL string, form *Shorten
 var errCodeTaken = errors.New("short code already taken")
 
 // resolveShortCode returns the custom code when free, otherwise generates one.
+// blockedTarget runs every destination of a validated link past the
+// blocklist, returning the field of the first one refused and why, or an
+// empty field when all of them may be used.
+func (s *Server) blockedTarget(in *shortenInput) (field, msg string) {
+	if !s.safety.IsSafeURL(in.LongURL) {
+		return "long_url", "That destination URL is blocked for safety reasons."
+	}
+	for _, t := range in.RotateTargets {
+		if !s.safety.IsSafeURL(t) {
+			return "rotate_targets", "One or more rotate target URLs are blocked or invalid."
+		}
+	}
+	if in.IOSTargetURL != "" && !s.safety.IsSafeURL(in.IOSTargetURL) {
+		return "ios_target_url", "iOS target URL is blocked or invalid."
+	}
+	if in.AndroidTargetURL != "" && !s.safety.IsSafeURL(in.AndroidTargetURL) {
+		return "android_target_url", "Android target URL is blocked or invalid."
+	}
+	return "", ""
+}
+
+// applyDefaultExpiry gives a link the instance's default lifetime when no
+// expiry was given. An empty expiry field means "not specified", not "never".
+// Without this, clearing the box produced a nil ExpiresAt and so a permanent
+// link — which is exactly what the "Please log in to create permanent links"
+// check on the explicit 0 exists to prevent. The default window counts from a
+// future start, so a scheduled link is not born already expired.
+func (s *Server) applyDefaultExpiry(in *shortenInput) {
+	if in.ExpiresAt != nil || in.ExpiryNever || s.cfg.ExpiryHours <= 0 {
+		return
+	}
+	base := nowUTC()
+	if in.StartAt != nil && in.StartAt.After(base) {
+		base = *in.StartAt
+	}
+	expires := base.Add(time.Duration(s.cfg.ExpiryHours) * time.Hour)
+	in.ExpiresAt = &expires
+}
+
 func (s *Server) resolveShortCode(r *http.Request, custom string, length int) (string, error) {
 	if custom != "" {
 		taken, err := s.db.ShortCodeTaken(r.Context(), custom)
@@ -258,7 +273,7 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 
 	user, err := s.db.UserByLogin(r.Context(), login)
 	if err != nil && !errors.Is(err, store.ErrNotFound) {
-		s.log.Error("look up user", "error", err)
+		s.log.ErrorContext(r.Context(), "look up user", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -272,6 +287,9 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !ok {
+		if user != nil {
+			s.recordSecurityEvent(r, user.ID, store.EventLoginFailed)
+		}
 		sess.AddFlash("danger", "Login Unsuccessful. Please check username/email and password")
 		// Also attach it to the field, so the message appears next to the input
 		// rather than only in a banner that may be scrolled off a short screen.
@@ -281,12 +299,21 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		s.render(w, r, http.StatusOK, "login_user.html", data)
 		return
 	}
+	// Only after the password, so the message does not tell anyone without
+	// it that the account exists.
+	if user.DisabledAt != nil {
+		form.Errors.add("password", "This account has been disabled.")
+		data := s.newPageData(r)
+		data.Data["form"] = form
+		s.render(w, r, http.StatusForbidden, "login_user.html", data)
+		return
+	}
 
 	// Transparently upgrade hashes left behind by the old deployment.
 	if security.NeedsRehash(user.PasswordHash) {
 		if hash, err := security.GeneratePasswordHash(password); err == nil {
 			if err := s.db.SetUserPasswordHash(r.Context(), user.ID, hash); err != nil {
-				s.log.Warn("upgrade password hash", "user", user.ID, "error", err)
+				s.log.WarnContext(r.Context(), "upgrade password hash", "user", user.ID, "error", err)
 			}
 		}
 	}
@@ -297,13 +324,23 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	if !isSafeRedirect(next) {
 		next = "/"
 	}
-	if user.TOTPEnabled {
+	twoStep, err := s.hasSecondFactor(r.Context(), user)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "check second factor", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if twoStep {
 		sess.BeginTwoFactor(user.ID, next)
 		http.Redirect(w, r, "/login/totp", http.StatusSeeOther)
 		return
 	}
 
-	sess.Login(user.ID)
+	if err := s.signIn(r, user); err != nil {
+		s.log.ErrorContext(r.Context(), "register session", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
 	if next != "/" {
 		http.Redirect(w, r, next, http.StatusSeeOther) // #nosec G710 -- validated by isSafeRedirect
 		return
@@ -366,18 +403,20 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// An administrator's name is held for them, whether or not they have
+	// registered it yet.
 	if taken, err := s.db.UsernameTaken(r.Context(), form.Username); err != nil {
-		s.log.Error("check username", "error", err)
+		s.log.ErrorContext(r.Context(), "check username", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
-	} else if taken {
+	} else if taken || s.cfg.IsAdmin(form.Username) {
 		form.Errors.add("username", "That username is already taken.")
 		renderForm()
 		return
 	}
 
 	if taken, err := s.db.EmailTaken(r.Context(), form.Email); err != nil {
-		s.log.Error("check email", "error", err)
+		s.log.ErrorContext(r.Context(), "check email", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	} else if taken {
@@ -388,7 +427,7 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 
 	hash, err := security.GeneratePasswordHash(password)
 	if err != nil {
-		s.log.Error("hash password", "error", err)
+		s.log.ErrorContext(r.Context(), "hash password", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -400,21 +439,81 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		APIKey:       uuid.NewString(),
 	}
 	if err := s.db.CreateUser(r.Context(), user); err != nil {
-		s.log.Error("create user", "error", err)
+		s.log.ErrorContext(r.Context(), "create user", "error", err)
 		form.Errors.add("username", "Could not create the account. Please try again.")
 		renderForm()
 		return
 	}
 
-	sess.AddFlash("success", "Your account has been created! You can now log in.")
+	if s.mailer != nil {
+		s.sendVerification(user)
+		sess.AddFlash("success", "Your account has been created! We sent a link to "+user.Email+
+			" to verify your address. You can now log in.")
+	} else {
+		sess.AddFlash("success", "Your account has been created! You can now log in.")
+	}
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
-	sessionFrom(r).Logout()
+	sess := sessionFrom(r)
+	if user := userFrom(r); user != nil {
+		if _, err := s.sessionStore.Delete(r.Context(), user.ID, sess.SessionID); err != nil {
+			s.log.ErrorContext(r.Context(), "revoke session on logout", "user", user.ID, "error", err)
+		}
+		s.recordSecurityEvent(r, user.ID, store.EventLogout)
+	}
+	sess.Logout()
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// linkHealth is the dashboard's health badge for one link.
+type linkHealth struct {
+	// State is "healthy", "degraded" (some destination failing), "down" (every
+	// destination serving ordinary traffic failing) or "unknown".
+	State     string
+	Detail    string
+	CheckedAt *time.Time
+}
+
+// summarizeHealth folds a link's per-destination results into one badge.
+func summarizeHealth(link *store.URL, rows []*store.LinkHealth) linkHealth {
+	if len(rows) == 0 {
+		return linkHealth{State: "unknown", Detail: "Not checked yet"}
+	}
+
+	byTarget := make(map[string]*store.LinkHealth, len(rows))
+	var (
+		failing []string
+		latest  time.Time
+	)
+	for _, h := range rows {
+		byTarget[h.Target] = h
+		if !h.Healthy() {
+			failing = append(failing, h.Target+": "+h.Error)
+		}
+		if h.CheckedAt.After(latest) {
+			latest = h.CheckedAt
+		}
+	}
+	out := linkHealth{CheckedAt: &latest}
+	if len(failing) == 0 {
+		out.State = "healthy"
+		out.Detail = "All destinations responding"
+		return out
+	}
+	out.Detail = strings.Join(failing, "\n")
+
+	out.State = "down"
+	for _, t := range link.PrimaryTargets() {
+		if h, ok := byTarget[t]; !ok || h.Healthy() {
+			out.State = "degraded"
+			break
+		}
+	}
+	return out
+}
+
 // pagination describes the dashboard's page controls.
 type pagination struct {
 	Page    int
@@ -467,7 +566,7 @@ func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
 
 	stats, err := s.db.DashboardStats(r.Context(), user.ID)
 	if err != nil {
-		s.log.Error("dashboard stats", "error", err)
+		s.log.ErrorContext(r.Context(), "dashboard stats", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -482,7 +581,7 @@ func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
 
 	urls, err := s.db.UserURLs(r.Context(), user.ID, dashboardPageSize, (page-1)*dashboardPageSize)
 	if err != nil {
-		s.log.Error("list user links", "error", err)
+		s.log.ErrorContext(r.Context(), "list user links", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -490,6 +589,22 @@ func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
 	data := s.newPageData(r)
 	data.Data["stats"] = stats
 	data.Data["urls"] = urls
+	if s.cfg.EnableHealthCheck {
+		ids := make([]int64, len(urls))
+		for i, u := range urls {
+			ids[i] = u.ID
+		}
+		rows, err := s.db.LinkHealthFor(r.Context(), ids)
+		if err != nil {
+			// The badges are advisory; the dashboard is still useful without them.
+			s.log.WarnContext(r.Context(), "load link health", "error", err)
+		}
+		health := make(map[int64]linkHealth, len(urls))
+		for _, u := range urls {
+			health[u.ID] = summarizeHealth(u, rows[u.ID])
+		}
+		data.Data["health"] = health
+	}
 	data.Data["pagination"] = pagination{
 		Page: page, Pages: pages, Total: stats.TotalLinks,
 		HasPrev: page > 1, HasNext: page < pages,
@@ -503,9 +618,10 @@ func (s *Server) handleRegenerateAPIKey(w http.ResponseWriter, r *http.Request)
 	sess := sessionFrom(r)
 
 	if err := s.db.SetAPIKey(r.Context(), user.ID, uuid.NewString()); err != nil {
-		s.log.Error("regenerate api key", "error", err)
+		s.log.ErrorContext(r.Context(), "regenerate api key", "error", err)
 		sess.AddFlash("danger", "Could not regenerate the API key.")
 	} else {
+		s.recordSecurityEvent(r, user.ID, store.EventAPIKeyRegenerated)
 		sess.AddFlash("success", "API Key regenerated successfully.")
 	}
 	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
@@ -520,7 +636,7 @@ func (s *Server) ownedLink(w http.ResponseWriter, r *http.Request) *store.URL {
 		return nil
 	}
 	if err != nil {
-		s.log.Error("load link", "code", code, "error", err)
+		s.log.ErrorContext(r.Context(), "load link", "code", code, "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return nil
 	}
@@ -542,9 +658,9 @@ func (s *Server) handleToggleStatus(w http.ResponseWriter, r *http.Request) {
 		apiError(w, http.StatusConflict, "Publish the draft before changing its status.")
 		return
 	}
-	enabled, err := s.db.SetURLEnabledToggle(r.Context(), link.ID)
+	enabled, err := s.db.SetURLEnabledToggle(r.Context(), link.ID, actorFrom(r))
 	if err != nil {
-		s.log.Error("toggle link status", "error", err)
+		s.log.ErrorContext(r.Context(), "toggle link status", "error", err)
 		apiError(w, http.StatusInternalServerError, "Could not update the link.")
 		return
 	}
@@ -564,8 +680,8 @@ func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request) {
 	if link == nil {
 		return
 	}
-	if err := s.db.PublishURL(r.Context(), link.ID); err != nil {
-		s.log.Error("publish draft", "error", err)
+	if err := s.db.PublishURL(r.Context(), link.ID, actorFrom(r)); err != nil {
+		s.log.ErrorContext(r.Context(), "publish draft", "error", err)
 		if wantsJSON(r) {
 			apiError(w, http.StatusInternalServerError, "Could not publish the draft.")
 			return
@@ -586,7 +702,7 @@ func (s *Server) handleExportLinks(w http.ResponseWriter, r *http.Request) {
 
 	links, err := s.db.AllUserURLs(r.Context(), user.ID)
 	if err != nil {
-		s.log.Error("export links", "error", err)
+		s.log.ErrorContext(r.Context(), "export links", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -621,28 +737,34 @@ func (s *Server) handleBulkDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	raw := r.PostForm["link_ids"]
-	if len(raw) == 0 {
+	ids := selectedLinkIDs(r)
+	if len(ids) == 0 {
 		sess.AddFlash("warning", "No links selected.")
 		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
 		return
 	}
 
+	deleted, err := s.db.DeleteUserURLs(r.Context(), user.ID, ids, actorFrom(r))
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "bulk delete", "error", err)
+		sess.AddFlash("danger", "Could not delete the selected links.")
+	} else {
+		sess.AddFlash("info", "Moved "+strconv.FormatInt(deleted, 10)+" links to the trash.")
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// selectedLinkIDs reads the link_ids checkboxes of a parsed form, dropping any
+// value that is not an id.
+func selectedLinkIDs(r *http.Request) []int64 {
+	raw := r.PostForm["link_ids"]
 	ids := make([]int64, 0, len(raw))
 	for _, v := range raw {
 		if id, err := strconv.ParseInt(v, 10, 64); err == nil {
 			ids = append(ids, id)
 		}
 	}
-
-	deleted, err := s.db.DeleteUserURLs(r.Context(), user.ID, ids)
-	if err != nil {
-		s.log.Error("bulk delete", "error", err)
-		sess.AddFlash("danger", "Could not delete the selected links.")
-	} else {
-		sess.AddFlash("info", "Successfully deleted "+strconv.FormatInt(deleted, 10)+" links.")
-	}
-	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+	return ids
 }
 
 func (s *Server) handleEditForm(w http.ResponseWriter, r *http.Request) {
@@ -652,13 +774,17 @@ func (s *Server) handleEditForm(w http.ResponseWriter, r *http.Request) {
 	}
 
 	form := &EditForm{
-		LongURL:          link.LongURL,
-		IOSTargetURL:     link.IOSTargetURL,
-		AndroidTargetURL: link.AndroidTargetURL,
-		PreviewMode:      link.PreviewMode,
-		StatsEnabled:     link.StatsEnabled,
-		IsDraft:          link.IsDraft,
-		Errors:           errorMap{},
+		LongURL:              link.LongURL,
+		IOSTargetURL:         link.IOSTargetURL,
+		AndroidTargetURL:     link.AndroidTargetURL,
+		PreviewMode:          link.PreviewMode,
+		StatsEnabled:         link.StatsEnabled,
+		IsDraft:              link.IsDraft,
+		SkipUnhealthyTargets: link.SkipUnhealthyTargets,
+		Errors:               errorMap{},
+	}
+	if link.AutoPauseAfter > 0 {
+		form.AutoPauseAfter = strconv.Itoa(link.AutoPauseAfter)
 	}
 	if link.StartAt != nil {
 		form.StartDate = link.StartAt.UTC().Format("2006-01-02")
@@ -677,18 +803,28 @@ func (s *Server) handleEditForm(w http.ResponseWriter, r *http.Request) {
 		if hours >= 1 {
 			form.ExpiryHours = strconv.Itoa(hours)
 		}
-		// Show the absolute time too, so "leave blank to keep it" is legible.
-		data := s.newPageData(r)
-		data.Data["form"] = form
-		data.Data["short_code"] = link.ShortCode
-		data.Data["expires_at"] = link.ExpiresAt.Format("2006-01-02 15:04 UTC")
-		s.render(w, r, http.StatusOK, "edit_url.html", data)
-		return
 	}
+	s.renderEditForm(w, r, link, form)
+}
+
+// revisionHistoryLimit caps how much of a link's history the edit page shows.
+const revisionHistoryLimit = 50
 
+// renderEditForm renders the edit page with the link's change history.
+func (s *Server) renderEditForm(w http.ResponseWriter, r *http.Request, link *store.URL, form *EditForm) {
 	data := s.newPageData(r)
 	data.Data["form"] = form
 	data.Data["short_code"] = link.ShortCode
+	if link.ExpiresAt != nil {
+		// Show the absolute time too, so "leave blank to keep it" is legible.
+		data.Data["expires_at"] = link.ExpiresAt.Format("2006-01-02 15:04 UTC")
+	}
+	revisions, err := s.db.Revisions(r.Context(), link.ID, revisionHistoryLimit)
+	if err != nil {
+		// The history is informational; the form still works without it.
+		s.log.WarnContext(r.Context(), "load link history", "code", link.ShortCode, "error", err)
+	}
+	data.Data["revisions"] = revisions
 	s.render(w, r, http.StatusOK, "edit_url.html", data)
 }
 
@@ -703,12 +839,7 @@ func (s *Server) handleEdit(w http.ResponseWriter, r *http.Request) {
 	form := bindEditForm(r)
 	in, ok := form.Validate()
 
-	renderForm := func() {
-		data := s.newPageData(r)
-		data.Data["form"] = form
-		data.Data["short_code"] = link.ShortCode
-		s.render(w, r, http.StatusOK, "edit_url.html", data)
-	}
+	renderForm := func() { s.renderEditForm(w, r, link, form) }
 
 	if !ok {
 		renderForm()
@@ -739,6 +870,8 @@ func (s *Server) handleEdit(w http.ResponseWriter, r *http.Request) {
 	link.StartAt = in.StartAt
 	link.EndAt = in.EndAt
 	link.IsDraft = in.IsDraft
+	link.AutoPauseAfter = in.AutoPauseAfter
+	link.SkipUnhealthyTargets = in.SkipUnhealthyTargets
 	if in.ExpiryGiven {
 		if in.ExpiryNever {
 			link.ExpiresAt = nil
@@ -747,14 +880,14 @@ func (s *Server) handleEdit(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if err := s.db.UpdateURL(r.Context(), link); err != nil {
-		s.log.Error("update link", "error", err)
+	if err := s.db.UpdateURL(r.Context(), link, actorFrom(r)); err != nil {
+		s.log.ErrorContext(r.Context(), "update link", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
 	if wasDraft && !link.IsDraft {
-		if err := s.db.PublishURL(r.Context(), link.ID); err != nil {
-			s.log.Error("publish edited draft", "error", err)
+		if err := s.db.PublishURL(r.Context(), link.ID, actorFrom(r)); err != nil {
+			s.log.ErrorContext(r.Context(), "publish edited draft", "error", err)
 			s.renderError(w, r, http.StatusInternalServerError)
 			return
 		}
@@ -764,6 +897,49 @@ func (s *Server) handleEdit(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
 }
 
+// errUnsafeRevert vetoes a revert whose destinations are now blocked.
+var errUnsafeRevert = errors.New("revert target is blocked")
+
+// handleRevert restores a link to one of its earlier revisions.
+func (s *Server) handleRevert(w http.ResponseWriter, r *http.Request) {
+	link := s.ownedLink(w, r)
+	if link == nil {
+		return
+	}
+	sess := sessionFrom(r)
+	editURL := "/edit/" + link.ShortCode
+
+	revisionID, err := strconv.ParseInt(r.PathValue("revision"), 10, 64)
+	if err != nil {
+		s.renderError(w, r, http.StatusNotFound)
+		return
+	}
+
+	// The blocklist may have grown since the revision was written, so the
+	// restored destinations are checked exactly as an edit's would be.
+	_, err = s.db.RevertURL(r.Context(), link.ID, revisionID, actorFrom(r), func(u *store.URL) error {
+		for _, target := range u.Destinations() {
+			if !s.safety.IsSafeURL(target) {
+				return errUnsafeRevert
+			}
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		s.renderError(w, r, http.StatusNotFound)
+		return
+	case errors.Is(err, errUnsafeRevert):
+		sess.AddFlash("danger", "That revision points at a destination that is now blocked.")
+	case err != nil:
+		s.log.ErrorContext(r.Context(), "revert link", "code", link.ShortCode, "error", err)
+		sess.AddFlash("danger", "Could not revert the link.")
+	default:
+		sess.AddFlash("success", "Link reverted.")
+	}
+	http.Redirect(w, r, editURL, http.StatusSeeOther)
+}
+
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	link := s.ownedLink(w, r)
 	if link == nil {
@@ -771,11 +947,11 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	}
 	sess := sessionFrom(r)
 
-	if err := s.db.DeleteURL(r.Context(), link.ID); err != nil {
-		s.log.Error("delete link", "error", err)
+	if err := s.db.DeleteURL(r.Context(), link.ID, actorFrom(r)); err != nil {
+		s.log.ErrorContext(r.Context(), "delete link", "error", err)
 		sess.AddFlash("danger", "Could not delete the link.")
 	} else {
-		sess.AddFlash("info", "Link deleted successfully.")
+		sess.AddFlash("info", "Link moved to the trash.")
 	}
 	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
 }
@@ -3,6 +3,7 @@ package web
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"math/rand/v2"
 	"net/http"
@@ -12,7 +13,9 @@ import (
 	"unicode/utf8"
 
 	"github.com/mileusna/useragent"
+	"golang.org/x/text/language"
 
+	"github.com/arumes31/redrx/internal/channel"
 	"github.com/arumes31/redrx/internal/geo"
 	"github.com/arumes31/redrx/internal/qr"
 	"github.com/arumes31/redrx/internal/security"
@@ -36,13 +39,13 @@ func (s *Server) handleRedirect(w http.ResponseWriter, r *http.Request) {
 
 	ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
 	defer cancel()
-	link, err := s.db.URLByShortCode(ctx, code)
+	link, err := s.redirectLink(ctx, code)
 	if errors.Is(err, store.ErrNotFound) {
 		s.renderError(w, r, http.StatusNotFound)
 		return
 	}
 	if err != nil {
-		s.log.Error("load link for redirect", "code", code, "error", err)
+		s.log.ErrorContext(r.Context(), "load link for redirect", "code", code, "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -67,14 +70,13 @@ func (s *Server) handleRedirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.db.TouchLastAccessed(r.Context(), link.ID, time.Now().UTC()); err != nil {
-		s.log.Warn("update last accessed", "code", link.ShortCode, "error", err)
-	}
 	s.metrics.redirects.Inc()
-
+	now := time.Now().UTC()
+	var click *store.Click
 	if link.StatsEnabled && s.shouldTrack(r) {
-		s.recordClick(r, link, ua)
+		click = s.newClick(r, link, ua, now)
 	}
+	s.recordRedirect(r, link, now, click)
 
 	if link.PreviewMode {
 		data := s.newPageData(r)
@@ -87,13 +89,25 @@ func (s *Server) handleRedirect(w http.ResponseWriter, r *http.Request) {
 	// The interstitial matches the previous behaviour: a countdown page rather
 	// than an HTTP redirect, so the destination is always shown first.
 	if err := s.renderer.Render(w, http.StatusOK, "redirect.html", struct{ TargetURL string }{target}); err != nil {
-		s.log.Error("render redirect page", "error", err)
+		s.log.ErrorContext(r.Context(), "render redirect page", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 	}
 }
 
+// redirectLink resolves a code for the redirect, through the link cache when
+// there is one. The link may be shared with other requests and must not be
+// modified.
+func (s *Server) redirectLink(ctx context.Context, code string) (*store.URL, error) {
+	if s.links == nil {
+		return s.db.URLByShortCode(ctx, code)
+	}
+	return s.links.Get(ctx, code, s.db.URLByShortCode)
+}
+
 // selectTarget picks the destination for this visitor: a device-specific URL
 // when one matches, otherwise a rotation target, otherwise the main URL.
+// Rotation targets the health monitor found failing are left out when the
+// owner asked for that.
 func (s *Server) selectTarget(link *store.URL, ua useragent.UserAgent) string {
 	if link.IOSTargetURL != "" && ua.IsIOS() {
 		return link.IOSTargetURL
@@ -102,9 +116,9 @@ func (s *Server) selectTarget(link *store.URL, ua useragent.UserAgent) string {
 		return link.AndroidTargetURL
 	}
 
-	if len(link.RotateTargets) > 0 {
-		safe := make([]string, 0, len(link.RotateTargets))
-		for _, t := range link.RotateTargets {
+	if rotation := link.HealthyRotateTargets(); len(rotation) > 0 {
+		safe := make([]string, 0, len(rotation))
+		for _, t := range rotation {
 			if s.safety.IsSafeURL(t) {
 				safe = append(safe, t)
 			}
@@ -119,12 +133,14 @@ func (s *Server) selectTarget(link *store.URL, ua useragent.UserAgent) string {
 	return link.LongURL
 }
 
-// recordClick stores an anonymised analytics row for the redirect.
-func (s *Server) recordClick(r *http.Request, link *store.URL, ua useragent.UserAgent) {
+// newClick builds the anonymised analytics row for the redirect.
+func (s *Server) newClick(r *http.Request, link *store.URL, ua useragent.UserAgent, at time.Time) *store.Click {
 	ip := s.geo.ClientIP(r)
-	country := s.geo.Country(r.Context(), ip, r)
+	loc := s.geo.Locate(r.Context(), ip, r)
 
+	utm := channel.FromQuery(r.URL.Query())
 	referrer := r.Referer()
+	trafficChannel := s.channels.Classify(referrer, utm)
 	if referrer == "" {
 		referrer = "Direct"
 	}
@@ -132,17 +148,53 @@ func (s *Server) recordClick(r *http.Request, link *store.URL, ua useragent.User
 	// Truncate to the column widths the schema declares. A crafted or unusual
 	// User-Agent can yield a browser/platform string over 50 chars, which
 	// Postgres rejects outright (VARCHAR(50)) and drops the click entirely.
+	anonIP := geo.AnonymizeIP(ip)
 	click := &store.Click{
 		URLID:     link.ID,
-		Timestamp: time.Now().UTC(),
-		IPAddress: truncate(geo.AnonymizeIP(ip), 45),
-		Country:   truncate(country, 100),
+		Timestamp: at,
+		IPAddress: truncate(anonIP, 45),
+		Country:   truncate(loc.Country, 100),
+		Region:    truncate(loc.Region, 100),
+		City:      truncate(loc.City, 100),
+		Network:   truncate(loc.Network, 255),
 		Browser:   truncate(browserName(ua), 50),
 		Platform:  truncate(firstNonEmpty(ua.OS, "Unknown"), 50),
 		Referrer:  truncate(referrer, 255),
+		Traffic:   s.trafficClass(r.Context(), r, link, ip, ua),
+
+		OSVersion:      truncate(osVersion(ua), 50),
+		BrowserVersion: truncate(browserVersion(ua), 50),
+		Language:       preferredLanguage(r.Header.Get("Accept-Language")),
+
+		Channel:     trafficChannel,
+		UTMSource:   truncate(utm.Source, 100),
+		UTMMedium:   truncate(utm.Medium, 100),
+		UTMCampaign: truncate(utm.Campaign, 100),
+	}
+	click.Device = deviceClass(ua, click.Traffic)
+	if s.cfg.UniqueVisitorWindow > 0 {
+		click.VisitorHash = s.visitorHash(r.Context(), click.Timestamp, anonIP, r.UserAgent())
+	}
+	return click
+}
+
+// recordRedirect saves the link's last access and the click, if tracked:
+// through the click queue, or straight away when there is none.
+func (s *Server) recordRedirect(r *http.Request, link *store.URL, at time.Time, click *store.Click) {
+	if s.clicks != nil {
+		s.clicks.add(redirectRecord{linkID: link.ID, at: at, click: click})
+		return
 	}
-	if err := s.db.RecordClick(r.Context(), click); err != nil {
-		s.log.Error("record click", "code", link.ShortCode, "error", err)
+
+	if err := s.db.TouchLastAccessed(r.Context(), link.ID, at); err != nil {
+		s.log.WarnContext(r.Context(), "update last accessed", "code", link.ShortCode, "error", err)
+	}
+	if click == nil {
+		return
+	}
+	window := time.Duration(s.cfg.UniqueVisitorWindow) * time.Minute
+	if err := s.db.RecordClick(r.Context(), click, window); err != nil {
+		s.log.ErrorContext(r.Context(), "record click", "code", link.ShortCode, "error", err)
 	}
 }
 
@@ -150,7 +202,7 @@ func (s *Server) handleLinkAuthForm(w http.ResponseWriter, r *http.Request) {
 	code := shortcode.Normalize(r.PathValue("code"))
 	if _, err := s.db.URLByShortCode(r.Context(), code); err != nil {
 		if !errors.Is(err, store.ErrNotFound) {
-			s.log.Error("load link for auth form", "code", code, "error", err)
+			s.log.ErrorContext(r.Context(), "load link for auth form", "code", code, "error", err)
 			s.renderError(w, r, http.StatusInternalServerError)
 			return
 		}
@@ -173,7 +225,7 @@ func (s *Server) handleLinkAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		s.log.Error("load link for auth", "code", code, "error", err)
+		s.log.ErrorContext(r.Context(), "load link for auth", "code", code, "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -199,7 +251,7 @@ func (s *Server) handleQR(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		s.log.Error("load link for qr", "code", code, "error", err)
+		s.log.ErrorContext(r.Context(), "load link for qr", "code", code, "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -211,7 +263,7 @@ func (s *Server) handleQR(w http.ResponseWriter, r *http.Request) {
 		Background: firstNonEmpty(link.QRBackground, s.cfg.DefaultQRBG),
 	})
 	if err != nil {
-		s.log.Error("render qr", "code", code, "error", err)
+		s.log.ErrorContext(r.Context(), "render qr", "code", code, "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -238,6 +290,67 @@ func browserName(ua useragent.UserAgent) string {
 	}
 }
 
+// deviceClass is the class of device a click came from. A click classified
+// as a bot's is one, whatever device its User-Agent claims.
+func deviceClass(ua useragent.UserAgent, traffic string) string {
+	switch {
+	case traffic == store.TrafficBot || ua.Bot:
+		return store.DeviceBot
+	case ua.Tablet:
+		return store.DeviceTablet
+	case ua.Mobile:
+		return store.DeviceMobile
+	case ua.Desktop:
+		return store.DeviceDesktop
+	}
+	return ""
+}
+
+// osVersion names the operating system with its version, as "Android 14" or
+// "iOS 17.4": the major version, and the minor one when it is not zero.
+func osVersion(ua useragent.UserAgent) string {
+	if ua.OS == "" || ua.OSVersionNo.Major == 0 {
+		return ua.OS
+	}
+	v := ua.OSVersionNo
+	if v.Minor == 0 {
+		return fmt.Sprintf("%s %d", ua.OS, v.Major)
+	}
+	return fmt.Sprintf("%s %d.%d", ua.OS, v.Major, v.Minor)
+}
+
+// browserVersion names the browser with its major version, as "Chrome 126".
+func browserVersion(ua useragent.UserAgent) string {
+	name := browserName(ua)
+	if ua.VersionNo.Major == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s %d", name, ua.VersionNo.Major)
+}
+
+// preferredLanguage returns the visitor's first choice in an Accept-Language
+// header, in canonical form ("de-AT"), or "" when it names none. The "*"
+// wildcard is no choice and is passed over.
+func preferredLanguage(header string) string {
+	// Bound the parse: the header is the visitor's to make as long as they like.
+	if header == "" || len(header) > 1024 {
+		return ""
+	}
+	tags, _, err := language.ParseAcceptLanguage(header)
+	if err != nil {
+		return ""
+	}
+	for _, tag := range tags {
+		if tag != language.Und && tag != anyLanguage {
+			return truncate(tag.String(), 35)
+		}
+	}
+	return ""
+}
+
+// anyLanguage is what the "*" of an Accept-Language header parses as.
+var anyLanguage = language.Make("mul")
+
 func firstNonEmpty(values ...string) string {
 	for _, v := range values {
 		if v != "" {
@@ -10,6 +10,7 @@ import (
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 
+	"github.com/arumes31/redrx/internal/geo"
 	"github.com/arumes31/redrx/internal/qr"
 	"github.com/arumes31/redrx/internal/security"
 	"github.com/arumes31/redrx/internal/store"
@@ -21,12 +22,31 @@ func (s *Server) handleTOTPLoginForm(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	if _, _, ok := sessionFrom(r).PendingTwoFactor(); !ok {
+	userID, _, ok := sessionFrom(r).PendingTwoFactor()
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	user, err := s.db.UserByID(r.Context(), userID)
+	if err != nil {
+		sessionFrom(r).Logout()
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
+	s.renderSecondFactorForm(w, r, user, errorMap{})
+}
+
+// renderSecondFactorForm renders the second sign-in step, offering whichever
+// factors the account has.
+func (s *Server) renderSecondFactorForm(w http.ResponseWriter, r *http.Request, user *store.User, errs errorMap) {
+	hasKeys, err := s.db.HasWebAuthnCredentials(r.Context(), user.ID)
+	if err != nil {
+		s.log.WarnContext(r.Context(), "check webauthn credentials", "user", user.ID, "error", err)
+	}
 	data := s.newPageData(r)
-	data.Data["errors"] = errorMap{}
+	data.Data["errors"] = errs
+	data.Data["totp"] = user.TOTPEnabled
+	data.Data["webauthn"] = hasKeys
 	s.render(w, r, http.StatusOK, "login_totp.html", data)
 }
 
@@ -41,7 +61,7 @@ func (s *Server) handleTOTPLogin(w http.ResponseWriter, r *http.Request) {
 	user, err := s.db.UserByID(r.Context(), userID)
 	if err != nil {
 		if !errors.Is(err, store.ErrNotFound) {
-			s.log.Error("load pending 2FA user", "error", err)
+			s.log.ErrorContext(r.Context(), "load pending 2FA user", "error", err)
 		}
 		sess.Logout()
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -49,20 +69,23 @@ func (s *Server) handleTOTPLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	valid, err := s.validateSecondFactor(r, user, r.PostFormValue("code"))
 	if err != nil {
-		s.log.Error("validate second factor", "user", user.ID, "error", err)
+		s.log.ErrorContext(r.Context(), "validate second factor", "user", user.ID, "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
 	if !valid {
-		data := s.newPageData(r)
+		s.recordSecurityEvent(r, user.ID, store.EventSecondFactorFail)
 		errs := errorMap{}
 		errs.add("code", "Enter a valid authenticator or unused recovery code.")
-		data.Data["errors"] = errs
-		s.render(w, r, http.StatusOK, "login_totp.html", data)
+		s.renderSecondFactorForm(w, r, user, errs)
 		return
 	}
 
-	sess.Login(user.ID)
+	if err := s.signIn(r, user); err != nil {
+		s.log.ErrorContext(r.Context(), "register session", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
 	if isSafeRedirect(next) {
 		http.Redirect(w, r, next, http.StatusSeeOther)
 		return
@@ -72,7 +95,34 @@ func (s *Server) handleTOTPLogin(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleSecuritySettings(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-store")
-	data := s.newPageData(r)
+	s.renderSecuritySettings(w, r, s.newPageData(r))
+}
+
+// securityEventLimit caps the activity list on the security settings page.
+const securityEventLimit = 50
+
+// renderSecuritySettings renders the security settings page with the account's
+// recent activity.
+func (s *Server) renderSecuritySettings(w http.ResponseWriter, r *http.Request, data *PageData) {
+	events, err := s.db.SecurityEvents(r.Context(), data.User.ID, securityEventLimit)
+	if err != nil {
+		// The activity list is informational; the 2FA controls still work.
+		s.log.WarnContext(r.Context(), "load security events", "user", data.User.ID, "error", err)
+	}
+	data.Data["events"] = events
+	keys, err := s.db.WebAuthnCredentials(r.Context(), data.User.ID)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "load webauthn credentials", "user", data.User.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	data.Data["keys"] = keys
+	sessions, err := s.sessionStore.List(r.Context(), data.User.ID)
+	if err != nil {
+		s.log.WarnContext(r.Context(), "list sessions", "user", data.User.ID, "error", err)
+	}
+	data.Data["sessions"] = sessions
+	data.Data["current_session"] = sessionFrom(r).SessionID
 	s.render(w, r, http.StatusOK, "security_settings.html", data)
 }
 
@@ -90,31 +140,31 @@ func (s *Server) handleTOTPStart(w http.ResponseWriter, r *http.Request) {
 		SecretSize: 20, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1,
 	})
 	if err != nil {
-		s.log.Error("generate TOTP enrollment", "error", err)
+		s.log.ErrorContext(r.Context(), "generate TOTP enrollment", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
 	encrypted, err := security.SealAccountSecret(s.cfg.SecretKey, key.Secret())
 	if err != nil {
-		s.log.Error("encrypt TOTP secret", "error", err)
+		s.log.ErrorContext(r.Context(), "encrypt TOTP secret", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
 	if err := s.db.SetTOTPPending(r.Context(), user.ID, encrypted); err != nil {
-		s.log.Error("store TOTP enrollment", "error", err)
+		s.log.ErrorContext(r.Context(), "store TOTP enrollment", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
 	qrData, err := qr.DataURLPayload(key.URL(), qr.Options{Foreground: "#000000", Background: "#ffffff"})
 	if err != nil {
-		s.log.Error("render TOTP QR", "error", err)
+		s.log.ErrorContext(r.Context(), "render TOTP QR", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
 	data := s.newPageData(r)
 	data.Data["totp_secret"] = key.Secret()
 	data.Data["totp_qr"] = qrData
-	s.render(w, r, http.StatusOK, "security_settings.html", data)
+	s.renderSecuritySettings(w, r, data)
 }
 
 func (s *Server) handleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
@@ -127,7 +177,7 @@ func (s *Server) handleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
 	}
 	secret, err := security.OpenAccountSecret(s.cfg.SecretKey, user.TOTPSecret)
 	if err != nil {
-		s.log.Error("decrypt pending TOTP secret", "user", user.ID, "error", err)
+		s.log.ErrorContext(r.Context(), "decrypt pending TOTP secret", "user", user.ID, "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -136,19 +186,19 @@ func (s *Server) handleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
 		sessionFrom(r).AddFlash("danger", "The authenticator code was invalid. Check the clock and try again.")
 		qrData, qrErr := qr.DataURLPayload(s.totpURL(user, secret), qr.Options{Foreground: "#000000", Background: "#ffffff"})
 		if qrErr != nil {
-			s.log.Error("render pending TOTP QR", "error", qrErr)
+			s.log.ErrorContext(r.Context(), "render pending TOTP QR", "error", qrErr)
 			s.renderError(w, r, http.StatusInternalServerError)
 			return
 		}
 		data := s.newPageData(r)
 		data.Data["totp_secret"] = secret
 		data.Data["totp_qr"] = qrData
-		s.render(w, r, http.StatusOK, "security_settings.html", data)
+		s.renderSecuritySettings(w, r, data)
 		return
 	}
 	codes, err := security.GenerateRecoveryCodes(10)
 	if err != nil {
-		s.log.Error("generate recovery codes", "error", err)
+		s.log.ErrorContext(r.Context(), "generate recovery codes", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -157,15 +207,16 @@ func (s *Server) handleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
 		hashes[i] = security.RecoveryCodeHash(s.cfg.SecretKey, code)
 	}
 	if err := s.db.EnableTOTP(r.Context(), user.ID, hashes); err != nil {
-		s.log.Error("enable TOTP", "user", user.ID, "error", err)
+		s.log.ErrorContext(r.Context(), "enable TOTP", "user", user.ID, "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
+	s.recordSecurityEvent(r, user.ID, store.EventTOTPEnabled)
 	user.TOTPEnabled = true
 	data := s.newPageData(r)
 	data.User = user
 	data.Data["recovery_codes"] = codes
-	s.render(w, r, http.StatusOK, "security_settings.html", data)
+	s.renderSecuritySettings(w, r, data)
 }
 
 func (s *Server) handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
@@ -182,7 +233,7 @@ func (s *Server) handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
 	}
 	valid, err := s.validateSecondFactor(r, user, r.PostFormValue("code"))
 	if err != nil {
-		s.log.Error("validate factor while disabling TOTP", "error", err)
+		s.log.ErrorContext(r.Context(), "validate factor while disabling TOTP", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -192,27 +243,36 @@ func (s *Server) handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err := s.db.DisableTOTP(r.Context(), user.ID); err != nil {
-		s.log.Error("disable TOTP", "error", err)
+		s.log.ErrorContext(r.Context(), "disable TOTP", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
-	sessionFrom(r).AddFlash("success", "Two-factor authentication disabled.")
+	s.recordSecurityEvent(r, user.ID, store.EventTOTPDisabled)
+	s.revokeSessions(r, user.ID, true)
+	sessionFrom(r).AddFlash("success", "Two-factor authentication disabled. Your other sessions have been signed out.")
 	http.Redirect(w, r, "/settings/security", http.StatusSeeOther)
 }
 
+// validateSecondFactor accepts a current authenticator code, when the account
+// has TOTP, or one of its unused recovery codes. A security-key-only account
+// can only use the latter here; its keys are checked by the WebAuthn handlers.
 func (s *Server) validateSecondFactor(r *http.Request, user *store.User, code string) (bool, error) {
-	secret, err := security.OpenAccountSecret(s.cfg.SecretKey, user.TOTPSecret)
-	if err != nil {
-		return false, err
-	}
 	trimmed := strings.TrimSpace(code)
-	if len(trimmed) == 6 && strings.IndexFunc(trimmed, func(r rune) bool { return r < '0' || r > '9' }) == -1 {
+	if user.TOTPEnabled && len(trimmed) == 6 && strings.IndexFunc(trimmed, func(r rune) bool { return r < '0' || r > '9' }) == -1 {
+		secret, err := security.OpenAccountSecret(s.cfg.SecretKey, user.TOTPSecret)
+		if err != nil {
+			return false, err
+		}
 		if valid, err := validateTOTP(secret, trimmed); err != nil || valid {
 			return valid, err
 		}
 	}
 	hash := security.RecoveryCodeHash(s.cfg.SecretKey, code)
-	return s.db.ConsumeRecoveryCode(r.Context(), user.ID, hash)
+	used, err := s.db.ConsumeRecoveryCode(r.Context(), user.ID, hash)
+	if used {
+		s.recordSecurityEvent(r, user.ID, store.EventRecoveryCodeUsed)
+	}
+	return used, err
 }
 
 func validateTOTP(secret, code string) (bool, error) {
@@ -242,3 +302,49 @@ func (s *Server) totpURL(user *store.User, secret string) string {
 	u := &url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + user.Email, RawQuery: query.Encode()}
 	return u.String()
 }
+
+// securityEvent describes the request as an entry in the account's audit trail.
+// The address is anonymised exactly as a click's is.
+func (s *Server) securityEvent(r *http.Request, userID int64, event string) *store.SecurityEvent {
+	ip := s.geo.ClientIP(r)
+	return &store.SecurityEvent{
+		UserID:    userID,
+		Event:     event,
+		IPAddress: geo.AnonymizeIP(ip),
+		Country:   s.geo.Country(r.Context(), ip, r),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// recordSecurityEvent appends to the account's audit trail. A failure is
+// logged rather than surfaced: the action it describes has already happened.
+func (s *Server) recordSecurityEvent(r *http.Request, userID int64, event string) {
+	if err := s.db.RecordSecurityEvent(r.Context(), s.securityEvent(r, userID, event)); err != nil {
+		s.log.WarnContext(r.Context(), "record security event", "user", userID, "event", event, "error", err)
+	}
+}
+
+// recordLogin records a completed sign-in, flagging one from a country the
+// account has not signed in from before and telling the user about it.
+func (s *Server) recordLogin(r *http.Request, e *store.SecurityEvent) {
+	if isKnownCountry(e.Country) {
+		isNew, err := s.db.LoginFromNewCountry(r.Context(), e.UserID, e.Country)
+		if err != nil {
+			s.log.WarnContext(r.Context(), "check login country", "user", e.UserID, "error", err)
+		}
+		e.NewCountry = isNew
+	}
+	if err := s.db.RecordSecurityEvent(r.Context(), e); err != nil {
+		s.log.WarnContext(r.Context(), "record security event", "user", e.UserID, "event", e.Event, "error", err)
+	}
+	if e.NewCountry {
+		sessionFrom(r).AddFlash("warning", "This sign-in came from a country your account has not been used from before ("+
+			e.Country+"). If it was not you, change your password and review the activity in Security settings.")
+	}
+}
+
+// isKnownCountry reports whether a geo lookup produced an actual country,
+// rather than a placeholder for a missing database or a private address.
+func isKnownCountry(country string) bool {
+	return country != "" && country != "Local Network" && !strings.HasPrefix(country, "Unknown")
+}
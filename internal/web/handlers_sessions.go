@@ -0,0 +1,134 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/arumes31/redrx/internal/session"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// dbSessionStore keeps the session registry in the database, the default when
+// no Redis is configured for it.
+type dbSessionStore struct {
+	db *store.DB
+}
+
+func (d dbSessionStore) Create(ctx context.Context, rec *session.Record) error {
+	return d.db.CreateUserSession(ctx, &store.UserSession{
+		ID: rec.ID, UserID: rec.UserID, UserAgent: rec.UserAgent, IPAddress: rec.IPAddress,
+		Country: rec.Country, CreatedAt: rec.CreatedAt, LastSeenAt: rec.LastSeenAt,
+	})
+}
+
+func (d dbSessionStore) Get(ctx context.Context, id string) (*session.Record, error) {
+	s, err := d.db.UserSession(ctx, id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sessionRecord(s), nil
+}
+
+func (d dbSessionStore) Seen(ctx context.Context, id string, at time.Time) error {
+	return d.db.TouchUserSession(ctx, id, at)
+}
+
+func (d dbSessionStore) List(ctx context.Context, userID int64) ([]*session.Record, error) {
+	rows, err := d.db.UserSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*session.Record, 0, len(rows))
+	for _, s := range rows {
+		out = append(out, sessionRecord(s))
+	}
+	return out, nil
+}
+
+func (d dbSessionStore) Delete(ctx context.Context, userID int64, id string) (bool, error) {
+	return d.db.DeleteUserSession(ctx, userID, id)
+}
+
+func (d dbSessionStore) DeleteAll(ctx context.Context, userID int64, except string) error {
+	return d.db.DeleteUserSessions(ctx, userID, except)
+}
+
+func sessionRecord(s *store.UserSession) *session.Record {
+	return &session.Record{
+		ID: s.ID, UserID: s.UserID, UserAgent: s.UserAgent, IPAddress: s.IPAddress,
+		Country: s.Country, CreatedAt: s.CreatedAt, LastSeenAt: s.LastSeenAt,
+	}
+}
+
+// signIn completes a sign-in: the session is signed in under a fresh id,
+// registered so it can be listed and revoked, and recorded in the audit log.
+// An error means the registration failed, and the sign-in with it.
+func (s *Server) signIn(r *http.Request, user *store.User) error {
+	sess := sessionFrom(r)
+	sess.Login(user.ID)
+	e := s.securityEvent(r, user.ID, store.EventLogin)
+	now := time.Now().UTC()
+	if err := s.sessionStore.Create(r.Context(), &session.Record{
+		ID: sess.SessionID, UserID: user.ID, UserAgent: e.UserAgent, IPAddress: e.IPAddress,
+		Country: e.Country, CreatedAt: now, LastSeenAt: now,
+	}); err != nil {
+		sess.Logout()
+		return err
+	}
+	s.recordLogin(r, e)
+	return nil
+}
+
+// revokeSessions signs the user out everywhere but the current session, as a
+// change of credentials must: whoever held the old ones may hold a session.
+func (s *Server) revokeSessions(r *http.Request, userID int64, keepCurrent bool) {
+	except := ""
+	if keepCurrent {
+		except = sessionFrom(r).SessionID
+	}
+	if err := s.sessionStore.DeleteAll(r.Context(), userID, except); err != nil {
+		s.log.ErrorContext(r.Context(), "revoke sessions", "user", userID, "error", err)
+	}
+}
+
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	sess := sessionFrom(r)
+	id := r.PathValue("id")
+	removed, err := s.sessionStore.Delete(r.Context(), user.ID, id)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "revoke session", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if id == sess.SessionID {
+		sess.Logout()
+		sess.AddFlash("info", "You have been signed out.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if removed {
+		s.recordSecurityEvent(r, user.ID, store.EventSessionRevoked)
+		sess.AddFlash("success", "That session has been signed out.")
+	}
+	http.Redirect(w, r, "/settings/security", http.StatusSeeOther)
+}
+
+func (s *Server) handleRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	if err := s.sessionStore.DeleteAll(r.Context(), user.ID, ""); err != nil {
+		s.log.ErrorContext(r.Context(), "revoke all sessions", "user", user.ID, "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	s.recordSecurityEvent(r, user.ID, store.EventSessionsRevoked)
+	sess := sessionFrom(r)
+	sess.Logout()
+	sess.AddFlash("info", "You have been signed out on every device.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -3,10 +3,13 @@ package web
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
 	"net/http"
 	"net/url"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/arumes31/redrx/internal/geo"
@@ -30,7 +33,7 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		s.log.Error("load link for stats", "code", code, "error", err)
+		s.log.ErrorContext(r.Context(), "load link for stats", "code", code, "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -54,71 +57,117 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rangeType := r.URL.Query().Get("range")
-	switch rangeType {
-	case "24h", "7d", "30d":
-	default:
-		rangeType = "30d"
+	// A valid tz parameter is carried over to the range links.
+	tzParam := strings.TrimSpace(r.URL.Query().Get("tz"))
+	loc, err := analyticsLocation(userFrom(r), tzParam)
+	rangeErr := ""
+	if err != nil {
+		rangeErr, tzParam = err.Error(), ""
 	}
+	now := time.Now()
+	sr, err := resolveStatsRange(r.URL.Query(), now, loc)
+	if err != nil {
+		// Chart the default range rather than fail the page over a bad input.
+		rangeErr = err.Error()
+		sr, _ = resolveStatsRange(nil, now, loc)
+	}
+	humanOnly, err := parseTraffic(r.URL.Query())
+	if err != nil {
+		rangeErr, humanOnly = err.Error(), true
+	}
+	keys, labels := timeBuckets(sr)
 
-	now := time.Now().UTC()
-	labels, cutoff, hourly := timeBuckets(rangeType, now)
-
-	series, err := s.db.ClicksByTimeBucket(r.Context(), link.ID, cutoff, hourly)
+	series, err := s.db.ClicksByTimeBucket(r.Context(), link.ID, sr.From, sr.To, sr.Granularity, sr.Location, humanOnly)
 	if err != nil {
-		s.log.Error("time series stats", "error", err)
+		s.log.ErrorContext(r.Context(), "time series stats", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
 
-	counts := make(map[string]int64, len(series))
-	for _, b := range series {
-		counts[b.Label] = b.Count
-	}
-	values := make([]int64, len(labels))
-	var total int64
-	for i, l := range labels {
-		values[i] = counts[l]
-		total += counts[l]
-	}
+	values, unique, total, totalUnique := fillBuckets(keys, series)
 
-	days := 30.0
-	switch rangeType {
-	case "24h":
-		days = 1
-	case "7d":
-		days = 7
+	// Average over the time that has passed: the current bucket is still
+	// filling, and a custom range may end in the future.
+	elapsed := sr.To
+	if now.Before(elapsed) {
+		elapsed = now
 	}
+	days := math.Max(elapsed.Sub(sr.From).Hours()/24, 1)
 	avgDaily := math.Round(float64(total)/days*10) / 10
 
-	countryLabels, countryValues, err := s.groupedStats(r.Context(), link.ID, cutoff, "country")
+	countryLabels, countryValues, err := s.groupedStats(r.Context(), link.ID, sr.From, sr.To, "country", humanOnly)
 	if err != nil {
-		s.log.Error("country stats", "error", err)
+		s.log.ErrorContext(r.Context(), "country stats", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
-	browserLabels, browserValues, err := s.groupedStats(r.Context(), link.ID, cutoff, "browser")
+	browserLabels, browserValues, err := s.groupedStats(r.Context(), link.ID, sr.From, sr.To, "browser", humanOnly)
 	if err != nil {
-		s.log.Error("browser stats", "error", err)
+		s.log.ErrorContext(r.Context(), "browser stats", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
-	platformLabels, platformValues, err := s.groupedStats(r.Context(), link.ID, cutoff, "platform")
+	platformLabels, platformValues, err := s.groupedStats(r.Context(), link.ID, sr.From, sr.To, "platform", humanOnly)
 	if err != nil {
-		s.log.Error("platform stats", "error", err)
+		s.log.ErrorContext(r.Context(), "platform stats", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
-	referrerLabels, referrerValues, err := s.referrerStats(r.Context(), link.ID, cutoff)
+	referrerLabels, referrerValues, err := s.referrerStats(r.Context(), link.ID, sr.From, sr.To, humanOnly)
 	if err != nil {
-		s.log.Error("referrer stats", "error", err)
+		s.log.ErrorContext(r.Context(), "referrer stats", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
 
-	recent, err := s.db.RecentClicks(r.Context(), link.ID, 10)
+	channelLabels, channelValues, err := s.groupedStats(r.Context(), link.ID, sr.From, sr.To, "channel", humanOnly)
 	if err != nil {
-		s.log.Error("recent clicks", "error", err)
+		s.log.ErrorContext(r.Context(), "channel stats", "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// Region, city and network are only there when the operator resolves
+	// them, and campaigns when the link was shared with UTM parameters.
+	places, err := s.knownBreakdowns(r.Context(), link.ID, sr, humanOnly, []breakdownColumn{
+		{"Top Regions", "region"}, {"Top Cities", "city"}, {"Top Networks", "network"},
+	})
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "place stats", "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	campaigns, err := s.knownBreakdowns(r.Context(), link.ID, sr, humanOnly, []breakdownColumn{
+		{"UTM Sources", "utm_source"}, {"UTM Mediums", "utm_medium"}, {"UTM Campaigns", "utm_campaign"},
+	})
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "campaign stats", "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// Device, language and versions, the ten most common of each: which
+	// landing pages to localise and which platforms to support.
+	audience := map[string]struct {
+		labels []string
+		values []int64
+	}{}
+	for _, column := range []string{"device", "language", "os_version", "browser_version"} {
+		labels, values, err := s.groupedStats(r.Context(), link.ID, sr.From, sr.To, column, humanOnly)
+		if err != nil {
+			s.log.ErrorContext(r.Context(), column+" stats", "error", err)
+			s.renderError(w, r, http.StatusInternalServerError)
+			return
+		}
+		audience[column] = struct {
+			labels []string
+			values []int64
+		}{topN(labels), topN(values)}
+	}
+
+	recent, err := s.db.RecentClicks(r.Context(), link.ID, 10, humanOnly)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "recent clicks", "error", err)
 		s.renderError(w, r, http.StatusInternalServerError)
 		return
 	}
@@ -138,10 +187,26 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	data.Data["url"] = link
 	data.Data["short_url"] = s.cfg.ShortURL(link.ShortCode)
 	data.Data["active"] = link.IsActive()
-	data.Data["range_type"] = rangeType
+	data.Data["range_type"] = sr.Preset
+	data.Data["range_from"] = sr.From.Format("2006-01-02")
+	data.Data["range_to"] = sr.To.Add(-time.Nanosecond).Format("2006-01-02")
+	data.Data["granularity"] = string(sr.Granularity)
+	data.Data["granularities"] = statsGranularities
+	data.Data["g_param"] = r.URL.Query().Get("g")
+	data.Data["timezone"] = sr.Location.String()
+	data.Data["tz_param"] = tzParam
+	data.Data["range_error"] = rangeErr
+	data.Data["human_only"] = humanOnly
+	if !humanOnly {
+		data.Data["traffic_param"] = "all"
+	}
+	data.Data["traffic_human_url"] = withQuery(r.URL, "traffic", "")
+	data.Data["traffic_all_url"] = withQuery(r.URL, "traffic", "all")
 	data.Data["avg_daily"] = avgDaily
 	data.Data["time_labels"] = labels
 	data.Data["time_values"] = values
+	data.Data["time_unique"] = unique
+	data.Data["unique_clicks"] = totalUnique
 	data.Data["country_labels"] = countryLabels
 	data.Data["country_values"] = countryValues
 	data.Data["browser_labels"] = browserLabels
@@ -150,45 +215,358 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	data.Data["platform_values"] = platformValues
 	data.Data["referrer_labels"] = referrerLabels
 	data.Data["referrer_values"] = referrerValues
+	data.Data["channel_labels"] = channelLabels
+	data.Data["channel_values"] = channelValues
+	data.Data["places"] = places
+	data.Data["campaigns"] = campaigns
+	for column, b := range audience {
+		data.Data[column+"_labels"] = b.labels
+		data.Data[column+"_values"] = b.values
+	}
 	data.Data["recent_clicks"] = views
 
 	s.render(w, r, http.StatusOK, "stats.html", data)
 }
 
-// timeBuckets returns the ordered bucket labels for a range, the query cutoff,
-// and whether buckets are hourly.
-func timeBuckets(rangeType string, now time.Time) (labels []string, cutoff time.Time, hourly bool) {
-	switch rangeType {
+// statsBreakdown is a ranked table on the stats page: the top entries of a
+// breakdown and their clicks.
+type statsBreakdown struct {
+	Title string
+	Rows  []store.Bucket
+}
+
+func newStatsBreakdown(title string, labels []string, values []int64) statsBreakdown {
+	b := statsBreakdown{Title: title}
+	for i, label := range topN(labels) {
+		b.Rows = append(b.Rows, store.Bucket{Label: label, Count: values[i]})
+	}
+	return b
+}
+
+// breakdownColumn is a statsBreakdown to build: its title and the column it
+// groups on.
+type breakdownColumn struct{ title, column string }
+
+// knownBreakdowns groups a link's clicks by each column, leaving off a
+// breakdown of nothing but Unknown.
+func (s *Server) knownBreakdowns(ctx context.Context, urlID int64, sr statsRange, humanOnly bool, columns []breakdownColumn) ([]statsBreakdown, error) {
+	var out []statsBreakdown
+	for _, b := range columns {
+		labels, values, err := s.groupedStats(ctx, urlID, sr.From, sr.To, b.column, humanOnly)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(labels, func(l string) bool { return l != "Unknown" }) {
+			out = append(out, newStatsBreakdown(b.title, labels, values))
+		}
+	}
+	return out, nil
+}
+
+// statsRange is the window the stats page charts: [From, To), bucketed by
+// Granularity in Location's wall-clock time.
+type statsRange struct {
+	// Preset is 24h, 7d, 30d or custom.
+	Preset      string
+	From, To    time.Time
+	Granularity store.Granularity
+	Location    *time.Location
+}
+
+var statsGranularities = []store.Granularity{store.ByHour, store.ByDay, store.ByWeek, store.ByMonth}
+
+// statsMaxBuckets bounds the points of the time series, so a year by the hour
+// cannot be asked for.
+const statsMaxBuckets = 1000
+
+// resolveStatsRange reads range (24h, 7d or 30d, the default, or custom with
+// from and to dates, to inclusive) and the optional granularity g from the
+// query. The presets end with the current hour or day, and start at the
+// beginning of the first one, so every labelled bucket is whole. The error is
+// the message to show.
+func resolveStatsRange(q url.Values, now time.Time, loc *time.Location) (statsRange, error) {
+	now = now.In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	sr := statsRange{Preset: q.Get("range"), Location: loc}
+	switch sr.Preset {
 	case "24h":
 		// The cutoff is the start of the oldest labelled hour, not simply 24h
-		// ago. Labels are hour-of-day only, so a cutoff mid-hour would let the
-		// leading partial hour fall under the same label as the current hour --
-		// one bucket holding two hours' clicks, double-counted in the total and
-		// so in the daily average too.
-		cutoff = now.Truncate(time.Hour).Add(-23 * time.Hour)
-		for i := 23; i >= 0; i-- {
-			labels = append(labels, now.Add(-time.Duration(i)*time.Hour).Format("15:00"))
-		}
-		return labels, cutoff, true
+		// ago. A cutoff mid-hour would let the leading partial hour into the
+		// first bucket, so the window would hold more than the 24 hours shown.
+		hour := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, loc)
+		sr.From, sr.To, sr.Granularity = hour.Add(-23*time.Hour), hour.Add(time.Hour), store.ByHour
 	case "7d":
-		cutoff = now.AddDate(0, 0, -7)
-		for i := 7; i >= 0; i-- {
-			labels = append(labels, now.AddDate(0, 0, -i).Format("2006-01-02"))
+		sr.From, sr.To, sr.Granularity = today.AddDate(0, 0, -7), today.AddDate(0, 0, 1), store.ByDay
+	case "custom":
+		from, err := time.ParseInLocation("2006-01-02", q.Get("from"), loc)
+		if err != nil {
+			return sr, errors.New("Choose a start date for the range.")
+		}
+		to := today
+		if raw := q.Get("to"); raw != "" {
+			if to, err = time.ParseInLocation("2006-01-02", raw, loc); err != nil {
+				return sr, errors.New("The end date is not a valid date.")
+			}
+		}
+		if to.Before(from) {
+			return sr, errors.New("The range ends before it starts.")
+		}
+		sr.From, sr.To = from, to.AddDate(0, 0, 1)
+		switch span := sr.To.Sub(sr.From); {
+		case span <= 2*24*time.Hour:
+			sr.Granularity = store.ByHour
+		case span <= 92*24*time.Hour:
+			sr.Granularity = store.ByDay
+		case span <= 2*366*24*time.Hour:
+			sr.Granularity = store.ByWeek
+		default:
+			sr.Granularity = store.ByMonth
+		}
+	default:
+		sr.Preset = "30d"
+		sr.From, sr.To, sr.Granularity = today.AddDate(0, 0, -30), today.AddDate(0, 0, 1), store.ByDay
+	}
+
+	if g := store.Granularity(q.Get("g")); g != "" {
+		if !slices.Contains(statsGranularities, g) {
+			return sr, errors.New("Choose hourly, daily, weekly or monthly buckets.")
+		}
+		sr.Granularity = g
+	}
+	if n := sr.To.Sub(sr.From) / bucketWidth(sr.Granularity); n > statsMaxBuckets {
+		return sr, fmt.Errorf("That range has too many %s buckets to chart; choose a shorter range or wider buckets.", sr.Granularity)
+	}
+	return sr, nil
+}
+
+// bucketWidth is a lower bound on the length of a bucket, for counting them.
+func bucketWidth(g store.Granularity) time.Duration {
+	switch g {
+	case store.ByHour:
+		return time.Hour
+	case store.ByWeek:
+		return 7 * 24 * time.Hour
+	case store.ByMonth:
+		return 28 * 24 * time.Hour
+	default:
+		return 23 * time.Hour
+	}
+}
+
+// statsPoint is one bucket of the stats API's series.
+type statsPoint struct {
+	Bucket string `json:"bucket"`
+	Clicks int64  `json:"clicks"`
+	Unique int64  `json:"unique"`
+}
+
+// handleAPIStats returns the total and unique clicks of one of the key
+// owner's links over a range, and its clicks by channel, taking the stats
+// page's range, from, to, g, tz and traffic parameters.
+func (s *Server) handleAPIStats(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.authenticateAPI(r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, "Valid API Key required. Access denied.")
+		return
+	}
+
+	code := shortcode.Normalize(r.PathValue("code"))
+	link, err := s.db.URLByShortCode(r.Context(), code)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		s.log.ErrorContext(r.Context(), "api stats: load link", "code", code, "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not load the link")
+		return
+	}
+	// 404 for someone else's link, as for its details.
+	if err != nil || link.UserID == nil || *link.UserID != user.ID {
+		apiError(w, http.StatusNotFound, "URL not found")
+		return
+	}
+
+	q := r.URL.Query()
+	loc, err := analyticsLocation(user, strings.TrimSpace(q.Get("tz")))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "Unknown timezone.")
+		return
+	}
+	sr, err := resolveStatsRange(q, time.Now(), loc)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	humanOnly, err := parseTraffic(q)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	keys, _ := timeBuckets(sr)
+	series, err := s.db.ClicksByTimeBucket(r.Context(), link.ID, sr.From, sr.To, sr.Granularity, sr.Location, humanOnly)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "api stats", "code", code, "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not load the stats")
+		return
+	}
+	clicks, unique, total, totalUnique := fillBuckets(keys, series)
+	channelLabels, channelValues, err := s.groupedStats(r.Context(), link.ID, sr.From, sr.To, "channel", humanOnly)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "api stats: channels", "code", code, "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not load the stats")
+		return
+	}
+	points := make([]statsPoint, len(keys))
+	for i, k := range keys {
+		points[i] = statsPoint{Bucket: k, Clicks: clicks[i], Unique: unique[i]}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"short_code":    link.ShortCode,
+		"from":          sr.From.Format(time.RFC3339),
+		"to":            sr.To.Format(time.RFC3339),
+		"granularity":   string(sr.Granularity),
+		"timezone":      sr.Location.String(),
+		"traffic":       trafficName(humanOnly),
+		"clicks":        total,
+		"unique_clicks": totalUnique,
+		"series":        points,
+		"channels":      analyticsCounts(channelLabels, channelValues),
+	})
+}
+
+// parseTraffic reads which traffic the stats count: human (the default), or
+// all of it, bots and the owner's own clicks included.
+func parseTraffic(q url.Values) (humanOnly bool, err error) {
+	switch q.Get("traffic") {
+	case "", store.TrafficHuman:
+		return true, nil
+	case "all":
+		return false, nil
+	}
+	return true, errors.New("Show either human or all traffic.")
+}
+
+func trafficName(humanOnly bool) string {
+	if humanOnly {
+		return store.TrafficHuman
+	}
+	return "all"
+}
+
+// withQuery returns the path and query of u with key set to value, or
+// removed when value is empty.
+func withQuery(u *url.URL, key, value string) string {
+	q := u.Query()
+	if value == "" {
+		q.Del(key)
+	} else {
+		q.Set(key, value)
+	}
+	next := url.URL{Path: u.Path, RawQuery: q.Encode()}
+	return next.RequestURI()
+}
+
+// fillBuckets lays the stored buckets over every key of the range, empty ones
+// included, returning the total and unique clicks of each and of the range.
+func fillBuckets(keys []string, series []store.Bucket) (clicks, unique []int64, total, totalUnique int64) {
+	byLabel := make(map[string]store.Bucket, len(series))
+	for _, b := range series {
+		byLabel[b.Label] = b
+	}
+	clicks = make([]int64, len(keys))
+	unique = make([]int64, len(keys))
+	for i, k := range keys {
+		b := byLabel[k]
+		clicks[i], unique[i] = b.Count, b.Unique
+		total += b.Count
+		totalUnique += b.Unique
+	}
+	return clicks, unique, total, totalUnique
+}
+
+// timeBuckets returns the buckets of a range in order: keys matching the
+// labels of store.ClicksByTimeBucket, and the labels to show. A repeated wall
+// hour, when the clocks go back, is one bucket, as it is in the query.
+func timeBuckets(sr statsRange) (keys, labels []string) {
+	keyLayout, labelLayout := "2006-01-02", "2006-01-02"
+	switch sr.Granularity {
+	case store.ByHour:
+		keyLayout, labelLayout = "2006-01-02 15:00", "Jan 2 15:00"
+		if sr.To.Sub(sr.From) <= 24*time.Hour {
+			labelLayout = "15:00"
+		}
+	case store.ByWeek:
+		labelLayout = "Week of Jan 2"
+	case store.ByMonth:
+		keyLayout, labelLayout = "2006-01", "Jan 2006"
+	}
+
+	t := sr.From.In(sr.Location)
+	switch sr.Granularity {
+	case store.ByHour:
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, sr.Location)
+	case store.ByWeek:
+		t = time.Date(t.Year(), t.Month(), t.Day()-(int(t.Weekday())+6)%7, 0, 0, 0, 0, sr.Location)
+	case store.ByMonth:
+		t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, sr.Location)
+	default:
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, sr.Location)
+	}
+	for ; t.Before(sr.To); t = nextBucket(t, sr.Granularity) {
+		key := t.Format(keyLayout)
+		if len(keys) > 0 && keys[len(keys)-1] == key {
+			continue
 		}
-		return labels, cutoff, false
+		keys = append(keys, key)
+		labels = append(labels, t.Format(labelLayout))
+	}
+	return keys, labels
+}
+
+func nextBucket(t time.Time, g store.Granularity) time.Time {
+	switch g {
+	case store.ByHour:
+		return t.Add(time.Hour)
+	case store.ByWeek:
+		return t.AddDate(0, 0, 7)
+	case store.ByMonth:
+		return t.AddDate(0, 1, 0)
 	default:
-		cutoff = now.AddDate(0, 0, -30)
-		for i := 30; i >= 0; i-- {
-			labels = append(labels, now.AddDate(0, 0, -i).Format("2006-01-02"))
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+// analyticsLocation is the zone analytics are shown in: tz, as a request
+// asked, then the user's setting, then UTC. An unknown tz falls back, with a
+// message to show.
+func analyticsLocation(user *store.User, tz string) (*time.Location, error) {
+	fallback := time.UTC
+	if user != nil {
+		if loc, err := loadTimezone(user.Timezone); err == nil {
+			fallback = loc
 		}
-		return labels, cutoff, false
 	}
+	if tz == "" {
+		return fallback, nil
+	}
+	loc, err := loadTimezone(tz)
+	if err != nil {
+		return fallback, fmt.Errorf("%q is not a known timezone, so times are in %s.", tz, fallback)
+	}
+	return loc, nil
+}
+
+// loadTimezone resolves an IANA zone name. "Local" is refused: it would be
+// the server's zone, which means nothing to the person reading the chart.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, errors.New("not a timezone")
+	}
+	return time.LoadLocation(name)
 }
 
 // groupedStats aggregates one categorical column, sorted by descending count so
 // the busiest values lead the chart.
-func (s *Server) groupedStats(ctx context.Context, urlID int64, cutoff time.Time, column string) ([]string, []int64, error) {
-	buckets, err := s.db.ClicksGroupedBy(ctx, urlID, cutoff, column)
+func (s *Server) groupedStats(ctx context.Context, urlID int64, from, to time.Time, column string, humanOnly bool) ([]string, []int64, error) {
+	buckets, err := s.db.ClicksGroupedBy(ctx, urlID, from, to, column, humanOnly)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -197,12 +575,16 @@ func (s *Server) groupedStats(ctx context.Context, urlID int64, cutoff time.Time
 
 // referrerStats groups referrers by hostname, so every path on one site counts
 // together.
-func (s *Server) referrerStats(ctx context.Context, urlID int64, cutoff time.Time) ([]string, []int64, error) {
-	buckets, err := s.db.ClicksGroupedBy(ctx, urlID, cutoff, "referrer")
+func (s *Server) referrerStats(ctx context.Context, urlID int64, from, to time.Time, humanOnly bool) ([]string, []int64, error) {
+	buckets, err := s.db.ClicksGroupedBy(ctx, urlID, from, to, "referrer", humanOnly)
 	if err != nil {
 		return nil, nil, err
 	}
+	return sortBuckets(byReferrerHost(buckets))
+}
 
+// byReferrerHost merges referrer buckets by hostname.
+func byReferrerHost(buckets []store.Bucket) []store.Bucket {
 	merged := map[string]int64{}
 	for _, b := range buckets {
 		merged[hostOf(b.Label)] += b.Count
@@ -212,7 +594,7 @@ func (s *Server) referrerStats(ctx context.Context, urlID int64, cutoff time.Tim
 	for label, count := range merged {
 		out = append(out, store.Bucket{Label: label, Count: count})
 	}
-	return sortBuckets(out)
+	return out
 }
 
 func sortBuckets(buckets []store.Bucket) ([]string, []int64, error) {
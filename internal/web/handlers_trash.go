@@ -0,0 +1,114 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// trashedLink is a row of the Trash page.
+type trashedLink struct {
+	*store.URL
+	// PurgeAt is when the retention purge will remove the link for good.
+	PurgeAt time.Time
+}
+
+func (s *Server) handleTrash(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+
+	urls, err := s.db.TrashedUserURLs(r.Context(), user.ID)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "list trashed links", "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	links := make([]trashedLink, len(urls))
+	for i, u := range urls {
+		links[i] = trashedLink{URL: u, PurgeAt: u.DeletedAt.AddDate(0, 0, s.cfg.TrashRetentionDays)}
+	}
+
+	data := s.newPageData(r)
+	data.Data["links"] = links
+	s.render(w, r, http.StatusOK, "trash.html", data)
+}
+
+// errStillBlocked keeps a link in the trash while its destinations are blocked.
+var errStillBlocked = errors.New("destination is blocked")
+
+// handleTrashRestore takes the selected links out of the trash. A link whose
+// destination is on the blocklist stays where it is: the phishing sweep puts
+// links there, and restoring one must not bypass the check it failed.
+func (s *Server) handleTrashRestore(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	sess := sessionFrom(r)
+
+	ids, ok := s.trashSelection(w, r)
+	if !ok {
+		return
+	}
+
+	blocked := 0
+	restored, err := s.db.RestoreUserURLs(r.Context(), user.ID, ids, actorFrom(r), func(u *store.URL) error {
+		for _, target := range u.Destinations() {
+			if !s.safety.IsSafeURL(target) {
+				blocked++
+				return errStillBlocked
+			}
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+		s.log.ErrorContext(r.Context(), "restore links", "error", err)
+		sess.AddFlash("danger", "Could not restore the selected links.")
+	case blocked > 0:
+		sess.AddFlash("warning", "Restored "+strconv.FormatInt(restored, 10)+" links. "+
+			strconv.Itoa(blocked)+" point at a blocked destination and stay in the trash.")
+	default:
+		sess.AddFlash("success", "Restored "+strconv.FormatInt(restored, 10)+" links.")
+	}
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// handleTrashPurge deletes the selected links from the trash for good, without
+// waiting for the retention period.
+func (s *Server) handleTrashPurge(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	sess := sessionFrom(r)
+
+	ids, ok := s.trashSelection(w, r)
+	if !ok {
+		return
+	}
+
+	purged, err := s.db.PurgeUserURLs(r.Context(), user.ID, ids)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "purge links", "error", err)
+		sess.AddFlash("danger", "Could not delete the selected links.")
+	} else {
+		sess.AddFlash("info", "Permanently deleted "+strconv.FormatInt(purged, 10)+" links.")
+	}
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// trashSelection reads the links selected on the Trash page, redirecting back
+// with a flash when there are none.
+func (s *Server) trashSelection(w http.ResponseWriter, r *http.Request) ([]int64, bool) {
+	sess := sessionFrom(r)
+	if err := r.ParseForm(); err != nil {
+		sess.AddFlash("warning", "Could not read the submitted form.")
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+		return nil, false
+	}
+	ids := selectedLinkIDs(r)
+	if len(ids) == 0 {
+		sess.AddFlash("warning", "No links selected.")
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+		return nil, false
+	}
+	return ids, true
+}
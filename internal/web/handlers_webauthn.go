@@ -0,0 +1,457 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"github.com/arumes31/redrx/internal/security"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// Ceremony kinds, kept in the session between the begin and finish requests.
+const (
+	ceremonyRegister     = "webauthn-register"
+	ceremonySecondFactor = "webauthn-2fa"
+	ceremonyPasskey      = "webauthn-passkey"
+	ceremonyReauth       = "webauthn-reauth"
+)
+
+// webauthnTimeout bounds every ceremony, both in the browser and here.
+const webauthnTimeout = 5 * time.Minute
+
+var (
+	errKeyNotPasswordless = errors.New("this key is not enabled for passwordless sign-in")
+	errAccountDisabled    = errors.New("the account is disabled")
+)
+
+func newWebAuthn(rpID string, origins []string) (*webauthn.WebAuthn, error) {
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: webauthnTimeout, TimeoutUVD: webauthnTimeout}
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "Redrx",
+		RPOrigins:     origins,
+		Timeouts:      webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+}
+
+// webauthnUser adapts an account and its stored credentials to the library.
+type webauthnUser struct {
+	user    *store.User
+	records []*store.WebAuthnCredential
+	creds   []webauthn.Credential
+}
+
+// webauthnUserID is the user handle an authenticator stores with a passkey.
+// The account id is stable and carries nothing personal, which is all the
+// handle needs; it is not a secret.
+func webauthnUserID(id int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id)) // #nosec G115 -- ids are positive
+}
+
+func (u *webauthnUser) WebAuthnID() []byte                         { return webauthnUserID(u.user.ID) }
+func (u *webauthnUser) WebAuthnName() string                       { return u.user.Username }
+func (u *webauthnUser) WebAuthnDisplayName() string                { return u.user.Username }
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential { return u.creds }
+
+// record finds the stored row of a credential the library verified.
+func (u *webauthnUser) record(credentialID []byte) *store.WebAuthnCredential {
+	id := base64.RawURLEncoding.EncodeToString(credentialID)
+	for _, r := range u.records {
+		if r.CredentialID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *Server) loadWebAuthnUser(ctx context.Context, user *store.User) (*webauthnUser, error) {
+	records, err := s.db.WebAuthnCredentials(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	u := &webauthnUser{user: user, records: records}
+	for _, r := range records {
+		var c webauthn.Credential
+		if err := json.Unmarshal([]byte(r.Data), &c); err != nil {
+			return nil, err
+		}
+		u.creds = append(u.creds, c)
+	}
+	return u, nil
+}
+
+// beginCeremony keeps the ceremony state in the session and sends the options
+// to the browser.
+func (s *Server) beginCeremony(w http.ResponseWriter, r *http.Request, kind string, options any, state *webauthn.SessionData) {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "encode webauthn ceremony", "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not start the security key request.")
+		return
+	}
+	sessionFrom(r).BeginCeremony(kind, raw)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, options)
+}
+
+func takeCeremony(r *http.Request, kind string) (webauthn.SessionData, bool) {
+	var state webauthn.SessionData
+	raw, ok := sessionFrom(r).TakeCeremony(kind)
+	if !ok || json.Unmarshal(raw, &state) != nil {
+		return state, false
+	}
+	return state, true
+}
+
+// completeAssertion stores the counter and flags from a verified assertion. A
+// counter that failed to advance means two authenticators hold the same key —
+// a cloned key — and the sign-in is refused.
+func (s *Server) completeAssertion(ctx context.Context, u *webauthnUser, cred *webauthn.Credential) error {
+	rec := u.record(cred.ID)
+	if rec == nil {
+		return errors.New("verified credential has no stored record")
+	}
+	if cred.Authenticator.CloneWarning {
+		s.log.WarnContext(ctx, "webauthn signature counter went backwards", "user", u.user.ID, "credential", rec.ID,
+			"stored", rec.SignCount, "presented", cred.Authenticator.SignCount)
+		return errors.New("signature counter did not advance")
+	}
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	return s.db.RecordWebAuthnUse(ctx, rec.ID, string(data), cred.Authenticator.SignCount)
+}
+
+func (s *Server) handleWebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	u, err := s.loadWebAuthnUser(r.Context(), userFrom(r))
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "load webauthn credentials", "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not load your security keys.")
+		return
+	}
+	// A resident key is preferred so the same registration can later serve
+	// as a passkey; a plain security key without one still works as a second
+	// factor.
+	creation, state, err := s.webauthn.BeginRegistration(u,
+		webauthn.WithExclusions(webauthn.Credentials(u.creds).CredentialDescriptors()),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+			UserVerification: protocol.VerificationPreferred,
+		}),
+	)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "begin webauthn registration", "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not start the security key request.")
+		return
+	}
+	s.beginCeremony(w, r, ceremonyRegister, creation, state)
+}
+
+func (s *Server) handleWebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	user := userFrom(r)
+	state, ok := takeCeremony(r, ceremonyRegister)
+	if !ok {
+		apiError(w, http.StatusBadRequest, "The security key request expired. Please try again.")
+		return
+	}
+	u, err := s.loadWebAuthnUser(r.Context(), user)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "load webauthn credentials", "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not load your security keys.")
+		return
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(r.Body)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "The security key response could not be read.")
+		return
+	}
+	cred, err := s.webauthn.CreateCredential(u, state, parsed)
+	if err != nil {
+		s.log.InfoContext(r.Context(), "webauthn registration rejected", "user", user.ID, "error", err)
+		apiError(w, http.StatusBadRequest, "The security key could not be verified.")
+		return
+	}
+	data, err := json.Marshal(cred)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "encode webauthn credential", "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not save the security key.")
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Security key " + strconv.Itoa(len(u.records)+1)
+	}
+	rec := &store.WebAuthnCredential{
+		UserID:       user.ID,
+		CredentialID: base64.RawURLEncoding.EncodeToString(cred.ID),
+		Name:         truncate(name, 64),
+		Data:         string(data),
+		SignCount:    cred.Authenticator.SignCount,
+		Passwordless: checkboxChecked(r, "passwordless"),
+	}
+
+	// The first second factor on an account comes with recovery codes, as
+	// enabling TOTP does.
+	var codes, hashes []string
+	if !user.TOTPEnabled && len(u.records) == 0 {
+		if codes, err = security.GenerateRecoveryCodes(10); err != nil {
+			s.log.ErrorContext(r.Context(), "generate recovery codes", "error", err)
+			apiError(w, http.StatusInternalServerError, "Could not save the security key.")
+			return
+		}
+		for _, code := range codes {
+			hashes = append(hashes, security.RecoveryCodeHash(s.cfg.SecretKey, code))
+		}
+	}
+	if err := s.db.AddWebAuthnCredential(r.Context(), rec, hashes); err != nil {
+		s.log.ErrorContext(r.Context(), "store webauthn credential", "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not save the security key. It may already be registered.")
+		return
+	}
+	s.recordSecurityEvent(r, user.ID, store.EventWebAuthnAdded)
+	writeJSON(w, http.StatusOK, map[string]any{"name": rec.Name, "recovery_codes": codes})
+}
+
+func (s *Server) handleWebAuthnDelete(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		s.renderError(w, r, http.StatusNotFound)
+		return
+	}
+	if !security.CheckPasswordHash(user.PasswordHash, r.PostFormValue("password")) {
+		sessionFrom(r).AddFlash("danger", "The password was incorrect.")
+		http.Redirect(w, r, "/settings/security", http.StatusSeeOther)
+		return
+	}
+	removed, err := s.db.DeleteWebAuthnCredential(r.Context(), user.ID, id)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "delete webauthn credential", "error", err)
+		s.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if removed {
+		s.recordSecurityEvent(r, user.ID, store.EventWebAuthnRemoved)
+		sessionFrom(r).AddFlash("success", "Security key removed.")
+	}
+	http.Redirect(w, r, "/settings/security", http.StatusSeeOther)
+}
+
+// pendingWebAuthnUser loads the account waiting on its second factor.
+func (s *Server) pendingWebAuthnUser(r *http.Request) (*webauthnUser, string, bool) {
+	userID, next, ok := sessionFrom(r).PendingTwoFactor()
+	if !ok {
+		return nil, "", false
+	}
+	user, err := s.db.UserByID(r.Context(), userID)
+	if err != nil {
+		return nil, "", false
+	}
+	u, err := s.loadWebAuthnUser(r.Context(), user)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "load webauthn credentials", "error", err)
+		return nil, "", false
+	}
+	return u, next, true
+}
+
+func (s *Server) handleWebAuthnLoginBegin(w http.ResponseWriter, r *http.Request) {
+	u, _, ok := s.pendingWebAuthnUser(r)
+	if !ok || len(u.creds) == 0 {
+		apiError(w, http.StatusBadRequest, "Start over from the login page.")
+		return
+	}
+	assertion, state, err := s.webauthn.BeginLogin(u)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "begin webauthn login", "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not start the security key request.")
+		return
+	}
+	s.beginCeremony(w, r, ceremonySecondFactor, assertion, state)
+}
+
+func (s *Server) handleWebAuthnLoginFinish(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	state, ok := takeCeremony(r, ceremonySecondFactor)
+	u, next, pending := s.pendingWebAuthnUser(r)
+	if !ok || !pending {
+		apiError(w, http.StatusBadRequest, "The security key request expired. Start over from the login page.")
+		return
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(r.Body)
+	if err == nil {
+		var cred *webauthn.Credential
+		if cred, err = s.webauthn.ValidateLogin(u, state, parsed); err == nil {
+			err = s.completeAssertion(r.Context(), u, cred)
+		}
+	}
+	if err != nil {
+		s.log.InfoContext(r.Context(), "webauthn second factor rejected", "user", u.user.ID, "error", err)
+		s.recordSecurityEvent(r, u.user.ID, store.EventSecondFactorFail)
+		apiError(w, http.StatusBadRequest, "The security key could not be verified.")
+		return
+	}
+
+	if err := s.signIn(r, u.user); err != nil {
+		s.log.ErrorContext(r.Context(), "register session", "user", u.user.ID, "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not sign you in.")
+		return
+	}
+	if !isSafeRedirect(next) {
+		next = "/"
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": next})
+}
+
+func (s *Server) handlePasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	// User verification is required: the passkey stands in for the password
+	// as well as the second factor, so presence alone is not enough.
+	assertion, state, err := s.webauthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "begin passkey login", "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not start the passkey request.")
+		return
+	}
+	s.beginCeremony(w, r, ceremonyPasskey, assertion, state)
+}
+
+func (s *Server) handlePasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	state, ok := takeCeremony(r, ceremonyPasskey)
+	if !ok {
+		apiError(w, http.StatusBadRequest, "The passkey request expired. Please try again.")
+		return
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(r.Body)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "The passkey response could not be read.")
+		return
+	}
+
+	var u *webauthnUser
+	lookup := func(rawID, userHandle []byte) (webauthn.User, error) {
+		rec, err := s.db.WebAuthnCredentialByCredentialID(r.Context(), base64.RawURLEncoding.EncodeToString(rawID))
+		if err != nil {
+			return nil, err
+		}
+		if !rec.Passwordless {
+			return nil, errKeyNotPasswordless
+		}
+		if !bytes.Equal(userHandle, webauthnUserID(rec.UserID)) {
+			return nil, errors.New("user handle does not match the credential")
+		}
+		user, err := s.db.UserByID(r.Context(), rec.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if user.DisabledAt != nil {
+			return nil, errAccountDisabled
+		}
+		if u, err = s.loadWebAuthnUser(r.Context(), user); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+	cred, err := s.webauthn.ValidateDiscoverableLogin(lookup, state, parsed)
+	if err == nil {
+		err = s.completeAssertion(r.Context(), u, cred)
+	}
+	if err != nil {
+		s.log.InfoContext(r.Context(), "passkey login rejected", "error", err)
+		if u != nil {
+			s.recordSecurityEvent(r, u.user.ID, store.EventLoginFailed)
+		}
+		msg := "The passkey could not be verified."
+		if errors.Is(err, errKeyNotPasswordless) {
+			msg = "This security key is not enabled for passwordless sign-in. Sign in with your password instead."
+		} else if errors.Is(err, errAccountDisabled) {
+			msg = "This account has been disabled."
+		}
+		apiError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err := s.signIn(r, u.user); err != nil {
+		s.log.ErrorContext(r.Context(), "register session", "user", u.user.ID, "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not sign you in.")
+		return
+	}
+	next := r.URL.Query().Get("next")
+	if !isSafeRedirect(next) {
+		next = "/"
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": next})
+}
+
+// handleReauthWebAuthnBegin starts the assertion an account change can be
+// confirmed with instead of a code. The page puts the signed assertion in the
+// form, and reauthenticate finishes the ceremony.
+func (s *Server) handleReauthWebAuthnBegin(w http.ResponseWriter, r *http.Request) {
+	u, err := s.loadWebAuthnUser(r.Context(), userFrom(r))
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "load webauthn credentials", "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not load your security keys.")
+		return
+	}
+	if len(u.creds) == 0 {
+		apiError(w, http.StatusBadRequest, "You have no security key to use.")
+		return
+	}
+	assertion, state, err := s.webauthn.BeginLogin(u)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "begin webauthn reauthentication", "error", err)
+		apiError(w, http.StatusInternalServerError, "Could not start the security key request.")
+		return
+	}
+	s.beginCeremony(w, r, ceremonyReauth, assertion, state)
+}
+
+// validateReauthAssertion checks a security key assertion posted with an
+// account change against the ceremony the page began. A key that cannot be
+// verified is a wrong answer, not an error.
+func (s *Server) validateReauthAssertion(r *http.Request, user *store.User, assertion string) (bool, error) {
+	state, ok := takeCeremony(r, ceremonyReauth)
+	if !ok {
+		return false, nil
+	}
+	u, err := s.loadWebAuthnUser(r.Context(), user)
+	if err != nil {
+		return false, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBytes([]byte(assertion))
+	if err == nil {
+		var cred *webauthn.Credential
+		if cred, err = s.webauthn.ValidateLogin(u, state, parsed); err == nil {
+			err = s.completeAssertion(r.Context(), u, cred)
+		}
+	}
+	if err != nil {
+		s.log.InfoContext(r.Context(), "webauthn reauthentication rejected", "user", user.ID, "error", err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// hasSecondFactor reports whether signing in to the account takes a second
+// step after the password.
+func (s *Server) hasSecondFactor(ctx context.Context, user *store.User) (bool, error) {
+	if user.TOTPEnabled {
+		return true, nil
+	}
+	return s.db.HasWebAuthnCredentials(ctx, user.ID)
+}
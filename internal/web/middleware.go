@@ -9,12 +9,22 @@ import (
 	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/arumes31/redrx/internal/config"
 	"github.com/arumes31/redrx/internal/geo"
 	"github.com/arumes31/redrx/internal/ratelimit"
 	"github.com/arumes31/redrx/internal/session"
 	"github.com/arumes31/redrx/internal/store"
+	"github.com/arumes31/redrx/internal/telemetry"
 )
 
+var tracer = telemetry.Tracer("web")
+
 type ctxKey int
 
 const (
@@ -29,19 +39,23 @@ type handlerFunc func(http.ResponseWriter, *http.Request)
 // wrap attaches session loading and CSRF verification to a handler.
 func (s *Server) wrap(h handlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		sess := s.sessions.Load(r)
+		sess, err := s.sessions.Load(r)
+		if err != nil {
+			s.log.ErrorContext(r.Context(), "check session registration", "error", err)
+		}
 
 		var user *store.User
 		if sess.UserID != 0 {
 			u, err := s.db.UserByID(r.Context(), sess.UserID)
 			switch {
-			case err == nil:
+			case err == nil && u.DisabledAt == nil:
 				user = u
-			case errors.Is(err, store.ErrNotFound):
-				// The account was deleted out from under the cookie.
+			case err == nil, errors.Is(err, store.ErrNotFound):
+				// The account was disabled or deleted out from under the
+				// cookie.
 				sess.Logout()
 			default:
-				s.log.Error("load session user", "error", err)
+				s.log.ErrorContext(r.Context(), "load session user", "error", err)
 			}
 		}
 
@@ -102,6 +116,24 @@ func (s *Server) requireLogin(h handlerFunc) handlerFunc {
 	}
 }
 
+// requireAdmin is requireLogin for the users named in ADMIN_USERS or made
+// admins from the command line. Anyone else gets the not-found page, so the
+// admin pages do not advertise themselves.
+func (s *Server) requireAdmin(h handlerFunc) handlerFunc {
+	return s.requireLogin(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(s.cfg, userFrom(r)) {
+			s.renderError(w, r, http.StatusNotFound)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// isAdmin reports whether u may open the admin pages.
+func isAdmin(cfg *config.Config, u *store.User) bool {
+	return u != nil && (u.IsAdmin || cfg.IsAdmin(u.Username))
+}
+
 func sessionFrom(r *http.Request) *session.Session {
 	if v, ok := r.Context().Value(ctxSession).(*session.Session); ok {
 		return v
@@ -116,6 +148,12 @@ func userFrom(r *http.Request) *store.User {
 	return nil
 }
 
+// actorFrom attributes a change made through the web UI to the signed-in
+// user, or to an anonymous visitor.
+func actorFrom(r *http.Request) store.Actor {
+	return store.UserActor(userFrom(r), store.SourceWeb)
+}
+
 func isStateChanging(method string) bool {
 	switch method {
 	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
@@ -305,7 +343,11 @@ func (s *Server) instrument(next http.Handler) http.Handler {
 		// be visible here. Passing a pointer through the context means both
 		// requests share the same cell and the label survives the copy.
 		label := &routeName{}
-		r = r.WithContext(context.WithValue(r.Context(), ctxRoute, label))
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(context.WithValue(ctx, ctxRoute, label), r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.request.method", r.Method)))
+		r = r.WithContext(ctx)
 
 		// Deferred, so a panicking request is still counted. recoverPanics sits
 		// outside this middleware, so without the defer the one class of failure
@@ -314,6 +356,25 @@ func (s *Server) instrument(next http.Handler) http.Handler {
 			route := routeLabel(r, label)
 			s.metrics.requests.WithLabelValues(r.Method, route, statusClass(rec.status)).Inc()
 			s.metrics.duration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+
+			// The span is named after the route, not the path, which holds
+			// short codes and ids. Most routes already lead with the method.
+			name := route
+			if !strings.Contains(route, " ") {
+				name = r.Method + " " + route
+			}
+			span.SetName(name)
+			span.SetAttributes(attribute.String("http.route", route),
+				attribute.Int("http.response.status_code", rec.status))
+			if p := recover(); p != nil {
+				span.SetStatus(codes.Error, "panic")
+				span.End()
+				panic(p)
+			}
+			if rec.status >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(rec.status))
+			}
+			span.End()
 		}()
 
 		next.ServeHTTP(rec, r)
@@ -325,7 +386,7 @@ func (s *Server) recoverPanics(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if rec := recover(); rec != nil {
-				s.log.Error("panic serving request", "path", r.URL.Path, "panic", rec)
+				s.log.ErrorContext(r.Context(), "panic serving request", "path", r.URL.Path, "panic", rec)
 				s.renderError(w, r, http.StatusInternalServerError)
 			}
 		}()
@@ -16,7 +16,7 @@ func (s *Server) addAnonymousProof(r *http.Request, data *PageData) {
 	}
 	challenge, err := proof.Issue(s.cfg.SecretKey, 10*time.Minute)
 	if err != nil {
-		s.log.Error("create proof-of-work challenge", "error", err)
+		s.log.ErrorContext(r.Context(), "create proof-of-work challenge", "error", err)
 		return
 	}
 	sessionFrom(r).SetPoWChallenge(challenge)
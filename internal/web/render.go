@@ -10,6 +10,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/mileusna/useragent"
+
 	"github.com/arumes31/redrx/internal/config"
 	"github.com/arumes31/redrx/internal/session"
 	"github.com/arumes31/redrx/internal/store"
@@ -24,8 +26,9 @@ var staticFS embed.FS
 // pages lists every template rendered on top of base.html.
 var pages = []string{
 	"index.html", "login.html", "login_user.html", "register.html",
-	"dashboard.html", "edit_url.html", "stats.html", "preview.html",
-	"login_totp.html", "security_settings.html",
+	"dashboard.html", "trash.html", "edit_url.html", "stats.html", "analytics.html", "preview.html",
+	"login_totp.html", "security_settings.html", "account_settings.html", "import.html", "admin_import.html",
+	"forgot_password.html", "reset_password.html",
 	"api_docs.html", "data_usage.html", "terms.html",
 	"403.html", "404.html", "410.html", "429.html", "500.html",
 }
@@ -114,6 +117,9 @@ type PageData struct {
 // IsAuthenticated reports whether a user is logged in, for template use.
 func (p *PageData) IsAuthenticated() bool { return p.User != nil }
 
+// IsAdmin reports whether the user may open the admin pages.
+func (p *PageData) IsAdmin() bool { return isAdmin(p.Config, p.User) }
+
 // Get reads a page-specific value, returning nil when absent so templates can
 // test for optional values without erroring.
 func (p *PageData) Get(key string) any {
@@ -144,8 +150,17 @@ func templateFuncs() template.FuncMap {
 			}
 			return t.Unix()
 		},
-		"dict": dict,
-		"seq":  seq,
+		"dict":       dict,
+		"seq":        seq,
+		"fieldLabel": fieldLabel,
+		"eventLabel": eventLabel,
+		"deviceLabel": func(raw string) string {
+			if raw == "" {
+				return "Unknown"
+			}
+			ua := useragent.Parse(raw)
+			return browserName(ua) + " on " + firstNonEmpty(ua.OS, "Unknown")
+		},
 		// deref unwraps an optional timestamp for formatting; the caller has
 		// already checked it is non-nil.
 		"deref": func(t *time.Time) time.Time {
@@ -157,6 +172,62 @@ func templateFuncs() template.FuncMap {
 	}
 }
 
+// revisionFieldLabels names the link fields a revision can record.
+var revisionFieldLabels = map[string]string{
+	"long_url":               "Destination",
+	"rotate_targets":         "Rotation targets",
+	"ios_target_url":         "iOS target",
+	"android_target_url":     "Android target",
+	"preview_mode":           "Preview mode",
+	"stats_enabled":          "Statistics",
+	"is_enabled":             "Enabled",
+	"is_draft":               "Draft",
+	"expires_at":             "Expires",
+	"start_at":               "Starts",
+	"end_at":                 "Ends",
+	"auto_pause_after":       "Auto-pause after",
+	"skip_unhealthy_targets": "Skip unhealthy targets",
+}
+
+// fieldLabel renders a revision field name for display, falling back to the
+// column name for a field this build does not know.
+func fieldLabel(field string) string {
+	if l, ok := revisionFieldLabels[field]; ok {
+		return l
+	}
+	return field
+}
+
+// securityEventLabels names the events on the security settings page.
+var securityEventLabels = map[string]string{
+	store.EventLogin:             "Signed in",
+	store.EventLoginFailed:       "Failed sign-in (wrong password)",
+	store.EventSecondFactorFail:  "Failed sign-in (wrong code)",
+	store.EventLogout:            "Signed out",
+	store.EventTOTPEnabled:       "Two-factor authentication enabled",
+	store.EventTOTPDisabled:      "Two-factor authentication disabled",
+	store.EventRecoveryCodeUsed:  "Recovery code used",
+	store.EventAPIKeyRegenerated: "API key regenerated",
+	store.EventPasswordReset:     "Password reset by email link",
+	store.EventEmailVerified:     "Email address verified",
+	store.EventWebAuthnAdded:     "Security key added",
+	store.EventWebAuthnRemoved:   "Security key removed",
+	store.EventSessionRevoked:    "Session signed out",
+	store.EventSessionsRevoked:   "Signed out everywhere",
+	store.EventPasswordChanged:   "Password changed",
+	store.EventUsernameChanged:   "Username changed",
+	store.EventEmailChanged:      "Email address changed",
+}
+
+// eventLabel renders a security event type for display, falling back to the
+// stored name for an event this build does not know.
+func eventLabel(event string) string {
+	if l, ok := securityEventLabels[event]; ok {
+		return l
+	}
+	return event
+}
+
 // timeUntil renders a future timestamp as a coarse "in 3d" style label.
 func timeUntil(t *time.Time) string {
 	if t == nil || t.IsZero() {
@@ -30,7 +30,7 @@ func (s *Server) newPageData(r *http.Request) *PageData {
 // render writes a page, falling back to a plain 500 if the template fails.
 func (s *Server) render(w http.ResponseWriter, r *http.Request, status int, name string, data *PageData) {
 	if err := s.renderer.Render(w, status, name, data); err != nil {
-		s.log.Error("render template", "template", name, "path", r.URL.Path, "error", err)
+		s.log.ErrorContext(r.Context(), "render template", "template", name, "path", r.URL.Path, "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 }
@@ -57,7 +57,7 @@ func (s *Server) renderError(w http.ResponseWriter, r *http.Request, status int)
 
 	data := s.newPageData(r)
 	if err := s.renderer.Render(w, status, template, data); err != nil {
-		s.log.Error("render error page", "template", template, "error", err)
+		s.log.ErrorContext(r.Context(), "render error page", "template", template, "error", err)
 		http.Error(w, http.StatusText(status), status)
 	}
 }
@@ -84,7 +84,7 @@ func (s *Server) renderRateLimited(w http.ResponseWriter, r *http.Request, retry
 		},
 	}
 	if err := s.renderer.Render(w, http.StatusTooManyRequests, "429.html", data); err != nil {
-		s.log.Error("render 429 page", "error", err)
+		s.log.ErrorContext(r.Context(), "render 429 page", "error", err)
 		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 	}
 }
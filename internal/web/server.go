@@ -6,13 +6,19 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/arumes31/redrx/internal/botdetect"
+	"github.com/arumes31/redrx/internal/channel"
 	"github.com/arumes31/redrx/internal/config"
 	"github.com/arumes31/redrx/internal/geo"
+	"github.com/arumes31/redrx/internal/linkcache"
+	"github.com/arumes31/redrx/internal/mail"
 	"github.com/arumes31/redrx/internal/ratelimit"
 	"github.com/arumes31/redrx/internal/safety"
 	"github.com/arumes31/redrx/internal/session"
@@ -26,12 +32,27 @@ type Server struct {
 	log      *slog.Logger
 	renderer *renderer
 	sessions *session.Manager
-	limiter  *ratelimit.Limiter
-	safety   *safety.Checker
-	geo      *geo.Resolver
-	metrics  *metrics
-	limits   limits
-	registry *prometheus.Registry
+	// sessionStore is the registry the session manager checks signed-in
+	// cookies against.
+	sessionStore session.Store
+	limiter      *ratelimit.Limiter
+	safety       *safety.Checker
+	geo          *geo.Resolver
+	metrics      *metrics
+	limits       limits
+	registry     *prometheus.Registry
+	// mailer is nil when no SMTP server is configured, which turns off email
+	// verification and password resets.
+	mailer   mail.Sender
+	mailWG   sync.WaitGroup
+	webauthn *webauthn.WebAuthn
+	salts    visitorSalts
+	bots     *botdetect.Detector
+	channels *channel.Classifier
+	links    *linkcache.Cache
+	// clicks writes redirects in batches; nil when CLICK_QUEUE_SIZE is 0
+	// and each redirect writes its own.
+	clicks *clickQueue
 
 	handler http.Handler
 }
@@ -61,6 +82,12 @@ type Options struct {
 	Safety   *safety.Checker
 	Geo      *geo.Resolver
 	Registry *prometheus.Registry
+	Mailer   mail.Sender
+	// Sessions registers signed-in sessions; nil keeps them in the database.
+	Sessions session.Store
+	// Links caches the redirect lookups; nil looks every one up in the
+	// database.
+	Links *linkcache.Cache
 }
 
 func NewServer(opts Options) (*Server, error) {
@@ -73,6 +100,10 @@ func NewServer(opts Options) (*Server, error) {
 	if registry == nil {
 		registry = prometheus.NewRegistry()
 	}
+	sessionStore := opts.Sessions
+	if sessionStore == nil {
+		sessionStore = dbSessionStore{db: opts.DB}
+	}
 
 	s := &Server{
 		cfg:      opts.Config,
@@ -81,12 +112,27 @@ func NewServer(opts Options) (*Server, error) {
 		renderer: r,
 		// Cookies are marked Secure unless running in debug, where the dev
 		// server is plain HTTP and a Secure cookie would never be sent back.
-		sessions: session.NewManager(opts.Config.SecretKey, !opts.Config.Debug),
-		limiter:  opts.Limiter,
-		safety:   opts.Safety,
-		geo:      opts.Geo,
-		metrics:  newMetrics(registry),
-		registry: registry,
+		sessions:     session.NewManager(opts.Config.SecretKey, !opts.Config.Debug, sessionStore),
+		sessionStore: sessionStore,
+		limiter:      opts.Limiter,
+		safety:       opts.Safety,
+		geo:          opts.Geo,
+		metrics:      newMetrics(registry),
+		registry:     registry,
+		mailer:       opts.Mailer,
+		bots:         botdetect.New(opts.Config.BotSignatures),
+		channels:     channel.New(opts.Config.CanonicalHost()),
+		links:        opts.Links,
+	}
+
+	if s.webauthn, err = newWebAuthn(s.cfg.WebAuthnRPID(), s.cfg.WebAuthnOrigins); err != nil {
+		return nil, fmt.Errorf("configure webauthn: %w", err)
+	}
+
+	if size := s.cfg.ClickQueueSize; size > 0 {
+		s.clicks = newClickQueue(s.db, s.log, registry, size, max(s.cfg.ClickBatchSize, 1),
+			time.Duration(max(s.cfg.ClickFlushInterval, 1))*time.Second,
+			time.Duration(s.cfg.UniqueVisitorWindow)*time.Minute)
 	}
 
 	s.limits = limits{
@@ -140,28 +186,65 @@ func (s *Server) routes() (http.Handler, error) {
 	mux.Handle("POST /login", s.limit("login", s.limits.Login, s.handleLogin))
 	mux.Handle("GET /login/totp", s.limit("totp_page", s.limits.Pages, s.handleTOTPLoginForm))
 	mux.Handle("POST /login/totp", s.limit("totp_login", s.limits.Auth, s.handleTOTPLogin))
+	mux.Handle("POST /login/webauthn/begin", s.limit("webauthn_login", s.limits.Auth, s.handleWebAuthnLoginBegin))
+	mux.Handle("POST /login/webauthn/finish", s.limit("webauthn_login", s.limits.Auth, s.handleWebAuthnLoginFinish))
+	mux.Handle("POST /login/passkey/begin", s.limit("passkey_login", s.limits.Login, s.handlePasskeyLoginBegin))
+	mux.Handle("POST /login/passkey/finish", s.limit("passkey_login", s.limits.Login, s.handlePasskeyLoginFinish))
 	mux.Handle("GET /register", s.limit("register_page", s.limits.Pages, s.handleRegisterForm))
 	mux.Handle("POST /register", s.limit("register", s.limits.Register, s.handleRegister))
 	// POST only: a GET logout is triggered by any third-party <img> tag, and by
 	// link prefetchers. The nav uses a form.
 	mux.Handle("POST /logout", s.wrap(s.handleLogout))
+	mux.Handle("GET /forgot-password", s.limit("forgot_page", s.limits.Pages, s.handleForgotPasswordForm))
+	mux.Handle("POST /forgot-password", s.limit("forgot", s.limits.Auth, s.handleForgotPassword))
+	mux.Handle("GET /reset-password/{token}", s.limit("reset_page", s.limits.Pages, s.handleResetPasswordForm))
+	mux.Handle("POST /reset-password/{token}", s.limit("reset", s.limits.Auth, s.handleResetPassword))
+	mux.Handle("GET /verify-email/{token}", s.limit("verify_email", s.limits.Auth, s.handleVerifyEmail))
+	mux.Handle("GET /confirm-email/{token}", s.limit("verify_email", s.limits.Auth, s.handleConfirmEmailChange))
 	mux.Handle("POST /privacy/consent", s.limit("consent", s.limits.Pages, s.handleConsent))
 
 	// Dashboard and link management.
 	mux.Handle("GET /dashboard", s.limit("dashboard", s.limits.Dashboard, s.requireLogin(s.handleDashboard)))
+	mux.Handle("GET /analytics", s.limit("stats", s.limits.Stats, s.requireLogin(s.handleAnalytics)))
 	mux.Handle("GET /settings/security", s.limit("settings", s.limits.Dashboard, s.requireLogin(s.handleSecuritySettings)))
+	mux.Handle("GET /settings/account", s.limit("settings", s.limits.Dashboard, s.requireLogin(s.handleAccountSettings)))
+	// Each change re-checks the password, so they share the Auth budget with
+	// the other places a password can be guessed.
+	mux.Handle("POST /settings/account/username", s.limit("account_change", s.limits.Auth, s.requireLogin(s.handleChangeUsername)))
+	mux.Handle("POST /settings/account/email", s.limit("account_change", s.limits.Auth, s.requireLogin(s.handleChangeEmail)))
+	mux.Handle("POST /settings/account/password", s.limit("account_change", s.limits.Auth, s.requireLogin(s.handleChangePassword)))
+	mux.Handle("POST /settings/account/timezone", s.limit("settings", s.limits.Dashboard, s.requireLogin(s.handleChangeTimezone)))
+	mux.Handle("POST /settings/account/networks", s.limit("settings", s.limits.Dashboard, s.requireLogin(s.handleChangeExcludedNetworks)))
+	mux.Handle("POST /settings/account/delete", s.limit("account_change", s.limits.Auth, s.requireLogin(s.handleDeleteAccount)))
+	mux.Handle("POST /settings/account/webauthn/begin", s.limit("account_change", s.limits.Auth, s.requireLogin(s.handleReauthWebAuthnBegin)))
+	mux.Handle("GET /settings/account/export", s.limit("export", s.limits.Export, s.requireLogin(s.handleExportData)))
 	mux.Handle("POST /settings/totp/start", s.limit("totp_setup", s.limits.Auth, s.requireLogin(s.handleTOTPStart)))
 	mux.Handle("POST /settings/totp/confirm", s.limit("totp_setup", s.limits.Auth, s.requireLogin(s.handleTOTPConfirm)))
+	mux.Handle("POST /settings/webauthn/register/begin", s.limit("webauthn_setup", s.limits.Auth, s.requireLogin(s.handleWebAuthnRegisterBegin)))
+	mux.Handle("POST /settings/webauthn/register/finish", s.limit("webauthn_setup", s.limits.Auth, s.requireLogin(s.handleWebAuthnRegisterFinish)))
+	mux.Handle("POST /settings/webauthn/{id}/delete", s.limit("webauthn_setup", s.limits.Auth, s.requireLogin(s.handleWebAuthnDelete)))
+	mux.Handle("POST /settings/verify-email", s.limit("verify_resend", s.limits.Auth, s.requireLogin(s.handleResendVerification)))
 	mux.Handle("POST /settings/totp/disable", s.limit("totp_disable", s.limits.Auth, s.requireLogin(s.handleTOTPDisable)))
+	mux.Handle("POST /settings/sessions/{id}/revoke", s.limit("settings", s.limits.Dashboard, s.requireLogin(s.handleRevokeSession)))
+	mux.Handle("POST /settings/sessions/revoke-all", s.limit("settings", s.limits.Dashboard, s.requireLogin(s.handleRevokeAllSessions)))
 	// Its own scope: regenerating a key is unrelated to unlocking a link, and
 	// the two shared the "auth" counter before.
 	mux.Handle("POST /regenerate-api-key", s.limit("regen_key", s.limits.Auth, s.requireLogin(s.handleRegenerateAPIKey)))
 	mux.Handle("POST /toggle-status/{code}", s.limit("dashboard", s.limits.Dashboard, s.requireLogin(s.handleToggleStatus)))
 	mux.Handle("POST /publish/{code}", s.limit("dashboard", s.limits.Dashboard, s.requireLogin(s.handlePublish)))
 	mux.Handle("GET /export-links", s.limit("export", s.limits.Export, s.requireLogin(s.handleExportLinks)))
+	mux.Handle("GET /export-clicks", s.limit("export", s.limits.Export, s.requireLogin(s.handleExportClicks)))
 	mux.Handle("POST /bulk-delete", s.limit("bulk", s.limits.Bulk, s.requireLogin(s.handleBulkDelete)))
+	mux.Handle("GET /import", s.limit("dashboard", s.limits.Dashboard, s.requireLogin(s.handleImportForm)))
+	mux.Handle("POST /import", s.limit("import", s.limits.Bulk, s.requireLogin(s.handleImport)))
+	mux.Handle("GET /admin/import", s.limit("dashboard", s.limits.Dashboard, s.requireAdmin(s.handleAdminImportForm)))
+	mux.Handle("POST /admin/import", s.limit("admin_import", s.limits.Bulk, s.requireAdmin(s.handleAdminImport)))
+	mux.Handle("GET /trash", s.limit("dashboard", s.limits.Dashboard, s.requireLogin(s.handleTrash)))
+	mux.Handle("POST /trash/restore", s.limit("bulk", s.limits.Bulk, s.requireLogin(s.handleTrashRestore)))
+	mux.Handle("POST /trash/purge", s.limit("bulk", s.limits.Bulk, s.requireLogin(s.handleTrashPurge)))
 	mux.Handle("GET /edit/{code}", s.limit("dashboard", s.limits.Dashboard, s.requireLogin(s.handleEditForm)))
 	mux.Handle("POST /edit/{code}", s.limit("dashboard", s.limits.Dashboard, s.requireLogin(s.handleEdit)))
+	mux.Handle("POST /edit/{code}/revert/{revision}", s.limit("dashboard", s.limits.Dashboard, s.requireLogin(s.handleRevert)))
 	mux.Handle("POST /delete/{code}", s.limit("dashboard", s.limits.Dashboard, s.requireLogin(s.handleDelete)))
 
 	// Static content pages, each on its own counter.
@@ -186,6 +269,13 @@ func (s *Server) routes() (http.Handler, error) {
 	// operator-configured rate; they simply no longer share one bucket.
 	mux.Handle("POST /api/v1/shorten", s.limit("api_write", s.limits.API, s.handleAPIShorten))
 	mux.Handle("GET /api/v1/{code}", s.limit("api_read", s.limits.API, s.handleAPIGetURL))
+	mux.Handle("GET /api/v1/{code}/stats", s.limit("api_read", s.limits.API, s.handleAPIStats))
+	mux.Handle("GET /api/v1/analytics", s.limit("api_read", s.limits.API, s.handleAPIAnalytics))
+	mux.Handle("POST /api/v1/import", s.limit("api_import", s.limits.Bulk, s.handleAPIImport))
+	// Click exports page through the log, so a large one takes many requests;
+	// they get their own API budget rather than eating into link reads.
+	mux.Handle("GET /api/v1/clicks", s.limit("api_clicks", s.limits.API, s.handleAPIClicks))
+	mux.Handle("GET /api/v1/{code}/clicks", s.limit("api_clicks", s.limits.API, s.handleAPIClicks))
 
 	// Link password gate. GET and POST share one scope — they are the two halves
 	// of unlocking a link — but no longer share with regenerate-api-key.
@@ -209,8 +299,27 @@ func (s *Server) routes() (http.Handler, error) {
 	return h, nil
 }
 
-// Shutdown releases resources held by the server's dependencies.
-func (s *Server) Shutdown(context.Context) error {
+// Shutdown releases resources held by the server's dependencies. Call it
+// once the HTTP server has stopped, so no redirect is left queued.
+func (s *Server) Shutdown(ctx context.Context) error {
+	// Write the queued clicks before anything else, while the database is
+	// still open.
+	if s.clicks != nil {
+		if err := s.clicks.close(ctx); err != nil {
+			s.log.Warn("shutdown: queued clicks not all written", "error", err)
+		}
+	}
+	// Let account mail already handed off finish, within the shutdown budget.
+	done := make(chan struct{})
+	go func() {
+		s.mailWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.log.Warn("shutdown: account mail still sending")
+	}
 	if s.geo != nil {
 		return s.geo.Close()
 	}
@@ -280,7 +389,7 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	if err := s.db.PingContext(dbCtx); err != nil {
 		// The message is logged, not returned: driver errors routinely name the
 		// host, port, database and user, and this endpoint is unauthenticated.
-		s.log.Error("health check: database unreachable", "error", err)
+		s.log.ErrorContext(r.Context(), "health check: database unreachable", "error", err)
 		health["status"] = "unhealthy"
 		checks["database"] = "error"
 	} else {
@@ -291,7 +400,7 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 		rlCtx, cancelRL := context.WithTimeout(r.Context(), 1*time.Second)
 		defer cancelRL()
 		if err := backend.Ping(rlCtx); err != nil {
-			s.log.Warn("health check: rate limit backend unreachable", "error", err)
+			s.log.WarnContext(r.Context(), "health check: rate limit backend unreachable", "error", err)
 			checks["ratelimit"] = "error"
 			if health["status"] == "healthy" {
 				health["status"] = "degraded"
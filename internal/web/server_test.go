@@ -1,26 +1,50 @@
 package web
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
+	"maps"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 	"unicode/utf8"
 
 	"github.com/arumes31/redrx/internal/config"
 	"github.com/arumes31/redrx/internal/geo"
+	"github.com/arumes31/redrx/internal/linkcache"
+	"github.com/arumes31/redrx/internal/mail"
 	"github.com/arumes31/redrx/internal/ratelimit"
 	"github.com/arumes31/redrx/internal/safety"
 	"github.com/arumes31/redrx/internal/security"
 	"github.com/arumes31/redrx/internal/store"
+	"github.com/arumes31/redrx/internal/telemetry"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/mileusna/useragent"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // newTestServer builds a server backed by a copy of the legacy Python database,
@@ -59,6 +83,7 @@ func newTestServer(t *testing.T, tweaks ...func(*config.Config)) (*Server, *stor
 		EnableSEO:           true,
 		SEODomain:           "redrx.eu",
 		RateLimitStorageURI: "memory://",
+		WebAuthnOrigins:     []string{"https://short.example.com"},
 	}
 	for _, tweak := range tweaks {
 		tweak(cfg)
@@ -67,6 +92,13 @@ func newTestServer(t *testing.T, tweaks ...func(*config.Config)) (*Server, *stor
 	backend := ratelimit.NewMemoryBackend()
 	t.Cleanup(func() { backend.Close() })
 
+	// As in main, the store tells the link cache of changes.
+	var links *linkcache.Cache
+	if cfg.LinkCacheSize > 0 {
+		links = linkcache.New(linkcache.Options{Size: cfg.LinkCacheSize, TTL: time.Duration(cfg.LinkCacheTTL) * time.Second})
+		db.OnURLChange(links.Invalidate)
+	}
+
 	srv, err := NewServer(Options{
 		Config:  cfg,
 		DB:      db,
@@ -76,6 +108,7 @@ func newTestServer(t *testing.T, tweaks ...func(*config.Config)) (*Server, *stor
 		// enabled the checker would correctly fail closed.
 		Safety: safety.New(safety.Options{Enabled: false}),
 		Geo:    geo.New(geo.Options{}),
+		Links:  links,
 	})
 	if err != nil {
 		t.Fatalf("NewServer: %v", err)
@@ -236,7 +269,7 @@ func TestPrivacySignalsSuppressClickAnalytics(t *testing.T) {
 		ShortCode: "TRACK1", LongURL: "https://tracking.example.com/",
 		PreviewMode: true, StatsEnabled: true, IsEnabled: true,
 	}
-	if err := db.CreateURL(context.Background(), link); err != nil {
+	if err := db.CreateURL(context.Background(), link, store.SystemActor("test")); err != nil {
 		t.Fatalf("CreateURL: %v", err)
 	}
 
@@ -707,7 +740,11 @@ func TestTimeBucketsAreUnique(t *testing.T) {
 		{"7d", 8},
 		{"30d", 31},
 	} {
-		labels, _, _ := timeBuckets(tc.rangeType, now)
+		sr, err := resolveStatsRange(url.Values{"range": {tc.rangeType}}, now, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, labels := timeBuckets(sr)
 		if len(labels) != tc.want {
 			t.Errorf("%s produced %d labels, want %d", tc.rangeType, len(labels), tc.want)
 		}
@@ -728,9 +765,14 @@ func TestTimeBucketsAreUnique(t *testing.T) {
 // hours of clicks and inflates both the total and the daily average.
 func TestTimeBucketsCutoffAlignsWithFirstLabel(t *testing.T) {
 	now := time.Date(2026, 5, 4, 15, 37, 0, 0, time.UTC)
-	labels, cutoff, hourly := timeBuckets("24h", now)
+	sr, err := resolveStatsRange(url.Values{"range": {"24h"}}, now, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, labels := timeBuckets(sr)
+	cutoff := sr.From
 
-	if !hourly {
+	if sr.Granularity != store.ByHour {
 		t.Fatal("24h range should use hourly buckets")
 	}
 	if got := cutoff.Format("15:00"); got != labels[0] {
@@ -746,6 +788,77 @@ func TestTimeBucketsCutoffAlignsWithFirstLabel(t *testing.T) {
 	}
 }
 
+// TestStatsRangeCustomAndTimezone resolves custom ranges, and checks the hour
+// repeated when New York's clocks go back is one bucket, as the query counts it.
+func TestStatsRangeCustomAndTimezone(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 11, 20, 15, 0, 0, 0, time.UTC)
+
+	sr, err := resolveStatsRange(url.Values{"range": {"custom"}, "from": {"2026-11-01"}, "to": {"2026-11-01"}}, now, ny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.Granularity != store.ByHour || sr.To.Sub(sr.From) != 25*time.Hour {
+		t.Fatalf("one day across the change = %s over %v, want hourly over 25h", sr.Granularity, sr.To.Sub(sr.From))
+	}
+	if keys, _ := timeBuckets(sr); len(keys) != 24 || keys[1] != "2026-11-01 01:00" || keys[2] != "2026-11-01 02:00" {
+		t.Errorf("hourly keys = %v, want the 24 wall hours with 01:00 once", keys)
+	}
+
+	sr, err = resolveStatsRange(url.Values{"range": {"custom"}, "from": {"2026-01-01"}, "to": {"2026-03-31"}, "g": {"week"}}, now, ny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, labels := timeBuckets(sr)
+	if keys[0] != "2025-12-29" || labels[0] != "Week of Dec 29" || keys[len(keys)-1] != "2026-03-30" {
+		t.Errorf("weekly keys = %v, want Mondays from 2025-12-29 to 2026-03-30", keys)
+	}
+
+	for _, q := range []url.Values{
+		{"range": {"custom"}},
+		{"range": {"custom"}, "from": {"2026-03-02"}, "to": {"2026-03-01"}},
+		{"range": {"30d"}, "g": {"year"}},
+		{"range": {"custom"}, "from": {"2020-01-01"}, "g": {"hour"}},
+	} {
+		if _, err := resolveStatsRange(q, now, ny); err == nil {
+			t.Errorf("%v was accepted", q)
+		}
+	}
+}
+
+// TestStatsPageTimezone saves a timezone in the account settings and checks
+// the stats page charts in it, unless a request asks for another.
+func TestStatsPageTimezone(t *testing.T) {
+	srv, db := newTestServer(t)
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+
+	token := extractCSRF(t, b.get("/settings/account").Body.String())
+	if rec := b.post("/settings/account/timezone", url.Values{"timezone": {"Mars/Olympus"}, "csrf_token": {token}}); !strings.Contains(rec.Body.String(), "Enter an IANA timezone") {
+		t.Errorf("an unknown zone was not refused: %d", rec.Code)
+	}
+	if rec := b.post("/settings/account/timezone", url.Values{"timezone": {"Asia/Tokyo"}, "csrf_token": {token}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("saving the timezone returned %d", rec.Code)
+	}
+	if user, err := db.UserByLogin(context.Background(), "alice"); err != nil || user.Timezone != "Asia/Tokyo" {
+		t.Fatalf("timezone = %q, %v", user.Timezone, err)
+	}
+
+	body := b.get("/ABC123/stats?range=custom&from=2026-01-01&to=2026-06-30&g=month").Body.String()
+	if !strings.Contains(body, "times in Asia/Tokyo") || !strings.Contains(body, "Jan 2026") {
+		t.Errorf("the stats page does not chart months in Tokyo time:\n%s", truncateBody(body))
+	}
+	body = b.get("/ABC123/stats?range=7d&tz=Europe/Vienna").Body.String()
+	if !strings.Contains(body, "times in Europe/Vienna") || !strings.Contains(body, "tz=Europe%2fVienna") {
+		t.Errorf("the tz parameter does not override the setting, or is lost from the range links")
+	}
+	if body = b.get("/ABC123/stats?tz=Nowhere/Special").Body.String(); !strings.Contains(body, "not a known timezone") {
+		t.Error("an unknown tz parameter was not reported")
+	}
+}
+
 // TestNormalizeHexColorExpandsShorthand checks that a valid "#rgb" is expanded
 // to "#rrggbb": the <input type="color"> that renders the value accepts only
 // the six-digit form and coerces "#f00" to black otherwise.
@@ -888,3 +1001,1844 @@ func TestRateLimitScopesAreIndependent(t *testing.T) {
 		t.Errorf("/login returned %d after /terms was throttled; scopes are shared", code)
 	}
 }
+
+// TestDashboardShowsHealthBadge checks the monitor's results reach the owner:
+// a link whose destination failed its last check is badged as down.
+func TestDashboardShowsHealthBadge(t *testing.T) {
+	srv, db := newTestServer(t, func(c *config.Config) { c.EnableHealthCheck = true })
+	ctx := context.Background()
+
+	link, err := db.URLByShortCode(ctx, "ABC123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RecordLinkHealth(ctx, &store.LinkHealth{
+		URLID: link.ID, Target: link.LongURL, StatusCode: http.StatusBadGateway, Error: "HTTP 502",
+	}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+	req.Host = "short.example.com"
+	req.AddCookie(login(t, srv, "alice", "alice-password"))
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("dashboard returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "Down") || !strings.Contains(body, "HTTP 502") {
+		t.Error("the failing link was not badged as down with its error")
+	}
+}
+
+func TestSelectTargetSkipsUnhealthyRotationTargets(t *testing.T) {
+	srv, _ := newTestServer(t)
+	link := &store.URL{
+		LongURL:              "https://main.example/",
+		RotateTargets:        []string{"https://a.example/", "https://b.example/"},
+		UnhealthyTargets:     []string{"https://b.example/"},
+		SkipUnhealthyTargets: true,
+	}
+	for range 50 {
+		if got := srv.selectTarget(link, useragent.Parse("")); got != "https://a.example/" {
+			t.Fatalf("selectTarget = %q, want only the healthy target", got)
+		}
+	}
+
+	// With every target unhealthy the rotation is served as is, rather than
+	// emptied.
+	link.UnhealthyTargets = link.RotateTargets
+	if got := srv.selectTarget(link, useragent.Parse("")); got == link.LongURL {
+		t.Error("all-unhealthy rotation fell through to the main URL")
+	}
+}
+
+// TestEditHistoryAndRevert edits a link through the form, checks the edit page
+// lists the change, then reverts to the original from the history.
+func TestEditHistoryAndRevert(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	cookie := login(t, srv, "alice", "alice-password")
+
+	b := &browser{srv: srv, cookie: cookie}
+	page := func() string {
+		t.Helper()
+		rec := b.get("/edit/ABC123")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("edit page returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+		}
+		return rec.Body.String()
+	}
+	post := b.post
+
+	original, err := db.URLByShortCode(ctx, "ABC123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Legacy rows predate the history, so the first edit is its first entry.
+	body := page()
+	token := extractCSRF(t, body)
+	rec := post("/edit/ABC123", url.Values{
+		"csrf_token": {token}, "long_url": {"https://changed.example/"}, "stats_enabled": {"y"},
+	})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("edit returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+
+	body = page()
+	if !strings.Contains(body, "https://changed.example/") || !strings.Contains(body, original.LongURL) {
+		t.Error("the history does not show the destination change")
+	}
+
+	revs, err := db.Revisions(ctx, original.ID, 10)
+	if err != nil || len(revs) != 1 {
+		t.Fatalf("revisions = %d (%v), want 1", len(revs), err)
+	}
+	rec = post("/edit/ABC123/revert/999999", url.Values{"csrf_token": {token}})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("revert to a missing revision = %d, want 404", rec.Code)
+	}
+
+	// Change again, then revert to the first edit.
+	rec = post("/edit/ABC123", url.Values{
+		"csrf_token": {token}, "long_url": {"https://third.example/"}, "stats_enabled": {"y"},
+	})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("second edit returned %d", rec.Code)
+	}
+	rec = post("/edit/ABC123/revert/"+strconv.FormatInt(revs[0].ID, 10), url.Values{"csrf_token": {token}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("revert returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	link, err := db.URLByShortCode(ctx, "ABC123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.LongURL != "https://changed.example/" {
+		t.Errorf("after revert LongURL = %q, want the first edit's destination", link.LongURL)
+	}
+}
+
+// browser replays requests with one session, picking up the session cookie
+// from each response the way a browser would. The CSRF token lives in the
+// session, so a form is only accepted with the cookie its page came with.
+type browser struct {
+	srv    *Server
+	cookie *http.Cookie
+}
+
+func (b *browser) do(req *http.Request) *httptest.ResponseRecorder {
+	req.Host = "short.example.com"
+	req.AddCookie(b.cookie)
+	rec := httptest.NewRecorder()
+	b.srv.ServeHTTP(rec, req)
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == b.cookie.Name {
+			b.cookie = c
+		}
+	}
+	return rec
+}
+
+func (b *browser) get(path string) *httptest.ResponseRecorder {
+	return b.do(httptest.NewRequest(http.MethodGet, path, nil))
+}
+
+func (b *browser) post(path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(req)
+}
+
+// TestTrashDeleteAndRestore deletes a link from the dashboard, checks it stops
+// resolving and shows up in the trash, and restores it from there.
+func TestTrashDeleteAndRestore(t *testing.T) {
+	srv, db := newTestServer(t)
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+
+	rec := b.get("/dashboard")
+	token := extractCSRF(t, rec.Body.String())
+	if rec = b.post("/delete/ABC123", url.Values{"csrf_token": {token}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("delete returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	if rec = b.get("/ABC123"); rec.Code != http.StatusNotFound {
+		t.Errorf("a deleted link answered %d, want 404", rec.Code)
+	}
+
+	rec = b.get("/trash")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("trash returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	if !strings.Contains(rec.Body.String(), "ABC123") {
+		t.Fatal("the deleted link is not in the trash")
+	}
+	alice, err := db.UserByLogin(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trash, err := db.TrashedUserURLs(context.Background(), alice.ID)
+	if err != nil || len(trash) != 1 {
+		t.Fatalf("trash = %d links, %v", len(trash), err)
+	}
+
+	rec = b.post("/trash/restore", url.Values{
+		"csrf_token": {token}, "link_ids": {strconv.FormatInt(trash[0].ID, 10)},
+	})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("restore returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	if _, err := db.URLByShortCode(context.Background(), "ABC123"); err != nil {
+		t.Errorf("the restored link does not resolve: %v", err)
+	}
+}
+
+// TestSecurityActivityRecordsSignIns fails a sign-in and then signs in, and
+// checks both show up on the security settings page with an anonymised
+// address.
+func TestSecurityActivityRecordsSignIns(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	rec := get(t, srv, "/login")
+	b := &browser{srv: srv, cookie: sessionCookie(t, rec.Result())}
+	token := extractCSRF(t, rec.Body.String())
+	b.post("/login", url.Values{"username": {"alice"}, "password": {"wrong"}, "csrf_token": {token}})
+
+	b.cookie = login(t, srv, "alice", "alice-password")
+	rec = b.get("/settings/security")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("security settings returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"Failed sign-in (wrong password)", "Signed in", ".xxx.xxx"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the activity list is missing %q", want)
+		}
+	}
+}
+
+// mailbox is a mail.Sender that keeps what it was asked to send.
+type mailbox struct {
+	mu   sync.Mutex
+	sent []mail.Message
+}
+
+func (m *mailbox) Send(_ context.Context, msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// newMailServer is newTestServer with account mail switched on and delivered
+// to the returned mailbox.
+func newMailServer(t *testing.T) (*Server, *store.DB, *mailbox) {
+	t.Helper()
+	srv, db := newTestServer(t, func(cfg *config.Config) {
+		cfg.SMTPHost = "smtp.test"
+		cfg.PasswordResetTTL = 60
+	})
+	box := &mailbox{}
+	srv.mailer = box
+	return srv, db, box
+}
+
+// link waits for mail in flight and returns the path of the link in the
+// newest message.
+func (m *mailbox) link(t *testing.T, srv *Server) string {
+	t.Helper()
+	srv.mailWG.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sent) == 0 {
+		t.Fatal("no mail was sent")
+	}
+	match := regexp.MustCompile(`https://short\.example\.com(/\S+)`).FindStringSubmatch(m.sent[len(m.sent)-1].Body)
+	if match == nil {
+		t.Fatalf("no link in the mail:\n%s", m.sent[len(m.sent)-1].Body)
+	}
+	return match[1]
+}
+
+// TestPasswordResetByEmail resets a 2FA-protected password through the mailed
+// link and checks the link stops working once used.
+func TestPasswordResetByEmail(t *testing.T) {
+	srv, db, box := newMailServer(t)
+	ctx := context.Background()
+	alice, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := security.SealAccountSecret(srv.cfg.SecretKey, "JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTOTPPending(ctx, alice.ID, secret); err != nil {
+		t.Fatal(err)
+	}
+	const recovery = "ABCD-EFGH-JKLM"
+	if err := db.EnableTOTP(ctx, alice.ID, []string{security.RecoveryCodeHash(srv.cfg.SecretKey, recovery)}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := get(t, srv, "/forgot-password")
+	b := &browser{srv: srv, cookie: sessionCookie(t, rec.Result())}
+	token := extractCSRF(t, rec.Body.String())
+	rec = b.post("/forgot-password", url.Values{"email": {"nobody@example.com"}, "csrf_token": {token}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("forgot password returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	srv.mailWG.Wait()
+	if len(box.sent) != 0 {
+		t.Fatalf("mail was sent for an unknown address: %+v", box.sent)
+	}
+	b.post("/forgot-password", url.Values{"email": {alice.Email}, "csrf_token": {token}})
+	reset := box.link(t, srv)
+	if box.sent[0].To != alice.Email {
+		t.Errorf("reset mail went to %q", box.sent[0].To)
+	}
+
+	rec = b.get(reset)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `name="code"`) {
+		t.Fatalf("reset form returned %d without a 2FA field\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	token = extractCSRF(t, rec.Body.String())
+	rec = b.post(reset, url.Values{"password": {"new-password"}, "code": {"000000"}, "csrf_token": {token}})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Enter a valid authenticator") {
+		t.Fatalf("reset without a valid code returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	rec = b.post(reset, url.Values{"password": {"new-password"}, "code": {recovery}, "csrf_token": {token}})
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || loc != "/login" {
+		t.Fatalf("reset = %d Location %q, want 303 /login\n%s", rec.Code, loc, truncateBody(rec.Body.String()))
+	}
+
+	updated, err := db.UserByID(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !security.CheckPasswordHash(updated.PasswordHash, "new-password") {
+		t.Error("the password was not changed")
+	}
+	if updated.EmailVerifiedAt == nil {
+		t.Error("a completed reset did not verify the address")
+	}
+	if rec = b.get(reset); rec.Header().Get("Location") != "/forgot-password" {
+		t.Errorf("a used reset link answered %d Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+// TestRegistrationSendsVerificationLink registers an account and follows the
+// mailed link.
+func TestRegistrationSendsVerificationLink(t *testing.T) {
+	srv, db, box := newMailServer(t)
+
+	rec := get(t, srv, "/register")
+	b := &browser{srv: srv, cookie: sessionCookie(t, rec.Result())}
+	token := extractCSRF(t, rec.Body.String())
+	rec = b.post("/register", url.Values{
+		"username": {"carol"}, "email": {"carol@example.com"}, "password": {"carol-password"}, "csrf_token": {token},
+	})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("register returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	verify := box.link(t, srv)
+
+	b.cookie = login(t, srv, "carol", "carol-password")
+	if !strings.Contains(b.get("/dashboard").Body.String(), "Please verify your email address") {
+		t.Error("the dashboard does not ask an unverified user to verify")
+	}
+	if rec = b.get(verify); rec.Header().Get("Location") != "/dashboard" {
+		t.Fatalf("verification returned %d Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	carol, err := db.UserByLogin(context.Background(), "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if carol.EmailVerifiedAt == nil {
+		t.Error("following the link did not verify the address")
+	}
+	if strings.Contains(b.get("/dashboard").Body.String(), "Please verify your email address") {
+		t.Error("the dashboard still asks a verified user to verify")
+	}
+}
+
+// softKey is a software authenticator: just enough of one to register an
+// ES256 credential and sign assertions for the test relying party.
+type softKey struct {
+	t          *testing.T
+	id         []byte
+	key        *ecdsa.PrivateKey
+	counter    uint32
+	userHandle []byte
+}
+
+func newSoftKey(t *testing.T) *softKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return &softKey{t: t, id: id, key: key}
+}
+
+// authData builds authenticator data with user presence and verification
+// set, attaching the credential when attested.
+func (k *softKey) authData(attested bool) []byte {
+	k.t.Helper()
+	rpHash := sha256.Sum256([]byte("short.example.com"))
+	flags := byte(0x01 | 0x04) // UP | UV
+	if attested {
+		flags |= 0x40 // AT
+	}
+	out := append(rpHash[:], flags)
+	out = binary.BigEndian.AppendUint32(out, k.counter)
+	if !attested {
+		return out
+	}
+	ecdh, err := k.key.PublicKey.ECDH()
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	point := ecdh.Bytes() // 0x04 || X || Y
+	cose, err := webauthncbor.Marshal(map[int]any{1: 2, 3: -7, -1: 1, -2: point[1:33], -3: point[33:]})
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	out = append(out, make([]byte, 16)...) // AAGUID
+	out = binary.BigEndian.AppendUint16(out, uint16(len(k.id)))
+	out = append(out, k.id...)
+	return append(out, cose...)
+}
+
+func clientData(t *testing.T, typ, challenge string) []byte {
+	t.Helper()
+	raw, err := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": "https://short.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// challenge pulls the challenge out of the options a begin endpoint returned,
+// keeping the user handle a registration asks the key to store.
+func (k *softKey) challenge(rec *httptest.ResponseRecorder) string {
+	k.t.Helper()
+	if rec.Code != http.StatusOK {
+		k.t.Fatalf("begin returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	var options struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			User      struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &options); err != nil {
+		k.t.Fatal(err)
+	}
+	if options.PublicKey.User.ID != "" {
+		handle, err := base64.RawURLEncoding.DecodeString(options.PublicKey.User.ID)
+		if err != nil {
+			k.t.Fatal(err)
+		}
+		k.userHandle = handle
+	}
+	return options.PublicKey.Challenge
+}
+
+func (k *softKey) attestation(challenge string) []byte {
+	k.t.Helper()
+	object, err := webauthncbor.Marshal(map[string]any{"fmt": "none", "attStmt": map[string]any{}, "authData": k.authData(true)})
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	return k.response(map[string]string{
+		"clientDataJSON":    b64(clientData(k.t, "webauthn.create", challenge)),
+		"attestationObject": b64(object),
+	})
+}
+
+func (k *softKey) assertion(challenge string) []byte {
+	k.t.Helper()
+	k.counter++
+	authData := k.authData(false)
+	client := clientData(k.t, "webauthn.get", challenge)
+	clientHash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, k.key, digest[:])
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	return k.response(map[string]string{
+		"clientDataJSON":    b64(client),
+		"authenticatorData": b64(authData),
+		"signature":         b64(sig),
+		"userHandle":        b64(k.userHandle),
+	})
+}
+
+func (k *softKey) response(response map[string]string) []byte {
+	k.t.Helper()
+	raw, err := json.Marshal(map[string]any{"id": b64(k.id), "rawId": b64(k.id), "type": "public-key", "response": response})
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	return raw
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func (b *browser) postJSON(path, csrf string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CSRFToken", csrf)
+	return b.do(req)
+}
+
+// TestWebAuthnSecurityKeyAndPasskey registers a software key, uses it as the
+// second step of a password sign-in and then on its own as a passkey, and
+// checks a replayed signature counter is refused.
+func TestWebAuthnSecurityKeyAndPasskey(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	csrf := extractCSRF(t, b.get("/settings/security").Body.String())
+	key := newSoftKey(t)
+
+	challenge := key.challenge(b.postJSON("/settings/webauthn/register/begin", csrf, nil))
+	rec := b.postJSON("/settings/webauthn/register/finish?name=Test+key&passwordless=on", csrf, key.attestation(challenge))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("register finish returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	var registered struct {
+		Name          string   `json:"name"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &registered); err != nil {
+		t.Fatal(err)
+	}
+	if registered.Name != "Test key" || len(registered.RecoveryCodes) != 10 {
+		t.Errorf("registration = %+v, want the name and 10 recovery codes", registered)
+	}
+	// A finished ceremony cannot be finished again.
+	if rec = b.postJSON("/settings/webauthn/register/finish", csrf, key.attestation(challenge)); rec.Code != http.StatusBadRequest {
+		t.Errorf("a replayed registration returned %d, want 400", rec.Code)
+	}
+
+	// The key is now a second factor for password sign-ins.
+	b = &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	rec = b.get("/login/totp")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `data-webauthn="login"`) {
+		t.Fatalf("second factor page = %d without the security key button", rec.Code)
+	}
+	csrf = extractCSRF(t, rec.Body.String())
+	challenge = key.challenge(b.postJSON("/login/webauthn/begin", csrf, nil))
+	if rec = b.postJSON("/login/webauthn/finish", csrf, key.assertion(challenge)); rec.Code != http.StatusOK {
+		t.Fatalf("second factor finish returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	if rec = b.get("/dashboard"); rec.Code != http.StatusOK {
+		t.Fatalf("dashboard after the key returned %d", rec.Code)
+	}
+	stored, err := db.WebAuthnCredentialByCredentialID(ctx, b64(key.id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SignCount != 1 || stored.LastUsedAt == nil {
+		t.Errorf("stored credential = %+v, want the counter and last use recorded", stored)
+	}
+
+	// On its own, as a passkey, from a fresh session.
+	rec = get(t, srv, "/login")
+	b = &browser{srv: srv, cookie: sessionCookie(t, rec.Result())}
+	csrf = extractCSRF(t, rec.Body.String())
+	challenge = key.challenge(b.postJSON("/login/passkey/begin", csrf, nil))
+	if rec = b.postJSON("/login/passkey/finish?next=/trash", csrf, key.assertion(challenge)); rec.Code != http.StatusOK ||
+		!strings.Contains(rec.Body.String(), `"/trash"`) {
+		t.Fatalf("passkey finish = %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	if rec = b.get("/dashboard"); rec.Code != http.StatusOK {
+		t.Fatalf("dashboard after the passkey returned %d", rec.Code)
+	}
+
+	// A cloned key presents a counter that has already been seen.
+	rec = get(t, srv, "/login")
+	b = &browser{srv: srv, cookie: sessionCookie(t, rec.Result())}
+	csrf = extractCSRF(t, rec.Body.String())
+	challenge = key.challenge(b.postJSON("/login/passkey/begin", csrf, nil))
+	key.counter = 0
+	if rec = b.postJSON("/login/passkey/finish", csrf, key.assertion(challenge)); rec.Code != http.StatusBadRequest {
+		t.Errorf("a replayed counter returned %d, want 400", rec.Code)
+	}
+	if rec = b.get("/dashboard"); rec.Code == http.StatusOK {
+		t.Error("a replayed counter signed the user in")
+	}
+}
+
+// TestAccountChangesNeedTheSecurityKey checks an account whose only second
+// factor is a security key must present it, or a recovery code, along with the
+// password before an account change.
+func TestAccountChangesNeedTheSecurityKey(t *testing.T) {
+	srv, _ := newTestServer(t)
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	csrf := extractCSRF(t, b.get("/settings/security").Body.String())
+	key := newSoftKey(t)
+	challenge := key.challenge(b.postJSON("/settings/webauthn/register/begin", csrf, nil))
+	rec := b.postJSON("/settings/webauthn/register/finish?name=Test+key", csrf, key.attestation(challenge))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("register finish returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	var registered struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &registered); err != nil || len(registered.RecoveryCodes) == 0 {
+		t.Fatalf("registration gave no recovery codes: %v", err)
+	}
+
+	rec = b.get("/settings/account")
+	if !strings.Contains(rec.Body.String(), `data-webauthn="reauth"`) {
+		t.Fatal("the account page offers no security key")
+	}
+	token := extractCSRF(t, rec.Body.String())
+
+	rec = b.post("/settings/account/username", url.Values{
+		"username": {"alice2"}, "current_password": {"alice-password"}, "csrf_token": {token},
+	})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Use your security key") {
+		t.Fatalf("the password alone returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+
+	challenge = key.challenge(b.postJSON("/settings/account/webauthn/begin", token, nil))
+	assertion := string(key.assertion(challenge))
+	rec = b.post("/settings/account/username", url.Values{
+		"username": {"alice2"}, "current_password": {"alice-password"}, "webauthn_assertion": {assertion}, "csrf_token": {token},
+	})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("the security key returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	// The ceremony is spent, so the same assertion cannot confirm another change.
+	rec = b.post("/settings/account/username", url.Values{
+		"username": {"alice3"}, "current_password": {"alice-password"}, "webauthn_assertion": {assertion}, "csrf_token": {token},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("a replayed assertion returned %d, want the form again", rec.Code)
+	}
+
+	rec = b.post("/settings/account/username", url.Values{
+		"username": {"alice3"}, "current_password": {"alice-password"}, "code": {registered.RecoveryCodes[0]}, "csrf_token": {token},
+	})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("a recovery code returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+}
+
+// cookieSessionID reads the session id out of a session cookie's payload.
+func cookieSessionID(t *testing.T, c *http.Cookie) string {
+	t.Helper()
+	body, _, _ := strings.Cut(c.Value, ".")
+	raw, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data struct {
+		SessionID string `json:"sid"`
+	}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		t.Fatal(err)
+	}
+	return data.SessionID
+}
+
+// TestSessionsCanBeListedAndRevoked signs in from two browsers, revokes one
+// from the other, and checks a logged-out cookie replayed later is refused.
+func TestSessionsCanBeListedAndRevoked(t *testing.T) {
+	srv, _ := newTestServer(t)
+	laptop := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	phone := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	phoneID := cookieSessionID(t, phone.cookie)
+
+	rec := laptop.get("/settings/security")
+	body := rec.Body.String()
+	listed := regexp.MustCompile(`/settings/sessions/([0-9a-f]+)/revoke`).FindAllString(body, -1)
+	if len(listed) != 2 || !strings.Contains(body, "/settings/sessions/"+phoneID+"/revoke") {
+		t.Fatalf("session list = %v, want both sessions", listed)
+	}
+	if strings.Count(body, "This device") != 1 {
+		t.Error("the session list does not mark exactly one session as current")
+	}
+
+	token := extractCSRF(t, body)
+	if rec = laptop.post("/settings/sessions/"+phoneID+"/revoke", url.Values{"csrf_token": {token}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("revoke returned %d", rec.Code)
+	}
+	if rec = phone.get("/dashboard"); rec.Code != http.StatusSeeOther {
+		t.Errorf("the revoked session still reached the dashboard (%d)", rec.Code)
+	}
+	if rec = laptop.get("/dashboard"); rec.Code != http.StatusOK {
+		t.Errorf("revoking the other session signed this one out (%d)", rec.Code)
+	}
+
+	// A copy of the cookie taken before logout stops working with it.
+	stolen := *laptop.cookie
+	token = extractCSRF(t, rec.Body.String())
+	laptop.post("/logout", url.Values{"csrf_token": {token}})
+	thief := &browser{srv: srv, cookie: &stolen}
+	if rec = thief.get("/dashboard"); rec.Code != http.StatusSeeOther {
+		t.Errorf("a cookie copied before logout still reached the dashboard (%d)", rec.Code)
+	}
+}
+
+// TestSignOutEverywhere checks the button ends every session, this one too.
+func TestSignOutEverywhere(t *testing.T) {
+	srv, _ := newTestServer(t)
+	laptop := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	phone := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+
+	token := extractCSRF(t, laptop.get("/settings/security").Body.String())
+	rec := laptop.post("/settings/sessions/revoke-all", url.Values{"csrf_token": {token}})
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || loc != "/login" {
+		t.Fatalf("revoke-all = %d Location %q, want 303 /login", rec.Code, loc)
+	}
+	for name, b := range map[string]*browser{"laptop": laptop, "phone": phone} {
+		if rec = b.get("/dashboard"); rec.Code != http.StatusSeeOther {
+			t.Errorf("the %s is still signed in (%d)", name, rec.Code)
+		}
+	}
+}
+
+// TestAccountChangesNeedThePassword changes the username and password from
+// the account page, checking each is refused without the current password and
+// that a new password signs out the other sessions.
+func TestAccountChangesNeedThePassword(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	laptop := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	phone := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+
+	rec := laptop.get("/settings/account")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("account settings returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	token := extractCSRF(t, rec.Body.String())
+
+	rec = laptop.post("/settings/account/username", url.Values{
+		"username": {"alice2"}, "current_password": {"wrong"}, "csrf_token": {token},
+	})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "The password was incorrect.") {
+		t.Fatalf("a wrong password returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	rec = laptop.post("/settings/account/username", url.Values{
+		"username": {"alice2"}, "current_password": {"alice-password"}, "csrf_token": {token},
+	})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("username change returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	alice, err := db.UserByLogin(ctx, "alice2")
+	if err != nil {
+		t.Fatalf("the new username does not sign in: %v", err)
+	}
+
+	rec = laptop.post("/settings/account/password", url.Values{
+		"password": {"fresh-secret"}, "confirm_password": {"other-password"},
+		"current_password": {"alice-password"}, "csrf_token": {token},
+	})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "The passwords do not match.") {
+		t.Fatalf("mismatched passwords returned %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "fresh-secret") {
+		t.Error("the form redisplayed the new password")
+	}
+	rec = laptop.post("/settings/account/password", url.Values{
+		"password": {"fresh-secret"}, "confirm_password": {"fresh-secret"},
+		"current_password": {"alice-password"}, "csrf_token": {token},
+	})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("password change returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	if rec = phone.get("/dashboard"); rec.Code != http.StatusSeeOther {
+		t.Errorf("the other session survived the password change (%d)", rec.Code)
+	}
+	if rec = laptop.get("/dashboard"); rec.Code != http.StatusOK {
+		t.Errorf("the password change signed out the session that made it (%d)", rec.Code)
+	}
+	login(t, srv, "alice2", "fresh-secret")
+
+	events, err := db.SecurityEvents(ctx, alice.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audited []string
+	for _, e := range events {
+		switch e.Event {
+		case store.EventUsernameChanged, store.EventPasswordChanged:
+			audited = append(audited, e.Event+":"+e.Detail)
+		}
+	}
+	want := []string{store.EventPasswordChanged + ":", store.EventUsernameChanged + ":alice → alice2"}
+	if strings.Join(audited, ",") != strings.Join(want, ",") {
+		t.Errorf("audit trail = %q, want %q", audited, want)
+	}
+}
+
+// TestEmailChangeNeedsConfirmation checks a new address only takes over once
+// the link mailed to it is opened, and that the old address is told.
+func TestEmailChangeNeedsConfirmation(t *testing.T) {
+	srv, db, box := newMailServer(t)
+	ctx := context.Background()
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	alice, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := extractCSRF(t, b.get("/settings/account").Body.String())
+	rec := b.post("/settings/account/email", url.Values{
+		"email": {"alice@new.example"}, "current_password": {"alice-password"}, "csrf_token": {token},
+	})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("email change returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	confirm := box.link(t, srv)
+	if to := box.sent[len(box.sent)-1].To; to != "alice@new.example" {
+		t.Errorf("the confirmation went to %q", to)
+	}
+	if u, _ := db.UserByID(ctx, alice.ID); u.Email != alice.Email {
+		t.Fatalf("the address changed to %q before it was confirmed", u.Email)
+	}
+
+	// The link is bound to the address it was sent to.
+	if rec = b.get(strings.Replace(confirm, "new.example", "evil.example", 1)); rec.Header().Get("Location") != "/" {
+		t.Errorf("a rewritten link answered %d Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec = b.get(confirm); rec.Header().Get("Location") != "/settings/account" {
+		t.Fatalf("confirm answered %d Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	updated, err := db.UserByID(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Email != "alice@new.example" || updated.EmailVerifiedAt == nil {
+		t.Errorf("after confirming email = %q verified %v", updated.Email, updated.EmailVerifiedAt)
+	}
+	srv.mailWG.Wait()
+	if notice := box.sent[len(box.sent)-1]; notice.To != alice.Email {
+		t.Errorf("the change notice went to %q, want the old address", notice.To)
+	}
+	if rec = b.get(confirm); rec.Header().Get("Location") != "/" {
+		t.Errorf("a used confirmation link answered %d Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+// TestExportMyData downloads the account archive and checks each file is there
+// and holds the account's links and clicks without its secrets.
+func TestExportMyData(t *testing.T) {
+	srv, _ := newTestServer(t)
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+
+	rec := b.get("/settings/account/export")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("export returned %d %q\n%s", rec.Code, rec.Header().Get("Content-Type"), truncateBody(rec.Body.String()))
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(body)
+	}
+	for _, name := range []string{"profile.json", "links.json", "links.csv", "clicks.json", "clicks.csv"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("the archive has no %s", name)
+		}
+	}
+
+	var profile struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+	}
+	if err := json.Unmarshal([]byte(files["profile.json"]), &profile); err != nil || profile.Username != "alice" {
+		t.Errorf("profile.json = %s (%v)", files["profile.json"], err)
+	}
+	if strings.Contains(files["profile.json"], "pbkdf2") || strings.Contains(files["profile.json"], "password_hash") {
+		t.Error("profile.json carries the password hash")
+	}
+	var links []struct {
+		ShortCode string `json:"short_code"`
+	}
+	if err := json.Unmarshal([]byte(files["links.json"]), &links); err != nil || len(links) != 1 || links[0].ShortCode != "ABC123" {
+		t.Errorf("links.json = %s (%v)", files["links.json"], err)
+	}
+	var clicks []struct {
+		ShortCode string `json:"short_code"`
+	}
+	if err := json.Unmarshal([]byte(files["clicks.json"]), &clicks); err != nil || len(clicks) != 5 || clicks[0].ShortCode != "ABC123" {
+		t.Errorf("clicks.json has %d clicks (%v), want the fixture's 5", len(clicks), err)
+	}
+	if rows := strings.Count(strings.TrimSpace(files["clicks.csv"]), "\n"); rows != 5 {
+		t.Errorf("clicks.csv has %d rows, want 5", rows)
+	}
+}
+
+// TestDeleteAccountTransfersLinks deletes an account, handing its links to
+// another, and checks the deleted account can no longer sign in.
+func TestDeleteAccountTransfersLinks(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	token := extractCSRF(t, b.get("/settings/account").Body.String())
+
+	form := url.Values{
+		"confirm": {"alice"}, "transfer_to": {"nobody"},
+		"current_password": {"alice-password"}, "csrf_token": {token},
+	}
+	rec := b.post("/settings/account/delete", form)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "No account has that username") {
+		t.Fatalf("an unknown heir returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	form.Set("transfer_to", "bob")
+	form.Set("confirm", "Alice")
+	if rec = b.post("/settings/account/delete", form); rec.Code != http.StatusOK {
+		t.Fatalf("a wrong confirmation returned %d", rec.Code)
+	}
+	form.Set("confirm", "alice")
+	rec = b.post("/settings/account/delete", form)
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || loc != "/" {
+		t.Fatalf("delete = %d Location %q\n%s", rec.Code, loc, truncateBody(rec.Body.String()))
+	}
+
+	if _, err := db.UserByLogin(ctx, "alice"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("the account survived: %v", err)
+	}
+	bob, err := db.UserByLogin(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := db.URLByShortCode(ctx, "ABC123")
+	if err != nil || link.UserID == nil || *link.UserID != bob.ID {
+		t.Errorf("ABC123 = %+v, %v; want it transferred to bob", link, err)
+	}
+	if rec = b.get("/dashboard"); rec.Code != http.StatusSeeOther {
+		t.Errorf("the deleted account's session still reached the dashboard (%d)", rec.Code)
+	}
+}
+
+// postFile submits a multipart form with one file field, as the import page
+// does.
+func (b *browser) postFile(path string, fields url.Values, name, content string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, vs := range fields {
+		for _, v := range vs {
+			_ = mw.WriteField(k, v)
+		}
+	}
+	fw, _ := mw.CreateFormFile(name, "links.csv")
+	_, _ = io.WriteString(fw, content)
+	_ = mw.Close()
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return b.do(req)
+}
+
+// TestImportPreviewThenCreate previews a CSV import, checks nothing was
+// created and each row got its outcome, then imports it for real.
+func TestImportPreviewThenCreate(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	token := extractCSRF(t, b.get("/import").Body.String())
+
+	const file = "long_url,custom_code,expiry_hours,rotate_targets\n" +
+		"https://one.example/,IMPORT1,0,https://alt1.example/ https://alt2.example/\n" +
+		"not-a-url,,,\n" +
+		"https://two.example/,ABC123,,\n" +
+		"https://three.example/,IMPORT1,,\n"
+
+	rec := b.postFile("/import", url.Values{"csrf_token": {token}, "dry_run": {"1"}}, "file", file)
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "1 ready to import") {
+		t.Fatalf("preview returned %d\n%s", rec.Code, truncateBody(body))
+	}
+	for _, want := range []string{"2 skipped", "1 failed", "long_url: Invalid URL", "already taken", "appears earlier in the file", "data-report="} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the preview is missing %q", want)
+		}
+	}
+	if taken, _ := db.ShortCodeTaken(ctx, "IMPORT1"); taken {
+		t.Fatal("the preview created a link")
+	}
+
+	rec = b.postFile("/import", url.Values{"csrf_token": {token}}, "file", file)
+	if body = rec.Body.String(); !strings.Contains(body, "1 created") {
+		t.Fatalf("import returned %d\n%s", rec.Code, truncateBody(body))
+	}
+	link, err := db.URLByShortCode(ctx, "IMPORT1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := db.UserByLogin(ctx, "alice")
+	if link.UserID == nil || *link.UserID != alice.ID || link.ExpiresAt != nil || len(link.RotateTargets) != 2 {
+		t.Errorf("imported link = %+v", link)
+	}
+}
+
+// TestAPIImport imports JSON through the API and reads the report back both
+// as JSON and as CSV.
+func TestAPIImport(t *testing.T) {
+	srv, db := newTestServer(t)
+	const key = "11111111-2222-3333-4444-555555555555"
+	post := func(query, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/import"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-KEY", key)
+		req.Host = "short.example.com"
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("", `[{"long_url": "https://api-import.example/", "custom_code": "APIIMP", "password": "pw", "start_at": "2030-01-01T00:00:00Z"},
+		{"long_url": "https://api-import.example/b", "expiry_hours": -1}]`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import returned %d\n%s", rec.Code, rec.Body.String())
+	}
+	var report struct {
+		Created, Failed int
+		Rows            []struct {
+			Status   string `json:"status"`
+			ShortURL string `json:"short_url"`
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Created != 1 || report.Failed != 1 || report.Rows[0].ShortURL != "https://short.example.com/APIIMP" {
+		t.Errorf("report = %+v", report)
+	}
+	link, err := db.URLByShortCode(context.Background(), "APIIMP")
+	if err != nil || !link.IsPasswordProtected() || link.StartAt == nil || link.StartAt.Year() != 2030 {
+		t.Errorf("imported link = %+v, %v", link, err)
+	}
+
+	rec = post("?dry_run=1&report=csv", `[{"long_url": "https://api-import.example/c"}]`)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") || !strings.Contains(rec.Body.String(), "1,valid,https://api-import.example/c") {
+		t.Errorf("CSV report = %q\n%s", ct, rec.Body.String())
+	}
+	if rec = post("", `not json`); rec.Code != http.StatusBadRequest {
+		t.Errorf("a malformed body returned %d", rec.Code)
+	}
+}
+
+// TestExportClicks downloads the click log of one link and of the account,
+// with and without a date range, and checks another account's link is not
+// reachable through it.
+func TestExportClicks(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	link, err := db.URLByShortCode(ctx, "ABC123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []string{"2031-03-01T10:00:00Z", "2031-03-02T23:59:00Z", "2031-03-03T00:00:00Z"} {
+		at, _ := time.Parse(time.RFC3339, ts)
+		if err := db.RecordClick(ctx, &store.Click{URLID: link.ID, Timestamp: at, IPAddress: "203.0.113.0", Country: "DE"}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+
+	rec := b.get("/export-clicks")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("account export returned %d %q\n%s", rec.Code, rec.Header().Get("Content-Type"), truncateBody(rec.Body.String()))
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 9 || lines[0] != "short_code,timestamp,ip_address,country,browser,platform,referrer,traffic,region,city,network,device,os_version,browser_version,language,channel,utm_source,utm_medium,utm_campaign" {
+		t.Errorf("account export has %d lines, want a header and 8 clicks:\n%s", len(lines), rec.Body.String())
+	}
+
+	rec = b.get("/export-clicks?code=abc123&from=2031-03-01&to=2031-03-02&format=ndjson")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" ||
+		!strings.Contains(rec.Header().Get("Content-Disposition"), "clicks-ABC123.ndjson") {
+		t.Fatalf("link export returned %d %q %q", rec.Code, rec.Header().Get("Content-Type"), rec.Header().Get("Content-Disposition"))
+	}
+	var got []exportClick
+	dec := json.NewDecoder(rec.Body)
+	for dec.More() {
+		var c exportClick
+		if err := dec.Decode(&c); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, c)
+	}
+	if len(got) != 2 || got[1].Timestamp.Day() != 2 || got[0].IPAddress != "203.0.113.0" {
+		t.Errorf("clicks from the 1st to the 2nd = %+v, want the two on those days", got)
+	}
+
+	if rec = b.get("/export-clicks?code=NOEXPIRE"); rec.Code != http.StatusNotFound {
+		t.Errorf("exporting bob's link returned %d, want 404", rec.Code)
+	}
+	if rec = b.get("/export-clicks?from=2031-03-05&to=2031-03-01"); rec.Code != http.StatusSeeOther {
+		t.Errorf("a backwards range returned %d, want a redirect with a warning", rec.Code)
+	}
+}
+
+// TestAPIClicksPagination pages through a link's clicks over the API and
+// checks every click is returned once, in order.
+func TestAPIClicksPagination(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	link, err := db.URLByShortCode(ctx, "ABC123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := db.RecordClick(ctx, &store.Click{URLID: link.ID, Country: "DE"}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-API-KEY", "11111111-2222-3333-4444-555555555555")
+		req.Host = "short.example.com"
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var (
+		pages, rows int
+		cursor      string
+	)
+	for {
+		rec := get("/api/v1/ABC123/clicks?limit=4&cursor=" + cursor)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("page %d returned %d %q\n%s", pages+1, rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+		}
+		pages++
+		rows += strings.Count(rec.Body.String(), "\n")
+		next := rec.Header().Get("X-Next-Cursor")
+		if next == "" {
+			if rec.Header().Get("Link") != "" {
+				t.Error("the last page still has a Link header")
+			}
+			break
+		}
+		if !strings.Contains(rec.Header().Get("Link"), "cursor="+next) {
+			t.Errorf("Link = %q, want the next cursor %s", rec.Header().Get("Link"), next)
+		}
+		if pages > 5 {
+			t.Fatal("the cursor does not advance")
+		}
+		cursor = next
+	}
+	if pages != 3 || rows != 10 {
+		t.Errorf("paged %d clicks over %d pages, want the 10 clicks over 3", rows, pages)
+	}
+
+	rec := get("/api/v1/clicks?format=csv")
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") || strings.Count(rec.Body.String(), "\n") != 11 {
+		t.Errorf("account CSV = %d %q\n%s", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	if rec = get("/api/v1/NOEXPIRE/clicks"); rec.Code != http.StatusNotFound {
+		t.Errorf("bob's link returned %d, want 404", rec.Code)
+	}
+	if rec = get("/api/v1/clicks?limit=100000"); rec.Code != http.StatusBadRequest {
+		t.Errorf("an oversized page returned %d, want 400", rec.Code)
+	}
+}
+
+// TestAdminMigration checks the admin import is for ADMIN_USERS only, that a
+// listed name nobody holds yet cannot be registered, and that an export is
+// moved into the chosen account with its codes kept.
+func TestAdminMigration(t *testing.T) {
+	srv, db := newTestServer(t, func(c *config.Config) { c.AdminUsers = []string{"alice", "Root"} })
+	ctx := context.Background()
+
+	rec := get(t, srv, "/register")
+	visitor := &browser{srv: srv, cookie: sessionCookie(t, rec.Result())}
+	token := extractCSRF(t, rec.Body.String())
+	for _, name := range []string{"root", "carol"} {
+		visitor.post("/register", url.Values{
+			"username": {name}, "email": {name + "@example.com"}, "password": {"carol-password"}, "csrf_token": {token},
+		})
+	}
+	if taken, _ := db.UsernameTaken(ctx, "root"); taken {
+		t.Error("an administrator's reserved name could be registered")
+	}
+	carol := &browser{srv: srv, cookie: login(t, srv, "carol", "carol-password")}
+	if rec := carol.get("/admin/import"); rec.Code != http.StatusNotFound {
+		t.Errorf("a non-admin got the admin import with %d", rec.Code)
+	}
+
+	admin := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	rec = admin.get("/admin/import")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `href="/admin/import"`) {
+		t.Fatalf("admin import returned %d without the nav link", rec.Code)
+	}
+	token = extractCSRF(t, rec.Body.String())
+	const export = "Title,Bitlink,Long URL,Created,Tags,Clicks\n" +
+		"Launch,bit.ly/Launch1,https://launch.example/,2022-01-02 03:04:05,news,31\n" +
+		"Old,bit.ly/abc123,https://old.example/,2022-01-02 03:04:05,,4\n"
+	rec = admin.postFile("/admin/import", url.Values{"csrf_token": {token}, "source": {"bitly"}, "owner": {"carol"}}, "file", export)
+	body := rec.Body.String()
+	if !strings.Contains(body, "1 created") || !strings.Contains(body, "1 conflicting") {
+		t.Fatalf("migration returned %d\n%s", rec.Code, truncateBody(body))
+	}
+	link, err := db.URLByShortCode(ctx, "LAUNCH1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, _ := db.UserByLogin(ctx, "carol")
+	if link.UserID == nil || *link.UserID != owner.ID || link.ClicksCount != 31 || link.Title != "Launch" {
+		t.Errorf("migrated link = %+v", link)
+	}
+	if dash := carol.get("/dashboard").Body.String(); !strings.Contains(dash, "Launch") || !strings.Contains(dash, "news") {
+		t.Error("the dashboard does not show the migrated title and tags")
+	}
+}
+
+// TestUniqueVisitorsInStatsAPI redirects the same visitor repeatedly and
+// checks the stats API counts them once among the clicks.
+func TestUniqueVisitorsInStatsAPI(t *testing.T) {
+	srv, db := newTestServer(t, func(c *config.Config) { c.UniqueVisitorWindow = 60 })
+	ctx := context.Background()
+	alice, err := db.UserByAPIKey(ctx, "11111111-2222-3333-4444-555555555555")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &store.URL{
+		ShortCode: "UNIQUE1", LongURL: "https://unique.example.com/",
+		UserID: &alice.ID, StatsEnabled: true, IsEnabled: true,
+	}
+	if err := db.CreateURL(ctx, link, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	for _, ua := range []string{"Firefox/1", "Firefox/1", "Firefox/1", "Safari/2"} {
+		req := httptest.NewRequest(http.MethodGet, "/UNIQUE1", nil)
+		req.Host = "short.example.com"
+		req.Header.Set("User-Agent", ua)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("redirect returned %d", rec.Code)
+		}
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-API-KEY", alice.APIKey)
+		req.Host = "short.example.com"
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := get("/api/v1/UNIQUE1/stats?range=24h")
+	var body struct {
+		Clicks       int64 `json:"clicks"`
+		UniqueClicks int64 `json:"unique_clicks"`
+		Granularity  string
+		Series       []struct {
+			Bucket string
+			Clicks int64
+			Unique int64
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("stats returned %d: %v\n%s", rec.Code, err, rec.Body.String())
+	}
+	if body.Clicks != 4 || body.UniqueClicks != 2 || body.Granularity != "hour" {
+		t.Errorf("stats = %d clicks, %d unique by %s; want 4, 2 by hour", body.Clicks, body.UniqueClicks, body.Granularity)
+	}
+	var clicks, unique int64
+	for _, p := range body.Series {
+		clicks += p.Clicks
+		unique += p.Unique
+	}
+	if len(body.Series) != 24 || clicks != 4 || unique != 2 {
+		t.Errorf("series of %d buckets sums to %d/%d, want 24 summing to 4/2", len(body.Series), clicks, unique)
+	}
+
+	if rec = get("/api/v1/NOEXPIRE/stats"); rec.Code != http.StatusNotFound {
+		t.Errorf("bob's link returned %d, want 404", rec.Code)
+	}
+	if rec = get("/api/v1/UNIQUE1/stats?range=custom&from=2026-02-01&to=2026-01-01"); rec.Code != http.StatusBadRequest {
+		t.Errorf("a reversed range returned %d, want 400", rec.Code)
+	}
+}
+
+func TestAccountAnalytics(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	alice, err := db.UserByAPIKey(ctx, "11111111-2222-3333-4444-555555555555")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []struct {
+		code     string
+		tags     []string
+		referrer string
+		clicks   int
+	}{
+		{"PROMO1", []string{"promo"}, "https://news.example/a", 3},
+		{"PROMO2", []string{"promo"}, "https://news.example/b", 1},
+		{"OTHER1", nil, "", 2},
+	} {
+		link := &store.URL{ShortCode: l.code, LongURL: "https://example.com/" + l.code,
+			UserID: &alice.ID, Tags: l.tags, StatsEnabled: true, IsEnabled: true}
+		if err := db.CreateURL(ctx, link, store.SystemActor("test")); err != nil {
+			t.Fatal(err)
+		}
+		for range l.clicks {
+			c := &store.Click{URLID: link.ID, Timestamp: time.Now().Add(-time.Hour),
+				Country: "AT", Platform: "Linux", Referrer: l.referrer, Traffic: store.TrafficHuman}
+			if err := db.RecordClick(ctx, c, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	api := func(path string) (int, map[string]any) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-API-KEY", alice.APIKey)
+		req.Host = "short.example.com"
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		var body map[string]any
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+	code, body := api("/api/v1/analytics?range=24h")
+	if code != http.StatusOK || body["clicks"] != 6.0 {
+		t.Fatalf("analytics returned %d with %v clicks, want 200 with 6", code, body["clicks"])
+	}
+	top, _ := body["top_links"].([]any)
+	if len(top) != 3 || top[0].(map[string]any)["short_code"] != "PROMO1" {
+		t.Errorf("top links = %v, want PROMO1 first of 3", top)
+	}
+	refs, _ := body["referrers"].([]any)
+	if len(refs) != 2 || refs[0].(map[string]any)["label"] != "news.example" || refs[0].(map[string]any)["clicks"] != 4.0 {
+		t.Errorf("referrers = %v, want news.example's two paths merged first", refs)
+	}
+
+	code, body = api("/api/v1/analytics?range=24h&tag=promo")
+	if code != http.StatusOK || body["clicks"] != 4.0 || body["tag"] != "promo" {
+		t.Errorf("tagged analytics returned %d: %v clicks for %v, want 4 for promo", code, body["clicks"], body["tag"])
+	}
+	if code, _ = api("/api/v1/analytics?traffic=bots"); code != http.StatusBadRequest {
+		t.Errorf("bad traffic returned %d, want 400", code)
+	}
+
+	if rec := get(t, srv, "/analytics"); rec.Code != http.StatusSeeOther {
+		t.Errorf("signed out, analytics returned %d, want a redirect to log in", rec.Code)
+	}
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	rec := b.get("/analytics?range=24h&tag=promo")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("analytics page returned %d\n%s", rec.Code, truncateBody(rec.Body.String()))
+	}
+	page := rec.Body.String()
+	for _, want := range []string{"PROMO1", `<option value="promo" selected>`, "/analytics?range=7d&amp;tag=promo"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("analytics page is missing %q", want)
+		}
+	}
+	if strings.Contains(page, "OTHER1") {
+		t.Error("analytics page for a tag lists an untagged link")
+	}
+}
+
+// TestTrafficClassification clicks a link as a person, a bot, the operator's
+// network, the owner's own network and the signed-in owner, and checks the
+// stats count only the person unless asked for all traffic.
+func TestTrafficClassification(t *testing.T) {
+	srv, db := newTestServer(t, func(c *config.Config) {
+		_, office, _ := net.ParseCIDR("198.51.100.0/24")
+		c.InternalNetworks = []*net.IPNet{office}
+	})
+	ctx := context.Background()
+	alice, err := db.UserByAPIKey(ctx, "11111111-2222-3333-4444-555555555555")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &store.URL{
+		ShortCode: "TRAFFIC1", LongURL: "https://traffic.example.com/",
+		UserID: &alice.ID, StatsEnabled: true, IsEnabled: true,
+	}
+	if err := db.CreateURL(ctx, link, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	token := extractCSRF(t, b.get("/settings/account").Body.String())
+	if rec := b.post("/settings/account/networks", url.Values{"networks": {"203.0.113.0/24\nnot-a-network"}, "csrf_token": {token}}); !strings.Contains(rec.Body.String(), "not-a-network is not an IP address") {
+		t.Errorf("an invalid network was not refused: %d", rec.Code)
+	}
+	if rec := b.post("/settings/account/networks", url.Values{"networks": {"203.0.113.0/24, 2001:db8::1"}, "csrf_token": {token}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("saving the networks returned %d", rec.Code)
+	}
+	if user, _ := db.UserByID(ctx, alice.ID); strings.Join(user.ExcludedNetworks, " ") != "203.0.113.0/24 2001:db8::1/128" {
+		t.Fatalf("excluded networks = %q", user.ExcludedNetworks)
+	}
+
+	const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+	click := func(remote, ua string, owner bool) {
+		req := httptest.NewRequest(http.MethodGet, "/TRAFFIC1", nil)
+		req.RemoteAddr = remote + ":4321"
+		req.Header.Set("User-Agent", ua)
+		var rec *httptest.ResponseRecorder
+		if owner {
+			rec = b.do(req)
+		} else {
+			req.Host = "short.example.com"
+			rec = httptest.NewRecorder()
+			srv.ServeHTTP(rec, req)
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("redirect returned %d", rec.Code)
+		}
+	}
+	click("192.0.2.10", firefox, false)
+	click("192.0.2.11", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", false)
+	click("192.0.2.12", "", false)
+	click("198.51.100.7", firefox, false)
+	click("203.0.113.9", firefox, false)
+	click("192.0.2.13", firefox, true)
+
+	want := map[string]int{store.TrafficHuman: 1, store.TrafficBot: 2, store.TrafficInternal: 3}
+	got := map[string]int{}
+	if err := db.EachClick(ctx, store.ClickFilter{UserID: alice.ID, URLID: link.ID}, func(c *store.Click) error {
+		got[c.Traffic]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("traffic = %v, want %v", got, want)
+	}
+
+	stats := func(query string) (int, int64) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/TRAFFIC1/stats"+query, nil)
+		req.Header.Set("X-API-KEY", alice.APIKey)
+		req.Host = "short.example.com"
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		var body struct{ Clicks int64 }
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body.Clicks
+	}
+	if code, n := stats("?range=24h"); code != http.StatusOK || n != 1 {
+		t.Errorf("human stats = %d, %d clicks; want 1", code, n)
+	}
+	if code, n := stats("?range=24h&traffic=all"); code != http.StatusOK || n != 6 {
+		t.Errorf("all-traffic stats = %d, %d clicks; want 6", code, n)
+	}
+	if code, _ := stats("?traffic=robots"); code != http.StatusBadRequest {
+		t.Errorf("an unknown traffic filter returned %d, want 400", code)
+	}
+
+	body := b.get("/TRAFFIC1/stats?range=7d&traffic=all").Body.String()
+	if !strings.Contains(body, ">Bot<") || !strings.Contains(body, ">Internal<") || !strings.Contains(body, "range=24h&amp;traffic=all") {
+		t.Errorf("the all-traffic stats page lacks the classes or the toggle:\n%s", truncateBody(body))
+	}
+	if body = b.get("/TRAFFIC1/stats").Body.String(); strings.Contains(body, ">Bot<") {
+		t.Error("the human stats page lists a bot click")
+	}
+}
+
+// TestDataUsageStatesRetention checks the data-usage page tells visitors how
+// long their individual clicks are kept.
+func TestDataUsageStatesRetention(t *testing.T) {
+	srv, _ := newTestServer(t)
+	if body := get(t, srv, "/data-usage").Body.String(); !strings.Contains(body, "kept for as long as their link exists") {
+		t.Errorf("without a retention the page does not say clicks are kept:\n%s", truncateBody(body))
+	}
+	srv, _ = newTestServer(t, func(c *config.Config) { c.ClickRetentionDays = 90 })
+	if body := get(t, srv, "/data-usage").Body.String(); !strings.Contains(body, "deleted after 90 days") {
+		t.Errorf("the page does not state the 90-day retention:\n%s", truncateBody(body))
+	}
+}
+
+func TestStatsShowPlacesWhenResolved(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	link := &store.URL{ShortCode: "PLACES1", LongURL: "https://places.example.com/", StatsEnabled: true, IsEnabled: true}
+	if err := db.CreateURL(ctx, link, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	record := func(c store.Click) {
+		t.Helper()
+		c.URLID, c.Timestamp, c.Country = link.ID, time.Now().Add(-time.Hour), "Austria"
+		if err := db.RecordClick(ctx, &c, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record(store.Click{})
+	if body := get(t, srv, "/PLACES1/stats").Body.String(); strings.Contains(body, "Top Cities") {
+		t.Error("the stats page lists cities no click has")
+	}
+	record(store.Click{Region: "Tyrol", City: "Innsbruck", Network: "AS64496 Example Networks"})
+	body := get(t, srv, "/PLACES1/stats").Body.String()
+	for _, want := range []string{"Top Regions", "Innsbruck, Tyrol", "AS64496 Example Networks"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the stats page is missing %q", want)
+		}
+	}
+}
+
+func TestDataUsageStatesGeolocation(t *testing.T) {
+	withCity := func(c *config.Config) { c.GeoIPCityDBPath = "/usr/share/GeoIP/GeoLite2-City.mmdb" }
+	srv, _ := newTestServer(t, withCity)
+	if body := get(t, srv, "/data-usage").Body.String(); !strings.Contains(body, "country, region and city") {
+		t.Errorf("with a city database the page does not say cities are recorded:\n%s", truncateBody(body))
+	}
+	srv, _ = newTestServer(t, withCity, func(c *config.Config) { c.GeoIPCoarseOnly = true })
+	if body := get(t, srv, "/data-usage").Body.String(); strings.Contains(body, "region") || !strings.Contains(body, "Country level only") {
+		t.Errorf("with coarse-only geolocation the page still mentions regions:\n%s", truncateBody(body))
+	}
+}
+
+func TestClickQueueWritesOnShutdown(t *testing.T) {
+	srv, db := newTestServer(t, func(c *config.Config) {
+		c.ClickQueueSize = 100
+		c.ClickBatchSize = 2
+		c.ClickFlushInterval = 60
+	})
+	ctx := context.Background()
+	link := &store.URL{ShortCode: "QUEUED1", LongURL: "https://queued.example.com/", StatsEnabled: true, IsEnabled: true}
+	if err := db.CreateURL(ctx, link, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	redirect := func() {
+		t.Helper()
+		if rec := get(t, srv, "/QUEUED1"); rec.Code != http.StatusOK {
+			t.Fatalf("redirect returned %d", rec.Code)
+		}
+	}
+	for range 3 {
+		redirect()
+	}
+
+	// The third redirect waits for the next batch, which shutdown writes.
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.URLByShortCode(ctx, "QUEUED1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ClicksCount != 3 || got.LastAccessedAt == nil {
+		t.Errorf("after shutdown: %d clicks, last accessed %v; want 3 and a time", got.ClicksCount, got.LastAccessedAt)
+	}
+
+	// Redirects still work once the queue is closed, but go unrecorded.
+	redirect()
+	body := get(t, srv, "/metrics").Body.String()
+	for _, want := range []string{
+		`redrx_clicks_written_total 3`,
+		`redrx_clicks_dropped_total{reason="closed"} 1`,
+		`redrx_click_queue_capacity 100`,
+		`redrx_click_batch_size_count 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+}
+
+func TestRedirectCacheFollowsChanges(t *testing.T) {
+	srv, db := newTestServer(t, func(c *config.Config) {
+		c.LinkCacheSize = 100
+		c.LinkCacheTTL = 3600
+	})
+	ctx := context.Background()
+	if rec := get(t, srv, "/CACHED1"); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown code returned %d", rec.Code)
+	}
+
+	// Creating the link replaces the cached miss.
+	link := &store.URL{ShortCode: "CACHED1", LongURL: "https://before.example.com/", IsEnabled: true}
+	if err := db.CreateURL(ctx, link, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	rec := get(t, srv, "/CACHED1")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "https://before.example.com/") {
+		t.Fatalf("new link returned %d: %s", rec.Code, truncateBody(rec.Body.String()))
+	}
+
+	link.LongURL = "https://after.example.com/"
+	if err := db.UpdateURL(ctx, link, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(t, srv, "/CACHED1"); !strings.Contains(rec.Body.String(), "https://after.example.com/") {
+		t.Errorf("edited link still redirects to the old destination: %s", truncateBody(rec.Body.String()))
+	}
+
+	if err := db.SetURLEnabled(ctx, link.ID, false, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(t, srv, "/CACHED1"); rec.Code != http.StatusGone {
+		t.Errorf("paused link returned %d, want 410", rec.Code)
+	}
+	if err := db.DeleteURL(ctx, link.ID, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(t, srv, "/CACHED1"); rec.Code != http.StatusNotFound {
+		t.Errorf("deleted link returned %d, want 404", rec.Code)
+	}
+}
+
+func TestClickAudienceFields(t *testing.T) {
+	const (
+		iphone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1"
+		ipad    = "Mozilla/5.0 (iPad; CPU OS 16_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Mobile/15E148 Safari/604.1"
+		windows = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+	)
+	for _, tc := range []struct {
+		ua, traffic, device, os, browser string
+	}{
+		{iphone, store.TrafficHuman, store.DeviceMobile, "iOS 17.4", "Safari 17"},
+		{ipad, store.TrafficHuman, store.DeviceTablet, "iOS 16", "Safari 16"},
+		{windows, store.TrafficHuman, store.DeviceDesktop, "Windows 10", "Chrome 126"},
+		{windows, store.TrafficBot, store.DeviceBot, "Windows 10", "Chrome 126"},
+	} {
+		ua := useragent.Parse(tc.ua)
+		if got := deviceClass(ua, tc.traffic); got != tc.device {
+			t.Errorf("deviceClass(%.40q, %s) = %q, want %q", tc.ua, tc.traffic, got, tc.device)
+		}
+		if got := osVersion(ua); got != tc.os {
+			t.Errorf("osVersion(%.40q) = %q, want %q", tc.ua, got, tc.os)
+		}
+		if got := browserVersion(ua); got != tc.browser {
+			t.Errorf("browserVersion(%.40q) = %q, want %q", tc.ua, got, tc.browser)
+		}
+	}
+
+	for header, want := range map[string]string{
+		"":                         "",
+		"de-at,de;q=0.9,en;q=0.8":  "de-AT",
+		"en;q=0.5, fr":             "fr",
+		"*":                        "",
+		"*, pt-br;q=0.7":           "pt-BR",
+		"not a language!":          "",
+		strings.Repeat("en,", 500): "",
+	} {
+		if got := preferredLanguage(header); got != want {
+			t.Errorf("preferredLanguage(%.40q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestStatsShowAudience(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	link := &store.URL{ShortCode: "AUDNCE1", LongURL: "https://audience.example.com/", StatsEnabled: true, IsEnabled: true}
+	if err := db.CreateURL(ctx, link, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/AUDNCE1", nil)
+	req.Host = "short.example.com"
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36")
+	req.Header.Set("Accept-Language", "de-AT,de;q=0.9")
+	srv.ServeHTTP(httptest.NewRecorder(), req)
+
+	recent, err := db.RecentClicks(ctx, link.ID, 1, false)
+	if err != nil || len(recent) != 1 {
+		t.Fatalf("recent clicks = %v, %v", recent, err)
+	}
+	if c := recent[0]; c.Device != store.DeviceMobile || c.OSVersion != "Android 14" || c.BrowserVersion != "Chrome 126" || c.Language != "de-AT" {
+		t.Errorf("recorded click = %+v, want a mobile Android 14, Chrome 126, de-AT visit", c)
+	}
+	body := get(t, srv, "/AUDNCE1/stats").Body.String()
+	for _, want := range []string{"deviceChart", "languageChart", `"de-AT"`, `"Android 14"`, `"Chrome 126"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the stats page is missing %s", want)
+		}
+	}
+}
+
+func TestRedirectRecordsChannel(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	alice, err := db.UserByAPIKey(ctx, "11111111-2222-3333-4444-555555555555")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &store.URL{
+		ShortCode: "CHANNEL1", LongURL: "https://channel.example.com/",
+		UserID: &alice.ID, StatsEnabled: true, IsEnabled: true,
+	}
+	if err := db.CreateURL(ctx, link, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	visit := func(path, referrer string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = "short.example.com"
+		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0")
+		if referrer != "" {
+			req.Header.Set("Referer", referrer)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("redirect returned %d", rec.Code)
+		}
+	}
+	visit("/CHANNEL1?utm_source=newsletter&utm_medium=email&utm_campaign=june", "")
+	visit("/CHANNEL1", "https://www.google.de/")
+	visit("/CHANNEL1", "")
+
+	recent, err := db.RecentClicks(ctx, link.ID, 10, false)
+	if err != nil || len(recent) != 3 {
+		t.Fatalf("recent clicks = %v, %v", recent, err)
+	}
+	if c := recent[2]; c.Channel != "email" || c.UTMSource != "newsletter" || c.UTMMedium != "email" || c.UTMCampaign != "june" {
+		t.Errorf("tagged click = %+v, want the email channel and its UTM values", c)
+	}
+	if c := recent[1]; c.Channel != "search" || c.UTMCampaign != "" {
+		t.Errorf("click from Google = %+v, want the search channel", c)
+	}
+
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	body := b.get("/CHANNEL1/stats").Body.String()
+	for _, want := range []string{"channelChart", "UTM Campaigns", "june"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the stats page is missing %q", want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/CHANNEL1/stats?range=24h", nil)
+	req.Header.Set("X-API-KEY", alice.APIKey)
+	req.Host = "short.example.com"
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	var stats struct {
+		Channels []analyticsCount `json:"channels"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("stats returned %d: %v\n%s", rec.Code, err, rec.Body.String())
+	}
+	want := []analyticsCount{{"direct", 1}, {"email", 1}, {"search", 1}}
+	if !slices.Equal(stats.Channels, want) {
+		t.Errorf("channels = %v, want %v", stats.Channels, want)
+	}
+}
+
+func TestRequestsAreTraced(t *testing.T) {
+	if _, err := telemetry.Setup(context.Background(), telemetry.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+
+	srv, db := newTestServer(t)
+	link := &store.URL{ShortCode: "TRACED1", LongURL: "https://traced.example.com/", StatsEnabled: true, IsEnabled: true}
+	if err := db.CreateURL(context.Background(), link, store.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parent  = "00f067aa0ba902b7"
+	)
+	req := httptest.NewRequest(http.MethodGet, "/TRACED1", nil)
+	req.Host = "short.example.com"
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parent+"-01")
+	srv.ServeHTTP(httptest.NewRecorder(), req)
+
+	names := map[string]bool{}
+	for _, span := range spans.Ended() {
+		if span.SpanContext().TraceID().String() != traceID {
+			continue
+		}
+		names[span.Name()] = true
+		if span.Name() == "GET /{code}" && span.Parent().SpanID().String() != parent {
+			t.Errorf("the request span's parent is %s, want the caller's %s", span.Parent().SpanID(), parent)
+		}
+	}
+	for _, want := range []string{"GET /{code}", "geo.locate", "sql.conn.query", "sql.conn.exec"} {
+		if !names[want] {
+			t.Errorf("no %q span in the redirect's trace; got %v", want, slices.Sorted(maps.Keys(names)))
+		}
+	}
+}
+
+// TestDisabledAccount checks a disabled account loses its session, its API
+// key and the sign-in form, and gets them back when enabled again.
+func TestDisabledAccount(t *testing.T) {
+	srv, db := newTestServer(t)
+	ctx := context.Background()
+	alice, err := db.UserByLogin(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	apiGet := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/analytics", nil)
+		req.Header.Set("X-API-KEY", alice.APIKey)
+		req.Host = "short.example.com"
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if err := db.SetUserDisabled(ctx, alice.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if rec := b.get("/dashboard"); rec.Code != http.StatusSeeOther {
+		t.Errorf("a disabled account's session still opened the dashboard: %d", rec.Code)
+	}
+	if code := apiGet(); code != http.StatusUnauthorized {
+		t.Errorf("a disabled account's API key returned %d, want 401", code)
+	}
+	rec := get(t, srv, "/login")
+	visitor := &browser{srv: srv, cookie: sessionCookie(t, rec.Result())}
+	rec = visitor.post("/login", url.Values{
+		"username": {"alice"}, "password": {"alice-password"}, "csrf_token": {extractCSRF(t, rec.Body.String())},
+	})
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "This account has been disabled.") {
+		t.Errorf("signing in to a disabled account returned %d", rec.Code)
+	}
+
+	if err := db.SetUserDisabled(ctx, alice.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	login(t, srv, "alice", "alice-password")
+	if code := apiGet(); code != http.StatusOK {
+		t.Errorf("the API key of a re-enabled account returned %d", code)
+	}
+}
+
+// TestStoredAdminFlag checks an account made admin from the command line
+// opens the admin pages without being listed in ADMIN_USERS.
+func TestStoredAdminFlag(t *testing.T) {
+	srv, db := newTestServer(t)
+	alice, err := db.UserByLogin(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &browser{srv: srv, cookie: login(t, srv, "alice", "alice-password")}
+	if rec := b.get("/admin/import"); rec.Code != http.StatusNotFound {
+		t.Fatalf("admin import returned %d before alice was an admin", rec.Code)
+	}
+	if err := db.SetUserAdmin(context.Background(), alice.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if rec := b.get("/admin/import"); rec.Code != http.StatusOK {
+		t.Errorf("admin import returned %d for an admin", rec.Code)
+	}
+}
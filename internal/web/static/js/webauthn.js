@@ -0,0 +1,142 @@
+// WebAuthn ceremonies for security keys and passkeys.
+//
+// Each button carries data-webauthn (register, login, passkey or reauth) and
+// the begin/finish endpoints. The server answers begin with the options for
+// navigator.credentials, and finish with JSON describing what to do next. A
+// reauth button has no finish: its assertion is posted with the account form
+// it confirms.
+
+(() => {
+    if (!window.PublicKeyCredential) {
+        document.querySelectorAll('[data-webauthn]').forEach((el) => { el.hidden = true; });
+        return;
+    }
+
+    const toBuffer = (value) => {
+        const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+        const binary = atob(base64 + '='.repeat((4 - base64.length % 4) % 4));
+        return Uint8Array.from(binary, (c) => c.charCodeAt(0)).buffer;
+    };
+
+    const toBase64url = (buffer) => {
+        const bytes = new Uint8Array(buffer);
+        let binary = '';
+        bytes.forEach((b) => { binary += String.fromCharCode(b); });
+        return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    };
+
+    const post = async (url, csrf, body) => {
+        const response = await fetch(url, {
+            method: 'POST',
+            credentials: 'same-origin',
+            headers: { 'Content-Type': 'application/json', 'X-CSRFToken': csrf },
+            body: body === undefined ? undefined : JSON.stringify(body),
+        });
+        const payload = await response.json().catch(() => ({}));
+        if (!response.ok) {
+            throw new Error(payload.error || 'The request failed. Please try again.');
+        }
+        return payload;
+    };
+
+    const descriptors = (list) => (list || []).map((c) => ({ ...c, id: toBuffer(c.id) }));
+
+    const register = async (options) => {
+        const publicKey = options.publicKey;
+        publicKey.challenge = toBuffer(publicKey.challenge);
+        publicKey.user.id = toBuffer(publicKey.user.id);
+        publicKey.excludeCredentials = descriptors(publicKey.excludeCredentials);
+        const credential = await navigator.credentials.create({ publicKey });
+        return {
+            id: credential.id,
+            rawId: toBase64url(credential.rawId),
+            type: credential.type,
+            response: {
+                attestationObject: toBase64url(credential.response.attestationObject),
+                clientDataJSON: toBase64url(credential.response.clientDataJSON),
+                transports: credential.response.getTransports ? credential.response.getTransports() : [],
+            },
+            clientExtensionResults: credential.getClientExtensionResults(),
+        };
+    };
+
+    const assert = async (options) => {
+        const publicKey = options.publicKey;
+        publicKey.challenge = toBuffer(publicKey.challenge);
+        publicKey.allowCredentials = descriptors(publicKey.allowCredentials);
+        const credential = await navigator.credentials.get({ publicKey });
+        const response = credential.response;
+        return {
+            id: credential.id,
+            rawId: toBase64url(credential.rawId),
+            type: credential.type,
+            response: {
+                authenticatorData: toBase64url(response.authenticatorData),
+                clientDataJSON: toBase64url(response.clientDataJSON),
+                signature: toBase64url(response.signature),
+                userHandle: response.userHandle ? toBase64url(response.userHandle) : undefined,
+            },
+            clientExtensionResults: credential.getClientExtensionResults(),
+        };
+    };
+
+    const showRecoveryCodes = (codes) => {
+        const card = document.getElementById('keyRecoveryCodes');
+        const list = card.querySelector('#recoveryCodes');
+        list.replaceChildren(...codes.map((code) => {
+            const col = document.createElement('div');
+            col.className = 'col-sm-6';
+            const box = document.createElement('div');
+            box.className = 'bg-dark border border-secondary rounded p-2 text-center';
+            box.textContent = code;
+            col.append(box);
+            return col;
+        }));
+        card.hidden = false;
+        card.scrollIntoView({ behavior: 'smooth' });
+    };
+
+    document.querySelectorAll('[data-webauthn]').forEach((button) => {
+        const error = button.parentElement.querySelector('[data-webauthn-error]');
+        button.addEventListener('click', async () => {
+            const kind = button.dataset.webauthn;
+            const csrf = button.dataset.csrf;
+            const form = button.closest('form');
+            if (kind === 'reauth' && !form.reportValidity()) return;
+            if (error) error.hidden = true;
+            button.disabled = true;
+            try {
+                const options = await post(button.dataset.begin, csrf);
+                if (kind === 'reauth') {
+                    form.elements.webauthn_assertion.value = JSON.stringify(await assert(options));
+                    form.submit();
+                    return;
+                }
+                let finish = button.dataset.finish;
+                let result;
+                if (kind === 'register') {
+                    const params = new URLSearchParams({ name: form.elements.name.value });
+                    if (form.elements.passwordless.checked) params.set('passwordless', '1');
+                    result = await post(`${finish}?${params}`, csrf, await register(options));
+                } else {
+                    const next = new URLSearchParams(window.location.search).get('next');
+                    if (kind === 'passkey' && next) finish += `?${new URLSearchParams({ next })}`;
+                    result = await post(finish, csrf, await assert(options));
+                }
+                if (result.recovery_codes && result.recovery_codes.length) {
+                    showRecoveryCodes(result.recovery_codes);
+                    button.disabled = false;
+                    return;
+                }
+                window.location.assign(result.redirect || window.location.pathname);
+            } catch (err) {
+                button.disabled = false;
+                if (error) {
+                    // A dismissed browser prompt is not worth an error message.
+                    error.textContent = err.name === 'NotAllowedError' ? 'The request was cancelled or timed out.' : err.message;
+                    error.hidden = false;
+                }
+            }
+        });
+    });
+})();
@@ -0,0 +1,83 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mileusna/useragent"
+
+	"github.com/arumes31/redrx/internal/config"
+	"github.com/arumes31/redrx/internal/store"
+)
+
+// maxExcludedNetworks caps the networks an account may exclude; each is
+// checked on every click of its links.
+const maxExcludedNetworks = 20
+
+// trafficClass classifies a click on link from ip. Internal traffic — the
+// owner's own signed-in visits, and clicks from INTERNAL_NETWORKS or the
+// owner's excluded networks — is told apart first, so an owner's monitoring
+// probe is theirs rather than a bot.
+func (s *Server) trafficClass(ctx context.Context, r *http.Request, link *store.URL, ip string, ua useragent.UserAgent) string {
+	if link.UserID != nil {
+		if user := userFrom(r); user != nil && user.ID == *link.UserID {
+			return store.TrafficInternal
+		}
+	}
+	addr := net.ParseIP(ip)
+	if addr != nil {
+		for _, n := range s.cfg.InternalNetworks {
+			if n.Contains(addr) {
+				return store.TrafficInternal
+			}
+		}
+		if link.UserID != nil && s.ownerExcludes(ctx, *link.UserID, addr) {
+			return store.TrafficInternal
+		}
+	}
+	if s.bots.IsBot(ua) {
+		return store.TrafficBot
+	}
+	return store.TrafficHuman
+}
+
+// ownerExcludes reports whether addr is in one of the owner's excluded
+// networks. A failed lookup counts the click as the owner's visitors'.
+func (s *Server) ownerExcludes(ctx context.Context, ownerID int64, addr net.IP) bool {
+	owner, err := s.db.UserByID(ctx, ownerID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			s.log.WarnContext(ctx, "load link owner for traffic", "user", ownerID, "error", err)
+		}
+		return false
+	}
+	for _, e := range owner.ExcludedNetworks {
+		if n, err := config.ParseNetwork(e); err == nil && n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExcludedNetworks reads the account setting: addresses and CIDR blocks
+// separated by spaces, commas or lines. They are returned in canonical form.
+func parseExcludedNetworks(raw string) ([]string, error) {
+	fields := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+	if len(fields) > maxExcludedNetworks {
+		return nil, errors.New("Enter at most 20 addresses or networks.")
+	}
+	out := make([]string, 0, len(fields))
+	for _, f := range fields {
+		n, err := config.ParseNetwork(f)
+		if err != nil {
+			return nil, errors.New(f + " is not an IP address or a CIDR block such as 192.0.2.0/24.")
+		}
+		out = append(out, n.String())
+	}
+	return out, nil
+}
@@ -0,0 +1,42 @@
+package web
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// visitorSalts caches the day's visitor salt, so a redirect reads it from the
+// database once a day rather than once a click.
+type visitorSalts struct {
+	mu   sync.Mutex
+	day  string
+	salt string
+}
+
+// visitorHash identifies a visitor for the unique-click dedupe: a keyed hash
+// of the anonymised address and the User-Agent under today's salt. The salt
+// is deleted once the day is over, after which the hash cannot be tied back
+// to an address even by someone holding the database. An empty hash, when
+// the salt cannot be loaded, leaves the click counted as unique.
+func (s *Server) visitorHash(ctx context.Context, now time.Time, anonIP, userAgent string) string {
+	day := now.UTC().Format("2006-01-02")
+	s.salts.mu.Lock()
+	defer s.salts.mu.Unlock()
+	if s.salts.day != day {
+		salt, err := s.db.VisitorSalt(ctx, day)
+		if err != nil {
+			s.log.WarnContext(ctx, "load visitor salt", "day", day, "error", err)
+			return ""
+		}
+		s.salts.day, s.salts.salt = day, salt
+	}
+	mac := hmac.New(sha256.New, []byte(s.salts.salt))
+	mac.Write([]byte(anonIP))
+	mac.Write([]byte{0})
+	mac.Write([]byte(userAgent))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}